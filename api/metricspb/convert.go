@@ -0,0 +1,58 @@
+package metricspb
+
+import (
+	"fmt"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+var (
+	typeNames = map[MetricType]string{
+		MetricType_METRIC_TYPE_GAUGE:   models.Gauge,
+		MetricType_METRIC_TYPE_COUNTER: models.Counter,
+		MetricType_METRIC_TYPE_SET:     models.Set,
+	}
+	typeValues = map[string]MetricType{
+		models.Gauge:   MetricType_METRIC_TYPE_GAUGE,
+		models.Counter: MetricType_METRIC_TYPE_COUNTER,
+		models.Set:     MetricType_METRIC_TYPE_SET,
+	}
+)
+
+// FromModel converts a metric of the JSON API into its protobuf form.
+func FromModel(m models.Metrics) (*Metric, error) {
+	mtype, ok := typeValues[m.MType]
+	if !ok {
+		return nil, fmt.Errorf("metricspb: unknown metric type %q", m.MType)
+	}
+
+	out := &Metric{Id: m.ID, Type: mtype, Registers: m.Registers, Timestamp: m.Timestamp}
+	if m.Value != nil {
+		out.Value = *m.Value
+	}
+	if m.Delta != nil {
+		out.Delta = *m.Delta
+	}
+	return out, nil
+}
+
+// ToModel converts a protobuf metric into the form used by storage.
+func ToModel(m *Metric) (models.Metrics, error) {
+	mtype, ok := typeNames[m.GetType()]
+	if !ok {
+		return models.Metrics{}, fmt.Errorf("metricspb: unknown metric type %v", m.GetType())
+	}
+
+	out := models.Metrics{ID: m.GetId(), MType: mtype, Timestamp: m.Timestamp}
+	switch mtype {
+	case models.Gauge:
+		value := m.GetValue()
+		out.Value = &value
+	case models.Counter:
+		delta := m.GetDelta()
+		out.Delta = &delta
+	case models.Set:
+		out.Registers = m.GetRegisters()
+	}
+	return out, nil
+}
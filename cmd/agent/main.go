@@ -24,7 +24,10 @@ func main() {
 	log.Printf("Build commit: %s", fallback(buildCommit))
 
 	cfg := agent.ParseConfig()
-	a := agent.New(cfg)
+	a, err := agent.New(cfg)
+	if err != nil {
+		log.Fatal("Agent setup failed:", err)
+	}
 
 	if err := a.Run(ctx); err != nil {
 		log.Fatal("Agent failed:", err)
@@ -4,54 +4,64 @@ import (
 	"context"
 	"crypto/rsa"
 	"crypto/x509"
-	"database/sql"
 	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"go-metrics-and-alerts/internal/audit"
+	"go-metrics-and-alerts/internal/federation"
+	"go-metrics-and-alerts/internal/graphite"
+	"go-metrics-and-alerts/internal/grpcserver"
 	"go-metrics-and-alerts/internal/handler"
 	"go-metrics-and-alerts/internal/middleware"
-	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/pull"
+	"go-metrics-and-alerts/internal/remotewrite"
 	"go-metrics-and-alerts/internal/repository"
+	"go-metrics-and-alerts/internal/statsd"
+	"go-metrics-and-alerts/internal/wal"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
+	pgxmigrate "github.com/golang-migrate/migrate/v4/database/pgx/v5"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/lib/pq"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"google.golang.org/grpc"
 )
 
 var (
-	storage         repository.Repository
-	fileStoragePath string
-	storeInterval   int
-	db              *sql.DB
-	useFileStorage  bool
+	storage repository.Repository
+	pool    *pgxpool.Pool
 
 	buildVersion string
 	buildDate    string
 	buildCommit  string
 )
 
-func runMigrations(db *sql.DB) error {
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
+func runMigrations(pool *pgxpool.Pool) error {
+	db := stdlib.OpenDBFromPool(pool)
+	defer db.Close()
+
+	driver, err := pgxmigrate.WithInstance(db, &pgxmigrate.Config{})
 	if err != nil {
 		return err
 	}
 
 	m, err := migrate.NewWithDatabaseInstance(
 		"file://migrations",
-		"postgres", driver)
+		"pgx5", driver)
 	if err != nil {
 		return err
 	}
@@ -59,71 +69,6 @@ func runMigrations(db *sql.DB) error {
 	return m.Up()
 }
 
-func saveToFile() error {
-	if !useFileStorage {
-		return nil
-	}
-
-	var metrics []models.Metrics
-
-	gauges := storage.GetAllGauges()
-	for name, value := range gauges {
-		metric := models.Metrics{
-			ID:    name,
-			MType: "gauge",
-			Value: &value,
-		}
-		metrics = append(metrics, metric)
-	}
-
-	counters := storage.GetAllCounters()
-	for name, delta := range counters {
-		metric := models.Metrics{
-			ID:    name,
-			MType: "counter",
-			Delta: &delta,
-		}
-		metrics = append(metrics, metric)
-	}
-
-	data, err := json.Marshal(metrics)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(fileStoragePath, data, 0666)
-}
-
-func loadFromFile() error {
-	data, err := os.ReadFile(fileStoragePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-
-	var metrics []models.Metrics
-	if err := json.Unmarshal(data, &metrics); err != nil {
-		return err
-	}
-
-	for _, metric := range metrics {
-		switch metric.MType {
-		case "gauge":
-			if metric.Value != nil {
-				storage.UpdateGauge(metric.ID, *metric.Value)
-			}
-		case "counter":
-			if metric.Delta != nil {
-				storage.UpdateCounter(metric.ID, *metric.Delta)
-			}
-		}
-	}
-
-	return nil
-}
-
 func main() {
 	fileCfg := loadServerConfigFile()
 
@@ -159,6 +104,136 @@ func main() {
 		cryptoDefault = fileCfg.CryptoKey
 	}
 
+	statsdFlushDefault := 10
+	if fileCfg != nil && fileCfg.StatsdFlushInterval != "" {
+		if d, err := time.ParseDuration(fileCfg.StatsdFlushInterval); err == nil {
+			statsdFlushDefault = int(d / time.Second)
+		}
+	}
+
+	statsdUDPDefault, statsdTCPDefault := "", ""
+	if fileCfg != nil {
+		statsdUDPDefault = fileCfg.StatsdUDP
+		statsdTCPDefault = fileCfg.StatsdTCP
+	}
+
+	grpcAddrDefault := ""
+	if fileCfg != nil && fileCfg.GRPCAddress != "" {
+		grpcAddrDefault = fileCfg.GRPCAddress
+	}
+
+	graphiteAddrDefault, graphiteTemplatesDefault := "", ""
+	if fileCfg != nil {
+		graphiteAddrDefault = fileCfg.GraphiteAddress
+		graphiteTemplatesDefault = strings.Join(fileCfg.GraphiteTemplates, ";")
+	}
+
+	remoteWriteURLDefault := ""
+	remoteWriteQueueDefault := filepath.Join(os.TempDir(), "metrics-remote-write")
+	remoteWriteShardsDefault := 4
+	if fileCfg != nil {
+		remoteWriteURLDefault = fileCfg.RemoteWriteURL
+		if fileCfg.RemoteWriteQueue != "" {
+			remoteWriteQueueDefault = fileCfg.RemoteWriteQueue
+		}
+		if fileCfg.RemoteWriteShards > 0 {
+			remoteWriteShardsDefault = fileCfg.RemoteWriteShards
+		}
+	}
+
+	federatePeersDefault, federateUpstreamDefault, federateSourceDefault := "", "", ""
+	if host, err := os.Hostname(); err == nil {
+		federateSourceDefault = host
+	}
+	federateIntervalDefault := 15
+	if fileCfg != nil {
+		federatePeersDefault = strings.Join(fileCfg.FederatePeers, ",")
+		federateUpstreamDefault = fileCfg.FederateUpstream
+		if fileCfg.FederateSource != "" {
+			federateSourceDefault = fileCfg.FederateSource
+		}
+		if d, err := time.ParseDuration(fileCfg.FederateInterval); err == nil {
+			federateIntervalDefault = int(d / time.Second)
+		}
+	}
+
+	scrapeTargetsDefault := ""
+	scrapeIntervalDefault := 10
+	if fileCfg != nil {
+		scrapeTargetsDefault = strings.Join(fileCfg.ScrapeTargets, ",")
+		if d, err := time.ParseDuration(fileCfg.ScrapeInterval); err == nil {
+			scrapeIntervalDefault = int(d / time.Second)
+		}
+	}
+
+	walDirDefault, walSyncDefault := "", string(wal.SyncInterval)
+	if fileCfg != nil {
+		walDirDefault = fileCfg.WALDir
+		if fileCfg.WALSync != "" {
+			walSyncDefault = fileCfg.WALSync
+		}
+	}
+
+	dbMaxConnsDefault, dbMinConnsDefault := 0, 0
+	dbStatementTimeoutDefault, dbHealthCheckDefault := 0, 0
+	if fileCfg != nil {
+		dbMaxConnsDefault = fileCfg.DBMaxConns
+		dbMinConnsDefault = fileCfg.DBMinConns
+		if d, err := time.ParseDuration(fileCfg.DBStatementTimeout); err == nil {
+			dbStatementTimeoutDefault = int(d / time.Millisecond)
+		}
+		if d, err := time.ParseDuration(fileCfg.DBHealthCheckPeriod); err == nil {
+			dbHealthCheckDefault = int(d / time.Second)
+		}
+	}
+
+	writeBehindIntervalDefault, writeBehindEntriesDefault := 0, repository.DefaultFlushEntries
+	writeBehindDurabilityDefault := string(repository.DurabilityAsync)
+	if fileCfg != nil {
+		if d, err := time.ParseDuration(fileCfg.WriteBehindInterval); err == nil {
+			writeBehindIntervalDefault = int(d / time.Millisecond)
+		}
+		if fileCfg.WriteBehindEntries > 0 {
+			writeBehindEntriesDefault = fileCfg.WriteBehindEntries
+		}
+		if fileCfg.WriteBehindDurability != "" {
+			writeBehindDurabilityDefault = fileCfg.WriteBehindDurability
+		}
+	}
+
+	metricTTLDefault, expiryIntervalDefault := 0, 0
+	if fileCfg != nil {
+		if d, err := time.ParseDuration(fileCfg.MetricTTL); err == nil {
+			metricTTLDefault = int(d / time.Second)
+		}
+		if d, err := time.ParseDuration(fileCfg.ExpiryInterval); err == nil {
+			expiryIntervalDefault = int(d / time.Second)
+		}
+	}
+
+	maxSeriesDefault, maxSeriesPerSourceDefault := 0, 0
+	maxNameLengthDefault, metricNamePatternDefault := repository.DefaultMaxNameLength, ""
+	if fileCfg != nil {
+		maxSeriesDefault = fileCfg.MaxSeries
+		maxSeriesPerSourceDefault = fileCfg.MaxSeriesPerSource
+		if fileCfg.MaxNameLength > 0 {
+			maxNameLengthDefault = fileCfg.MaxNameLength
+		}
+		metricNamePatternDefault = fileCfg.MetricNamePattern
+	}
+
+	boltPathDefault := ""
+	if fileCfg != nil {
+		boltPathDefault = fileCfg.BoltPath
+	}
+
+	toleranceDefault := 0
+	if fileCfg != nil && fileCfg.SampleTolerance != "" {
+		if d, err := time.ParseDuration(fileCfg.SampleTolerance); err == nil {
+			toleranceDefault = int(d / time.Second)
+		}
+	}
+
 	addr := flag.String("a", addrDefault, "server address")
 	storeIntervalFlag := flag.Int("i", storeIntervalDefault, "store interval in seconds")
 	fileStoragePathFlag := flag.String("f", filePathDefault, "file storage path")
@@ -168,6 +243,38 @@ func main() {
 	auditFileFlag := flag.String("audit-file", "", "audit file path")
 	auditURLFlag := flag.String("audit-url", "", "audit url")
 	cryptoKeyFlag := flag.String("crypto-key", cryptoDefault, "path to private key")
+	toleranceFlag := flag.Int("sample-tolerance", toleranceDefault, "out-of-order sample tolerance in seconds, 0 accepts any age")
+	statsdUDPFlag := flag.String("statsd-udp", statsdUDPDefault, "StatsD UDP listen address, empty disables")
+	statsdTCPFlag := flag.String("statsd-tcp", statsdTCPDefault, "StatsD TCP listen address, empty disables")
+	statsdFlushFlag := flag.Int("statsd-flush", statsdFlushDefault, "StatsD flush interval in seconds")
+	grpcAddrFlag := flag.String("grpc-address", grpcAddrDefault, "gRPC listen address, empty disables")
+	graphiteAddrFlag := flag.String("graphite", graphiteAddrDefault, "Graphite plaintext TCP listen address, empty disables")
+	graphiteTemplatesFlag := flag.String("graphite-templates", graphiteTemplatesDefault, "semicolon separated Graphite path templates")
+	remoteWriteURLFlag := flag.String("remote-write-url", remoteWriteURLDefault, "Prometheus remote write URL, empty disables")
+	remoteWriteQueueFlag := flag.String("remote-write-queue", remoteWriteQueueDefault, "remote write queue directory")
+	remoteWriteShardsFlag := flag.Int("remote-write-shards", remoteWriteShardsDefault, "number of parallel remote write queues")
+	federatePeersFlag := flag.String("federate-peers", federatePeersDefault, "comma separated source=url peers to pull metrics from")
+	federateUpstreamFlag := flag.String("federate-upstream", federateUpstreamDefault, "server URL to push metrics to, empty disables")
+	federateSourceFlag := flag.String("federate-source", federateSourceDefault, "source name used when pushing upstream")
+	federateIntervalFlag := flag.Int("federate-interval", federateIntervalDefault, "federation pull and push interval in seconds")
+	scrapeTargetsFlag := flag.String("scrape-targets", scrapeTargetsDefault, "comma separated agent addresses to pull metrics from")
+	scrapeIntervalFlag := flag.Int("scrape-interval", scrapeIntervalDefault, "agent scrape interval in seconds")
+	walDirFlag := flag.String("wal", walDirDefault, "write-ahead log directory for file storage, empty disables")
+	dbMaxConnsFlag := flag.Int("db-max-conns", dbMaxConnsDefault, "maximum database connections, 0 keeps the DSN or driver default")
+	dbMinConnsFlag := flag.Int("db-min-conns", dbMinConnsDefault, "database connections kept open, 0 keeps the DSN or driver default")
+	dbStatementTimeoutFlag := flag.Int("db-statement-timeout", dbStatementTimeoutDefault, "database statement timeout in milliseconds, 0 disables")
+	dbHealthCheckFlag := flag.Int("db-health-check", dbHealthCheckDefault, "database connection health check period in seconds, 0 keeps the default")
+	writeBehindIntervalFlag := flag.Int("write-behind-interval", writeBehindIntervalDefault, "database write-behind flush interval in milliseconds, 0 disables")
+	writeBehindEntriesFlag := flag.Int("write-behind-entries", writeBehindEntriesDefault, "buffered metrics that trigger an early write-behind flush")
+	writeBehindDurabilityFlag := flag.String("write-behind-durability", writeBehindDurabilityDefault, "write-behind durability: async or sync")
+	metricTTLFlag := flag.Int("metric-ttl", metricTTLDefault, "seconds without updates after which a metric is deleted, 0 keeps metrics without a TTL in their metadata")
+	expiryIntervalFlag := flag.Int("expiry-interval", expiryIntervalDefault, "seconds between metric expiry checks, 0 checks every minute")
+	maxSeriesFlag := flag.Int("max-series", maxSeriesDefault, "maximum number of stored series, 0 disables the limit")
+	maxSeriesPerSourceFlag := flag.Int("max-series-per-source", maxSeriesPerSourceDefault, "maximum number of series each client may write, 0 disables the limit")
+	maxNameLengthFlag := flag.Int("max-name-length", maxNameLengthDefault, "maximum metric name length in bytes, 0 disables the limit")
+	metricNamePatternFlag := flag.String("metric-name-pattern", metricNamePatternDefault, "regular expression metric names must match, empty accepts any name")
+	boltPathFlag := flag.String("bolt", boltPathDefault, "embedded database file path, used instead of file storage")
+	walSyncFlag := flag.String("wal-sync", walSyncDefault, "write-ahead log sync policy: always, interval or never")
 	configFlag := flag.String("config", "", "path to config file")
 	shortConfigFlag := flag.String("c", "", "path to config file (shorthand)")
 	flag.Parse()
@@ -184,14 +291,14 @@ func main() {
 		finalAddr = envAddr
 	}
 
-	storeInterval = *storeIntervalFlag
+	storeInterval := *storeIntervalFlag
 	if envInterval := os.Getenv("STORE_INTERVAL"); envInterval != "" {
 		if val, err := strconv.Atoi(envInterval); err == nil {
 			storeInterval = val
 		}
 	}
 
-	fileStoragePath = *fileStoragePathFlag
+	fileStoragePath := *fileStoragePathFlag
 	if envPath := os.Getenv("FILE_STORAGE_PATH"); envPath != "" {
 		fileStoragePath = envPath
 	}
@@ -233,6 +340,218 @@ func main() {
 		finalCryptoKey = envCrypto
 	}
 
+	finalTolerance := *toleranceFlag
+	if envTolerance := os.Getenv("SAMPLE_TOLERANCE"); envTolerance != "" {
+		if val, err := strconv.Atoi(envTolerance); err == nil {
+			finalTolerance = val
+		}
+	}
+
+	finalStatsdUDP := *statsdUDPFlag
+	if env := os.Getenv("STATSD_UDP_ADDRESS"); env != "" {
+		finalStatsdUDP = env
+	}
+
+	finalStatsdTCP := *statsdTCPFlag
+	if env := os.Getenv("STATSD_TCP_ADDRESS"); env != "" {
+		finalStatsdTCP = env
+	}
+
+	finalStatsdFlush := *statsdFlushFlag
+	if env := os.Getenv("STATSD_FLUSH_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			finalStatsdFlush = val
+		}
+	}
+
+	finalGRPCAddr := *grpcAddrFlag
+	if env := os.Getenv("GRPC_ADDRESS"); env != "" {
+		finalGRPCAddr = env
+	}
+
+	finalGraphiteAddr := *graphiteAddrFlag
+	if env := os.Getenv("GRAPHITE_ADDRESS"); env != "" {
+		finalGraphiteAddr = env
+	}
+
+	finalGraphiteTemplates := *graphiteTemplatesFlag
+	if env := os.Getenv("GRAPHITE_TEMPLATES"); env != "" {
+		finalGraphiteTemplates = env
+	}
+
+	finalRemoteWriteURL := *remoteWriteURLFlag
+	if env := os.Getenv("REMOTE_WRITE_URL"); env != "" {
+		finalRemoteWriteURL = env
+	}
+
+	finalRemoteWriteQueue := *remoteWriteQueueFlag
+	if env := os.Getenv("REMOTE_WRITE_QUEUE"); env != "" {
+		finalRemoteWriteQueue = env
+	}
+
+	finalRemoteWriteShards := *remoteWriteShardsFlag
+	if env := os.Getenv("REMOTE_WRITE_SHARDS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			finalRemoteWriteShards = val
+		}
+	}
+
+	finalFederatePeers := *federatePeersFlag
+	if env := os.Getenv("FEDERATE_PEERS"); env != "" {
+		finalFederatePeers = env
+	}
+
+	finalFederateUpstream := *federateUpstreamFlag
+	if env := os.Getenv("FEDERATE_UPSTREAM"); env != "" {
+		finalFederateUpstream = env
+	}
+
+	finalFederateSource := *federateSourceFlag
+	if env := os.Getenv("FEDERATE_SOURCE"); env != "" {
+		finalFederateSource = env
+	}
+
+	finalFederateInterval := *federateIntervalFlag
+	if env := os.Getenv("FEDERATE_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			finalFederateInterval = val
+		}
+	}
+
+	finalScrapeTargets := *scrapeTargetsFlag
+	if env := os.Getenv("SCRAPE_TARGETS"); env != "" {
+		finalScrapeTargets = env
+	}
+
+	finalScrapeInterval := *scrapeIntervalFlag
+	if env := os.Getenv("SCRAPE_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			finalScrapeInterval = val
+		}
+	}
+
+	finalWALDir := *walDirFlag
+	if env := os.Getenv("WAL_DIR"); env != "" {
+		finalWALDir = env
+	}
+
+	dbMaxConns := *dbMaxConnsFlag
+	if env := os.Getenv("DB_MAX_CONNS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			dbMaxConns = val
+		}
+	}
+
+	dbMinConns := *dbMinConnsFlag
+	if env := os.Getenv("DB_MIN_CONNS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			dbMinConns = val
+		}
+	}
+
+	dbStatementTimeout := *dbStatementTimeoutFlag
+	if env := os.Getenv("DB_STATEMENT_TIMEOUT"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			dbStatementTimeout = val
+		}
+	}
+
+	dbHealthCheck := *dbHealthCheckFlag
+	if env := os.Getenv("DB_HEALTH_CHECK"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			dbHealthCheck = val
+		}
+	}
+
+	writeBehindInterval := *writeBehindIntervalFlag
+	if env := os.Getenv("WRITE_BEHIND_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			writeBehindInterval = val
+		}
+	}
+
+	writeBehindEntries := *writeBehindEntriesFlag
+	if env := os.Getenv("WRITE_BEHIND_ENTRIES"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			writeBehindEntries = val
+		}
+	}
+
+	finalWriteBehindDurability := *writeBehindDurabilityFlag
+	if env := os.Getenv("WRITE_BEHIND_DURABILITY"); env != "" {
+		finalWriteBehindDurability = env
+	}
+	writeBehindDurability, err := repository.ParseDurability(finalWriteBehindDurability)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	metricTTL := *metricTTLFlag
+	if env := os.Getenv("METRIC_TTL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			metricTTL = val
+		}
+	}
+
+	expiryInterval := *expiryIntervalFlag
+	if env := os.Getenv("EXPIRY_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			expiryInterval = val
+		}
+	}
+
+	maxSeries := *maxSeriesFlag
+	if env := os.Getenv("MAX_SERIES"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			maxSeries = val
+		}
+	}
+
+	maxSeriesPerSource := *maxSeriesPerSourceFlag
+	if env := os.Getenv("MAX_SERIES_PER_SOURCE"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			maxSeriesPerSource = val
+		}
+	}
+
+	maxNameLength := *maxNameLengthFlag
+	if env := os.Getenv("MAX_NAME_LENGTH"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			maxNameLength = val
+		}
+	}
+
+	finalMetricNamePattern := *metricNamePatternFlag
+	if env := os.Getenv("METRIC_NAME_PATTERN"); env != "" {
+		finalMetricNamePattern = env
+	}
+	var metricNamePattern *regexp.Regexp
+	if finalMetricNamePattern != "" {
+		metricNamePattern, err = regexp.Compile(finalMetricNamePattern)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+	}
+
+	finalBoltPath := *boltPathFlag
+	if env := os.Getenv("BOLT_PATH"); env != "" {
+		finalBoltPath = env
+	}
+
+	finalWALSync := *walSyncFlag
+	if env := os.Getenv("WAL_SYNC"); env != "" {
+		finalWALSync = env
+	}
+	walSync, err := wal.ParseSyncPolicy(finalWALSync)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	peers, err := federation.ParsePeers(finalFederatePeers)
+	if err != nil {
+		log.Fatalf("Invalid federation peers: %v", err)
+	}
+
 	var privateKey *rsa.PrivateKey
 	if finalCryptoKey != "" {
 		var err error
@@ -242,54 +561,149 @@ func main() {
 		}
 	}
 
+	var fileStorage *repository.FileStorage
+	var boltStorage *repository.BoltStorage
+	var writeBehind *repository.WriteBehind
+	var pgStorage *repository.PostgresStorage
 	if finalDSN != "" {
 		var err error
-		db, err = sql.Open("postgres", finalDSN)
+		pool, err = repository.NewPostgresPool(context.Background(), repository.PostgresConfig{
+			DSN:               finalDSN,
+			MaxConns:          int32(dbMaxConns),
+			MinConns:          int32(dbMinConns),
+			StatementTimeout:  time.Duration(dbStatementTimeout) * time.Millisecond,
+			HealthCheckPeriod: time.Duration(dbHealthCheck) * time.Second,
+		})
 		if err != nil {
 			log.Fatal("Failed to connect to database:", err)
 		}
-		defer db.Close()
+		defer pool.Close()
 
-		if err := runMigrations(db); err != nil && err != migrate.ErrNoChange {
+		if err := runMigrations(pool); err != nil && err != migrate.ErrNoChange {
 			log.Printf("Failed to run migrations: %v", err)
 		}
 
-		storage, err = repository.NewPostgresStorage(db)
+		pgStorage, err = repository.NewPostgresStorage(pool)
 		if err != nil {
 			log.Fatal("Failed to create postgres storage:", err)
 		}
-		useFileStorage = false
+		storage = pgStorage
+		if writeBehindInterval > 0 {
+			writeBehind = repository.NewWriteBehind(storage, repository.WriteBehindConfig{
+				Interval:   time.Duration(writeBehindInterval) * time.Millisecond,
+				MaxEntries: writeBehindEntries,
+				Durability: writeBehindDurability,
+			})
+			storage = writeBehind
+		}
+	} else if finalBoltPath != "" {
+		var err error
+		boltStorage, err = repository.NewBoltStorage(finalBoltPath)
+		if err != nil {
+			log.Fatalf("Failed to open embedded database: %v", err)
+		}
+		storage = boltStorage
 	} else if fileStoragePath != "" {
-		storage = repository.NewMemStorage()
-		useFileStorage = true
-		if finalRestore {
-			if err := loadFromFile(); err != nil {
-				log.Printf("Failed to load from file: %v", err)
+		mem := repository.NewMemStorage()
+		storage = mem
+		restoreSnapshot := finalRestore
+		if finalWALDir != "" {
+			// The snapshot and the log are both replayed into the plain
+			// storage, so the replay is not logged again.
+			if finalRestore {
+				if err := repository.LoadFile(context.Background(), fileStoragePath, mem); err != nil {
+					log.Printf("Failed to load from file: %v", err)
+				}
+				n, err := wal.Restore(context.Background(), finalWALDir, mem)
+				if err != nil {
+					log.Fatalf("Failed to replay write-ahead log: %v", err)
+				}
+				log.Printf("Replayed %d write-ahead log records", n)
+				restoreSnapshot = false
 			}
+			walLog, err := wal.Open(finalWALDir, walSync)
+			if err != nil {
+				log.Fatalf("Failed to open write-ahead log: %v", err)
+			}
+			defer walLog.Close()
+			storage = wal.Wrap(mem, walLog)
 		}
-		defer func() {
-			if err := saveToFile(); err != nil {
-				log.Printf("Failed to save to file: %v", err)
+
+		var err error
+		fileStorage, err = repository.NewFileStorage(storage, repository.FileConfig{
+			Path:     fileStoragePath,
+			Interval: time.Duration(storeInterval) * time.Second,
+			Restore:  restoreSnapshot,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create file storage: %v", err)
+		}
+		storage = fileStorage
+		if finalWALDir != "" {
+			// Folds the replayed log into the snapshot, or drops it when
+			// restoring is disabled.
+			if err := fileStorage.Save(); err != nil {
+				log.Printf("Failed to checkpoint: %v", err)
 			}
-		}()
+		}
 	} else {
 		storage = repository.NewMemStorage()
-		useFileStorage = false
 	}
 
-	if useFileStorage && storeInterval > 0 {
-		go func() {
-			ticker := time.NewTicker(time.Duration(storeInterval) * time.Second)
-			defer ticker.Stop()
-			for range ticker.C {
-				if err := saveToFile(); err != nil {
-					log.Printf("Failed to save to file: %v", err)
-				}
-			}
-		}()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
+
+	// Wrapped after the restore so restored values are not exported again.
+	var exporter *remotewrite.Exporter
+	if finalRemoteWriteURL != "" {
+		var err error
+		exporter, err = remotewrite.New(remotewrite.Config{
+			URL:      finalRemoteWriteURL,
+			QueueDir: finalRemoteWriteQueue,
+			Shards:   finalRemoteWriteShards,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open remote write queue: %v", err)
+		}
+		exporter.Start(ctx)
+		storage = remotewrite.Wrap(storage, exporter)
+		log.Printf("Remote write to %s", exporter)
+	}
+
+	var limiter *repository.Limiter
+	if maxSeries > 0 || maxSeriesPerSource > 0 || maxNameLength > 0 || metricNamePattern != nil {
+		limiter, err = repository.NewLimiter(ctx, storage, repository.LimitConfig{
+			MaxSeries:          maxSeries,
+			MaxSeriesPerSource: maxSeriesPerSource,
+			MaxNameLength:      maxNameLength,
+			NamePattern:        metricNamePattern,
+		})
+		if err != nil {
+			log.Fatalf("Failed to count stored series: %v", err)
+		}
+		storage = limiter
+	}
+
+	history := repository.NewHistory(repository.DefaultHistorySize)
+	if boltStorage != nil {
+		history, err = repository.LoadHistory(repository.DefaultHistorySize, boltStorage)
+		if err != nil {
+			log.Fatalf("Failed to load history: %v", err)
+		}
 	}
 
+	// Expiry always runs, since metadata may set a TTL at any time. Without
+	// any TTL a check only reads the metadata.
+	expiring := repository.NewExpiring(storage, repository.ExpiryConfig{
+		TTL:      time.Duration(metricTTL) * time.Second,
+		Interval: time.Duration(expiryInterval) * time.Second,
+		OnDelete: history.Delete,
+	})
+	storage = expiring
+
 	h := handler.New(storage)
+	h.SetSampleTolerance(time.Duration(finalTolerance) * time.Second)
+	h.SetHistory(history)
 
 	var auditor audit.Notifier
 	publisher := audit.NewPublisher()
@@ -309,13 +723,25 @@ func main() {
 
 	handler.SecretKey = finalKey
 
-	if useFileStorage && storeInterval == 0 {
-		handler.SyncSaveFunc = func() {
-			if err := saveToFile(); err != nil {
-				log.Printf("Failed to sync save: %v", err)
-			}
+	federator := federation.New(h, storage, federation.Config{
+		Peers:    peers,
+		Upstream: finalFederateUpstream,
+		Source:   finalFederateSource,
+		Interval: time.Duration(finalFederateInterval) * time.Second,
+		Key:      finalKey,
+	})
+
+	var targets []string
+	for _, t := range strings.Split(finalScrapeTargets, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
 		}
 	}
+	scraper := pull.New(h, pull.Config{
+		Targets:  targets,
+		Interval: time.Duration(finalScrapeInterval) * time.Second,
+		Key:      finalKey,
+	})
 
 	r := chi.NewRouter()
 
@@ -325,33 +751,129 @@ func main() {
 	r.Use(middleware.WithGzip)
 
 	r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
-		if db == nil {
+		if pool == nil {
 			http.Error(w, "Database not configured", http.StatusInternalServerError)
 			return
 		}
-		if err := db.Ping(); err != nil {
+		if err := pool.Ping(r.Context()); err != nil {
 			http.Error(w, "Database connection failed", http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 	})
+	r.Get("/api/v1/db", func(w http.ResponseWriter, r *http.Request) {
+		if pgStorage == nil {
+			http.Error(w, "Database not configured", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pgStorage.PoolStats())
+	})
+
+	r.Get("/api/v1/limits", func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			http.Error(w, "Limits not configured", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(limiter.Stats())
+	})
 
 	r.Post("/update/{type}/{name}/{value}", h.UpdateMetric)
 	r.Post("/update", h.UpdateMetricJSON)
 	r.Post("/update/", h.UpdateMetricJSON)
 	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Get("/history/{type}/{name}", h.GetHistory)
 	r.Post("/value", h.GetMetricJSON)
 	r.Post("/value/", h.GetMetricJSON)
 	r.Get("/", h.ListMetrics)
+	r.Get("/assets/*", h.DashboardAssets)
+	r.Get("/api/v1/snapshot", h.DashboardSnapshot)
+	r.Get("/api/v1/ws", h.DashboardSocket)
+	r.Get("/metrics", h.PrometheusMetrics)
+	r.Post("/api/v2/write", h.InfluxWrite)
+	r.Post("/v1/metrics", h.OTLPMetrics)
 	r.Post("/updates/", h.UpdateMetricsBatch)
+	r.Post("/metadata", h.UpdateMetadata)
+	r.Post("/metadata/", h.UpdateMetadata)
+	r.Get("/metadata/", h.ListMetadata)
+	r.Get("/metadata/{name}", h.GetMetadata)
+	r.Get("/api/v1/stream", h.Stream)
+	r.Get("/api/v1/export", h.Export)
+	r.Post("/api/v1/federate/{source}", federator.Receive)
+	r.Get("/api/v1/federation", federator.Status)
+	r.Get("/api/v1/targets", scraper.Status)
+	r.Delete("/api/v1/metrics", h.DeleteMetrics)
+	r.Delete("/api/v1/metrics/{type}/{name}", h.DeleteMetric)
+	r.Post("/api/v1/metrics/{type}/{name}/rename", h.RenameMetric)
+
+	var statsdServer *statsd.Server
+	if finalStatsdUDP != "" || finalStatsdTCP != "" {
+		statsdServer = statsd.NewServer(statsd.Config{
+			UDPAddr:       finalStatsdUDP,
+			TCPAddr:       finalStatsdTCP,
+			FlushInterval: time.Duration(finalStatsdFlush) * time.Second,
+		}, storage)
+		if err := statsdServer.Start(ctx); err != nil {
+			log.Fatalf("Failed to start StatsD listener: %v", err)
+		}
+		log.Printf("StatsD listening on udp=%q tcp=%q", finalStatsdUDP, finalStatsdTCP)
+	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	defer stop()
+	var graphiteServer *graphite.Server
+	if finalGraphiteAddr != "" {
+		var templates []string
+		for _, t := range strings.Split(finalGraphiteTemplates, ";") {
+			if t = strings.TrimSpace(t); t != "" {
+				templates = append(templates, t)
+			}
+		}
+		var err error
+		graphiteServer, err = graphite.NewServer(graphite.Config{
+			Addr:      finalGraphiteAddr,
+			Templates: templates,
+			Tolerance: time.Duration(finalTolerance) * time.Second,
+		}, storage)
+		if err != nil {
+			log.Fatalf("Invalid Graphite configuration: %v", err)
+		}
+		h.SetDeleteHook(graphiteServer.Forget)
+		if err := graphiteServer.Start(ctx); err != nil {
+			log.Fatalf("Failed to start Graphite listener: %v", err)
+		}
+		log.Printf("Graphite listening on %s", finalGraphiteAddr)
+	}
+
+	federator.Start(ctx)
+	if len(peers) > 0 || finalFederateUpstream != "" {
+		log.Printf("Federating with %d peers, upstream %q", len(peers), finalFederateUpstream)
+	}
+
+	scraper.Start(ctx)
+	if len(targets) > 0 {
+		log.Printf("Scraping %d agents every %ds", len(targets), finalScrapeInterval)
+	}
+
+	var grpcSrv *grpc.Server
+	if finalGRPCAddr != "" {
+		lis, err := net.Listen("tcp", finalGRPCAddr)
+		if err != nil {
+			log.Fatalf("Failed to start gRPC listener: %v", err)
+		}
+		grpcSrv = grpcserver.New(h, finalKey, privateKey).Register()
+		go func() {
+			log.Printf("Starting gRPC server on %s", finalGRPCAddr)
+			if err := grpcSrv.Serve(lis); err != nil {
+				log.Printf("gRPC server error: %v", err)
+			}
+		}()
+	}
 
 	srv := &http.Server{
 		Addr:    finalAddr,
 		Handler: r,
 	}
+	srv.RegisterOnShutdown(h.CloseStreams)
 
 	go func() {
 		log.Printf("Starting server on %s", finalAddr)
@@ -368,12 +890,39 @@ func main() {
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
 
-	if useFileStorage {
-		if err := saveToFile(); err != nil {
+	if statsdServer != nil {
+		statsdServer.Wait()
+	}
+	if graphiteServer != nil {
+		graphiteServer.Wait()
+	}
+	federator.Wait()
+	scraper.Wait()
+	if exporter != nil {
+		exporter.Wait()
+	}
+
+	// Expiry stops first, so it cannot delete metrics after the final save.
+	expiring.Close()
+	if fileStorage != nil {
+		if err := fileStorage.Close(); err != nil {
 			log.Printf("Failed to save during shutdown: %v", err)
 		}
 	}
+	if writeBehind != nil {
+		if err := writeBehind.Close(); err != nil {
+			log.Printf("Failed to flush buffered updates during shutdown: %v", err)
+		}
+	}
+	if boltStorage != nil {
+		if err := boltStorage.Close(); err != nil {
+			log.Printf("Failed to close embedded database: %v", err)
+		}
+	}
 }
 
 func fallback(value string) string {
@@ -384,12 +933,44 @@ func fallback(value string) string {
 }
 
 type serverFileConfig struct {
-	Address       string `json:"address"`
-	Restore       *bool  `json:"restore"`
-	StoreInterval string `json:"store_interval"`
-	StoreFile     string `json:"store_file"`
-	DatabaseDSN   string `json:"database_dsn"`
-	CryptoKey     string `json:"crypto_key"`
+	Address               string   `json:"address"`
+	Restore               *bool    `json:"restore"`
+	StoreInterval         string   `json:"store_interval"`
+	StoreFile             string   `json:"store_file"`
+	DatabaseDSN           string   `json:"database_dsn"`
+	CryptoKey             string   `json:"crypto_key"`
+	SampleTolerance       string   `json:"sample_tolerance"`
+	StatsdUDP             string   `json:"statsd_udp"`
+	StatsdTCP             string   `json:"statsd_tcp"`
+	StatsdFlushInterval   string   `json:"statsd_flush_interval"`
+	GRPCAddress           string   `json:"grpc_address"`
+	GraphiteAddress       string   `json:"graphite_address"`
+	GraphiteTemplates     []string `json:"graphite_templates"`
+	RemoteWriteURL        string   `json:"remote_write_url"`
+	RemoteWriteQueue      string   `json:"remote_write_queue"`
+	RemoteWriteShards     int      `json:"remote_write_shards"`
+	FederatePeers         []string `json:"federate_peers"`
+	FederateUpstream      string   `json:"federate_upstream"`
+	FederateSource        string   `json:"federate_source"`
+	FederateInterval      string   `json:"federate_interval"`
+	ScrapeTargets         []string `json:"scrape_targets"`
+	ScrapeInterval        string   `json:"scrape_interval"`
+	WALDir                string   `json:"wal_dir"`
+	WALSync               string   `json:"wal_sync"`
+	MetricTTL             string   `json:"metric_ttl"`
+	ExpiryInterval        string   `json:"expiry_interval"`
+	MaxSeries             int      `json:"max_series"`
+	MaxSeriesPerSource    int      `json:"max_series_per_source"`
+	MaxNameLength         int      `json:"max_name_length"`
+	MetricNamePattern     string   `json:"metric_name_pattern"`
+	BoltPath              string   `json:"bolt_path"`
+	DBMaxConns            int      `json:"db_max_conns"`
+	DBMinConns            int      `json:"db_min_conns"`
+	DBStatementTimeout    string   `json:"db_statement_timeout"`
+	DBHealthCheckPeriod   string   `json:"db_health_check_period"`
+	WriteBehindInterval   string   `json:"write_behind_interval"`
+	WriteBehindEntries    int      `json:"write_behind_entries"`
+	WriteBehindDurability string   `json:"write_behind_durability"`
 }
 
 func loadServerConfigFile() *serverFileConfig {
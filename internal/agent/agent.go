@@ -23,38 +23,83 @@ import (
 
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
+	"google.golang.org/grpc"
 
+	"go-metrics-and-alerts/api/metricspb"
 	models "go-metrics-and-alerts/internal/model"
 )
 
 const encryptedHeader = "X-Encrypted"
 
+// pullDrainIntervals is how many report intervals an agent in pull mode
+// waits on shutdown for the server to collect its last counter increases.
+// The report interval should match the server's scrape interval.
+const pullDrainIntervals = 3
+
+// sample is a collected metric value stamped with its collection time in
+// Unix milliseconds, so delayed retries still report when it was measured.
+type sample struct {
+	value       interface{}
+	collectedAt int64
+}
+
 // Agent collects runtime and system metrics and delivers them to the server.
 type Agent struct {
 	config      *Config
 	randomValue float64
 	client      *http.Client
 	metricsMu   sync.Mutex
-	metrics     map[string]interface{}
+	metrics     map[string]sample
 	pollCount   int64
 	publicKey   *rsa.PublicKey
+	registered  map[string]bool
+	grpcConn    *grpc.ClientConn
+	grpcClient  metricspb.MetricsClient
+
+	scraper      *scraper
+	scrapeDeltas map[string]int64
+	scrapedMeta  map[string]models.Metadata
+
+	pullMu  sync.Mutex
+	pullSeq uint64
+	unacked []pendingDeltas
 }
 
 // New builds an Agent with the provided configuration.
-func New(config *Config) *Agent {
+func New(config *Config) (*Agent, error) {
 	a := &Agent{
-		config:  config,
-		client:  &http.Client{},
-		metrics: make(map[string]interface{}),
+		config:     config,
+		client:     &http.Client{},
+		metrics:    make(map[string]sample),
+		registered: make(map[string]bool),
+
+		scrapeDeltas: make(map[string]int64),
+		scrapedMeta:  make(map[string]models.Metadata),
+	}
+	if config != nil && len(config.ScrapeTargets) > 0 {
+		a.scraper = newScraper(config.ScrapeTargets)
 	}
 	if config != nil && config.CryptoKeyPath != "" {
 		key, err := loadPublicKey(config.CryptoKeyPath)
 		if err != nil {
-			log.Fatalf("load public key: %v", err)
+			return nil, fmt.Errorf("load public key: %w", err)
 		}
 		a.publicKey = key
 	}
-	return a
+	if config != nil && config.Transport == TransportGRPC {
+		// Each snapshot goes out as one unary call, so there is nothing
+		// for parallel senders to spread.
+		if config.RateLimit > 1 {
+			return nil, fmt.Errorf("rate limit %d is not supported with the gRPC transport", config.RateLimit)
+		}
+		conn, err := dialGRPC(config.GRPCAddress)
+		if err != nil {
+			return nil, fmt.Errorf("create gRPC client: %w", err)
+		}
+		a.grpcConn = conn
+		a.grpcClient = metricspb.NewMetricsClient(conn)
+	}
+	return a, nil
 }
 
 // Run launches metric collection and reporting loops.
@@ -68,11 +113,19 @@ func (a *Agent) Run(ctx context.Context) error {
 	defer pollTicker.Stop()
 	defer reportTicker.Stop()
 
+	server := a.config.ServerURL
+	if a.grpcClient != nil {
+		server = "grpc://" + a.config.GRPCAddress
+	}
+	pull := a.config.ListenAddress != ""
+	if pull {
+		server = "pulled from " + a.config.ListenAddress
+	}
 	log.Printf("Agent starting, server: %s, poll: %v, report: %v",
-		a.config.ServerURL, a.config.PollInterval, a.config.ReportInterval)
+		server, a.config.PollInterval, a.config.ReportInterval)
 
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
@@ -98,49 +151,102 @@ func (a *Agent) Run(ctx context.Context) error {
 		}
 	}()
 
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-reportTicker.C:
-				snap := a.buildSnapshot()
-				a.dispatchSnapshot(snap)
+	// In pull mode the server fetches snapshots through the listener
+	// instead of the agent reporting them.
+	// Metadata is still registered with the server every report interval.
+	if pull {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := a.listen(ctx, pullDrainIntervals*a.config.ReportInterval); err != nil {
+				log.Printf("Snapshot listener failed: %v", err)
 			}
-		}
-	}()
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-reportTicker.C:
+					a.registerMetadata(a.collectedNames())
+				}
+			}
+		}()
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-reportTicker.C:
+					snap := a.buildSnapshot()
+					a.dispatchSnapshot(snap)
+				}
+			}
+		}()
+	}
+
+	if a.scraper != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scrapeTicker := time.NewTicker(a.config.PollInterval)
+			defer scrapeTicker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-scrapeTicker.C:
+					a.scrapeTargets(ctx)
+				}
+			}
+		}()
+	}
 
 	<-ctx.Done()
 	wg.Wait()
-	snap := a.buildSnapshot()
-	a.dispatchSnapshot(snap)
+	if !pull {
+		snap := a.buildSnapshot()
+		a.dispatchSnapshot(snap)
+	}
 
+	if a.grpcConn != nil {
+		a.grpcConn.Close()
+	}
 	return nil
 }
 
-func (a *Agent) buildSnapshot() map[string]interface{} {
-	snap := make(map[string]interface{})
+func (a *Agent) buildSnapshot() map[string]sample {
+	snap := make(map[string]sample)
 	a.metricsMu.Lock()
 	for k, v := range a.metrics {
 		snap[k] = v
 	}
 	pc := a.pollCount
 	a.pollCount = 0
+	now := time.Now().UnixMilli()
+	for k, d := range a.scrapeDeltas {
+		snap[k] = sample{value: d, collectedAt: now}
+	}
+	clear(a.scrapeDeltas)
 	a.metricsMu.Unlock()
 
 	if pc < 0 {
 		pc = 0
 	}
-	snap["PollCount"] = pc
+	snap["PollCount"] = sample{value: pc, collectedAt: now}
 	return snap
 }
 
-func (a *Agent) dispatchSnapshot(snap map[string]interface{}) {
+func (a *Agent) dispatchSnapshot(snap map[string]sample) {
 	if len(snap) == 0 {
 		return
 	}
-	if a.config.RateLimit > 1 {
+	a.registerMetadata(snap)
+	if a.config.RateLimit > 1 && a.grpcClient == nil {
 		a.sendMetricsWithRetry(snap)
 	} else {
 		a.sendMetricsBatchWithRetry(snap)
@@ -150,48 +256,50 @@ func (a *Agent) dispatchSnapshot(snap map[string]interface{}) {
 func (a *Agent) collectRuntimeMetrics() {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
+	now := time.Now().UnixMilli()
 
 	a.metricsMu.Lock()
-	a.metrics["Alloc"] = float64(m.Alloc)
-	a.metrics["BuckHashSys"] = float64(m.BuckHashSys)
-	a.metrics["Frees"] = float64(m.Frees)
-	a.metrics["GCCPUFraction"] = m.GCCPUFraction
-	a.metrics["GCSys"] = float64(m.GCSys)
-	a.metrics["HeapAlloc"] = float64(m.HeapAlloc)
-	a.metrics["HeapIdle"] = float64(m.HeapIdle)
-	a.metrics["HeapInuse"] = float64(m.HeapInuse)
-	a.metrics["HeapObjects"] = float64(m.HeapObjects)
-	a.metrics["HeapReleased"] = float64(m.HeapReleased)
-	a.metrics["HeapSys"] = float64(m.HeapSys)
-	a.metrics["LastGC"] = float64(m.LastGC)
-	a.metrics["Lookups"] = float64(m.Lookups)
-	a.metrics["MCacheInuse"] = float64(m.MCacheInuse)
-	a.metrics["MCacheSys"] = float64(m.MCacheSys)
-	a.metrics["MSpanInuse"] = float64(m.MSpanInuse)
-	a.metrics["MSpanSys"] = float64(m.MSpanSys)
-	a.metrics["Mallocs"] = float64(m.Mallocs)
-	a.metrics["NextGC"] = float64(m.NextGC)
-	a.metrics["NumForcedGC"] = float64(m.NumForcedGC)
-	a.metrics["NumGC"] = float64(m.NumGC)
-	a.metrics["OtherSys"] = float64(m.OtherSys)
-	a.metrics["PauseTotalNs"] = float64(m.PauseTotalNs)
-	a.metrics["StackInuse"] = float64(m.StackInuse)
-	a.metrics["StackSys"] = float64(m.StackSys)
-	a.metrics["Sys"] = float64(m.Sys)
-	a.metrics["TotalAlloc"] = float64(m.TotalAlloc)
+	a.metrics["Alloc"] = sample{value: float64(m.Alloc), collectedAt: now}
+	a.metrics["BuckHashSys"] = sample{value: float64(m.BuckHashSys), collectedAt: now}
+	a.metrics["Frees"] = sample{value: float64(m.Frees), collectedAt: now}
+	a.metrics["GCCPUFraction"] = sample{value: m.GCCPUFraction, collectedAt: now}
+	a.metrics["GCSys"] = sample{value: float64(m.GCSys), collectedAt: now}
+	a.metrics["HeapAlloc"] = sample{value: float64(m.HeapAlloc), collectedAt: now}
+	a.metrics["HeapIdle"] = sample{value: float64(m.HeapIdle), collectedAt: now}
+	a.metrics["HeapInuse"] = sample{value: float64(m.HeapInuse), collectedAt: now}
+	a.metrics["HeapObjects"] = sample{value: float64(m.HeapObjects), collectedAt: now}
+	a.metrics["HeapReleased"] = sample{value: float64(m.HeapReleased), collectedAt: now}
+	a.metrics["HeapSys"] = sample{value: float64(m.HeapSys), collectedAt: now}
+	a.metrics["LastGC"] = sample{value: float64(m.LastGC), collectedAt: now}
+	a.metrics["Lookups"] = sample{value: float64(m.Lookups), collectedAt: now}
+	a.metrics["MCacheInuse"] = sample{value: float64(m.MCacheInuse), collectedAt: now}
+	a.metrics["MCacheSys"] = sample{value: float64(m.MCacheSys), collectedAt: now}
+	a.metrics["MSpanInuse"] = sample{value: float64(m.MSpanInuse), collectedAt: now}
+	a.metrics["MSpanSys"] = sample{value: float64(m.MSpanSys), collectedAt: now}
+	a.metrics["Mallocs"] = sample{value: float64(m.Mallocs), collectedAt: now}
+	a.metrics["NextGC"] = sample{value: float64(m.NextGC), collectedAt: now}
+	a.metrics["NumForcedGC"] = sample{value: float64(m.NumForcedGC), collectedAt: now}
+	a.metrics["NumGC"] = sample{value: float64(m.NumGC), collectedAt: now}
+	a.metrics["OtherSys"] = sample{value: float64(m.OtherSys), collectedAt: now}
+	a.metrics["PauseTotalNs"] = sample{value: float64(m.PauseTotalNs), collectedAt: now}
+	a.metrics["StackInuse"] = sample{value: float64(m.StackInuse), collectedAt: now}
+	a.metrics["StackSys"] = sample{value: float64(m.StackSys), collectedAt: now}
+	a.metrics["Sys"] = sample{value: float64(m.Sys), collectedAt: now}
+	a.metrics["TotalAlloc"] = sample{value: float64(m.TotalAlloc), collectedAt: now}
 
 	a.randomValue = mathrand.Float64()
-	a.metrics["RandomValue"] = a.randomValue
+	a.metrics["RandomValue"] = sample{value: a.randomValue, collectedAt: now}
 	a.pollCount++
 	a.metricsMu.Unlock()
 }
 
 func (a *Agent) collectSystemMetrics() {
+	now := time.Now().UnixMilli()
 	vm, err := mem.VirtualMemory()
 	if err == nil {
 		a.metricsMu.Lock()
-		a.metrics["TotalMemory"] = float64(vm.Total)
-		a.metrics["FreeMemory"] = float64(vm.Free)
+		a.metrics["TotalMemory"] = sample{value: float64(vm.Total), collectedAt: now}
+		a.metrics["FreeMemory"] = sample{value: float64(vm.Free), collectedAt: now}
 		a.metricsMu.Unlock()
 	}
 
@@ -200,13 +308,13 @@ func (a *Agent) collectSystemMetrics() {
 		a.metricsMu.Lock()
 		for i := range per {
 			name := fmt.Sprintf("CPUutilization%d", i+1)
-			a.metrics[name] = per[i]
+			a.metrics[name] = sample{value: per[i], collectedAt: now}
 		}
 		a.metricsMu.Unlock()
 	}
 }
 
-func (a *Agent) sendMetricsBatchWithRetry(metrics map[string]interface{}) {
+func (a *Agent) sendMetricsBatchWithRetry(metrics map[string]sample) {
 	retryIntervals := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
 
 	for attempt := 0; attempt <= len(retryIntervals); attempt++ {
@@ -222,6 +330,12 @@ func (a *Agent) sendMetricsBatchWithRetry(metrics map[string]interface{}) {
 		}
 
 		if attempt == len(retryIntervals) {
+			// A gRPC batch is stored as a whole or not at all, so
+			// resending its metrics one by one would not help.
+			if a.grpcClient != nil {
+				log.Printf("Failed to send batch after all retries: %v", err)
+				return
+			}
 			log.Printf("Failed to send batch after all retries, falling back to single requests")
 			a.sendMetricsWithRetry(metrics)
 			return
@@ -231,21 +345,12 @@ func (a *Agent) sendMetricsBatchWithRetry(metrics map[string]interface{}) {
 	}
 }
 
-func (a *Agent) sendMetricsBatch(metrics map[string]interface{}) error {
+func (a *Agent) sendMetricsBatch(metrics map[string]sample) error {
 	var batch []models.Metrics
 
-	for name, value := range metrics {
-		var metric models.Metrics
-		metric.ID = name
-
-		switch v := value.(type) {
-		case float64:
-			metric.MType = "gauge"
-			metric.Value = &v
-		case int64:
-			metric.MType = "counter"
-			metric.Delta = &v
-		default:
+	for name, s := range metrics {
+		metric, err := toMetric(name, s)
+		if err != nil {
 			log.Printf("Unsupported type for %s", name)
 			continue
 		}
@@ -257,51 +362,19 @@ func (a *Agent) sendMetricsBatch(metrics map[string]interface{}) error {
 		return nil
 	}
 
+	if a.grpcClient != nil {
+		return a.sendBatchGRPC(batch)
+	}
+
 	jsonData, err := json.Marshal(batch)
 	if err != nil {
 		return fmt.Errorf("error marshaling batch: %w", err)
 	}
 
-	var hashHeader string
-	if a.config.Key != "" {
-		h := hmac.New(sha256.New, []byte(a.config.Key))
-		h.Write(jsonData)
-		hashHeader = hex.EncodeToString(h.Sum(nil))
-	}
-
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	if _, err := gz.Write(jsonData); err != nil {
-		return fmt.Errorf("error compressing batch: %w", err)
-	}
-	if err := gz.Close(); err != nil {
-		return fmt.Errorf("error closing gzip: %w", err)
-	}
-
-	payload := buf.Bytes()
-	encrypted := false
-	if a.publicKey != nil {
-		payload, err = encryptPayload(a.publicKey, payload)
-		if err != nil {
-			return fmt.Errorf("encrypt batch: %w", err)
-		}
-		encrypted = true
-	}
-
-	url := fmt.Sprintf("%s/updates/", a.config.ServerURL)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	req, err := a.newRequest("/updates/", jsonData)
 	if err != nil {
 		return fmt.Errorf("error creating request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Accept-Encoding", "gzip")
-	if hashHeader != "" {
-		req.Header.Set("HashSHA256", hashHeader)
-	}
-	if encrypted {
-		req.Header.Set(encryptedHeader, "1")
-	}
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -317,7 +390,7 @@ func (a *Agent) sendMetricsBatch(metrics map[string]interface{}) error {
 	return nil
 }
 
-func (a *Agent) sendMetricsWithRetry(metrics map[string]interface{}) {
+func (a *Agent) sendMetricsWithRetry(metrics map[string]sample) {
 	concurrency := a.config.RateLimit
 	if concurrency <= 0 {
 		concurrency = 1
@@ -325,7 +398,7 @@ func (a *Agent) sendMetricsWithRetry(metrics map[string]interface{}) {
 
 	type item struct {
 		n string
-		v interface{}
+		v sample
 	}
 
 	tasks := make(chan item)
@@ -360,7 +433,7 @@ func (a *Agent) sendMetricsWithRetry(metrics map[string]interface{}) {
 	log.Printf("Sent %d metrics", sent)
 }
 
-func (a *Agent) sendSingleMetricWithRetry(name string, value interface{}) error {
+func (a *Agent) sendSingleMetricWithRetry(name string, value sample) error {
 	retryIntervals := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
 
 	for attempt := 0; attempt <= len(retryIntervals); attempt++ {
@@ -382,11 +455,36 @@ func (a *Agent) sendSingleMetricWithRetry(name string, value interface{}) error
 	return fmt.Errorf("failed after all retries")
 }
 
-func (a *Agent) sendSingleMetric(name string, value interface{}) error {
-	var metric models.Metrics
-	metric.ID = name
+func (a *Agent) sendSingleMetric(name string, value sample) error {
+	metric, err := toMetric(name, value)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(metric)
+	if err != nil {
+		return fmt.Errorf("marshaling metric %s: %w", name, err)
+	}
+
+	req, err := a.newRequest("/update", jsonData)
+	if err != nil {
+		return fmt.Errorf("creating request for %s: %w", name, err)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending metric %s: %w", name, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// toMetric converts a collected sample into the wire representation.
+func toMetric(name string, s sample) (models.Metrics, error) {
+	metric := models.Metrics{ID: name}
 
-	switch v := value.(type) {
+	switch v := s.value.(type) {
 	case float64:
 		metric.MType = "gauge"
 		metric.Value = &v
@@ -394,14 +492,19 @@ func (a *Agent) sendSingleMetric(name string, value interface{}) error {
 		metric.MType = "counter"
 		metric.Delta = &v
 	default:
-		return fmt.Errorf("unsupported type for %s", name)
+		return metric, fmt.Errorf("unsupported type for %s", name)
 	}
 
-	jsonData, err := json.Marshal(metric)
-	if err != nil {
-		return fmt.Errorf("marshaling metric %s: %w", name, err)
+	if s.collectedAt != 0 {
+		ts := s.collectedAt
+		metric.Timestamp = &ts
 	}
+	return metric, nil
+}
 
+// newRequest builds a signed, gzip-compressed and optionally encrypted POST
+// request carrying jsonData to the server path.
+func (a *Agent) newRequest(path string, jsonData []byte) (*http.Request, error) {
 	var hashHeader string
 	if a.config.Key != "" {
 		h := hmac.New(sha256.New, []byte(a.config.Key))
@@ -412,26 +515,26 @@ func (a *Agent) sendSingleMetric(name string, value interface{}) error {
 	var buf bytes.Buffer
 	gz := gzip.NewWriter(&buf)
 	if _, err := gz.Write(jsonData); err != nil {
-		return fmt.Errorf("gzip write error for %s: %w", name, err)
+		return nil, fmt.Errorf("gzip write: %w", err)
 	}
 	if err := gz.Close(); err != nil {
-		return fmt.Errorf("gzip close error for %s: %w", name, err)
+		return nil, fmt.Errorf("gzip close: %w", err)
 	}
 
 	payload := buf.Bytes()
 	encrypted := false
 	if a.publicKey != nil {
+		var err error
 		payload, err = encryptPayload(a.publicKey, payload)
 		if err != nil {
-			return fmt.Errorf("encrypt metric %s: %w", name, err)
+			return nil, fmt.Errorf("encrypt: %w", err)
 		}
 		encrypted = true
 	}
 
-	url := fmt.Sprintf("%s/update", a.config.ServerURL)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	req, err := http.NewRequest("POST", a.config.ServerURL+path, bytes.NewReader(payload))
 	if err != nil {
-		return fmt.Errorf("creating request for %s: %w", name, err)
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
@@ -442,14 +545,7 @@ func (a *Agent) sendSingleMetric(name string, value interface{}) error {
 	if encrypted {
 		req.Header.Set(encryptedHeader, "1")
 	}
-
-	resp, err := a.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("sending metric %s: %w", name, err)
-	}
-	resp.Body.Close()
-
-	return nil
+	return req, nil
 }
 
 func loadPublicKey(path string) (*rsa.PublicKey, error) {
@@ -18,6 +18,14 @@ type Config struct {
 	Key            string
 	RateLimit      int
 	CryptoKeyPath  string
+	ScrapeTargets  []string
+	// Transport selects how metrics reach the server: TransportHTTP or
+	// TransportGRPC. Metadata is always registered over HTTP.
+	Transport   string
+	GRPCAddress string
+	// ListenAddress switches the agent to pull mode: instead of reporting,
+	// it serves its snapshot for the server to scrape.
+	ListenAddress string
 }
 
 // ParseConfig builds Config from flags and environment variables.
@@ -48,12 +56,36 @@ func ParseConfig() *Config {
 		cryptoDefault = fileCfg.CryptoKey
 	}
 
+	scrapeDefault := ""
+	if fileCfg != nil && len(fileCfg.ScrapeTargets) > 0 {
+		scrapeDefault = strings.Join(fileCfg.ScrapeTargets, ",")
+	}
+
+	transportDefault := TransportHTTP
+	if fileCfg != nil && fileCfg.Transport != "" {
+		transportDefault = fileCfg.Transport
+	}
+
+	grpcDefault := "localhost:3200"
+	if fileCfg != nil && fileCfg.GRPCAddress != "" {
+		grpcDefault = fileCfg.GRPCAddress
+	}
+
+	listenDefault := ""
+	if fileCfg != nil {
+		listenDefault = fileCfg.ListenAddress
+	}
+
 	addr := flag.String("a", addrDefault, "server address")
 	reportInterval := flag.Int("r", reportDefault, "report interval in seconds")
 	pollInterval := flag.Int("p", pollDefault, "poll interval in seconds")
 	keyFlag := flag.String("k", "", "hash key")
 	limitFlag := flag.Int("l", 1, "rate limit")
 	cryptoKeyFlag := flag.String("crypto-key", cryptoDefault, "path to public key")
+	scrapeFlag := flag.String("scrape", scrapeDefault, "comma separated Prometheus/OpenMetrics endpoints to scrape")
+	transportFlag := flag.String("transport", transportDefault, "metric delivery transport: http or grpc")
+	grpcFlag := flag.String("grpc-address", grpcDefault, "server gRPC address")
+	listenFlag := flag.String("listen", listenDefault, "serve snapshots for the server to pull on this address instead of reporting")
 	configFlag := flag.String("config", "", "path to config file")
 	shortConfigFlag := flag.String("c", "", "path to config file (shorthand)")
 	flag.Parse()
@@ -101,6 +133,26 @@ func ParseConfig() *Config {
 		finalCryptoKey = envCrypto
 	}
 
+	finalScrape := *scrapeFlag
+	if envScrape := os.Getenv("SCRAPE_TARGETS"); envScrape != "" {
+		finalScrape = envScrape
+	}
+
+	finalTransport := *transportFlag
+	if env := os.Getenv("TRANSPORT"); env != "" {
+		finalTransport = env
+	}
+
+	finalGRPC := *grpcFlag
+	if env := os.Getenv("GRPC_ADDRESS"); env != "" {
+		finalGRPC = env
+	}
+
+	finalListen := *listenFlag
+	if env := os.Getenv("LISTEN_ADDRESS"); env != "" {
+		finalListen = env
+	}
+
 	return &Config{
 		ServerURL:      "http://" + finalAddr,
 		PollInterval:   time.Duration(finalPollInterval) * time.Second,
@@ -108,14 +160,32 @@ func ParseConfig() *Config {
 		Key:            finalKey,
 		RateLimit:      finalLimit,
 		CryptoKeyPath:  finalCryptoKey,
+		ScrapeTargets:  splitList(finalScrape),
+		Transport:      finalTransport,
+		GRPCAddress:    finalGRPC,
+		ListenAddress:  finalListen,
 	}
 }
 
 type agentFileConfig struct {
-	Address        string `json:"address"`
-	ReportInterval string `json:"report_interval"`
-	PollInterval   string `json:"poll_interval"`
-	CryptoKey      string `json:"crypto_key"`
+	Address        string   `json:"address"`
+	ReportInterval string   `json:"report_interval"`
+	PollInterval   string   `json:"poll_interval"`
+	CryptoKey      string   `json:"crypto_key"`
+	ScrapeTargets  []string `json:"scrape_targets"`
+	Transport      string   `json:"transport"`
+	GRPCAddress    string   `json:"grpc_address"`
+	ListenAddress  string   `json:"listen_address"`
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func loadAgentConfigFile() *agentFileConfig {
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"go-metrics-and-alerts/api/metricspb"
+	models "go-metrics-and-alerts/internal/model"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Transports selectable through Config.Transport.
+const (
+	TransportHTTP = "http"
+	TransportGRPC = "grpc"
+)
+
+const (
+	grpcTimeout     = 10 * time.Second
+	grpcHashKey     = "hashsha256"
+	grpcEncryptedMD = "x-encrypted"
+)
+
+func dialGRPC(address string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
+	)
+}
+
+// newUpdateRequest builds a request carrying metrics and the HMAC of their
+// MetricBatch. With a public key configured the batch is sent encrypted.
+func (a *Agent) newUpdateRequest(metrics []models.Metrics) (*metricspb.UpdateRequest, string, error) {
+	batch := &metricspb.MetricBatch{}
+	for _, m := range metrics {
+		pm, err := metricspb.FromModel(m)
+		if err != nil {
+			return nil, "", err
+		}
+		batch.Metrics = append(batch.Metrics, pm)
+	}
+
+	raw, err := proto.MarshalOptions{Deterministic: true}.Marshal(batch)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshal batch: %w", err)
+	}
+
+	var hash string
+	if a.config.Key != "" {
+		h := hmac.New(sha256.New, []byte(a.config.Key))
+		h.Write(raw)
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	req := &metricspb.UpdateRequest{}
+	if a.publicKey != nil {
+		req.Encrypted, err = encryptPayload(a.publicKey, raw)
+		if err != nil {
+			return nil, "", fmt.Errorf("encrypt: %w", err)
+		}
+	} else {
+		req.Metrics = batch.Metrics
+	}
+	return req, hash, nil
+}
+
+func (a *Agent) grpcContext(ctx context.Context, hash string) context.Context {
+	var pairs []string
+	if a.publicKey != nil {
+		pairs = append(pairs, grpcEncryptedMD, "1")
+	}
+	if hash != "" {
+		pairs = append(pairs, grpcHashKey, hash)
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+func (a *Agent) sendBatchGRPC(batch []models.Metrics) error {
+	req, hash, err := a.newUpdateRequest(batch)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+
+	resp, err := a.grpcClient.UpdateBatch(a.grpcContext(ctx, hash), req)
+	if err != nil {
+		return fmt.Errorf("error sending batch: %w", err)
+	}
+
+	log.Printf("Successfully sent batch of %d metrics over gRPC", resp.GetAccepted())
+	return nil
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"go-metrics-and-alerts/api/metricspb"
+	"go-metrics-and-alerts/internal/grpcserver"
+	"go-metrics-and-alerts/internal/handler"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCTransportSignedAndEncrypted(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	storage := repository.NewMemStorage()
+	srv := grpcserver.New(handler.New(storage), "secret", key).Register()
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	a, err := New(&Config{Key: "secret"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	a.publicKey = &key.PublicKey
+	a.grpcClient = metricspb.NewMetricsClient(conn)
+
+	value := 3.5
+	if err := a.sendBatchGRPC([]models.Metrics{{ID: "Alloc", MType: models.Gauge, Value: &value}}); err != nil {
+		t.Fatalf("sendBatchGRPC: %v", err)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "Alloc"); v != 3.5 {
+		t.Fatalf("Expected Alloc 3.5, got %v", v)
+	}
+
+	err = a.sendMetricsBatch(map[string]sample{
+		"PollCount": {value: int64(4)},
+		"Frees":     {value: 7.0},
+	})
+	if err != nil {
+		t.Fatalf("sendMetricsBatch: %v", err)
+	}
+	if v, _, _ := storage.GetCounter(ctx, "PollCount"); v != 4 {
+		t.Fatalf("Expected PollCount 4, got %v", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "Frees"); v != 7 {
+		t.Fatalf("Expected Frees 7, got %v", v)
+	}
+
+	a.config.Key = "other"
+	if err := a.sendBatchGRPC([]models.Metrics{{ID: "Alloc", MType: models.Gauge, Value: &value}}); err == nil {
+		t.Fatal("Expected a hash mismatch to be rejected")
+	}
+}
+
+func TestNewRejectsRateLimitWithGRPC(t *testing.T) {
+	if _, err := New(&Config{Transport: TransportGRPC, GRPCAddress: "localhost:3200", RateLimit: 4}); err == nil {
+		t.Fatal("Expected rate limit with gRPC transport to be rejected")
+	}
+}
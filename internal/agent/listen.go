@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+const (
+	// SnapshotPath is where an agent in pull mode serves its metrics.
+	SnapshotPath = "/snapshot"
+	// SnapshotSeqHeader carries the sequence number of a snapshot. The
+	// scraper acknowledges a stored snapshot by passing its number in the
+	// AckParam query parameter of the next request.
+	SnapshotSeqHeader = "X-Snapshot-Seq"
+	// AckParam is the query parameter acknowledging stored snapshots.
+	AckParam = "ack"
+
+	// maxUnacked bounds the snapshots awaiting acknowledgement. Beyond it
+	// the oldest two are merged, so a scraper acknowledging that far
+	// behind counts the older one again.
+	maxUnacked = 64
+)
+
+// pendingDeltas are the counter increases handed out in one snapshot and
+// not acknowledged yet.
+type pendingDeltas struct {
+	seq    uint64
+	deltas map[string]int64
+}
+
+// Snapshot serves the collected metrics as a JSON array in the format of the
+// server's /updates/ endpoint. Counters carry their increase since the last
+// acknowledged snapshot: increases stay with the agent until the scraper
+// acknowledges a snapshot holding them, so a failed store or a lost response
+// only delays them. A POST only acknowledges, for a scraper that stops. With
+// a key configured the request must be signed like the response, over its
+// raw query.
+func (a *Agent) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.config.Key != "" && !validSignature(a.config.Key, []byte(r.URL.RawQuery), r.Header.Get("HashSHA256")) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var ack uint64
+	if v := r.URL.Query().Get(AckParam); v != "" {
+		var err error
+		if ack, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		a.acknowledge(ack)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	snap, seq := a.pullSnapshot(ack)
+	batch := make([]models.Metrics, 0, len(snap))
+	for name, s := range snap {
+		metric, err := toMetric(name, s)
+		if err != nil {
+			log.Printf("Unsupported type for %s", name)
+			continue
+		}
+		batch = append(batch, metric)
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+
+	resp, err := json.Marshal(batch)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(SnapshotSeqHeader, strconv.FormatUint(seq, 10))
+	if a.config.Key != "" {
+		h := hmac.New(sha256.New, []byte(a.config.Key))
+		h.Write(resp)
+		w.Header().Set("HashSHA256", hex.EncodeToString(h.Sum(nil)))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// pullSnapshot drops the increases acknowledged by ack, takes a new
+// snapshot and returns it with its sequence number. Its counters sum every
+// unacknowledged increase.
+func (a *Agent) pullSnapshot(ack uint64) (map[string]sample, uint64) {
+	a.pullMu.Lock()
+	defer a.pullMu.Unlock()
+
+	a.dropAcknowledged(ack)
+	snap := a.buildSnapshot()
+	a.pullSeq++
+	fresh := pendingDeltas{seq: a.pullSeq, deltas: make(map[string]int64)}
+	for name, s := range snap {
+		if delta, ok := s.value.(int64); ok {
+			fresh.deltas[name] = delta
+		}
+	}
+	a.unacked = append(a.unacked, fresh)
+	if len(a.unacked) > maxUnacked {
+		for name, delta := range a.unacked[0].deltas {
+			a.unacked[1].deltas[name] += delta
+		}
+		a.unacked = a.unacked[1:]
+	}
+
+	now := time.Now().UnixMilli()
+	totals := make(map[string]int64)
+	for _, p := range a.unacked {
+		for name, delta := range p.deltas {
+			totals[name] += delta
+		}
+	}
+	for name, total := range totals {
+		snap[name] = sample{value: total, collectedAt: now}
+	}
+	return snap, a.pullSeq
+}
+
+// acknowledge drops the increases acknowledged by ack.
+func (a *Agent) acknowledge(ack uint64) {
+	a.pullMu.Lock()
+	defer a.pullMu.Unlock()
+	a.dropAcknowledged(ack)
+}
+
+// dropAcknowledged must be called with pullMu held.
+func (a *Agent) dropAcknowledged(ack uint64) {
+	kept := a.unacked[:0]
+	for _, p := range a.unacked {
+		if p.seq > ack {
+			kept = append(kept, p)
+		}
+	}
+	a.unacked = kept
+}
+
+// drained reports whether every counter increase has been acknowledged.
+func (a *Agent) drained() bool {
+	a.pullMu.Lock()
+	defer a.pullMu.Unlock()
+	for _, p := range a.unacked {
+		for _, delta := range p.deltas {
+			if delta != 0 {
+				return false
+			}
+		}
+	}
+	a.metricsMu.Lock()
+	defer a.metricsMu.Unlock()
+	if a.pollCount > 0 {
+		return false
+	}
+	for _, delta := range a.scrapeDeltas {
+		if delta != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// collectedNames returns the names of the metrics collected so far, for
+// metadata registration in pull mode.
+func (a *Agent) collectedNames() map[string]sample {
+	a.metricsMu.Lock()
+	defer a.metricsMu.Unlock()
+	names := make(map[string]sample, len(a.metrics)+len(a.scrapeDeltas)+1)
+	for name, s := range a.metrics {
+		names[name] = s
+	}
+	for name := range a.scrapeDeltas {
+		names[name] = sample{}
+	}
+	names["PollCount"] = sample{}
+	return names
+}
+
+// listen serves Snapshot on the configured address until ctx is done. On
+// shutdown it keeps serving for up to drainTimeout, until the scraper has
+// acknowledged every counter increase.
+func (a *Agent) listen(ctx context.Context, drainTimeout time.Duration) error {
+	lis, err := net.Listen("tcp", a.config.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(SnapshotPath, a.Snapshot)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		deadline := time.Now().Add(drainTimeout)
+		for !a.drained() && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !a.drained() {
+			log.Printf("Shutting down with unacknowledged counter increases")
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving snapshots on %s%s", lis.Addr(), SnapshotPath)
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func validSignature(key string, data []byte, header string) bool {
+	want, err := hex.DecodeString(strings.TrimSpace(header))
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+func TestSnapshotKeepsDeltasUntilAcknowledged(t *testing.T) {
+	a, err := New(&Config{Key: "secret"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	a.collectRuntimeMetrics()
+	a.collectRuntimeMetrics()
+
+	sign := func(data string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(data))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	do := func(method, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, SnapshotPath+"?"+query, nil)
+		req.Header.Set("HashSHA256", sign(query))
+		w := httptest.NewRecorder()
+		a.Snapshot(w, req)
+		return w
+	}
+	get := func(query, wantSeq string) []models.Metrics {
+		w := do(http.MethodGet, query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Header().Get("HashSHA256") != sign(w.Body.String()) {
+			t.Fatal("Snapshot signature mismatch")
+		}
+		if seq := w.Header().Get(SnapshotSeqHeader); seq != wantSeq {
+			t.Fatalf("Expected snapshot %s, got %s", wantSeq, seq)
+		}
+		var metrics []models.Metrics
+		if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+			t.Fatal(err)
+		}
+		return metrics
+	}
+	pollCount := func(metrics []models.Metrics) int64 {
+		for _, m := range metrics {
+			if m.ID == "PollCount" {
+				return *m.Delta
+			}
+		}
+		t.Fatal("PollCount missing from snapshot")
+		return 0
+	}
+
+	w := httptest.NewRecorder()
+	a.Snapshot(w, httptest.NewRequest(http.MethodGet, SnapshotPath, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an unsigned request to be rejected, got %d", w.Code)
+	}
+
+	first := get("", "1")
+	if got := pollCount(first); got != 2 {
+		t.Fatalf("Expected PollCount 2, got %d", got)
+	}
+	for i := 1; i < len(first); i++ {
+		if first[i-1].ID > first[i].ID {
+			t.Fatal("Snapshot should be sorted by ID")
+		}
+	}
+
+	a.collectRuntimeMetrics()
+	if got := pollCount(get("", "2")); got != 3 {
+		t.Fatalf("Expected unacknowledged PollCount to be sent again, got %d", got)
+	}
+	if got := pollCount(get("ack=2", "3")); got != 0 {
+		t.Fatalf("Expected acknowledged PollCount to be consumed, got %d", got)
+	}
+
+	a.collectRuntimeMetrics()
+	get("ack=3", "4")
+	if a.drained() {
+		t.Fatal("Expected snapshot 4 to await acknowledgement")
+	}
+	if w := do(http.MethodPost, "ack=4"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for an acknowledgement, got %d", w.Code)
+	}
+	if !a.drained() {
+		t.Fatal("Expected every increase to be acknowledged")
+	}
+}
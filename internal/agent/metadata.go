@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+const metadataOwner = "agent"
+
+// builtinMetadata describes the runtime and gopsutil metrics the agent reports.
+var builtinMetadata = map[string]models.Metadata{
+	"Alloc":         {Description: "Bytes of allocated heap objects", Unit: "bytes", MType: models.Gauge},
+	"BuckHashSys":   {Description: "Bytes of memory in profiling bucket hash tables", Unit: "bytes", MType: models.Gauge},
+	"Frees":         {Description: "Cumulative count of heap objects freed", Unit: "objects", MType: models.Gauge},
+	"GCCPUFraction": {Description: "Fraction of CPU time used by the GC since program start", Unit: "ratio", MType: models.Gauge},
+	"GCSys":         {Description: "Bytes of memory in garbage collection metadata", Unit: "bytes", MType: models.Gauge},
+	"HeapAlloc":     {Description: "Bytes of allocated heap objects", Unit: "bytes", MType: models.Gauge},
+	"HeapIdle":      {Description: "Bytes in idle heap spans", Unit: "bytes", MType: models.Gauge},
+	"HeapInuse":     {Description: "Bytes in in-use heap spans", Unit: "bytes", MType: models.Gauge},
+	"HeapObjects":   {Description: "Number of allocated heap objects", Unit: "objects", MType: models.Gauge},
+	"HeapReleased":  {Description: "Bytes of physical memory returned to the OS", Unit: "bytes", MType: models.Gauge},
+	"HeapSys":       {Description: "Bytes of heap memory obtained from the OS", Unit: "bytes", MType: models.Gauge},
+	"LastGC":        {Description: "Time the last garbage collection finished", Unit: "nanoseconds since epoch", MType: models.Gauge},
+	"Lookups":       {Description: "Number of pointer lookups performed by the runtime", Unit: "lookups", MType: models.Gauge},
+	"MCacheInuse":   {Description: "Bytes of allocated mcache structures", Unit: "bytes", MType: models.Gauge},
+	"MCacheSys":     {Description: "Bytes of memory obtained from the OS for mcache structures", Unit: "bytes", MType: models.Gauge},
+	"MSpanInuse":    {Description: "Bytes of allocated mspan structures", Unit: "bytes", MType: models.Gauge},
+	"MSpanSys":      {Description: "Bytes of memory obtained from the OS for mspan structures", Unit: "bytes", MType: models.Gauge},
+	"Mallocs":       {Description: "Cumulative count of heap objects allocated", Unit: "objects", MType: models.Gauge},
+	"NextGC":        {Description: "Target heap size of the next GC cycle", Unit: "bytes", MType: models.Gauge},
+	"NumForcedGC":   {Description: "Number of GC cycles forced by the application", Unit: "cycles", MType: models.Gauge},
+	"NumGC":         {Description: "Number of completed GC cycles", Unit: "cycles", MType: models.Gauge},
+	"OtherSys":      {Description: "Bytes of memory in miscellaneous off-heap runtime allocations", Unit: "bytes", MType: models.Gauge},
+	"PauseTotalNs":  {Description: "Cumulative nanoseconds in GC stop-the-world pauses", Unit: "nanoseconds", MType: models.Gauge},
+	"StackInuse":    {Description: "Bytes in stack spans", Unit: "bytes", MType: models.Gauge},
+	"StackSys":      {Description: "Bytes of stack memory obtained from the OS", Unit: "bytes", MType: models.Gauge},
+	"Sys":           {Description: "Total bytes of memory obtained from the OS", Unit: "bytes", MType: models.Gauge},
+	"TotalAlloc":    {Description: "Cumulative bytes allocated for heap objects", Unit: "bytes", MType: models.Gauge},
+	"RandomValue":   {Description: "Random value refreshed on every poll", MType: models.Gauge},
+	"PollCount":     {Description: "Number of polls since the previous report", Unit: "polls", MType: models.Counter},
+	"TotalMemory":   {Description: "Total physical memory", Unit: "bytes", MType: models.Gauge},
+	"FreeMemory":    {Description: "Free physical memory", Unit: "bytes", MType: models.Gauge},
+}
+
+// describeMetric returns metadata for a built-in metric name.
+func describeMetric(name string) (models.Metadata, bool) {
+	meta, ok := builtinMetadata[name]
+	if !ok && strings.HasPrefix(name, "CPUutilization") {
+		cpuNum := strings.TrimPrefix(name, "CPUutilization")
+		meta = models.Metadata{Description: "Utilization of CPU " + cpuNum, Unit: "percent", MType: models.Gauge}
+		ok = true
+	}
+	if !ok {
+		return models.Metadata{}, false
+	}
+	meta.ID = name
+	meta.Owner = metadataOwner
+	return meta, true
+}
+
+// registerMetadata sends metadata for snapshot metrics the server has not
+// acknowledged yet. Failures are retried on the next report.
+func (a *Agent) registerMetadata(snap map[string]sample) {
+	var pending []models.Metadata
+	a.metricsMu.Lock()
+	for name := range snap {
+		if a.registered[name] {
+			continue
+		}
+		if meta, ok := describeMetric(name); ok {
+			pending = append(pending, meta)
+		} else if meta, ok := a.scrapedMeta[name]; ok {
+			pending = append(pending, meta)
+		}
+	}
+	a.metricsMu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := a.sendMetadata(pending); err != nil {
+		log.Printf("Error registering metadata: %v", err)
+		return
+	}
+
+	a.metricsMu.Lock()
+	for _, meta := range pending {
+		a.registered[meta.ID] = true
+	}
+	a.metricsMu.Unlock()
+}
+
+func (a *Agent) sendMetadata(items []models.Metadata) error {
+	jsonData, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata: %w", err)
+	}
+
+	req, err := a.newRequest("/metadata/", jsonData)
+	if err != nil {
+		return fmt.Errorf("creating metadata request: %w", err)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending metadata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned non-200: %d", resp.StatusCode)
+	}
+	return nil
+}
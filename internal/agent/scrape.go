@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/promtext"
+)
+
+const scrapeAccept = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// scraper pulls Prometheus or OpenMetrics text from local endpoints. Source
+// counters are cumulative while the server expects deltas, so the scraper
+// remembers the last value of every counter series; the first observation
+// of a series only sets that baseline. A series missing from a successful
+// scrape of its target is forgotten.
+type scraper struct {
+	client  *http.Client
+	targets []string
+	last    map[string]float64
+	// series holds the IDs of the last successful scrape of every target.
+	series map[string]map[string]bool
+}
+
+// scrapeResult holds the gauges and counter deltas of one scrape round, and
+// the series that disappeared from their targets.
+type scrapeResult struct {
+	gauges   map[string]float64
+	deltas   map[string]int64
+	metadata map[string]models.Metadata
+	gone     []string
+}
+
+func newScraper(targets []string) *scraper {
+	return &scraper{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		targets: targets,
+		last:    make(map[string]float64),
+		series:  make(map[string]map[string]bool),
+	}
+}
+
+// scrape fetches every target; a failing target is logged and skipped.
+func (s *scraper) scrape(ctx context.Context) scrapeResult {
+	res := scrapeResult{
+		gauges:   make(map[string]float64),
+		deltas:   make(map[string]int64),
+		metadata: make(map[string]models.Metadata),
+	}
+	for _, target := range s.targets {
+		families, err := s.fetch(ctx, target)
+		if err != nil {
+			log.Printf("Error scraping %s: %v", target, err)
+			continue
+		}
+		s.convert(target, families, &res)
+	}
+	return res
+}
+
+func (s *scraper) fetch(ctx context.Context, target string) ([]promtext.Family, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", scrapeAccept)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("target returned non-200: %d", resp.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return promtext.Parse(resp.Body, mediaType == "application/openmetrics-text")
+}
+
+func (s *scraper) convert(target string, families []promtext.Family, res *scrapeResult) {
+	instance := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		instance = u.Host
+	}
+
+	current := make(map[string]bool)
+
+	for _, f := range families {
+		for _, sample := range f.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+
+			mtype := sampleType(f, sample.Name)
+			if mtype == "" {
+				continue
+			}
+
+			labels := sample.Labels
+			if !hasLabel(labels, "instance") {
+				labels = append(labels, models.Label{Name: "instance", Value: instance})
+			}
+			id := models.JoinID(sample.Name, labels)
+			current[id] = true
+
+			if f.Help != "" || f.Unit != "" {
+				res.metadata[id] = models.Metadata{
+					ID:          id,
+					Description: f.Help,
+					Unit:        f.Unit,
+					MType:       mtype,
+					Owner:       metadataOwner,
+				}
+			}
+
+			switch mtype {
+			case models.Gauge:
+				res.gauges[id] = sample.Value
+			case models.Counter:
+				prev, seen := s.last[id]
+				s.last[id] = sample.Value
+				if !seen {
+					continue
+				}
+				delta := int64(sample.Value) - int64(prev)
+				if sample.Value < prev {
+					delta = int64(sample.Value)
+				}
+				res.deltas[id] += delta
+			}
+		}
+	}
+
+	for id := range s.series[target] {
+		if !current[id] {
+			delete(s.last, id)
+			res.gone = append(res.gone, id)
+		}
+	}
+	s.series[target] = current
+}
+
+// sampleType maps a sample onto the server metric type, or "" when the
+// sample carries no value worth forwarding.
+func sampleType(f promtext.Family, name string) string {
+	suffix := strings.TrimPrefix(name, f.Name)
+	if suffix == "_created" {
+		return ""
+	}
+
+	switch f.Type {
+	case "counter":
+		return models.Counter
+	case "histogram":
+		if suffix == "_bucket" || suffix == "_count" {
+			return models.Counter
+		}
+	case "summary":
+		if suffix == "_count" {
+			return models.Counter
+		}
+	}
+	return models.Gauge
+}
+
+func hasLabel(labels []models.Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scrapeTargets runs one scrape round and merges the result into the
+// collected metrics. Gauges that disappeared from their target are no
+// longer reported.
+func (a *Agent) scrapeTargets(ctx context.Context) {
+	res := a.scraper.scrape(ctx)
+	now := time.Now().UnixMilli()
+
+	a.metricsMu.Lock()
+	for _, id := range res.gone {
+		delete(a.metrics, id)
+		delete(a.scrapedMeta, id)
+	}
+	for id, v := range res.gauges {
+		a.metrics[id] = sample{value: v, collectedAt: now}
+	}
+	for id, d := range res.deltas {
+		a.scrapeDeltas[id] += d
+	}
+	for id, meta := range res.metadata {
+		a.scrapedMeta[id] = meta
+	}
+	a.metricsMu.Unlock()
+}
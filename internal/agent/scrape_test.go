@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScraperConvertsCountersToDeltas(t *testing.T) {
+	total := 10
+	present := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if !present {
+			return
+		}
+		fmt.Fprintf(w, "# HELP jobs_total Jobs done.\n# TYPE jobs_total counter\njobs_total{queue=\"a\"} %d\n", total)
+		fmt.Fprint(w, "# TYPE temperature gauge\ntemperature 21.5\nbroken NaN\n")
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	counterID := fmt.Sprintf(`jobs_total{instance="%s",queue="a"}`, u.Host)
+	gaugeID := fmt.Sprintf(`temperature{instance="%s"}`, u.Host)
+
+	s := newScraper([]string{srv.URL})
+
+	res := s.scrape(context.Background())
+	if _, ok := res.deltas[counterID]; ok {
+		t.Fatal("first observation should only set the baseline")
+	}
+	if res.gauges[gaugeID] != 21.5 {
+		t.Fatalf("unexpected gauges %v", res.gauges)
+	}
+	if len(res.gauges) != 1 {
+		t.Fatalf("non-finite samples should be skipped, got %v", res.gauges)
+	}
+	if res.metadata[counterID].Description != "Jobs done." {
+		t.Fatalf("unexpected metadata %v", res.metadata)
+	}
+
+	total = 25
+	res = s.scrape(context.Background())
+	if res.deltas[counterID] != 15 {
+		t.Fatalf("expected delta 15, got %v", res.deltas)
+	}
+
+	total = 4
+	res = s.scrape(context.Background())
+	if res.deltas[counterID] != 4 {
+		t.Fatalf("expected reset to report the new value, got %v", res.deltas)
+	}
+
+	present = false
+	res = s.scrape(context.Background())
+	if len(res.gone) != 2 {
+		t.Fatalf("expected both series to be gone, got %v", res.gone)
+	}
+	present = true
+	if res = s.scrape(context.Background()); len(res.deltas) != 0 {
+		t.Fatalf("a returning series should only set the baseline, got %v", res.deltas)
+	}
+}
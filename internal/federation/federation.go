@@ -0,0 +1,493 @@
+// Package federation merges the metrics of several servers into one.
+//
+// A federating server pulls the bulk export of each configured peer, or
+// peers push their export to it. Every series is stored under an extra
+// source label naming the peer, so equal metric names from different
+// datacenters stay apart. Series that already carry a source label keep it,
+// which lets federation be chained. Counters are exported as running totals
+// and turned back into deltas here; a total lower than the previous one means
+// the peer restarted. A peer not heard from within StaleAfter is reported as
+// down through the federation_up gauge and the status endpoint.
+package federation
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-metrics-and-alerts/internal/handler"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// SourceLabel names the peer a federated series came from.
+	SourceLabel = "source"
+	// UpMetric is the gauge reporting whether a peer is current.
+	UpMetric = "federation_up"
+
+	exportPath  = "/api/v1/export"
+	receivePath = "/api/v1/federate/"
+)
+
+// Peer is a server whose metrics are pulled.
+type Peer struct {
+	Source string
+	URL    string
+}
+
+// Config controls pulling from peers and pushing upstream. Either part may
+// be left empty.
+type Config struct {
+	Peers []Peer
+	// Upstream is the base URL of a server this one pushes its export to
+	// under the name Source.
+	Upstream string
+	Source   string
+	// Interval is the time between pulls and pushes.
+	Interval time.Duration
+	// StaleAfter is how long a peer may stay silent before it is reported
+	// as down. It defaults to three intervals.
+	StaleAfter time.Duration
+	// Key signs pushed and verifies pulled exports when set.
+	Key    string
+	Client *http.Client
+}
+
+// PeerStatus describes the state of one peer.
+type PeerStatus struct {
+	Source   string    `json:"source"`
+	URL      string    `json:"url,omitempty"`
+	Up       bool      `json:"up"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type peerState struct {
+	PeerStatus
+	added time.Time
+	// stale is set once the peer has been reported as down.
+	stale bool
+}
+
+// Federator pulls, receives and pushes federated metrics.
+type Federator struct {
+	cfg     Config
+	h       *handler.Handler
+	storage repository.Repository
+
+	// ingestMu serializes ingestion so counter totals of one peer are
+	// turned into deltas in order.
+	ingestMu sync.Mutex
+	totals   map[string]int64
+
+	mu    sync.Mutex
+	peers map[string]*peerState
+
+	wg sync.WaitGroup
+}
+
+// New creates a federator storing through h. storage is the repository
+// behind h and is used to read the totals already stored.
+func New(h *handler.Handler, storage repository.Repository, cfg Config) *Federator {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	if cfg.StaleAfter <= 0 {
+		cfg.StaleAfter = 3 * cfg.Interval
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Interval}
+	}
+
+	f := &Federator{
+		cfg:     cfg,
+		h:       h,
+		storage: storage,
+		totals:  make(map[string]int64),
+		peers:   make(map[string]*peerState),
+	}
+	now := time.Now()
+	for _, p := range cfg.Peers {
+		f.peers[p.Source] = &peerState{PeerStatus: PeerStatus{Source: p.Source, URL: p.URL}, added: now}
+	}
+	return f
+}
+
+// ParsePeers parses a comma separated list of source=url pairs.
+func ParsePeers(s string) ([]Peer, error) {
+	var peers []Peer
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		source, rawURL, ok := strings.Cut(item, "=")
+		source, rawURL = strings.TrimSpace(source), strings.TrimSpace(rawURL)
+		if !ok || source == "" || rawURL == "" {
+			return nil, fmt.Errorf("peer %q is not source=url", item)
+		}
+		if seen[source] {
+			return nil, fmt.Errorf("duplicate peer source %q", source)
+		}
+		seen[source] = true
+		peers = append(peers, Peer{Source: source, URL: strings.TrimRight(rawURL, "/")})
+	}
+	return peers, nil
+}
+
+// Start pulls, pushes and checks for stale peers every interval until ctx
+// is done.
+func (f *Federator) Start(ctx context.Context) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := time.NewTicker(f.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			f.round(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Wait blocks until the loop started by Start has returned.
+func (f *Federator) Wait() {
+	f.wg.Wait()
+}
+
+func (f *Federator) round(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range f.cfg.Peers {
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			if err := f.pull(ctx, p); err != nil && ctx.Err() == nil {
+				log.Printf("Federation pull from %s failed: %v", p.Source, err)
+				f.setError(p.Source, err)
+			}
+		}(p)
+	}
+	if f.cfg.Upstream != "" {
+		if err := f.push(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Federation push to %s failed: %v", f.cfg.Upstream, err)
+		}
+	}
+	wg.Wait()
+	f.checkStale(ctx, time.Now())
+}
+
+func (f *Federator) pull(ctx context.Context, p Peer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+exportPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("export returned %d", resp.StatusCode)
+	}
+	if f.cfg.Key != "" && !f.validHash(body, resp.Header.Get("HashSHA256")) {
+		return errors.New("export hash mismatch")
+	}
+
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		return err
+	}
+	return f.Ingest(ctx, p.Source, metrics)
+}
+
+func (f *Federator) push(ctx context.Context) error {
+	metrics, err := f.h.ExportMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	target := strings.TrimRight(f.cfg.Upstream, "/") + receivePath + url.PathEscape(f.cfg.Source)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.cfg.Key != "" {
+		req.Header.Set("HashSHA256", f.sign(body))
+	}
+
+	resp, err := f.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Receive stores an export pushed by the peer named in the path, as in
+// POST /api/v1/federate/{source}.
+func (f *Federator) Receive(w http.ResponseWriter, r *http.Request) {
+	source := chi.URLParam(r, "source")
+	if source == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if f.cfg.Key != "" && !f.validHash(body, r.Header.Get("HashSHA256")) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if err := f.Ingest(r.Context(), source, metrics); err != nil {
+		if errors.Is(err, repository.ErrSeriesLimit) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, handler.ErrInvalidBatch) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error storing federated metrics from %s: %v", source, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Status lists the known peers as JSON.
+func (f *Federator) Status(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(f.Peers())
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// Peers returns the state of every configured or pushing peer sorted by
+// source.
+func (f *Federator) Peers() []PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peers := make([]PeerStatus, 0, len(f.peers))
+	for _, p := range f.peers {
+		peers = append(peers, p.PeerStatus)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Source < peers[j].Source })
+	return peers
+}
+
+// Ingest stores an export of the peer named source.
+func (f *Federator) Ingest(ctx context.Context, source string, metrics []models.Metrics) error {
+	f.ingestMu.Lock()
+	defer f.ingestMu.Unlock()
+
+	batch := make([]models.Metrics, 0, len(metrics))
+	pending := make(map[string]int64)
+	for _, m := range metrics {
+		if m.ID == "" {
+			continue
+		}
+		out := models.Metrics{ID: namespace(m.ID, source), MType: m.MType, Timestamp: m.Timestamp}
+		switch m.MType {
+		case models.Gauge:
+			if m.Value == nil {
+				continue
+			}
+			out.Value = m.Value
+		case models.Counter:
+			if m.Delta == nil {
+				continue
+			}
+			delta, store, err := f.counterDelta(ctx, out.ID, *m.Delta)
+			if err != nil {
+				return err
+			}
+			pending[out.ID] = *m.Delta
+			if !store {
+				continue
+			}
+			out.Delta = &delta
+		case models.Set:
+			out.Registers = m.Registers
+		default:
+			continue
+		}
+		batch = append(batch, out)
+	}
+
+	if len(batch) > 0 {
+		if err := f.h.StoreBatch(ctx, "federation:"+source, batch); err != nil {
+			return err
+		}
+	}
+	for id, total := range pending {
+		f.totals[id] = total
+	}
+	f.markSeen(ctx, source)
+	return nil
+}
+
+// counterDelta turns the running total of a federated counter into the
+// increase since the previous export. Without a previous export the stored
+// value is the baseline, so a restart of this server does not count the
+// peer's total twice. It reports false when there is nothing to store.
+func (f *Federator) counterDelta(ctx context.Context, id string, total int64) (int64, bool, error) {
+	last, ok := f.totals[id]
+	if !ok {
+		stored, exists, err := f.storage.GetCounter(ctx, id)
+		if err != nil {
+			return 0, false, err
+		}
+		if !exists {
+			return total, true, nil
+		}
+		last = stored
+	}
+	switch {
+	case total > last:
+		return total - last, true, nil
+	case total < last && ok:
+		// The peer restarted and counts from zero again.
+		return total, total > 0, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// namespace adds the source label to id unless it already has one.
+func namespace(id, source string) string {
+	name, labels := models.SplitID(id)
+	for _, l := range labels {
+		if l.Name == SourceLabel {
+			return id
+		}
+	}
+	return models.JoinID(name, append(labels, models.Label{Name: SourceLabel, Value: source}))
+}
+
+func (f *Federator) markSeen(ctx context.Context, source string) {
+	f.mu.Lock()
+	p, ok := f.peers[source]
+	if !ok {
+		p = &peerState{PeerStatus: PeerStatus{Source: source}}
+		f.peers[source] = p
+	}
+	p.LastSeen = time.Now()
+	p.Error = ""
+	wasUp := p.Up
+	p.Up, p.stale = true, false
+	f.mu.Unlock()
+
+	if !wasUp {
+		log.Printf("Federation peer %s is up", source)
+		f.storeUp(ctx, source, true)
+	}
+}
+
+func (f *Federator) setError(source string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.peers[source]; ok {
+		p.Error = err.Error()
+	}
+}
+
+// checkStale marks peers silent for longer than StaleAfter as down. A
+// configured peer that never answered counts as silent since the start.
+func (f *Federator) checkStale(ctx context.Context, now time.Time) {
+	var down []string
+	f.mu.Lock()
+	for source, p := range f.peers {
+		last := p.LastSeen
+		if last.IsZero() {
+			last = p.added
+		}
+		if now.Sub(last) <= f.cfg.StaleAfter {
+			continue
+		}
+		if p.Up || !p.stale {
+			p.Up, p.stale = false, true
+			down = append(down, source)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, source := range down {
+		log.Printf("Federation peer %s is stale", source)
+		f.storeUp(ctx, source, false)
+	}
+}
+
+func (f *Federator) storeUp(ctx context.Context, source string, up bool) {
+	value := 0.0
+	if up {
+		value = 1
+	}
+	id := models.JoinID(UpMetric, []models.Label{{Name: SourceLabel, Value: source}})
+	if err := f.h.StoreBatch(ctx, "federation", []models.Metrics{{ID: id, MType: models.Gauge, Value: &value}}); err != nil {
+		log.Printf("Error storing %s: %v", id, err)
+	}
+}
+
+func (f *Federator) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.cfg.Key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *Federator) validHash(body []byte, header string) bool {
+	want, err := hex.DecodeString(strings.TrimSpace(header))
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(f.cfg.Key))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,176 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-metrics-and-alerts/internal/handler"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type server struct {
+	storage repository.Repository
+	h       *handler.Handler
+}
+
+func newServer() *server {
+	storage := repository.NewMemStorage()
+	return &server{storage: storage, h: handler.New(storage)}
+}
+
+func (s *server) add(t *testing.T, metrics ...models.Metrics) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.h.StoreBatch(ctx, "test", metrics); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func counter(id string, delta int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &delta}
+}
+
+func gauge(id string, value float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &value}
+}
+
+func TestPullNamespacesAndTracksTotals(t *testing.T) {
+	ctx := context.Background()
+	peer := newServer()
+	srv := httptest.NewServer(http.HandlerFunc(peer.h.Export))
+	defer srv.Close()
+
+	global := newServer()
+	f := New(global.h, global.storage, Config{Peers: []Peer{{Source: "dc1", URL: srv.URL}}})
+	p := f.cfg.Peers[0]
+
+	peer.add(t, counter("hits", 5), gauge(`temp{room="a"}`, 21.5), gauge(`load{source="edge"}`, 1))
+	if err := f.pull(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _, _ := global.storage.GetCounter(ctx, `hits{source="dc1"}`); v != 5 {
+		t.Fatalf("Expected hits 5, got %d", v)
+	}
+	if v, _, _ := global.storage.GetGauge(ctx, `temp{room="a",source="dc1"}`); v != 21.5 {
+		t.Fatalf("Expected temp 21.5, got %v", v)
+	}
+	if _, ok, _ := global.storage.GetGauge(ctx, `load{source="edge"}`); !ok {
+		t.Fatal("Expected an existing source label to be kept")
+	}
+
+	// Pulling the same totals again must not count them twice.
+	peer.add(t, counter("hits", 3))
+	f.pull(context.Background(), p)
+	f.pull(context.Background(), p)
+	if v, _, _ := global.storage.GetCounter(ctx, `hits{source="dc1"}`); v != 8 {
+		t.Fatalf("Expected hits 8, got %d", v)
+	}
+
+	// A restarted peer counts from zero again.
+	restarted := newServer()
+	restarted.add(t, counter("hits", 2))
+	srv.Config.Handler = http.HandlerFunc(restarted.h.Export)
+	f.pull(context.Background(), p)
+	if v, _, _ := global.storage.GetCounter(ctx, `hits{source="dc1"}`); v != 10 {
+		t.Fatalf("Expected hits 10 after peer restart, got %d", v)
+	}
+}
+
+func TestRestartedServerKeepsStoredTotals(t *testing.T) {
+	ctx := context.Background()
+	global := newServer()
+	global.add(t, counter(`hits{source="dc1"}`, 7))
+
+	f := New(global.h, global.storage, Config{})
+	if err := f.Ingest(ctx, "dc1", []models.Metrics{counter("hits", 9)}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := global.storage.GetCounter(ctx, `hits{source="dc1"}`); v != 9 {
+		t.Fatalf("Expected hits 9, got %d", v)
+	}
+}
+
+func TestPushToUpstream(t *testing.T) {
+	ctx := context.Background()
+	global := newServer()
+	up := New(global.h, global.storage, Config{Key: "secret"})
+	r := chi.NewRouter()
+	r.Post("/api/v1/federate/{source}", up.Receive)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	local := newServer()
+	local.add(t, gauge("queue", 3))
+	down := New(local.h, local.storage, Config{Upstream: srv.URL, Source: "dc2", Key: "secret"})
+	if err := down.push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := global.storage.GetGauge(ctx, `queue{source="dc2"}`); v != 3 {
+		t.Fatalf("Expected pushed gauge 3, got %v", v)
+	}
+
+	body, _ := json.Marshal([]models.Metrics{gauge("queue", 4)})
+	resp, err := http.Post(srv.URL+"/api/v1/federate/dc2", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected unsigned push to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestStalePeers(t *testing.T) {
+	ctx := context.Background()
+	global := newServer()
+	f := New(global.h, global.storage, Config{
+		Peers:      []Peer{{Source: "dc1", URL: "http://127.0.0.1:0"}},
+		StaleAfter: time.Minute,
+	})
+	upID := `federation_up{source="dc1"}`
+
+	if err := f.Ingest(ctx, "dc1", []models.Metrics{gauge("load", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := global.storage.GetGauge(ctx, upID); v != 1 {
+		t.Fatalf("Expected %s 1, got %v", upID, v)
+	}
+
+	f.checkStale(ctx, time.Now().Add(2*time.Minute))
+	if v, ok, _ := global.storage.GetGauge(ctx, upID); !ok || v != 0 {
+		t.Fatalf("Expected %s 0, got %v", upID, v)
+	}
+	if peers := f.Peers(); len(peers) != 1 || peers[0].Up {
+		t.Fatalf("Expected dc1 to be reported down, got %+v", peers)
+	}
+
+	f.Ingest(ctx, "dc1", nil)
+	if v, _, _ := global.storage.GetGauge(ctx, upID); v != 1 {
+		t.Fatalf("Expected %s 1 after recovery, got %v", upID, v)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers(" dc1=http://a:8080/ , dc2=http://b:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].URL != "http://a:8080" || peers[1].Source != "dc2" {
+		t.Fatalf("Unexpected peers: %+v", peers)
+	}
+	if _, err := ParsePeers("dc1"); err == nil {
+		t.Fatal("Expected an error for a peer without URL")
+	}
+	if _, err := ParsePeers("dc1=http://a,dc1=http://b"); err == nil {
+		t.Fatal("Expected an error for duplicate sources")
+	}
+}
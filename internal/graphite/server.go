@@ -0,0 +1,329 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+// Config describes the Graphite listener.
+type Config struct {
+	Addr      string
+	Templates []string
+	// FlushInterval controls how often buffered values reach storage.
+	FlushInterval time.Duration
+	// Tolerance is how far a point may run ahead of the server clock or lag
+	// behind it. Points outside are dropped, so a wrong timestamp cannot
+	// hold back its metric. Zero uses DefaultTolerance.
+	Tolerance time.Duration
+}
+
+// DefaultTolerance is the Tolerance used unless Config says otherwise.
+const DefaultTolerance = 10 * time.Minute
+
+type point struct {
+	value float64
+	ts    int64
+}
+
+// idleTimeout closes connections that send nothing for this long.
+const idleTimeout = 5 * time.Minute
+
+// Server accepts Graphite plaintext lines over TCP. Values are buffered per
+// metric and flushed periodically; the point with the newest timestamp wins,
+// within an interval and across flushes.
+type Server struct {
+	cfg     Config
+	mapper  *Mapper
+	storage repository.Repository
+
+	ln net.Listener
+	wg sync.WaitGroup
+	// readers tracks the accept loop and connections, which must be done
+	// before the final flush.
+	readers sync.WaitGroup
+
+	connMu  sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+
+	mu      sync.Mutex
+	pending map[string]point
+	// flushed holds the timestamp of the last stored point of each metric.
+	// Entries older than the tolerance are pruned: every point they would
+	// hold back is dropped as stale anyway.
+	flushed map[string]int64
+	pruned  time.Time
+}
+
+// NewServer creates a Graphite server writing into storage.
+func NewServer(cfg Config, storage repository.Repository) (*Server, error) {
+	mapper, err := NewMapper(cfg.Templates)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Tolerance <= 0 {
+		cfg.Tolerance = DefaultTolerance
+	}
+	return &Server{
+		cfg:     cfg,
+		mapper:  mapper,
+		storage: storage,
+		conns:   make(map[net.Conn]struct{}),
+		pending: make(map[string]point),
+		flushed: make(map[string]int64),
+	}, nil
+}
+
+// Start opens the listener and serves it until ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	s.readers.Add(1)
+	go s.serve()
+	s.wg.Add(1)
+	go s.flushLoop(ctx)
+	return nil
+}
+
+// Wait blocks until the listener is closed and the last flush is done.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Addr returns the bound listen address.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// ParseLine parses "path value [timestamp]". Missing or negative timestamps
+// mean now.
+func ParseLine(line string, now time.Time) (string, float64, int64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", 0, 0, fmt.Errorf("graphite: malformed line %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", 0, 0, fmt.Errorf("graphite: invalid value in %q", line)
+	}
+
+	ts := now.UnixMilli()
+	if len(fields) == 3 {
+		sec, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("graphite: invalid timestamp in %q", line)
+		}
+		if sec >= 0 {
+			ts = int64(sec * 1000)
+		}
+	}
+	return fields[0], value, ts, nil
+}
+
+// Flush writes buffered values into storage. Points older than the last
+// stored one of their metric are dropped. Values beyond the storage limits
+// are dropped without holding back the rest; on other storage errors the
+// values stay buffered for the next flush.
+func (s *Server) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	batch := s.pending
+	s.pending = make(map[string]point)
+	s.prune(time.Now())
+	metrics := make([]models.Metrics, 0, len(batch))
+	for id, p := range batch {
+		if last, ok := s.flushed[id]; ok && p.ts < last {
+			delete(batch, id)
+			continue
+		}
+		value, ts := p.value, p.ts
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &value, Timestamp: &ts})
+	}
+	s.mu.Unlock()
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	ctx = repository.WithPartialWrites(repository.WithSource(ctx, "graphite"))
+	err := s.storage.UpdateBatch(ctx, metrics)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && !errors.Is(err, repository.ErrSeriesLimit) && !errors.Is(err, repository.ErrInvalidName) {
+		for id, p := range batch {
+			if current, ok := s.pending[id]; !ok || current.ts < p.ts {
+				s.pending[id] = p
+			}
+		}
+		return err
+	}
+	for id, p := range batch {
+		s.flushed[id] = p.ts
+	}
+	return err
+}
+
+// Forget drops what the server remembers of a metric, for metrics deleted
+// or renamed away from.
+func (s *Server) Forget(mtype, name string) {
+	if mtype != models.Gauge {
+		return
+	}
+	s.mu.Lock()
+	delete(s.flushed, name)
+	s.mu.Unlock()
+}
+
+// prune forgets the metrics whose last stored point is beyond the
+// tolerance. It must be called with mu held.
+func (s *Server) prune(now time.Time) {
+	if now.Sub(s.pruned) < s.cfg.Tolerance {
+		return
+	}
+	oldest := now.Add(-s.cfg.Tolerance).UnixMilli()
+	for id, ts := range s.flushed {
+		if ts < oldest {
+			delete(s.flushed, id)
+		}
+	}
+	s.pruned = now
+}
+
+func (s *Server) add(path string, value float64, ts int64, now time.Time) {
+	id := s.mapper.ID(path)
+	if tol := s.cfg.Tolerance.Milliseconds(); ts > now.UnixMilli()+tol || ts < now.UnixMilli()-tol {
+		log.Printf("graphite: dropping %s: timestamp %d is outside the tolerance", id, ts/1000)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.pending[id]; ok && current.ts > ts {
+		return
+	}
+	s.pending[id] = point{value: value, ts: ts}
+}
+
+func (s *Server) flushLoop(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop()
+			// ctx is done by now, so the final flush runs without it.
+			if err := s.Flush(context.Background()); err != nil {
+				log.Printf("graphite: final flush error: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				log.Printf("graphite: flush error: %v", err)
+			}
+		}
+	}
+}
+
+// stop closes the listener and open connections and waits for their
+// readers, so that every line received makes it into the final flush.
+func (s *Server) stop() {
+	s.ln.Close()
+	s.connMu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMu.Unlock()
+	s.readers.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.readers.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("graphite: accept error: %v", err)
+			}
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.readers.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// track registers conn to be closed on shutdown. It reports false once
+// shutdown has begun.
+func (s *Server) track(conn net.Conn) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.readers.Done()
+	defer func() {
+		s.connMu.Lock()
+		delete(s.conns, conn)
+		s.connMu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		now := time.Now()
+		path, value, ts, err := ParseLine(line, now)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		s.add(path, value, ts, now)
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Printf("graphite: read error: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.UnixMilli(5000)
+
+	path, value, ts, err := ParseLine("a.b 1.5 1700000000", now)
+	if err != nil || path != "a.b" || value != 1.5 || ts != 1700000000000 {
+		t.Fatalf("unexpected parse %s %v %d %v", path, value, ts, err)
+	}
+	if _, _, ts, _ := ParseLine("a.b 1 -1", now); ts != 5000 {
+		t.Fatalf("expected now for -1 timestamp, got %d", ts)
+	}
+	for _, line := range []string{"a.b", "a.b x 1", "a.b 1 x", "a.b 1 2 3", "a.b NaN"} {
+		if _, _, _, err := ParseLine(line, now); err == nil {
+			t.Fatalf("expected error for %q", line)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	storage := repository.NewMemStorage()
+	srv, err := NewServer(Config{
+		Addr:          "127.0.0.1:0",
+		Templates:     []string{"servers.* .host.measurement*"},
+		FlushInterval: time.Hour,
+	}, storage)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	now := time.Now().Unix()
+	fmt.Fprintf(conn, "servers.web01.cpu.load 0.7 %d\n", now)
+	fmt.Fprintf(conn, "servers.web01.cpu.load 0.3 %d\n", now-10)
+	fmt.Fprint(conn, "garbage\n")
+	fmt.Fprint(conn, "collectd.uptime 42\n")
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		n := len(srv.pending)
+		srv.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	srv.Wait()
+
+	if v, ok, _ := storage.GetGauge(ctx, `cpu.load{host="web01"}`); !ok || v != 0.7 {
+		t.Fatalf("expected newest value 0.7, got %v %v", v, ok)
+	}
+	if v, ok, _ := storage.GetGauge(ctx, "collectd.uptime"); !ok || v != 42 {
+		t.Fatalf("expected 42, got %v %v", v, ok)
+	}
+}
+
+type flakyStorage struct {
+	*repository.MemStorage
+	fail bool
+}
+
+var errStorageDown = errors.New("storage down")
+
+func (f *flakyStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	if f.fail {
+		return errStorageDown
+	}
+	return f.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestFlushKeepsNewestPoint(t *testing.T) {
+	ctx := context.Background()
+	storage := &flakyStorage{MemStorage: repository.NewMemStorage(), fail: true}
+	srv, err := NewServer(Config{Addr: "127.0.0.1:0"}, storage)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	now := time.Now()
+	ts := now.UnixMilli()
+	srv.add("load", 2, ts, now)
+	if err := srv.Flush(ctx); !errors.Is(err, errStorageDown) {
+		t.Fatalf("expected the storage error, got %v", err)
+	}
+	storage.fail = false
+	if err := srv.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if v, ok, _ := storage.GetGauge(ctx, "load"); !ok || v != 2 {
+		t.Fatalf("expected the failed flush to be retried, got %v %v", v, ok)
+	}
+
+	srv.add("load", 1, ts-1000, now)
+	if err := srv.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "load"); v != 2 {
+		t.Fatalf("expected an older point not to overwrite 2, got %v", v)
+	}
+}
+
+func TestTimestampTolerance(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	srv, err := NewServer(Config{Addr: "127.0.0.1:0", Tolerance: time.Minute}, storage)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	// Milliseconds sent as seconds are far in the future and dropped.
+	now := time.Now()
+	srv.add("load", 9, now.UnixMilli()*1000, now)
+	srv.add("load", 1, now.UnixMilli(), now)
+	srv.add("old", 1, now.Add(-time.Hour).UnixMilli(), now)
+	if err := srv.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "load"); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	if _, ok, _ := storage.GetGauge(ctx, "old"); ok {
+		t.Fatal("expected a stale point to be dropped")
+	}
+
+	srv.Forget(models.Gauge, "load")
+	srv.mu.Lock()
+	_, remembered := srv.flushed["load"]
+	srv.mu.Unlock()
+	if remembered {
+		t.Fatal("expected a deleted metric to be forgotten")
+	}
+
+	srv.add("cpu", 1, now.UnixMilli(), now)
+	srv.Flush(ctx)
+	srv.mu.Lock()
+	srv.prune(now.Add(2 * time.Minute))
+	n := len(srv.flushed)
+	srv.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected idle metrics to be pruned, got %d", n)
+	}
+}
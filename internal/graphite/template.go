@@ -0,0 +1,114 @@
+// Package graphite receives the Graphite plaintext protocol and stores the
+// values as gauges.
+package graphite
+
+import (
+	"fmt"
+	"strings"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// Template maps dotted Graphite paths onto a metric name and labels.
+//
+// A template is written as "[filter ]pattern". The optional filter is a
+// dotted glob where * matches one path segment; a path matches when its
+// leading segments match the filter. Each pattern segment says what the
+// path segment at the same position becomes: "measurement" appends it to
+// the metric name, "measurement*" appends it and every remaining segment,
+// an empty segment drops it and any other word makes it a label of that
+// name. Segments past the end of the pattern are appended to the name.
+//
+// For example "servers.* .host.measurement*" turns
+// servers.web01.cpu.load into cpu.load{host="web01"}.
+type Template struct {
+	filter  []string
+	pattern []string
+}
+
+// ParseTemplate parses a "[filter ]pattern" template.
+func ParseTemplate(s string) (Template, error) {
+	fields := strings.Fields(s)
+	var t Template
+	switch len(fields) {
+	case 1:
+		t.pattern = strings.Split(fields[0], ".")
+	case 2:
+		t.filter = strings.Split(fields[0], ".")
+		t.pattern = strings.Split(fields[1], ".")
+	default:
+		return t, fmt.Errorf("graphite: invalid template %q", s)
+	}
+	return t, nil
+}
+
+// Matches reports whether the template filter accepts the path segments.
+func (t Template) Matches(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply converts path segments into a metric ID.
+func (t Template) Apply(parts []string) string {
+	var name []string
+	var labels []models.Label
+
+	i := 0
+	for ; i < len(parts) && i < len(t.pattern); i++ {
+		switch p := t.pattern[i]; p {
+		case "":
+		case "measurement":
+			name = append(name, parts[i])
+		case "measurement*":
+			name = append(name, parts[i:]...)
+			i = len(parts)
+		default:
+			labels = append(labels, models.Label{Name: p, Value: parts[i]})
+		}
+	}
+	if i < len(parts) {
+		name = append(name, parts[i:]...)
+	}
+
+	if len(name) == 0 {
+		name = parts
+	}
+	return models.JoinID(strings.Join(name, "."), labels)
+}
+
+// Mapper picks the first template matching a path.
+type Mapper struct {
+	templates []Template
+}
+
+// NewMapper parses the templates in order of precedence.
+func NewMapper(templates []string) (*Mapper, error) {
+	m := &Mapper{}
+	for _, s := range templates {
+		t, err := ParseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		m.templates = append(m.templates, t)
+	}
+	return m, nil
+}
+
+// ID maps the dotted path to a metric ID; paths matching no template are
+// used unchanged.
+func (m *Mapper) ID(path string) string {
+	parts := strings.Split(path, ".")
+	for _, t := range m.templates {
+		if t.Matches(parts) {
+			return t.Apply(parts)
+		}
+	}
+	return path
+}
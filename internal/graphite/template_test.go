@@ -0,0 +1,37 @@
+package graphite
+
+import "testing"
+
+func TestMapperID(t *testing.T) {
+	m, err := NewMapper([]string{
+		"servers.* .host.measurement*",
+		"apps.*.*.requests .app.env.measurement",
+		"region.measurement",
+	})
+	if err != nil {
+		t.Fatalf("new mapper: %v", err)
+	}
+
+	tests := map[string]string{
+		"servers.web01.cpu.load":     `cpu.load{host="web01"}`,
+		"apps.shop.prod.requests":    `requests{app="shop",env="prod"}`,
+		"apps.shop.prod.errors":      `shop.prod.errors{region="apps"}`,
+		"eu.disk.free":               `disk.free{region="eu"}`,
+		"servers":                    `servers{region="servers"}`,
+		"collectd.host1.memory.used": `host1.memory.used{region="collectd"}`,
+	}
+	for path, want := range tests {
+		if got := m.ID(path); got != want {
+			t.Fatalf("ID(%q) = %s, want %s", path, got, want)
+		}
+	}
+
+	plain, _ := NewMapper(nil)
+	if got := plain.ID("a.b.c"); got != "a.b.c" {
+		t.Fatalf("expected path unchanged, got %s", got)
+	}
+
+	if _, err := NewMapper([]string{"a b c"}); err == nil {
+		t.Fatal("expected error for invalid template")
+	}
+}
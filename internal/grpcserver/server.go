@@ -0,0 +1,195 @@
+// Package grpcserver serves the gRPC Metrics service defined in
+// api/metricspb.
+package grpcserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"go-metrics-and-alerts/api/metricspb"
+	"go-metrics-and-alerts/internal/handler"
+	"go-metrics-and-alerts/internal/middleware"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Metadata keys shared with the agent.
+const (
+	HashKey      = "hashsha256"
+	EncryptedKey = "x-encrypted"
+)
+
+// Server implements metricspb.MetricsServer on top of the same validation
+// and storage path as the HTTP batch endpoint.
+type Server struct {
+	metricspb.UnimplementedMetricsServer
+
+	h          *handler.Handler
+	key        string
+	privateKey *rsa.PrivateKey
+}
+
+// New creates a Server storing through h. key enables HMAC verification and
+// privateKey enables decryption of encrypted requests.
+func New(h *handler.Handler, key string, privateKey *rsa.PrivateKey) *Server {
+	return &Server{h: h, key: key, privateKey: privateKey}
+}
+
+// Register creates a gRPC server with the Metrics service registered.
+func (s *Server) Register(opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	metricspb.RegisterMetricsServer(srv, s)
+	return srv
+}
+
+// UpdateBatch stores one batch of metrics.
+func (s *Server) UpdateBatch(ctx context.Context, req *metricspb.UpdateRequest) (*metricspb.UpdateResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	metrics, err := s.decode(req, isEncrypted(md), firstValue(md, HashKey))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store(ctx, metrics); err != nil {
+		return nil, err
+	}
+	return &metricspb.UpdateResponse{Accepted: int64(len(metrics))}, nil
+}
+
+// StreamUpdates stores each message of the stream as it arrives. A failed
+// message ends the stream; messages stored before it stay stored.
+func (s *Server) StreamUpdates(stream metricspb.Metrics_StreamUpdatesServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	encrypted := isEncrypted(md)
+
+	var accepted int64
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&metricspb.UpdateResponse{Accepted: accepted})
+		}
+		if err != nil {
+			return err
+		}
+
+		metrics, err := s.decode(req, encrypted, req.GetHash())
+		if err != nil {
+			return err
+		}
+		if err := s.store(stream.Context(), metrics); err != nil {
+			return err
+		}
+		accepted += int64(len(metrics))
+	}
+}
+
+// decode decrypts the request if needed, verifies its HMAC and converts the
+// metrics. As over HTTP, the hash is only checked when the client sends one.
+func (s *Server) decode(req *metricspb.UpdateRequest, encrypted bool, hash string) ([]models.Metrics, error) {
+	var batch metricspb.MetricBatch
+	var raw []byte
+	if encrypted {
+		if s.privateKey == nil {
+			return nil, status.Error(codes.InvalidArgument, "encryption is not configured")
+		}
+		var err error
+		raw, err = middleware.DecryptPayload(s.privateKey, req.GetEncrypted())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "cannot decrypt request")
+		}
+		if err := proto.Unmarshal(raw, &batch); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid encrypted batch")
+		}
+	} else {
+		batch.Metrics = req.GetMetrics()
+	}
+
+	if s.key != "" && hash != "" && !strings.EqualFold(hash, "none") {
+		if raw == nil {
+			var err error
+			raw, err = proto.MarshalOptions{Deterministic: true}.Marshal(&batch)
+			if err != nil {
+				return nil, status.Error(codes.Internal, "cannot verify hash")
+			}
+		}
+		if !validHash(s.key, raw, hash) {
+			return nil, status.Error(codes.InvalidArgument, "hash mismatch")
+		}
+	}
+
+	if len(batch.GetMetrics()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty batch")
+	}
+	metrics := make([]models.Metrics, 0, len(batch.GetMetrics()))
+	for _, m := range batch.GetMetrics() {
+		metric, err := metricspb.ToModel(m)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+func (s *Server) store(ctx context.Context, metrics []models.Metrics) error {
+	err := s.h.StoreBatch(ctx, peerIP(ctx), metrics)
+	if errors.Is(err, repository.ErrSeriesLimit) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if errors.Is(err, handler.ErrInvalidBatch) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error storing gRPC batch: %v", err)
+		return status.Error(codes.Internal, "storage error")
+	}
+	return nil
+}
+
+func validHash(key string, data []byte, hash string) bool {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func isEncrypted(md metadata.MD) bool {
+	return firstValue(md, EncryptedKey) == "1"
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,148 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"go-metrics-and-alerts/api/metricspb"
+	"go-metrics-and-alerts/internal/handler"
+	"go-metrics-and-alerts/internal/repository"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+const testKey = "secret"
+
+func startServer(t *testing.T, privateKey *rsa.PrivateKey) (*repository.MemStorage, metricspb.MetricsClient) {
+	t.Helper()
+	storage := repository.NewMemStorage()
+	srv := New(handler.New(storage), testKey, privateKey).Register()
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return storage, metricspb.NewMetricsClient(conn)
+}
+
+func sign(t *testing.T, batch *metricspb.MetricBatch) ([]byte, string) {
+	t.Helper()
+	raw, err := proto.MarshalOptions{Deterministic: true}.Marshal(batch)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(testKey))
+	mac.Write(raw)
+	return raw, hex.EncodeToString(mac.Sum(nil))
+}
+
+func gauge(id string, value float64) *metricspb.Metric {
+	return &metricspb.Metric{Id: id, Type: metricspb.MetricType_METRIC_TYPE_GAUGE, Value: value}
+}
+
+func counter(id string, delta int64) *metricspb.Metric {
+	return &metricspb.Metric{Id: id, Type: metricspb.MetricType_METRIC_TYPE_COUNTER, Delta: delta}
+}
+
+func TestUpdateBatchVerifiesHash(t *testing.T) {
+	storage, client := startServer(t, nil)
+
+	batch := &metricspb.MetricBatch{Metrics: []*metricspb.Metric{gauge("Alloc", 1.5), counter("PollCount", 3)}}
+	_, hash := sign(t, batch)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), HashKey, hash)
+	resp, err := client.UpdateBatch(ctx, &metricspb.UpdateRequest{Metrics: batch.Metrics})
+	if err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	if resp.GetAccepted() != 2 {
+		t.Fatalf("Expected 2 accepted, got %d", resp.GetAccepted())
+	}
+	if v, _, _ := storage.GetGauge(ctx, "Alloc"); v != 1.5 {
+		t.Fatalf("Expected Alloc 1.5, got %v", v)
+	}
+	if v, _, _ := storage.GetCounter(ctx, "PollCount"); v != 3 {
+		t.Fatalf("Expected PollCount 3, got %v", v)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), HashKey, hex.EncodeToString([]byte("forged")))
+	_, err = client.UpdateBatch(ctx, &metricspb.UpdateRequest{Metrics: batch.Metrics})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for a bad hash, got %v", err)
+	}
+
+	_, err = client.UpdateBatch(context.Background(), &metricspb.UpdateRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an empty batch, got %v", err)
+	}
+}
+
+func TestUpdateBatchEncrypted(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	storage, client := startServer(t, key)
+
+	batch := &metricspb.MetricBatch{Metrics: []*metricspb.Metric{gauge("HeapAlloc", 42)}}
+	raw, hash := sign(t, batch)
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, raw)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), EncryptedKey, "1", HashKey, hash)
+	if _, err := client.UpdateBatch(ctx, &metricspb.UpdateRequest{Encrypted: encrypted}); err != nil {
+		t.Fatalf("UpdateBatch: %v", err)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "HeapAlloc"); v != 42 {
+		t.Fatalf("Expected HeapAlloc 42, got %v", v)
+	}
+}
+
+func TestStreamUpdates(t *testing.T) {
+	ctx := context.Background()
+	storage, client := startServer(t, nil)
+
+	stream, err := client.StreamUpdates(context.Background())
+	if err != nil {
+		t.Fatalf("StreamUpdates: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		batch := &metricspb.MetricBatch{Metrics: []*metricspb.Metric{counter("Requests", 2)}}
+		_, hash := sign(t, batch)
+		if err := stream.Send(&metricspb.UpdateRequest{Metrics: batch.Metrics, Hash: hash}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv: %v", err)
+	}
+	if resp.GetAccepted() != 3 {
+		t.Fatalf("Expected 3 accepted, got %d", resp.GetAccepted())
+	}
+	if v, _, _ := storage.GetCounter(ctx, "Requests"); v != 6 {
+		t.Fatalf("Expected Requests 6, got %v", v)
+	}
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// deleteResult reports how many metrics a delete request removed.
+type deleteResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// renameRequest is the body of a rename request.
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// authorizeAdmin reports whether the admin request may proceed. With a
+// SecretKey it requires a HashSHA256 header signing the method, the request
+// URI and the body, separated by newlines, and answers 403 otherwise.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if SecretKey == "" {
+		return true
+	}
+	want, err := hex.DecodeString(getHashHeader(r))
+	if err == nil && len(want) > 0 {
+		mac := hmac.New(sha256.New, []byte(SecretKey))
+		mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n"))
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), want) {
+			return true
+		}
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// DeleteMetric removes /api/v1/metrics/{type}/{name} with its history.
+func (h *Handler) DeleteMetric(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, nil) {
+		return
+	}
+	mtype, name := chi.URLParam(r, "type"), chi.URLParam(r, "name")
+	if !isMetricType(mtype) || name == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	found, err := h.storage.DeleteMetric(r.Context(), mtype, name)
+	if err != nil {
+		log.Printf("Error deleting %s %s: %v", mtype, name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.forget(mtype, name)
+	if !found {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, deleteResult{Deleted: 1})
+}
+
+// DeleteMetrics removes every metric whose name matches the glob in the
+// pattern query parameter, limited to one type by the optional type
+// parameter. The pattern syntax is that of path.Match.
+func (h *Handler) DeleteMetrics(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, nil) {
+		return
+	}
+	pattern := r.URL.Query().Get("pattern")
+	mtype := r.URL.Query().Get("type")
+	if pattern == "" || (mtype != "" && !isMetricType(mtype)) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	metrics, err := h.ExportMetrics(ctx)
+	if err != nil {
+		log.Printf("Error reading metrics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var result deleteResult
+	for _, m := range metrics {
+		if mtype != "" && m.MType != mtype {
+			continue
+		}
+		if ok, _ := path.Match(pattern, m.ID); !ok {
+			continue
+		}
+		found, err := h.storage.DeleteMetric(ctx, m.MType, m.ID)
+		if err != nil {
+			log.Printf("Error deleting %s %s: %v", m.MType, m.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		h.forget(m.MType, m.ID)
+		if found {
+			result.Deleted++
+		}
+	}
+	writeJSON(w, result)
+}
+
+// RenameMetric moves /api/v1/metrics/{type}/{name}/rename, with its history
+// and metadata, to the name in the JSON body.
+func (h *Handler) RenameMetric(w http.ResponseWriter, r *http.Request) {
+	mtype, from := chi.URLParam(r, "type"), chi.URLParam(r, "name")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !authorizeAdmin(w, r, body) {
+		return
+	}
+	var req renameRequest
+	if err := json.Unmarshal(body, &req); err != nil || !isMetricType(mtype) || from == "" || req.Name == "" || req.Name == from {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	conflict, err := h.conflictsWithMetadata(ctx, req.Name, mtype)
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if conflict {
+		http.Error(w, errTypeConflict, http.StatusBadRequest)
+		return
+	}
+
+	err = h.storage.RenameMetric(ctx, mtype, from, req.Name)
+	switch {
+	case errors.Is(err, repository.ErrMetricNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errors.Is(err, repository.ErrMetricExists):
+		http.Error(w, "Metric already exists", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error renaming %s %s: %v", mtype, from, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.history.Rename(mtype, from, req.Name)
+	if h.onDelete != nil {
+		h.onDelete(mtype, from)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// forget drops the history of a deleted metric and calls the delete hook.
+func (h *Handler) forget(mtype, name string) {
+	h.history.Delete(mtype, name)
+	if h.onDelete != nil {
+		h.onDelete(mtype, name)
+	}
+}
+
+func isMetricType(mtype string) bool {
+	switch mtype {
+	case models.Gauge, models.Counter, models.Set:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDeleteAndRenameMetrics(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	handler := New(storage)
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handler.UpdateMetric)
+	r.Get("/history/{type}/{name}", handler.GetHistory)
+	r.Delete("/api/v1/metrics", handler.DeleteMetrics)
+	r.Delete("/api/v1/metrics/{type}/{name}", handler.DeleteMetric)
+	r.Post("/api/v1/metrics/{type}/{name}/rename", handler.RenameMetric)
+
+	for _, path := range []string{
+		"/update/gauge/CPUutilization1/10",
+		"/update/gauge/CPUutilization2/20",
+		"/update/gauge/CPUutilization16/30",
+		"/update/counter/PollCount/5",
+		"/update/gauge/Alloc/1",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, w.Code)
+		}
+	}
+	storage.SetMetadata(ctx, models.Metadata{ID: "Total", MType: models.Gauge})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"DELETE", "/api/v1/metrics/gauge/CPUutilization16", "", http.StatusOK, `{"deleted":1}`},
+		{"DELETE", "/api/v1/metrics/gauge/CPUutilization16", "", http.StatusNotFound, ""},
+		{"DELETE", "/api/v1/metrics/histogram/x", "", http.StatusBadRequest, ""},
+		{"DELETE", "/api/v1/metrics?pattern=CPUutilization*", "", http.StatusOK, `{"deleted":2}`},
+		{"DELETE", "/api/v1/metrics?pattern=[", "", http.StatusBadRequest, ""},
+		{"DELETE", "/api/v1/metrics", "", http.StatusBadRequest, ""},
+		{"POST", "/api/v1/metrics/counter/PollCount/rename", `{"name":"Polls"}`, http.StatusOK, ""},
+		{"POST", "/api/v1/metrics/counter/PollCount/rename", `{"name":"Polls2"}`, http.StatusNotFound, ""},
+		{"POST", "/api/v1/metrics/gauge/Alloc/rename", `{"name":"Total"}`, http.StatusOK, ""},
+		{"POST", "/api/v1/metrics/counter/Polls/rename", `{"name":"Total"}`, http.StatusBadRequest, ""},
+		{"POST", "/api/v1/metrics/counter/Polls/rename", `{}`, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Fatalf("%s %s: expected %d, got %d", test.method, test.path, test.status, w.Code)
+		}
+		if test.want != "" && strings.TrimSpace(w.Body.String()) != test.want {
+			t.Fatalf("%s %s: expected %s, got %s", test.method, test.path, test.want, w.Body.String())
+		}
+	}
+
+	if _, ok, _ := storage.GetGauge(ctx, "CPUutilization1"); ok {
+		t.Fatal("Expected CPUutilization1 to be deleted")
+	}
+	if v, ok, _ := storage.GetCounter(ctx, "Polls"); !ok || v != 5 {
+		t.Fatalf("Expected Polls 5, got %d", v)
+	}
+	for path, status := range map[string]int{
+		"/history/gauge/CPUutilization1": http.StatusNotFound,
+		"/history/counter/PollCount":     http.StatusNotFound,
+		"/history/counter/Polls":         http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, w.Code)
+		}
+	}
+}
+
+func TestAdminRequiresSignature(t *testing.T) {
+	SecretKey = "secret"
+	defer func() { SecretKey = "" }()
+
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(context.Background(), "Alloc", 1)
+	handler := New(storage)
+
+	r := chi.NewRouter()
+	r.Delete("/api/v1/metrics", handler.DeleteMetrics)
+	r.Delete("/api/v1/metrics/{type}/{name}", handler.DeleteMetric)
+	r.Post("/api/v1/metrics/{type}/{name}/rename", handler.RenameMetric)
+
+	sign := func(method, uri, body string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(method + "\n" + uri + "\n" + body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		hash   string
+		status int
+	}{
+		{"DELETE", "/api/v1/metrics/gauge/Alloc", "", "", http.StatusForbidden},
+		{"DELETE", "/api/v1/metrics/gauge/Alloc", "", sign("DELETE", "/api/v1/metrics/gauge/Other", ""), http.StatusForbidden},
+		{"DELETE", "/api/v1/metrics?pattern=*", "", sign("DELETE", "/api/v1/metrics?pattern=A*", ""), http.StatusForbidden},
+		{"POST", "/api/v1/metrics/gauge/Alloc/rename", `{"name":"Heap"}`, sign("POST", "/api/v1/metrics/gauge/Alloc/rename", `{"name":"Other"}`), http.StatusForbidden},
+		{"POST", "/api/v1/metrics/gauge/Alloc/rename", `{"name":"Heap"}`, sign("POST", "/api/v1/metrics/gauge/Alloc/rename", `{"name":"Heap"}`), http.StatusOK},
+		{"DELETE", "/api/v1/metrics?pattern=H*", "", sign("DELETE", "/api/v1/metrics?pattern=H*", ""), http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.hash != "" {
+			req.Header.Set("HashSHA256", test.hash)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("%s %s: expected %d, got %d", test.method, test.path, test.status, w.Code)
+		}
+	}
+
+	if gauges, _ := storage.GetAllGauges(context.Background()); len(gauges) != 0 {
+		t.Fatal("Expected every gauge to be deleted")
+	}
+}
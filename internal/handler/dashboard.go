@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/stream"
+	"go-metrics-and-alerts/pkg/hll"
+
+	"github.com/gorilla/websocket"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+var (
+	dashboardIndex  []byte
+	dashboardAssets http.Handler
+)
+
+func init() {
+	assets, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		log.Printf("Error loading dashboard assets: %v", err)
+		return
+	}
+	dashboardIndex, err = fs.ReadFile(assets, "index.html")
+	if err != nil {
+		log.Printf("Error loading dashboard page: %v", err)
+	}
+	dashboardAssets = http.StripPrefix("/assets/", http.FileServer(http.FS(assets)))
+}
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// dashboardMetric is a metric as the dashboard shows it. Counters carry
+// their total and sets their estimated cardinality in Value.
+type dashboardMetric struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Value       float64         `json:"value"`
+	Timestamp   int64           `json:"ts,omitempty"`
+	Unit        string          `json:"unit,omitempty"`
+	Description string          `json:"description,omitempty"`
+	History     []models.Sample `json:"history,omitempty"`
+}
+
+// dashboardMessage is sent over the dashboard WebSocket.
+type dashboardMessage struct {
+	Kind    string            `json:"kind"`
+	Metrics []dashboardMetric `json:"metrics,omitempty"`
+	Dropped int64             `json:"dropped,omitempty"`
+}
+
+// ListMetrics serves the dashboard page. The page is static; it loads its
+// data from /api/v1/snapshot and /api/v1/ws.
+func (h *Handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardIndex)
+}
+
+// DashboardAssets serves the dashboard scripts and styles under /assets/.
+func (h *Handler) DashboardAssets(w http.ResponseWriter, r *http.Request) {
+	dashboardAssets.ServeHTTP(w, r)
+}
+
+// DashboardSnapshot returns every metric with its metadata and recent
+// history, sorted by ID.
+func (h *Handler) DashboardSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := h.dashboardSnapshot(r.Context())
+	if err != nil {
+		log.Printf("Error reading metrics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, snapshot)
+}
+
+// DashboardSocket upgrades the connection to a WebSocket that first sends a
+// snapshot and then every accepted update, with counters and sets at their
+// current total. Updates a slow client cannot keep up with are dropped and
+// counted in a "dropped" message.
+func (h *Handler) DashboardSocket(w http.ResponseWriter, r *http.Request) {
+	sub := h.hub.Subscribe(stream.Filter{})
+	if sub == nil {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.hub.Unsubscribe(sub)
+
+	// The snapshot is read before the upgrade so a storage failure can still
+	// be answered with a status code.
+	snapshot, err := h.dashboardSnapshot(r.Context())
+	if err != nil {
+		log.Printf("Error reading metrics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// The dashboard never sends data; reading only notices the close.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg dashboardMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(msg) == nil
+	}
+
+	if !send(dashboardMessage{Kind: "snapshot", Metrics: snapshot}) {
+		return
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case m, ok := <-sub.C:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if dropped := sub.Dropped(); dropped > 0 {
+				if !send(dashboardMessage{Kind: "dropped", Dropped: dropped}) {
+					return
+				}
+			}
+			m, ok = h.withTotal(r.Context(), m)
+			if !ok {
+				continue
+			}
+			meta, _, err := h.storage.GetMetadata(r.Context(), m.ID)
+			if err != nil {
+				log.Printf("Error reading metadata of %s: %v", m.ID, err)
+			}
+			if !send(dashboardMessage{Kind: "update", Metrics: []dashboardMetric{toDashboardMetric(m, meta)}}) {
+				return
+			}
+		}
+	}
+}
+
+func (h *Handler) dashboardSnapshot(ctx context.Context) ([]dashboardMetric, error) {
+	meta, err := h.storage.GetAllMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gauges, err := h.storage.GetAllGauges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := h.storage.GetAllCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := h.storage.GetAllSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []dashboardMetric
+	add := func(id, mtype string, value float64) {
+		m := meta[id]
+		metrics = append(metrics, dashboardMetric{
+			ID:          id,
+			Type:        mtype,
+			Value:       value,
+			Unit:        m.Unit,
+			Description: m.Description,
+			History:     h.history.Get(mtype, id),
+		})
+	}
+
+	for id, value := range gauges {
+		add(id, models.Gauge, value)
+	}
+	for id, delta := range counters {
+		add(id, models.Counter, float64(delta))
+	}
+	for id, registers := range sets {
+		sketch, err := hll.FromBytes(registers)
+		if err != nil {
+			log.Printf("Error decoding set %s: %v", id, err)
+			continue
+		}
+		add(id, models.Set, float64(sketch.Estimate()))
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].Type < metrics[j].Type
+	})
+	return metrics, nil
+}
+
+// withTotal replaces the increase a counter or set event carries with the
+// stored total the dashboard shows. It reports false when the metric is gone.
+// The read runs on the connection, so the ingest path never waits for it.
+func (h *Handler) withTotal(ctx context.Context, m models.Metrics) (models.Metrics, bool) {
+	var total int64
+	var ok bool
+	var err error
+	switch m.MType {
+	case models.Counter:
+		total, ok, err = h.storage.GetCounter(ctx, m.ID)
+	case models.Set:
+		total, ok, err = h.getSetEstimate(ctx, m.ID)
+	default:
+		return m, true
+	}
+	if err != nil {
+		log.Printf("Error reading %s %s: %v", m.MType, m.ID, err)
+	}
+	if !ok {
+		return m, false
+	}
+	m.Delta = &total
+	return m, true
+}
+
+func toDashboardMetric(m models.Metrics, meta models.Metadata) dashboardMetric {
+	d := dashboardMetric{ID: m.ID, Type: m.MType, Unit: meta.Unit, Description: meta.Description}
+	switch {
+	case m.Value != nil:
+		d.Value = *m.Value
+	case m.Delta != nil:
+		d.Value = float64(*m.Delta)
+	}
+	if m.Timestamp != nil {
+		d.Timestamp = *m.Timestamp
+	} else {
+		d.Timestamp = time.Now().UnixMilli()
+	}
+	return d
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-metrics-and-alerts/internal/middleware"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestDashboardPageAndAssets(t *testing.T) {
+	h := New(repository.NewMemStorage())
+	r := chi.NewRouter()
+	r.Get("/", h.ListMetrics)
+	r.Get("/assets/*", h.DashboardAssets)
+
+	for path, want := range map[string]string{
+		"/":               `<script src="/assets/app.js">`,
+		"/assets/app.js":  "new WebSocket(",
+		"/assets/app.css": "svg.spark",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("GET %s: status %d, missing %q", path, w.Code, want)
+		}
+	}
+}
+
+func TestDashboardSocket(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(ctx, "Alloc", 1)
+	h := New(storage)
+
+	r := chi.NewRouter()
+	r.Use(middleware.WithLogging)
+	r.Use(middleware.WithGzip)
+	r.Get("/api/v1/ws", h.DashboardSocket)
+	r.Post("/updates/", h.UpdateMetricsBatch)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	defer h.CloseStreams()
+
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/ws", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg dashboardMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	if msg.Kind != "snapshot" || len(msg.Metrics) != 1 || msg.Metrics[0].ID != "Alloc" {
+		t.Fatalf("Unexpected snapshot %+v", msg)
+	}
+
+	resp, err := http.Post(srv.URL+"/updates/", "application/json",
+		strings.NewReader(`[{"id":"PollCount","type":"counter","delta":2},{"id":"PollCount","type":"counter","delta":3}]`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Both updates of the batch arrive as one event.
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read update: %v", err)
+	}
+	if msg.Kind != "update" || msg.Metrics[0].ID != "PollCount" || msg.Metrics[0].Type != "counter" {
+		t.Fatalf("Unexpected update %+v", msg)
+	}
+	if msg.Metrics[0].Value != 5 {
+		t.Fatalf("Expected the counter total 5, got %v", msg.Metrics[0].Value)
+	}
+}
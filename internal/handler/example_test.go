@@ -2,6 +2,7 @@ package handler_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net/http/httptest"
 
@@ -10,6 +11,7 @@ import (
 )
 
 func ExampleHandler_UpdateMetricJSON() {
+	ctx := context.Background()
 	storage := repository.NewMemStorage()
 	h := handler.New(storage)
 
@@ -21,7 +23,7 @@ func ExampleHandler_UpdateMetricJSON() {
 	h.UpdateMetricJSON(rr, req)
 
 	fmt.Println(rr.Code)
-	if value, ok := storage.GetGauge("Alloc"); ok {
+	if value, ok, _ := storage.GetGauge(ctx, "Alloc"); ok {
 		fmt.Printf("%.2f\n", value)
 	}
 
@@ -31,6 +33,7 @@ func ExampleHandler_UpdateMetricJSON() {
 }
 
 func ExampleHandler_UpdateMetricsBatch() {
+	ctx := context.Background()
 	storage := repository.NewMemStorage()
 	h := handler.New(storage)
 
@@ -42,7 +45,7 @@ func ExampleHandler_UpdateMetricsBatch() {
 	h.UpdateMetricsBatch(rr, req)
 
 	fmt.Println(rr.Code)
-	if delta, ok := storage.GetCounter("Requests"); ok {
+	if delta, ok, _ := storage.GetCounter(ctx, "Requests"); ok {
 		fmt.Println(delta)
 	}
 
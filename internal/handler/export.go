@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// Export returns every stored metric as a JSON array in the format of the
+// /updates/ endpoint, except that counters carry their running total in delta
+// and gauges the timestamp of their newest sample. Federating servers pull it
+// from their peers.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.ExportMetrics(r.Context())
+	if err != nil {
+		log.Printf("Error reading metrics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(metrics)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if SecretKey != "" {
+		hmacResp := hmac.New(sha256.New, []byte(SecretKey))
+		hmacResp.Write(resp)
+		w.Header().Set("HashSHA256", hex.EncodeToString(hmacResp.Sum(nil)))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// ExportMetrics returns the stored state of every metric sorted by type and
+// ID, as served by Export.
+func (h *Handler) ExportMetrics(ctx context.Context) ([]models.Metrics, error) {
+	gauges, err := h.storage.GetAllGauges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := h.storage.GetAllCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := h.storage.GetAllSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []models.Metrics
+	for id, value := range gauges {
+		value := value
+		m := models.Metrics{ID: id, MType: models.Gauge, Value: &value}
+		if ts, ok := h.history.Latest(models.Gauge, id); ok {
+			m.Timestamp = &ts
+		}
+		metrics = append(metrics, m)
+	}
+	for id, total := range counters {
+		total := total
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &total})
+	}
+	for id, registers := range sets {
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Set, Registers: registers})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+	if metrics == nil {
+		metrics = []models.Metrics{}
+	}
+	return metrics, nil
+}
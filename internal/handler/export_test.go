@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+func TestExportReportsTotals(t *testing.T) {
+	ctx := context.Background()
+	h := New(repository.NewMemStorage())
+	delta := int64(2)
+	value := 1.5
+	ts := int64(1700000000000)
+	batch := []models.Metrics{
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "load", MType: models.Gauge, Value: &value, Timestamp: &ts},
+	}
+	if err := h.StoreBatch(ctx, "test", batch); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.Export(w, httptest.NewRequest(http.MethodGet, "/api/v1/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var got []models.Metrics
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 metrics, got %d", len(got))
+	}
+	if got[0].ID != "hits" || *got[0].Delta != 4 {
+		t.Fatalf("Expected hits total 4, got %+v", got[0])
+	}
+	if got[1].ID != "load" || got[1].Timestamp == nil || *got[1].Timestamp != ts {
+		t.Fatalf("Expected load with its sample timestamp, got %+v", got[1])
+	}
+}
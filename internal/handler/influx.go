@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"go-metrics-and-alerts/internal/lineproto"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+type influxError struct {
+	Code    string                `json:"code"`
+	Message string                `json:"message"`
+	Errors  []lineproto.LineError `json:"errors,omitempty"`
+}
+
+// InfluxWrite accepts InfluxDB line protocol on /api/v2/write. Every numeric
+// or boolean field becomes the metric measurement_field with tags as labels.
+// Line protocol carries no metric kind, so fields are stored as gauges
+// unless metadata registers the metric as a counter. Counter fields hold
+// running totals, as Telegraf sends them, and are converted to deltas
+// against the previous value of the series; the first value only sets the
+// baseline. Valid lines are stored even when others fail, including lines
+// with stale samples or series beyond the limits; failures are reported per
+// line with 400, success returns 204.
+func (h *Handler) InfluxWrite(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	points, lineErrors, err := lineproto.Parse(string(body), r.URL.Query().Get("precision"))
+	if err != nil {
+		writeInfluxError(w, influxError{Code: "invalid", Message: err.Error()})
+		return
+	}
+
+	ctx := repository.WithPartialWrites(r.Context())
+	meta, err := h.storage.GetAllMetadata(ctx)
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	tx := h.cumulative.begin()
+	defer tx.rollback()
+	var metrics []models.Metrics
+	// lines holds the line number of each metric.
+	var lines []int
+	for _, p := range points {
+		converted, err := pointMetrics(tx, p, meta)
+		if err != nil {
+			lineErrors = append(lineErrors, lineproto.LineError{Line: p.Line, Err: err.Error()})
+			continue
+		}
+		for range converted {
+			lines = append(lines, p.Line)
+		}
+		metrics = append(metrics, converted...)
+	}
+
+	unstored := make(map[string]bool)
+	if len(metrics) > 0 {
+		stale, err := h.applyBatch(ctx, clientIP(r), metrics)
+		var rejected *repository.RejectedError
+		if err != nil && !errors.As(err, &rejected) {
+			log.Printf("Error writing line protocol batch: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		failed := make(map[int]bool)
+		fail := func(i int, msg string) {
+			unstored[metrics[i].ID] = true
+			if !failed[lines[i]] {
+				failed[lines[i]] = true
+				lineErrors = append(lineErrors, lineproto.LineError{Line: lines[i], Err: msg})
+			}
+		}
+		for _, i := range stale {
+			fail(i, fmt.Sprintf("%s: %s", metrics[i].ID, errStaleSample))
+		}
+		if rejected != nil {
+			for i, m := range metrics {
+				if cause := rejected.Rejected(m.MType, m.ID); cause != nil {
+					fail(i, cause.Error())
+				}
+			}
+		}
+	}
+
+	tx.commit(unstored)
+
+	if len(lineErrors) > 0 {
+		sort.Slice(lineErrors, func(i, j int) bool { return lineErrors[i].Line < lineErrors[j].Line })
+		writeInfluxError(w, influxError{
+			Code:    "invalid",
+			Message: fmt.Sprintf("partial write: %d line(s) rejected", len(lineErrors)),
+			Errors:  lineErrors,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pointMetrics converts the numeric fields of p into metrics. Counter
+// fields whose value only sets the baseline produce no metric.
+func pointMetrics(tx *cumulativeTx, p lineproto.Point, meta map[string]models.Metadata) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	numeric := false
+	for _, f := range p.Fields {
+		if f.Kind == lineproto.KindString {
+			continue
+		}
+		numeric = true
+
+		id := models.JoinID(p.Measurement+"_"+f.Key, p.Tags)
+		registered := meta[id]
+		if registered.MType == "" {
+			base, _ := models.SplitID(id)
+			registered = meta[base]
+		}
+
+		metric := models.Metrics{ID: id, Timestamp: p.Timestamp}
+		switch registered.MType {
+		case "", models.Gauge:
+			value := f.Number
+			metric.MType = models.Gauge
+			metric.Value = &value
+		case models.Counter:
+			if f.Kind != lineproto.KindInteger && f.Kind != lineproto.KindUnsigned {
+				return nil, fmt.Errorf("field %q: counter %s needs an integer value", f.Key, id)
+			}
+			delta, ok := tx.delta(id, 0, float64(f.Int))
+			if !ok {
+				continue
+			}
+			metric.MType = models.Counter
+			metric.Delta = &delta
+		default:
+			return nil, fmt.Errorf("field %q: %s", f.Key, errTypeConflict)
+		}
+		metrics = append(metrics, metric)
+	}
+
+	if !numeric {
+		return nil, fmt.Errorf("no numeric fields")
+	}
+	return metrics, nil
+}
+
+func writeInfluxError(w http.ResponseWriter, e influxError) {
+	resp, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(resp)
+}
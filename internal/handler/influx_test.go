@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+func TestInfluxWrite(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.SetMetadata(ctx, models.Metadata{ID: "net_packets", MType: models.Counter})
+	h := New(storage)
+
+	body := `cpu,host=a usage=12.5,state="busy",up=true
+net,host=a packets=10i
+net,host=b packets=1.5
+mem,host=a used=100i 1700000000`
+
+	req := httptest.NewRequest("POST", "/api/v2/write?precision=s", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.InfluxWrite(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for partial write, got %d", w.Code)
+	}
+	var resp influxError
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Line != 3 {
+		t.Fatalf("Expected one error on line 3, got %+v", resp)
+	}
+
+	if v, _, _ := storage.GetGauge(ctx, `cpu_usage{host="a"}`); v != 12.5 {
+		t.Fatalf("Expected cpu_usage 12.5, got %v", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, `cpu_up{host="a"}`); v != 1 {
+		t.Fatalf("Expected cpu_up 1, got %v", v)
+	}
+	if _, ok, _ := storage.GetGauge(ctx, `cpu_state{host="a"}`); ok {
+		t.Fatal("String fields should not be stored")
+	}
+	if _, ok, _ := storage.GetCounter(ctx, `net_packets{host="a"}`); ok {
+		t.Fatal("Expected the first counter value to only set the baseline")
+	}
+	if v, _, _ := storage.GetGauge(ctx, `mem_used{host="a"}`); v != 100 {
+		t.Fatalf("Expected mem_used 100, got %v", v)
+	}
+
+	// Counter fields are running totals.
+	for _, total := range []string{"25i", "30i"} {
+		req = httptest.NewRequest("POST", "/api/v2/write", strings.NewReader("net,host=a packets="+total))
+		w = httptest.NewRecorder()
+		h.InfluxWrite(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", w.Code)
+		}
+	}
+	if v, _, _ := storage.GetCounter(ctx, `net_packets{host="a"}`); v != 20 {
+		t.Fatalf("Expected counter 20, got %v", v)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v2/write?precision=h", strings.NewReader("cpu usage=1"))
+	w = httptest.NewRecorder()
+	h.InfluxWrite(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for bad precision, got %d", w.Code)
+	}
+}
+
+func TestInfluxWriteRejectsPerPoint(t *testing.T) {
+	ctx := context.Background()
+	limiter, err := repository.NewLimiter(ctx, repository.NewMemStorage(), repository.LimitConfig{MaxSeries: 2})
+	if err != nil {
+		t.Fatalf("limiter: %v", err)
+	}
+	h := New(limiter)
+	h.SetSampleTolerance(time.Minute)
+
+	now := time.Now().Unix()
+	body := fmt.Sprintf("mem value=5 %d\ncpu value=0 %d", now, now)
+	req := httptest.NewRequest("POST", "/api/v2/write?precision=s", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.InfluxWrite(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// cpu is stale and net exceeds the series limit; mem is stored anyway.
+	body = fmt.Sprintf("mem value=6 %d\ncpu value=1 %d\nnet value=3 %d", now, now-600, now)
+	req = httptest.NewRequest("POST", "/api/v2/write?precision=s", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	h.InfluxWrite(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", w.Code)
+	}
+	var resp influxError
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(resp.Errors) != 2 || resp.Errors[0].Line != 2 || resp.Errors[1].Line != 3 {
+		t.Fatalf("Expected errors on lines 2 and 3, got %+v", resp)
+	}
+	if v, _, _ := limiter.GetGauge(ctx, "mem_value"); v != 6 {
+		t.Fatalf("Expected mem_value 6, got %v", v)
+	}
+}
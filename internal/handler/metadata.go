@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// UpdateMetadata registers metric metadata sent as a JSON object or array.
+// Records are merged into the stored ones: empty fields keep the stored
+// value, so an agent re-registering its builtin metadata does not clear a
+// TTL or owner set by an administrator. IDs are checked against the storage
+// limits like metric names.
+func (h *Handler) UpdateMetadata(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if SecretKey != "" {
+		header := getHashHeader(r)
+		if header != "" && !validateHash(body, header) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var items []models.Metadata
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &items)
+	} else {
+		var item models.Metadata
+		err = json.Unmarshal(body, &item)
+		items = append(items, item)
+	}
+	if err != nil || len(items) == 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	for _, item := range items {
+		if item.ID == "" || !isKnownType(item.MType) || !isValidTTL(item.TTL) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.metadataMu.Lock()
+	defer h.metadataMu.Unlock()
+	for _, item := range items {
+		stored, _, err := h.storage.GetMetadata(r.Context(), item.ID)
+		if err == nil {
+			err = h.storage.SetMetadata(r.Context(), mergeMetadata(stored, item))
+		}
+		if err != nil {
+			if writeLimitError(w, err) {
+				return
+			}
+			log.Printf("Error saving metadata: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetMetadata returns the metadata registered for /metadata/{name}.
+func (h *Handler) GetMetadata(w http.ResponseWriter, r *http.Request) {
+	meta, exists, err := h.storage.GetMetadata(r.Context(), chi.URLParam(r, "name"))
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, meta)
+}
+
+// ListMetadata returns every registered metadata record.
+func (h *Handler) ListMetadata(w http.ResponseWriter, r *http.Request) {
+	all, err := h.storage.GetAllMetadata(r.Context())
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	items := make([]models.Metadata, 0, len(all))
+	for _, meta := range all {
+		items = append(items, meta)
+	}
+	writeJSON(w, items)
+}
+
+// mergeMetadata returns update with its empty fields taken from stored.
+func mergeMetadata(stored, update models.Metadata) models.Metadata {
+	if update.Description == "" {
+		update.Description = stored.Description
+	}
+	if update.Unit == "" {
+		update.Unit = stored.Unit
+	}
+	if update.MType == "" {
+		update.MType = stored.MType
+	}
+	if update.Owner == "" {
+		update.Owner = stored.Owner
+	}
+	if update.TTL == "" {
+		update.TTL = stored.TTL
+	}
+	return update
+}
+
+// conflictsWith reports whether the metadata pins the metric to another type.
+func conflictsWith(meta models.Metadata, mtype string) bool {
+	return meta.MType != "" && meta.MType != mtype
+}
+
+func (h *Handler) conflictsWithMetadata(ctx context.Context, id, mtype string) (bool, error) {
+	meta, exists, err := h.storage.GetMetadata(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return exists && conflictsWith(meta, mtype), nil
+}
+
+func isKnownType(mtype string) bool {
+	switch mtype {
+	case "", "gauge", "counter", "set":
+		return true
+	}
+	return false
+}
+
+func isValidTTL(ttl string) bool {
+	if ttl == "" {
+		return true
+	}
+	d, err := time.ParseDuration(ttl)
+	return err == nil && d >= 0
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
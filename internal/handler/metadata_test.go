@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestMetadata(t *testing.T) {
+	storage := repository.NewMemStorage()
+	handler := New(storage)
+
+	r := chi.NewRouter()
+	r.Post("/metadata/", handler.UpdateMetadata)
+	r.Get("/metadata/{name}", handler.GetMetadata)
+	r.Post("/update/{type}/{name}/{value}", handler.UpdateMetric)
+	r.Post("/updates/", handler.UpdateMetricsBatch)
+	r.Get("/api/v1/snapshot", handler.DashboardSnapshot)
+
+	body := `[{"id":"HeapAlloc","type":"gauge","unit":"bytes","description":"Heap bytes"}]`
+	req := httptest.NewRequest("POST", "/metadata/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/metadata/", strings.NewReader(`{"id":"Bad","type":"histogram"}`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for unknown type, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/metadata/HeapAlloc", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"unit":"bytes"`) {
+		t.Fatalf("Unexpected metadata response %d %s", w.Code, w.Body.String())
+	}
+
+	// Empty fields keep the stored values, such as a TTL set by an admin.
+	for _, body := range []string{`{"id":"HeapAlloc","ttl":"1h"}`, `{"id":"HeapAlloc","type":"gauge","description":"Heap bytes"}`} {
+		req = httptest.NewRequest("POST", "/metadata/", strings.NewReader(body))
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+	if meta, _, _ := storage.GetMetadata(context.Background(), "HeapAlloc"); meta.TTL != "1h" || meta.Unit != "bytes" || meta.Description != "Heap bytes" {
+		t.Fatalf("Expected merged metadata, got %+v", meta)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/update/gauge/HeapAlloc/10", "", http.StatusOK},
+		{"POST", "/update/counter/HeapAlloc/10", "", http.StatusBadRequest},
+		{"POST", "/updates/", `[{"id":"HeapAlloc","type":"counter","delta":1}]`, http.StatusBadRequest},
+		{"POST", "/updates/", `[{"id":"Other","type":"counter","delta":1}]`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("Expected %d, got %d for %s %s", test.status, w.Code, test.path, test.body)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/snapshot", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"id":"HeapAlloc","type":"gauge","value":10`) ||
+		!strings.Contains(w.Body.String(), `"unit":"bytes","description":"Heap bytes"`) {
+		t.Fatalf("Expected unit in listing, got %s", w.Body.String())
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	limiter, err := repository.NewLimiter(context.Background(), repository.NewMemStorage(), repository.LimitConfig{
+		MaxSeries:   1,
+		NamePattern: regexp.MustCompile(`^[A-Za-z_]+$`),
+	})
+	if err != nil {
+		t.Fatalf("limiter: %v", err)
+	}
+	handler := New(limiter)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"id":"bad name"}`, http.StatusBadRequest},
+		{`{"id":"HeapAlloc","unit":"bytes"}`, http.StatusOK},
+		{`{"id":"Other","unit":"bytes"}`, http.StatusTooManyRequests},
+		{`{"id":"HeapAlloc","description":"Heap bytes"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/metadata/", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		handler.UpdateMetadata(w, req)
+		if w.Code != test.status {
+			t.Fatalf("Expected %d, got %d for %s", test.status, w.Code, test.body)
+		}
+	}
+}
@@ -2,54 +2,67 @@
 package handler
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"html/template"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go-metrics-and-alerts/internal/audit"
 	models "go-metrics-and-alerts/internal/model"
 	"go-metrics-and-alerts/internal/repository"
+	"go-metrics-and-alerts/internal/stream"
+	"go-metrics-and-alerts/pkg/hll"
 
 	"github.com/go-chi/chi/v5"
 )
 
-// SyncSaveFunc triggers a synchronous persistence when assigned.
-var SyncSaveFunc func()
-
 // SecretKey is the optional HMAC secret shared with the agent.
 var SecretKey string
 
-var metricsTemplate = template.Must(template.New("metrics").Parse(`<html><body><h1>Metrics</h1>
-<h2>Gauges</h2><ul>
-{{range $name, $value := .Gauges}}
-<li>{{$name}}: {{$value}}</li>
-{{end}}
-</ul>
-<h2>Counters</h2><ul>
-{{range $name, $value := .Counters}}
-<li>{{$name}}: {{$value}}</li>
-{{end}}
-</ul>
-</body></html>`))
+// ErrInvalidBatch reports a batch rejected by StoreBatch.
+var ErrInvalidBatch = errors.New("invalid metrics batch")
+
+const (
+	errTypeConflict = "Metric type conflicts with registered metadata"
+	errStaleSample  = "Sample timestamp is outside the accepted tolerance"
+)
 
 // Handler processes HTTP requests that read or update metrics.
 type Handler struct {
-	storage repository.Repository
-	auditor audit.Notifier
+	storage    repository.Repository
+	auditor    audit.Notifier
+	history    *repository.History
+	tolerance  time.Duration
+	cumulative *cumulativeTracker
+	hub        *stream.Hub
+	placing    [placeStripes]sync.Mutex
+	// metadataMu serializes metadata upserts, which read and merge the
+	// stored record.
+	metadataMu sync.Mutex
+	onDelete   func(mtype, name string)
 }
 
 // New creates a handler backed by the provided repository.
 func New(storage repository.Repository) *Handler {
-	return &Handler{storage: storage}
+	return &Handler{
+		storage:    storage,
+		history:    repository.NewHistory(repository.DefaultHistorySize),
+		cumulative: newCumulativeTracker(),
+		hub:        stream.NewHub(stream.DefaultBuffer),
+	}
 }
 
 // SetAuditor attaches an audit publisher that will receive events.
@@ -57,6 +70,25 @@ func (h *Handler) SetAuditor(a audit.Notifier) {
 	h.auditor = a
 }
 
+// SetHistory replaces the in-memory sample history, e.g. with one loaded
+// from persistent storage.
+func (h *Handler) SetHistory(history *repository.History) {
+	h.history = history
+}
+
+// SetDeleteHook sets a function called for every metric deleted or renamed
+// away from through the admin API, e.g. to drop state kept about it.
+func (h *Handler) SetDeleteHook(fn func(mtype, name string)) {
+	h.onDelete = fn
+}
+
+// SetSampleTolerance sets how far a sample timestamp may lag behind the newest
+// sample of its metric, or run ahead of the server clock, before the sample
+// is rejected. Zero accepts samples of any age.
+func (h *Handler) SetSampleTolerance(d time.Duration) {
+	h.tolerance = d
+}
+
 // UpdateMetric handles path based updates like /update/{type}/{name}/{value}.
 func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
@@ -68,6 +100,22 @@ func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := repository.WithSource(r.Context(), clientIP(r))
+	conflict, err := h.conflictsWithMetadata(ctx, metricName, metricType)
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if conflict {
+		http.Error(w, errTypeConflict, http.StatusBadRequest)
+		return
+	}
+
+	stored := true
+	update := models.Metrics{ID: metricName, MType: metricType}
+	tl := h.newTimeline(time.Now(), update)
+	defer tl.release()
 	switch metricType {
 	case "gauge":
 		value, err := strconv.ParseFloat(metricValue, 64)
@@ -75,11 +123,23 @@ func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
-		if err := h.storage.UpdateGauge(metricName, value); err != nil {
-			log.Printf("Error updating gauge: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		update.Value = &value
+		newest, ok := tl.place(update)
+		if !ok {
+			http.Error(w, errStaleSample, http.StatusBadRequest)
 			return
 		}
+		stored = newest
+		if newest {
+			if err := h.storage.UpdateGauge(ctx, metricName, value); err != nil {
+				if writeLimitError(w, err) {
+					return
+				}
+				log.Printf("Error updating gauge: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
 
 	case "counter":
 		value, err := strconv.ParseInt(metricValue, 10, 64)
@@ -87,23 +147,44 @@ func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
-		if err := h.storage.UpdateCounter(metricName, value); err != nil {
+		update.Delta = &value
+		if _, ok := tl.place(update); !ok {
+			http.Error(w, errStaleSample, http.StatusBadRequest)
+			return
+		}
+		if err := h.storage.UpdateCounter(ctx, metricName, value); err != nil {
+			if writeLimitError(w, err) {
+				return
+			}
 			log.Printf("Error updating counter: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+	case "set":
+		sketch := hll.New()
+		sketch.AddString(metricValue)
+		update.Registers = sketch.Bytes()
+		if err := h.storage.UpdateSet(ctx, metricName, update.Registers); err != nil {
+			if writeLimitError(w, err) {
+				return
+			}
+			log.Printf("Error updating set: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 	default:
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 
-	if SyncSaveFunc != nil {
-		SyncSaveFunc()
+	tl.commit()
+	h.publishAudit(clientIP(r), []string{metricName})
+	if stored {
+		h.publishUpdates(update)
 	}
 
-	h.publishAudit(r, []string{metricName})
-
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -111,10 +192,16 @@ func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetMetric(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
 	metricName := chi.URLParam(r, "name")
+	ctx := r.Context()
 
 	switch metricType {
 	case "gauge":
-		value, exists := h.storage.GetGauge(metricName)
+		value, exists, err := h.storage.GetGauge(ctx, metricName)
+		if err != nil {
+			log.Printf("Error reading gauge: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		if !exists {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
@@ -125,7 +212,12 @@ func (h *Handler) GetMetric(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case "counter":
-		value, exists := h.storage.GetCounter(metricName)
+		value, exists, err := h.storage.GetCounter(ctx, metricName)
+		if err != nil {
+			log.Printf("Error reading counter: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		if !exists {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
@@ -135,26 +227,35 @@ func (h *Handler) GetMetric(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Error writingg response: %v", err)
 		}
 
+	case "set":
+		value, exists, err := h.getSetEstimate(ctx, metricName)
+		if err != nil {
+			log.Printf("Error reading set: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := w.Write([]byte(strconv.FormatInt(value, 10))); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+
 	default:
 		http.Error(w, "Bad request", http.StatusBadRequest)
 	}
 }
 
-// ListMetrics renders all saved metrics as a simple HTML page.
-func (h *Handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-
-	data := struct {
-		Gauges   map[string]float64
-		Counters map[string]int64
-	}{
-		Gauges:   h.storage.GetAllGauges(),
-		Counters: h.storage.GetAllCounters(),
-	}
-
-	if err := metricsTemplate.Execute(w, data); err != nil {
-		log.Printf("Error executing template: %v", err)
+// GetHistory returns recent samples of /history/{type}/{name} ordered by timestamp.
+func (h *Handler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	samples := h.history.Get(chi.URLParam(r, "type"), chi.URLParam(r, "name"))
+	if len(samples) == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
 	}
+	writeJSON(w, samples)
 }
 
 // UpdateMetricJSON handles JSON payloads for single metric updates.
@@ -179,40 +280,87 @@ func (h *Handler) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := repository.WithSource(r.Context(), clientIP(r))
+	conflict, err := h.conflictsWithMetadata(ctx, metric.ID, metric.MType)
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if conflict {
+		http.Error(w, errTypeConflict, http.StatusBadRequest)
+		return
+	}
+
+	stored := true
+	tl := h.newTimeline(time.Now(), metric)
+	defer tl.release()
 	switch metric.MType {
 	case "gauge":
 		if metric.Value == nil {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
-		if err := h.storage.UpdateGauge(metric.ID, *metric.Value); err != nil {
-			log.Printf("Error updating gauge: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		newest, ok := tl.place(metric)
+		if !ok {
+			http.Error(w, errStaleSample, http.StatusBadRequest)
 			return
 		}
+		stored = newest
+		if newest {
+			if err := h.storage.UpdateGauge(ctx, metric.ID, *metric.Value); err != nil {
+				if writeLimitError(w, err) {
+					return
+				}
+				log.Printf("Error updating gauge: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
 
 	case "counter":
 		if metric.Delta == nil {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
-		if err := h.storage.UpdateCounter(metric.ID, *metric.Delta); err != nil {
+		if _, ok := tl.place(metric); !ok {
+			http.Error(w, errStaleSample, http.StatusBadRequest)
+			return
+		}
+		if err := h.storage.UpdateCounter(ctx, metric.ID, *metric.Delta); err != nil {
+			if writeLimitError(w, err) {
+				return
+			}
 			log.Printf("Error updating counter: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+	case "set":
+		if len(metric.Registers) != hll.Size {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if err := h.storage.UpdateSet(ctx, metric.ID, metric.Registers); err != nil {
+			if writeLimitError(w, err) {
+				return
+			}
+			log.Printf("Error updating set: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 	default:
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 
-	if SyncSaveFunc != nil {
-		SyncSaveFunc()
+	tl.commit()
+	h.publishAudit(clientIP(r), []string{metric.ID})
+	if stored {
+		h.publishUpdates(metric)
 	}
 
-	h.publishAudit(r, []string{metric.ID})
-
 	w.Header().Set("Content-Type", "application/json")
 	resp, err := json.Marshal(metric)
 	if err != nil {
@@ -253,9 +401,15 @@ func (h *Handler) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := r.Context()
 	switch metric.MType {
 	case "gauge":
-		value, exists := h.storage.GetGauge(metric.ID)
+		value, exists, err := h.storage.GetGauge(ctx, metric.ID)
+		if err != nil {
+			log.Printf("Error reading gauge: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		if !exists {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
@@ -263,13 +417,39 @@ func (h *Handler) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 		metric.Value = &value
 
 	case "counter":
-		value, exists := h.storage.GetCounter(metric.ID)
+		value, exists, err := h.storage.GetCounter(ctx, metric.ID)
+		if err != nil {
+			log.Printf("Error reading counter: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		if !exists {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
 		metric.Delta = &value
 
+	case "set":
+		registers, exists, err := h.storage.GetSet(ctx, metric.ID)
+		if err != nil {
+			log.Printf("Error reading set: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		sketch, err := hll.FromBytes(registers)
+		if err != nil {
+			log.Printf("Error decoding set %s: %v", metric.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		value := int64(sketch.Estimate())
+		metric.Delta = &value
+		metric.Registers = registers
+
 	default:
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -320,41 +500,255 @@ func (h *Handler) UpdateMetricsBatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.storage.UpdateBatch(metrics); err != nil {
+	ctx := r.Context()
+	msg, err := h.validateBatch(ctx, metrics)
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.applyBatch(ctx, clientIP(r), metrics); err != nil {
+		if writeLimitError(w, err) {
+			return
+		}
 		log.Printf("Error updating metrics batch: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if SyncSaveFunc != nil {
-		SyncSaveFunc()
+	w.Header().Set("Content-Type", "application/json")
+	if SecretKey != "" {
+		hmacResp := hmac.New(sha256.New, []byte(SecretKey))
+		w.Header().Set("HashSHA256", hex.EncodeToString(hmacResp.Sum(nil)))
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	names := make([]string, 0, len(metrics))
+// StoreBatch validates and stores metrics that arrive outside of the HTTP
+// API, such as over gRPC. source is the client address recorded in audit
+// events. Stale samples are dropped and the rest is stored. Validation
+// failures wrap ErrInvalidBatch, and so do rejections by the storage
+// limits, which also wrap repository.ErrSeriesLimit or
+// repository.ErrInvalidName; any other error comes from the storage.
+func (h *Handler) StoreBatch(ctx context.Context, source string, metrics []models.Metrics) error {
+	msg, err := h.validateBatch(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidBatch, msg)
+	}
+	_, err = h.applyBatch(ctx, source, metrics)
+	if isLimitError(err) {
+		return fmt.Errorf("%w: %w", ErrInvalidBatch, err)
+	}
+	return err
+}
+
+// validateBatch returns the reason a batch is rejected, or "" if it is valid.
+func (h *Handler) validateBatch(ctx context.Context, metrics []models.Metrics) (string, error) {
+	meta, err := h.storage.GetAllMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
 	for _, metric := range metrics {
+		if metric.MType == "set" && len(metric.Registers) != hll.Size {
+			return "Bad request", nil
+		}
+		if conflictsWith(meta[metric.ID], metric.MType) {
+			return errTypeConflict, nil
+		}
+	}
+	return "", nil
+}
+
+// applyBatch places validated metrics on their timelines, stores the ones
+// that are current and notifies audit and stream subscribers. source is
+// also passed to the storage for its per-source limits. Stale samples are
+// dropped and logged, the rest of the batch is stored, and the indexes of
+// the dropped samples in metrics are returned. Under
+// repository.WithPartialWrites the series rejected by the storage limits are
+// left out as well, and the error is a *repository.RejectedError.
+func (h *Handler) applyBatch(ctx context.Context, source string, metrics []models.Metrics) ([]int, error) {
+	ctx = repository.WithSource(ctx, source)
+	tl := h.newTimeline(time.Now(), metrics...)
+	defer tl.release()
+
+	accepted := make([]models.Metrics, 0, len(metrics))
+	names := make([]string, 0, len(metrics))
+	var stale []int
+	var staleNames []string
+	for i, metric := range metrics {
+		newest, ok := tl.place(metric)
+		if !ok {
+			stale = append(stale, i)
+			staleNames = append(staleNames, metric.ID)
+			continue
+		}
 		if metric.ID != "" {
 			names = append(names, metric.ID)
 		}
+		if metric.MType == "gauge" && !newest {
+			continue
+		}
+		accepted = append(accepted, metric)
+	}
+	if len(stale) > 0 {
+		log.Printf("Dropped %d stale samples from %s: %s", len(stale), source, strings.Join(staleNames, ", "))
+	}
+
+	err := h.storage.UpdateBatch(ctx, accepted)
+	var rejected *repository.RejectedError
+	if err != nil && !errors.As(err, &rejected) {
+		return stale, err
+	}
+	if rejected != nil {
+		// A partial write stored the rest of the batch.
+		accepted = slices.DeleteFunc(accepted, func(m models.Metrics) bool {
+			return rejected.Rejected(m.MType, m.ID) != nil
+		})
+		tl.samples = slices.DeleteFunc(tl.samples, func(s repository.HistorySample) bool {
+			return rejected.Rejected(s.MType, s.Name) != nil
+		})
+		names = names[:0]
+		for _, metric := range accepted {
+			names = append(names, metric.ID)
+		}
 	}
+	tl.commit()
 
-	h.publishAudit(r, names)
+	h.publishAudit(source, names)
+	h.publishUpdates(accepted...)
+	return stale, err
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if SecretKey != "" {
-		hmacResp := hmac.New(sha256.New, []byte(SecretKey))
-		w.Header().Set("HashSHA256", hex.EncodeToString(hmacResp.Sum(nil)))
+// placeStripes is the number of locks that serialize the updates of
+// metrics from placement on the timeline to the history commit.
+const placeStripes = 64
+
+// timeline places the gauge and counter samples of one update on the
+// timelines of their metrics. The samples only enter history on commit,
+// once the update is stored, so a failed or rejected write leaves no trace.
+// A timeline holds the locks of its metrics until commit or release, so
+// concurrent updates of a metric are placed and stored one at a time and
+// the newest sample is stored last.
+type timeline struct {
+	h       *Handler
+	now     int64
+	latest  map[string]int64
+	samples []repository.HistorySample
+	locked  []int
+}
+
+// newTimeline returns a timeline holding the locks of the gauges and
+// counters among metrics. The locks are taken in stripe order, so
+// concurrent batches cannot deadlock.
+func (h *Handler) newTimeline(now time.Time, metrics ...models.Metrics) *timeline {
+	t := &timeline{h: h, now: now.UnixMilli(), latest: make(map[string]int64)}
+	var stripes [placeStripes]bool
+	for _, metric := range metrics {
+		if metric.MType == "gauge" || metric.MType == "counter" {
+			stripes[placeStripe(metric.MType+":"+metric.ID)] = true
+		}
 	}
-	w.WriteHeader(http.StatusOK)
+	for i, lock := range stripes {
+		if lock {
+			h.placing[i].Lock()
+			t.locked = append(t.locked, i)
+		}
+	}
+	return t
 }
 
-func (h *Handler) publishAudit(r *http.Request, names []string) {
-	if h == nil || h.auditor == nil || len(names) == 0 {
-		return
+func placeStripe(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % placeStripes)
+}
+
+// place reports whether the sample of metric is the newest one of its
+// metric, which tells gauges whether to overwrite the stored value, and
+// whether the sample is within tolerance at all. Samples placed earlier in
+// the same update count as recorded. Samples without a timestamp are stamped
+// with now.
+func (t *timeline) place(metric models.Metrics) (newest bool, ok bool) {
+	var value float64
+	switch {
+	case metric.MType == "gauge" && metric.Value != nil:
+		value = *metric.Value
+	case metric.MType == "counter" && metric.Delta != nil:
+		value = float64(*metric.Delta)
+	default:
+		return true, true
 	}
 
-	ip := r.RemoteAddr
-	if host, _, err := net.SplitHostPort(ip); err == nil {
-		ip = host
+	ts := t.now
+	if metric.Timestamp != nil {
+		ts = *metric.Timestamp
+	}
+
+	key := metric.MType + ":" + metric.ID
+	latest, exists := t.latest[key]
+	if !exists {
+		latest, exists = t.h.history.Latest(metric.MType, metric.ID)
+	}
+	if t.h.tolerance > 0 {
+		tol := t.h.tolerance.Milliseconds()
+		if ts > t.now+tol || (exists && latest-ts > tol) {
+			return false, false
+		}
+	}
+
+	newest = !exists || ts >= latest
+	if newest {
+		t.latest[key] = ts
+	} else {
+		t.latest[key] = latest
+	}
+	t.samples = append(t.samples, repository.HistorySample{
+		MType:  metric.MType,
+		Name:   metric.ID,
+		Sample: models.Sample{Timestamp: ts, Value: value},
+	})
+	return newest, true
+}
+
+// commit records the placed samples in history and releases the locks.
+func (t *timeline) commit() {
+	t.h.history.InsertBatch(t.samples)
+	t.release()
+}
+
+// release releases the locks of the timeline. It may be called again after
+// commit.
+func (t *timeline) release() {
+	for _, i := range t.locked {
+		t.h.placing[i].Unlock()
+	}
+	t.locked = nil
+}
+
+func (h *Handler) getSetEstimate(ctx context.Context, name string) (int64, bool, error) {
+	registers, exists, err := h.storage.GetSet(ctx, name)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	sketch, err := hll.FromBytes(registers)
+	if err != nil {
+		log.Printf("Error decoding set %s: %v", name, err)
+		return 0, false, nil
+	}
+	return int64(sketch.Estimate()), true, nil
+}
+
+func (h *Handler) publishAudit(ip string, names []string) {
+	if h == nil || h.auditor == nil || len(names) == 0 {
+		return
 	}
 
 	event := audit.Event{
@@ -365,6 +759,34 @@ func (h *Handler) publishAudit(r *http.Request, names []string) {
 	h.auditor.Publish(event)
 }
 
+// isLimitError reports whether the storage rejected a write for its series
+// or metric name limits.
+func isLimitError(err error) bool {
+	return errors.Is(err, repository.ErrSeriesLimit) || errors.Is(err, repository.ErrInvalidName)
+}
+
+// writeLimitError answers a write rejected by the storage limits, with the
+// limit in the body, and reports whether err was such a rejection.
+func writeLimitError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrSeriesLimit):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, repository.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		return false
+	}
+	return true
+}
+
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
 func validateHash(body []byte, header string) bool {
 	if header == "" {
 		return false
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -39,9 +40,10 @@ func BenchmarkUpdateMetricsBatch(b *testing.B) {
 }
 
 func BenchmarkListMetrics(b *testing.B) {
+	ctx := context.Background()
 	storage := repository.NewMemStorage()
-	storage.UpdateGauge("Alloc", 123.45)
-	storage.UpdateCounter("PollCount", 5)
+	storage.UpdateGauge(ctx, "Alloc", 123.45)
+	storage.UpdateCounter(ctx, "PollCount", 5)
 	h := New(storage)
 
 	req := httptest.NewRequest("GET", "/", nil)
@@ -1,12 +1,21 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	models "go-metrics-and-alerts/internal/model"
 	"go-metrics-and-alerts/internal/repository"
+	"go-metrics-and-alerts/pkg/hll"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -40,11 +49,12 @@ func TestUpdateMetric(t *testing.T) {
 }
 
 func TestGetMetric(t *testing.T) {
+	ctx := context.Background()
 	storage := repository.NewMemStorage()
 	handler := New(storage)
 
-	storage.UpdateGauge("test", 123.45)
-	storage.UpdateCounter("counter", 100)
+	storage.UpdateGauge(ctx, "test", 123.45)
+	storage.UpdateCounter(ctx, "counter", 100)
 
 	r := chi.NewRouter()
 	r.Get("/value/{type}/{name}", handler.GetMetric)
@@ -74,3 +84,246 @@ func TestGetMetric(t *testing.T) {
 		}
 	}
 }
+
+func TestSetMetric(t *testing.T) {
+	storage := repository.NewMemStorage()
+	handler := New(storage)
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handler.UpdateMetric)
+	r.Post("/updates/", handler.UpdateMetricsBatch)
+	r.Get("/value/{type}/{name}", handler.GetMetric)
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		req := httptest.NewRequest("POST", "/update/set/users/"+user, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+
+	sketch := hll.New()
+	sketch.AddString("carol")
+	body, _ := json.Marshal([]models.Metrics{{ID: "users", MType: models.Set, Registers: sketch.Bytes()}})
+	req := httptest.NewRequest("POST", "/updates/", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/updates/", strings.NewReader(`[{"id":"users","type":"set","registers":"AAEC"}]`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for short registers, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/value/set/users", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "3" {
+		t.Fatalf("Expected estimate 3, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestOutOfOrderSamples(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	handler := New(storage)
+	handler.SetSampleTolerance(time.Minute)
+
+	r := chi.NewRouter()
+	r.Post("/update/", handler.UpdateMetricJSON)
+	r.Post("/updates/", handler.UpdateMetricsBatch)
+	r.Get("/history/{type}/{name}", handler.GetHistory)
+
+	now := time.Now().UnixMilli()
+	tests := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/update/", fmt.Sprintf(`{"id":"Load","type":"gauge","value":2,"timestamp":%d}`, now), http.StatusOK},
+		{"/update/", fmt.Sprintf(`{"id":"Load","type":"gauge","value":1,"timestamp":%d}`, now-10000), http.StatusOK},
+		{"/update/", fmt.Sprintf(`{"id":"Load","type":"gauge","value":0,"timestamp":%d}`, now-120000), http.StatusBadRequest},
+		{"/update/", fmt.Sprintf(`{"id":"Load","type":"gauge","value":9,"timestamp":%d}`, now+120000), http.StatusBadRequest},
+		{"/updates/", fmt.Sprintf(`[{"id":"Load","type":"gauge","value":1.5,"timestamp":%d},{"id":"Hits","type":"counter","delta":4,"timestamp":%d}]`, now-5000, now-5000), http.StatusOK},
+		{"/updates/", fmt.Sprintf(`[{"id":"Fresh","type":"gauge","value":1},{"id":"Load","type":"gauge","value":0,"timestamp":%d}]`, now-120000), http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("Expected %d, got %d for %s", test.status, w.Code, test.body)
+		}
+	}
+
+	// Only the stale sample of a batch is dropped.
+	if value, ok, _ := storage.GetGauge(ctx, "Fresh"); !ok || value != 1 {
+		t.Fatalf("Expected the rest of the batch to be stored, got %v %v", value, ok)
+	}
+
+	if value, _, _ := storage.GetGauge(ctx, "Load"); value != 2 {
+		t.Fatalf("Expected newest gauge value 2, got %v", value)
+	}
+	if delta, _, _ := storage.GetCounter(ctx, "Hits"); delta != 4 {
+		t.Fatalf("Expected late counter delta to be applied, got %d", delta)
+	}
+
+	req := httptest.NewRequest("GET", "/history/gauge/Load", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var samples []models.Sample
+	if err := json.Unmarshal(w.Body.Bytes(), &samples); err != nil {
+		t.Fatalf("decode history: %v", err)
+	}
+	want := []float64{1, 1.5, 2}
+	if len(samples) != len(want) {
+		t.Fatalf("Expected %d samples, got %v", len(want), samples)
+	}
+	for i, v := range want {
+		if samples[i].Value != v {
+			t.Fatalf("Expected history %v, got %v", want, samples)
+		}
+	}
+}
+
+// slowStorage delays the writes of low gauge values, so the older of two
+// concurrent samples would finish its write last.
+type slowStorage struct {
+	*repository.MemStorage
+}
+
+func (s slowStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if m.Value != nil {
+			time.Sleep(time.Duration(50-*m.Value) * time.Millisecond / 10)
+		}
+	}
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestConcurrentSamplesStoreNewest(t *testing.T) {
+	ctx := context.Background()
+	storage := slowStorage{repository.NewMemStorage()}
+	handler := New(storage)
+
+	now := time.Now().UnixMilli()
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, ts := float64(i), now+int64(i)
+			handler.StoreBatch(ctx, "test", []models.Metrics{{ID: "Load", MType: models.Gauge, Value: &value, Timestamp: &ts}})
+		}()
+	}
+	wg.Wait()
+
+	if value, _, _ := storage.GetGauge(ctx, "Load"); value != 49 {
+		t.Fatalf("Expected the newest value 49, got %v", value)
+	}
+}
+
+// failingStorage reports every read as a storage failure.
+type failingStorage struct {
+	*repository.MemStorage
+}
+
+var errStorageDown = errors.New("storage down")
+
+func (failingStorage) GetGauge(context.Context, string) (float64, bool, error) {
+	return 0, false, errStorageDown
+}
+
+func (failingStorage) GetMetadata(context.Context, string) (models.Metadata, bool, error) {
+	return models.Metadata{}, false, errStorageDown
+}
+
+func (failingStorage) GetAllMetadata(context.Context) (map[string]models.Metadata, error) {
+	return nil, errStorageDown
+}
+
+func TestStorageErrorsAreServerErrors(t *testing.T) {
+	handler := New(failingStorage{repository.NewMemStorage()})
+
+	r := chi.NewRouter()
+	r.Get("/value/{type}/{name}", handler.GetMetric)
+	r.Post("/update/{type}/{name}/{value}", handler.UpdateMetric)
+	r.Post("/updates/", handler.UpdateMetricsBatch)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/value/gauge/Alloc", ""},
+		{"POST", "/update/gauge/Alloc/1", ""},
+		{"POST", "/updates/", `[{"id":"Alloc","type":"gauge","value":1}]`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500 for %s %s, got %d", test.method, test.path, w.Code)
+		}
+	}
+
+	if err := handler.StoreBatch(context.Background(), "test", nil); !errors.Is(err, errStorageDown) || errors.Is(err, ErrInvalidBatch) {
+		t.Errorf("Expected the storage error from StoreBatch, got %v", err)
+	}
+}
+
+func TestLimitRejections(t *testing.T) {
+	ctx := context.Background()
+	limiter, err := repository.NewLimiter(ctx, repository.NewMemStorage(), repository.LimitConfig{
+		MaxSeries:     1,
+		MaxNameLength: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := New(limiter)
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handler.UpdateMetric)
+	r.Post("/update/", handler.UpdateMetricJSON)
+	r.Post("/updates/", handler.UpdateMetricsBatch)
+
+	tests := []struct {
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"/update/gauge/load/1", "", http.StatusOK, ""},
+		{"/update/gauge/temp/1", "", http.StatusTooManyRequests, "at most 1 series"},
+		{"/update/gauge/much_too_long/1", "", http.StatusBadRequest, "longer than 8 bytes"},
+		{"/update/", `{"id":"temp","type":"counter","delta":1}`, http.StatusTooManyRequests, "series limit exceeded"},
+		{"/updates/", `[{"id":"load","type":"gauge","value":2},{"id":"temp","type":"gauge","value":1}]`, http.StatusTooManyRequests, "series limit exceeded"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", test.path, strings.NewReader(test.body)))
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s %s: expected %d %q, got %d %q", test.path, test.body, test.status, test.want, w.Code, w.Body.String())
+		}
+	}
+
+	if got := handler.history.Get(models.Gauge, "temp"); len(got) != 0 {
+		t.Errorf("Expected no history for the rejected series, got %+v", got)
+	}
+	if got := handler.history.Get(models.Gauge, "load"); len(got) != 1 || got[0].Value != 1 {
+		t.Errorf("Expected only the stored sample of load in history, got %+v", got)
+	}
+
+	metrics := []models.Metrics{{ID: "temp", MType: models.Gauge, Value: new(float64)}}
+	if err := handler.StoreBatch(ctx, "test", metrics); !errors.Is(err, ErrInvalidBatch) || !errors.Is(err, repository.ErrSeriesLimit) {
+		t.Errorf("Expected a limit error from StoreBatch, got %v", err)
+	}
+}
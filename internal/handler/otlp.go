@@ -0,0 +1,529 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// resourceLabels maps the resource attributes that identify a source onto
+// labels. Other resource attributes are dropped to keep cardinality down.
+var resourceLabels = map[string]string{
+	"service.name":        "job",
+	"service.instance.id": "instance",
+}
+
+// cumulativeIdle is how long a series is tracked after its last point.
+const cumulativeIdle = time.Hour
+
+// cumulativeState remembers the last cumulative value seen for a series.
+type cumulativeState struct {
+	start uint64
+	last  float64
+	// carry holds the fractional part of float deltas not yet added to an
+	// integer counter.
+	carry float64
+	// total is the running total of a delta histogram sum.
+	total float64
+	seen  time.Time
+}
+
+// cumulativeTracker converts cumulative OTLP sums into counter deltas and
+// keeps the running totals of delta histogram sums. Series without points
+// for cumulativeIdle are forgotten; a cumulative series then starts over
+// from a new baseline. Requests change the tracker through a cumulativeTx.
+type cumulativeTracker struct {
+	// txMu is held by the transaction in progress.
+	txMu   sync.Mutex
+	mu     sync.Mutex
+	series map[string]*cumulativeState
+	pruned time.Time
+	now    func() time.Time
+}
+
+func newCumulativeTracker() *cumulativeTracker {
+	return &cumulativeTracker{series: make(map[string]*cumulativeState), now: time.Now}
+}
+
+// begin starts a transaction. The caller must commit or roll it back.
+func (t *cumulativeTracker) begin() *cumulativeTx {
+	return &cumulativeTx{t: t, pending: make(map[string]*cumulativeState)}
+}
+
+// lookup returns a copy of the state of series id and whether it was
+// tracked, forgetting idle series on the way.
+func (t *cumulativeTracker) lookup(id string) (*cumulativeState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if now.Sub(t.pruned) >= cumulativeIdle/4 {
+		for key, s := range t.series {
+			if now.Sub(s.seen) >= cumulativeIdle {
+				delete(t.series, key)
+			}
+		}
+		t.pruned = now
+	}
+
+	s, ok := t.series[id]
+	if !ok {
+		return &cumulativeState{}, false
+	}
+	copied := *s
+	return &copied, true
+}
+
+// tracked reports whether series id is tracked.
+func (t *cumulativeTracker) tracked(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.series[id]
+	return ok
+}
+
+// cumulativeTx stages the changes one request makes to the tracker. They
+// take effect on commit, once the converted metrics are stored, so a failed
+// write leaves the tracker as it was and a retried export converts the same
+// points again. A transaction holds the tracker from its first use until
+// commit or rollback, so each request converts against the baselines of the
+// previous one; requests without cumulative points never wait.
+type cumulativeTx struct {
+	t       *cumulativeTracker
+	locked  bool
+	pending map[string]*cumulativeState
+}
+
+// state returns the staged state of series id and whether the series was
+// tracked already.
+func (x *cumulativeTx) state(id string) (*cumulativeState, bool) {
+	if !x.locked {
+		x.t.txMu.Lock()
+		x.locked = true
+	}
+	if s, ok := x.pending[id]; ok {
+		return s, true
+	}
+	s, ok := x.t.lookup(id)
+	x.pending[id] = s
+	return s, ok
+}
+
+// delta returns the integer increase of series id since its previous
+// observation. The first observation only sets the baseline. A new start
+// time or a drop in value means the producer restarted, and the whole value
+// counts as the increase.
+func (x *cumulativeTx) delta(id string, start uint64, value float64) (int64, bool) {
+	s, ok := x.state(id)
+	if !ok {
+		s.start, s.last = start, value
+		return 0, false
+	}
+
+	increase := value - s.last
+	if (start != 0 && start != s.start) || increase < 0 {
+		increase = value
+	}
+	s.start, s.last = start, value
+	return s.add(increase), true
+}
+
+// accumulate adds a float delta to series id and returns its integer part.
+func (x *cumulativeTx) accumulate(id string, value float64) int64 {
+	s, _ := x.state(id)
+	return s.add(value)
+}
+
+// total adds value to the running total of series id and returns it. A
+// series not tracked yet starts from stored, read by the caller beforehand.
+func (x *cumulativeTx) total(id string, stored, value float64) float64 {
+	s, ok := x.state(id)
+	if !ok {
+		s.total = stored
+	}
+	s.total += value
+	return s.total
+}
+
+// tracked reports whether series id is tracked or staged.
+func (x *cumulativeTx) tracked(id string) bool {
+	if _, ok := x.pending[id]; ok {
+		return true
+	}
+	return x.t.tracked(id)
+}
+
+// commit applies the staged changes, except those of the series in
+// unstored, and ends the transaction.
+func (x *cumulativeTx) commit(unstored map[string]bool) {
+	if !x.locked {
+		return
+	}
+	x.t.mu.Lock()
+	now := x.t.now()
+	for id, s := range x.pending {
+		if unstored[id] {
+			continue
+		}
+		s.seen = now
+		x.t.series[id] = s
+	}
+	x.t.mu.Unlock()
+	x.rollback()
+}
+
+// rollback discards the staged changes and ends the transaction. It may be
+// called again after commit.
+func (x *cumulativeTx) rollback() {
+	if x.locked {
+		x.pending = nil
+		x.locked = false
+		x.t.txMu.Unlock()
+	}
+}
+
+func (s *cumulativeState) add(value float64) int64 {
+	total := s.carry + value
+	whole := math.Trunc(total)
+	s.carry = total - whole
+	return int64(whole)
+}
+
+// OTLPMetrics accepts OTLP/HTTP metric exports on /v1/metrics in protobuf or
+// JSON encoding. Gauges and non-monotonic sums are stored as gauges.
+// Monotonic sums become counters: delta points are added as they are and
+// cumulative points are converted to deltas against the previous point of
+// the same series. Histograms become name_count and name_bucket{le} counters
+// with a name_sum gauge. Point attributes become labels and take precedence
+// over resource labels of the same name. Points without a value, such as
+// NaN staleness markers, are skipped. Points that cannot be stored are
+// reported through partial success.
+func (h *Handler) OTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != contentTypeProtobuf && contentType != contentTypeJSON) {
+		http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req colmetricspb.ExportMetricsServiceRequest
+	if contentType == contentTypeJSON {
+		err = protojson.Unmarshal(body, &req)
+	} else {
+		err = proto.Unmarshal(body, &req)
+	}
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	tx := h.cumulative.begin()
+	defer tx.rollback()
+	metrics, rejected, reason, err := h.otlpToMetrics(r.Context(), tx, &req)
+	if err != nil {
+		log.Printf("Error reading OTLP metric state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	unstored := make(map[string]bool)
+	if len(metrics) > 0 {
+		stale, err := h.applyBatch(r.Context(), clientIP(r), metrics)
+		if err != nil {
+			if writeLimitError(w, err) {
+				return
+			}
+			log.Printf("Error writing OTLP metrics: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, i := range stale {
+			unstored[metrics[i].ID] = true
+			rejected++
+			reason = fmt.Sprintf("%s: %s", metrics[i].ID, errStaleSample)
+		}
+	}
+	tx.commit(unstored)
+
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       reason,
+		}
+	}
+
+	var out []byte
+	if contentType == contentTypeJSON {
+		out, err = protojson.Marshal(resp)
+	} else {
+		out, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// otlpToMetrics translates an export request into metrics, returning the
+// number of rejected points and the reason of the last rejection. An error
+// means the storage could not be read.
+func (h *Handler) otlpToMetrics(ctx context.Context, tx *cumulativeTx, req *colmetricspb.ExportMetricsServiceRequest) ([]models.Metrics, int64, string, error) {
+	meta, err := h.storage.GetAllMetadata(ctx)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var metrics []models.Metrics
+	var rejected int64
+	var reason string
+
+	reject := func(n int, format string, args ...interface{}) {
+		rejected += int64(n)
+		reason = fmt.Sprintf(format, args...)
+	}
+
+	for _, rm := range req.GetResourceMetrics() {
+		var resource []models.Label
+		for _, kv := range rm.GetResource().GetAttributes() {
+			if name, ok := resourceLabels[kv.GetKey()]; ok {
+				resource = append(resource, models.Label{Name: name, Value: anyValueString(kv.GetValue())})
+			}
+		}
+
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				name := m.GetName()
+				switch data := m.GetData().(type) {
+				case *metricspb.Metric_Gauge:
+					for _, dp := range data.Gauge.GetDataPoints() {
+						if !hasValue(numberValue(dp), dp.GetFlags()) {
+							continue
+						}
+						id := otlpID(name, resource, dp.GetAttributes())
+						if conflictsWith(meta[id], models.Gauge) {
+							reject(1, "%s: %s", id, errTypeConflict)
+							continue
+						}
+						metrics = append(metrics, otlpGauge(id, numberValue(dp), dp.GetTimeUnixNano()))
+					}
+
+				case *metricspb.Metric_Sum:
+					sum := data.Sum
+					for _, dp := range sum.GetDataPoints() {
+						if !hasValue(numberValue(dp), dp.GetFlags()) {
+							continue
+						}
+						id := otlpID(name, resource, dp.GetAttributes())
+						if !sum.GetIsMonotonic() {
+							if conflictsWith(meta[id], models.Gauge) {
+								reject(1, "%s: %s", id, errTypeConflict)
+								continue
+							}
+							metrics = append(metrics, otlpGauge(id, numberValue(dp), dp.GetTimeUnixNano()))
+							continue
+						}
+						if conflictsWith(meta[id], models.Counter) {
+							reject(1, "%s: %s", id, errTypeConflict)
+							continue
+						}
+						if metric, ok := h.otlpCounter(tx, id, sum.GetAggregationTemporality(), dp.GetStartTimeUnixNano(), dp.GetTimeUnixNano(), numberValue(dp)); ok {
+							metrics = append(metrics, metric)
+						}
+					}
+
+				case *metricspb.Metric_Histogram:
+					hist := data.Histogram
+					for _, dp := range hist.GetDataPoints() {
+						if !hasValue(dp.GetSum(), dp.GetFlags()) {
+							continue
+						}
+						converted, rejection, err := h.otlpHistogram(ctx, tx, name, resource, hist.GetAggregationTemporality(), dp, meta)
+						if err != nil {
+							return nil, 0, "", err
+						}
+						if rejection != "" {
+							reject(1, "%s", rejection)
+							continue
+						}
+						metrics = append(metrics, converted...)
+					}
+
+				case *metricspb.Metric_ExponentialHistogram:
+					reject(len(data.ExponentialHistogram.GetDataPoints()), "%s: exponential histograms are not supported", name)
+				case *metricspb.Metric_Summary:
+					reject(len(data.Summary.GetDataPoints()), "%s: summaries are not supported", name)
+				}
+			}
+		}
+	}
+
+	return metrics, rejected, reason, nil
+}
+
+// otlpCounter converts one monotonic sum point into a counter delta. It
+// reports false when the point only establishes a cumulative baseline.
+func (h *Handler) otlpCounter(tx *cumulativeTx, id string, temporality metricspb.AggregationTemporality, start, ts uint64, value float64) (models.Metrics, bool) {
+	var delta int64
+	if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+		delta = tx.accumulate(id, value)
+	} else {
+		var ok bool
+		if delta, ok = tx.delta(id, start, value); !ok {
+			return models.Metrics{}, false
+		}
+	}
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &delta, Timestamp: unixNanoToMilli(ts)}, true
+}
+
+// otlpHistogram converts a histogram point into _count and cumulative
+// _bucket{le} counters and a _sum gauge holding the running total.
+func (h *Handler) otlpHistogram(ctx context.Context, tx *cumulativeTx, name string, resource []models.Label, temporality metricspb.AggregationTemporality, dp *metricspb.HistogramDataPoint, meta map[string]models.Metadata) ([]models.Metrics, string, error) {
+	bounds := dp.GetExplicitBounds()
+	counts := dp.GetBucketCounts()
+	if len(counts) != 0 && len(counts) != len(bounds)+1 {
+		return nil, fmt.Sprintf("%s: %d bucket counts for %d bounds", name, len(counts), len(bounds)), nil
+	}
+
+	labels := otlpLabels(resource, dp.GetAttributes())
+	countID := models.JoinID(name+"_count", labels)
+	sumID := models.JoinID(name+"_sum", labels)
+	if conflictsWith(meta[countID], models.Counter) {
+		return nil, fmt.Sprintf("%s: %s", countID, errTypeConflict), nil
+	}
+	if conflictsWith(meta[sumID], models.Gauge) {
+		return nil, fmt.Sprintf("%s: %s", sumID, errTypeConflict), nil
+	}
+
+	start, ts := dp.GetStartTimeUnixNano(), dp.GetTimeUnixNano()
+	var metrics []models.Metrics
+	if metric, ok := h.otlpCounter(tx, countID, temporality, start, ts, float64(dp.GetCount())); ok {
+		metrics = append(metrics, metric)
+	}
+
+	var cumulative uint64
+	for i, count := range counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		}
+		bucketLabels := append(append([]models.Label(nil), labels...), models.Label{Name: "le", Value: le})
+		bucketID := models.JoinID(name+"_bucket", bucketLabels)
+		if metric, ok := h.otlpCounter(tx, bucketID, temporality, start, ts, float64(cumulative)); ok {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	if dp.Sum != nil {
+		sum := dp.GetSum()
+		if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+			var stored float64
+			if !tx.tracked(sumID) {
+				var err error
+				if stored, _, err = h.storage.GetGauge(ctx, sumID); err != nil {
+					return nil, "", err
+				}
+			}
+			sum = tx.total(sumID, stored, sum)
+		}
+		metrics = append(metrics, otlpGauge(sumID, sum, ts))
+	}
+	return metrics, "", nil
+}
+
+func otlpGauge(id string, value float64, ts uint64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &value, Timestamp: unixNanoToMilli(ts)}
+}
+
+func otlpID(name string, resource []models.Label, attrs []*commonpb.KeyValue) string {
+	return models.JoinID(name, otlpLabels(resource, attrs))
+}
+
+func otlpLabels(resource []models.Label, attrs []*commonpb.KeyValue) []models.Label {
+	labels := make([]models.Label, 0, len(resource)+len(attrs))
+	for _, kv := range attrs {
+		labels = append(labels, models.Label{Name: models.SanitizeLabelName(kv.GetKey()), Value: anyValueString(kv.GetValue())})
+	}
+	attributes := labels
+	for _, l := range resource {
+		if !hasLabel(attributes, l.Name) {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+func hasLabel(labels []models.Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasValue reports whether a point carries a value: it is not NaN and not
+// flagged as having no recorded value.
+func hasValue(value float64, flags uint32) bool {
+	return !math.IsNaN(value) && flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) == 0
+}
+
+func numberValue(dp *metricspb.NumberDataPoint) float64 {
+	if v, ok := dp.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return dp.GetAsDouble()
+}
+
+func anyValueString(v *commonpb.AnyValue) string {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(value.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(value.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(value.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return string(value.BytesValue)
+	default:
+		return ""
+	}
+}
+
+func unixNanoToMilli(ns uint64) *int64 {
+	if ns == 0 {
+		return nil
+	}
+	ms := int64(ns / 1e6)
+	return &ms
+}
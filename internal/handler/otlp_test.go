@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func otlpRequest(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "api"}}},
+				{Key: "process.pid", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 42}}},
+			}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func cumulativeSum(name string, value int64, start, ts uint64) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				StartTimeUnixNano: start,
+				TimeUnixNano:      ts,
+				Value:             &metricspb.NumberDataPoint_AsInt{AsInt: value},
+			}},
+		}},
+	}
+}
+
+func postOTLP(t *testing.T, h *Handler, req *colmetricspb.ExportMetricsServiceRequest) *colmetricspb.ExportMetricsServiceResponse {
+	t.Helper()
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	h.OTLPMetrics(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp colmetricspb.ExportMetricsServiceResponse
+	if err := proto.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	return &resp
+}
+
+func TestOTLPMetricsProtobuf(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	h := New(storage)
+
+	const start, t1, t2 = 1_000_000_000, 2_000_000_000, 3_000_000_000
+	gauge := &metricspb.Metric{
+		Name: "queue.depth",
+		Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{{
+			TimeUnixNano: t1,
+			Attributes:   []*commonpb.KeyValue{{Key: "queue.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "jobs"}}}},
+			Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: 7.5},
+		}}}},
+	}
+	summary := &metricspb.Metric{
+		Name: "latency",
+		Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: []*metricspb.SummaryDataPoint{{}}}},
+	}
+
+	resp := postOTLP(t, h, otlpRequest(gauge, cumulativeSum("requests", 100, start, t1), summary))
+	if resp.GetPartialSuccess().GetRejectedDataPoints() != 1 {
+		t.Fatalf("Expected the summary point to be rejected, got %v", resp.GetPartialSuccess())
+	}
+	if v, _, _ := storage.GetGauge(ctx, `queue.depth{job="api",queue_name="jobs"}`); v != 7.5 {
+		t.Fatalf("Expected gauge 7.5, got %v", v)
+	}
+	if _, ok, _ := storage.GetCounter(ctx, `requests{job="api"}`); ok {
+		t.Fatal("First cumulative point should only set the baseline")
+	}
+
+	postOTLP(t, h, otlpRequest(cumulativeSum("requests", 130, start, t2)))
+	if v, _, _ := storage.GetCounter(ctx, `requests{job="api"}`); v != 30 {
+		t.Fatalf("Expected counter 30, got %v", v)
+	}
+
+	// A new start time means the producer restarted.
+	postOTLP(t, h, otlpRequest(cumulativeSum("requests", 5, t2, t2+1_000_000_000)))
+	if v, _, _ := storage.GetCounter(ctx, `requests{job="api"}`); v != 35 {
+		t.Fatalf("Expected counter 35 after reset, got %v", v)
+	}
+
+	sum := 12.5
+	hist := &metricspb.Metric{
+		Name: "duration",
+		Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints: []*metricspb.HistogramDataPoint{{
+				TimeUnixNano:   t2,
+				Count:          5,
+				Sum:            &sum,
+				ExplicitBounds: []float64{1, 5},
+				BucketCounts:   []uint64{2, 2, 1},
+			}},
+		}},
+	}
+	postOTLP(t, h, otlpRequest(hist))
+	postOTLP(t, h, otlpRequest(hist))
+
+	if v, _, _ := storage.GetCounter(ctx, `duration_count{job="api"}`); v != 10 {
+		t.Fatalf("Expected duration_count 10, got %v", v)
+	}
+	if v, _, _ := storage.GetCounter(ctx, `duration_bucket{job="api",le="5"}`); v != 8 {
+		t.Fatalf("Expected le=5 bucket 8, got %v", v)
+	}
+	if v, _, _ := storage.GetCounter(ctx, `duration_bucket{job="api",le="+Inf"}`); v != 10 {
+		t.Fatalf("Expected +Inf bucket 10, got %v", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, `duration_sum{job="api"}`); v != 25 {
+		t.Fatalf("Expected duration_sum 25, got %v", v)
+	}
+}
+
+func TestOTLPMetricsJSON(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	h := New(storage)
+
+	body := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"errors","sum":{
+		"aggregationTemporality":1,"isMonotonic":true,
+		"dataPoints":[{"timeUnixNano":"1700000000000000000","asDouble":2.5}]}}]}]}]}`
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/v1/metrics", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.OTLPMetrics(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Expected JSON response, got %q", ct)
+		}
+	}
+
+	if v, _, _ := storage.GetCounter(ctx, "errors"); v != 5 {
+		t.Fatalf("Expected delta counter 5, got %v", v)
+	}
+
+	r := httptest.NewRequest("POST", "/v1/metrics", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	h.OTLPMetrics(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected 415, got %d", w.Code)
+	}
+}
+
+func TestOTLPMetricsLabelsAndNaN(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	h := New(storage)
+
+	gauge := &metricspb.Metric{
+		Name: "temp",
+		Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+			{
+				Attributes: []*commonpb.KeyValue{{Key: "job", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "worker"}}}},
+				Value:      &metricspb.NumberDataPoint_AsDouble{AsDouble: 21},
+			},
+			{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: math.NaN()}},
+		}}},
+	}
+	resp := postOTLP(t, h, otlpRequest(gauge))
+	if resp.GetPartialSuccess().GetRejectedDataPoints() != 0 {
+		t.Fatalf("Expected no rejected points, got %v", resp.GetPartialSuccess())
+	}
+
+	gauges, _ := storage.GetAllGauges(ctx)
+	if len(gauges) != 1 || gauges[`temp{job="worker"}`] != 21 {
+		t.Fatalf("Expected only the point attribute job, got %v", gauges)
+	}
+}
+
+// flakyStorage fails the writes while down is set.
+type flakyStorage struct {
+	*repository.MemStorage
+	down bool
+}
+
+func (s *flakyStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	if s.down {
+		return errStorageDown
+	}
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestOTLPMetricsRetryAfterFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	storage := &flakyStorage{MemStorage: repository.NewMemStorage()}
+	h := New(storage)
+
+	const start = 1_000_000_000
+	sum := 2.5
+	hist := &metricspb.Metric{
+		Name: "duration",
+		Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints:             []*metricspb.HistogramDataPoint{{TimeUnixNano: start, Count: 1, Sum: &sum}},
+		}},
+	}
+	postOTLP(t, h, otlpRequest(cumulativeSum("requests", 100, start, start)))
+
+	// The exporter retries a request the storage failed to write.
+	export := func() int {
+		body, _ := proto.Marshal(otlpRequest(cumulativeSum("requests", 130, start, 2*start), hist))
+		r := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-protobuf")
+		w := httptest.NewRecorder()
+		h.OTLPMetrics(w, r)
+		return w.Code
+	}
+	storage.down = true
+	if code := export(); code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, got %d", code)
+	}
+	storage.down = false
+	if code := export(); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	if v, _, _ := storage.GetCounter(ctx, `requests{job="api"}`); v != 30 {
+		t.Fatalf("Expected counter 30 after the retry, got %v", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, `duration_sum{job="api"}`); v != 2.5 {
+		t.Fatalf("Expected duration_sum 2.5 after the retry, got %v", v)
+	}
+}
+
+func TestCumulativeTrackerForgetsIdleSeries(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := newCumulativeTracker()
+	tracker.now = func() time.Time { return now }
+	observe := func(id string, value float64) {
+		tx := tracker.begin()
+		tx.delta(id, 1, value)
+		tx.commit(nil)
+	}
+
+	observe("old", 10)
+	now = now.Add(cumulativeIdle / 2)
+	observe("new", 10)
+	now = now.Add(cumulativeIdle / 2)
+	observe("new", 20)
+
+	if tracker.tracked("old") {
+		t.Fatal("Expected the idle series to be forgotten")
+	}
+	if !tracker.tracked("new") {
+		t.Fatal("Expected the active series to be kept")
+	}
+}
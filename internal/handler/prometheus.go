@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type promSeries struct {
+	labels []models.Label
+	value  string
+}
+
+type promFamily struct {
+	name   string
+	mtype  string
+	help   string
+	series []promSeries
+	// ids maps the labels of every series to the metric ID it came from.
+	ids map[string]string
+}
+
+// promEntry is a stored metric before it is placed in a family.
+type promEntry struct {
+	id    string
+	mtype string
+	value string
+}
+
+// promTypeOrder is the order in which types claim family names.
+var promTypeOrder = map[string]int{models.Gauge: 0, models.Counter: 1, models.Set: 2}
+
+// PrometheusMetrics renders every stored metric in the Prometheus text
+// exposition format. Sets are exposed as gauges holding their estimate.
+// Counters and sets sharing a name with a gauge, or sets with a counter, get
+// a "_counter" or "_set" suffix; series still colliding after that are
+// skipped.
+func (h *Handler) PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	meta, err := h.storage.GetAllMetadata(ctx)
+	if err != nil {
+		log.Printf("Error reading metadata: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	gauges, err := h.storage.GetAllGauges(ctx)
+	if err != nil {
+		log.Printf("Error reading gauges: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	counters, err := h.storage.GetAllCounters(ctx)
+	if err != nil {
+		log.Printf("Error reading counters: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sets, err := h.storage.GetAllSets(ctx)
+	if err != nil {
+		log.Printf("Error reading sets: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var entries []promEntry
+	for id, v := range gauges {
+		entries = append(entries, promEntry{id: id, mtype: models.Gauge, value: strconv.FormatFloat(v, 'g', -1, 64)})
+	}
+	for id, v := range counters {
+		entries = append(entries, promEntry{id: id, mtype: models.Counter, value: strconv.FormatInt(v, 10)})
+	}
+	for id, registers := range sets {
+		sketch, err := hll.FromBytes(registers)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, promEntry{id: id, mtype: models.Set, value: strconv.FormatUint(sketch.Estimate(), 10)})
+	}
+	// Entries are added gauges first, then counters and sets, each ordered
+	// by ID, so collisions always resolve the same way.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].mtype != entries[j].mtype {
+			return promTypeOrder[entries[i].mtype] < promTypeOrder[entries[j].mtype]
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	families := make(map[string]*promFamily)
+	for _, e := range entries {
+		base, labels := models.SplitID(e.id)
+		name := models.SanitizeMetricName(base)
+		// A family has exactly one type, so a name shared across types is
+		// disambiguated with a type suffix. A series whose name or labels
+		// still collide with an earlier one after sanitizing is skipped.
+		if f, ok := families[name]; ok && f.mtype != e.mtype {
+			name += "_" + e.mtype
+		}
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{name: name, mtype: e.mtype, help: helpText(base, e.mtype, meta[base], meta[e.id]), ids: make(map[string]string)}
+			families[name] = f
+		} else if f.mtype != e.mtype {
+			log.Printf("Skipping %s %s in /metrics: %s is a %s", e.mtype, e.id, name, f.mtype)
+			continue
+		}
+		series := promSeries{labels: sanitizeLabels(labels), value: e.value}
+		key := models.JoinID("", series.labels)
+		if other, ok := f.ids[key]; ok {
+			log.Printf("Skipping %s %s in /metrics: same series as %s", e.mtype, e.id, other)
+			continue
+		}
+		f.ids[key] = e.id
+		f.series = append(f.series, series)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		writeFamily(bw, families[name])
+	}
+	if err := bw.Flush(); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeFamily(w *bufio.Writer, f *promFamily) {
+	promType := f.mtype
+	if promType == "set" {
+		promType = "gauge"
+	}
+
+	w.WriteString("# HELP ")
+	w.WriteString(f.name)
+	w.WriteByte(' ')
+	w.WriteString(escapeHelp(f.help))
+	w.WriteString("\n# TYPE ")
+	w.WriteString(f.name)
+	w.WriteByte(' ')
+	w.WriteString(promType)
+	w.WriteByte('\n')
+
+	sort.Slice(f.series, func(i, j int) bool {
+		return models.JoinID("", f.series[i].labels) < models.JoinID("", f.series[j].labels)
+	})
+	for _, s := range f.series {
+		w.WriteString(models.JoinID(f.name, s.labels))
+		w.WriteByte(' ')
+		w.WriteString(s.value)
+		w.WriteByte('\n')
+	}
+}
+
+// helpText prefers metadata registered for the exact series, then for the
+// base name, and falls back to the original metric name. Metadata pinned to
+// another type is ignored.
+func helpText(base, mtype string, metas ...models.Metadata) string {
+	for i := len(metas) - 1; i >= 0; i-- {
+		meta := metas[i]
+		if meta.Description == "" || conflictsWith(meta, mtype) {
+			continue
+		}
+		if meta.Unit != "" {
+			return meta.Description + " (" + meta.Unit + ")"
+		}
+		return meta.Description
+	}
+	return base
+}
+
+func sanitizeLabels(labels []models.Label) []models.Label {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make([]models.Label, 0, len(labels))
+	for _, l := range labels {
+		out = append(out, models.Label{Name: models.SanitizeLabelName(l.Name), Value: l.Value})
+	}
+	return out
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-metrics-and-alerts/internal/middleware"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(ctx, "HeapAlloc", 1024)
+	storage.UpdateGauge(ctx, "cpu.load-1", 0.5)
+	storage.UpdateGauge(ctx, `disk_free{path="/"}`, 10)
+	storage.UpdateGauge(ctx, `disk_free{path="/var"}`, 20)
+	storage.UpdateCounter(ctx, "PollCount", 7)
+	storage.UpdateCounter(ctx, "HeapAlloc", 1)
+	storage.SetMetadata(ctx, models.Metadata{ID: "HeapAlloc", Description: "Heap bytes", Unit: "bytes", MType: models.Gauge})
+	h := New(storage)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	h.PrometheusMetrics(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected content type %s", ct)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"# HELP HeapAlloc Heap bytes (bytes)\n# TYPE HeapAlloc gauge\nHeapAlloc 1024\n",
+		"# HELP HeapAlloc_counter HeapAlloc\n# TYPE HeapAlloc_counter counter\nHeapAlloc_counter 1\n",
+		"# TYPE PollCount counter\nPollCount 7\n",
+		"# TYPE cpu_load_1 gauge\ncpu_load_1 0.5\n",
+		"# TYPE disk_free gauge\ndisk_free{path=\"/\"} 10\ndisk_free{path=\"/var\"} 20\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("Expected output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestPrometheusMetricsSkipsCollisions(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(ctx, "cpu.load", 1)
+	storage.UpdateGauge(ctx, "cpu_load", 2)
+	storage.UpdateGauge(ctx, "hits_counter", 3)
+	storage.UpdateGauge(ctx, "hits", 4)
+	storage.UpdateCounter(ctx, "hits", 5)
+	h := New(storage)
+
+	for range 5 {
+		w := httptest.NewRecorder()
+		h.PrometheusMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+		want := "# HELP cpu_load cpu.load\n# TYPE cpu_load gauge\ncpu_load 1\n" +
+			"# HELP hits hits\n# TYPE hits gauge\nhits 4\n" +
+			"# HELP hits_counter hits_counter\n# TYPE hits_counter gauge\nhits_counter 3\n"
+		if body := w.Body.String(); body != want {
+			t.Fatalf("Expected:\n%s\ngot:\n%s", want, body)
+		}
+	}
+}
+
+func TestPrometheusMetricsThroughGzip(t *testing.T) {
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(context.Background(), "x", 1)
+	h := New(storage)
+
+	r := chi.NewRouter()
+	r.Use(middleware.WithGzip)
+	r.Get("/metrics", h.PrometheusMetrics)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Prometheus always advertises gzip; plain text must stay uncompressed
+	// and free of gzip framing.
+	req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Unexpected content encoding %q", enc)
+	}
+	if want := "# HELP x x\n# TYPE x gauge\nx 1\n"; string(body) != want {
+		t.Fatalf("Expected %q, got %q", want, body)
+	}
+}
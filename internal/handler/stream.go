@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/stream"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+const streamKeepAlive = 15 * time.Second
+
+// Stream serves live metric updates on /api/v1/stream as server-sent events.
+// The optional prefix parameter keeps IDs starting with it and type, which
+// may repeat or hold a comma separated list, keeps those metric types. Each
+// event carries the update as it was applied: the new value of a gauge, the
+// increase of a counter and the estimate of the registers added to a set.
+// A client that falls behind loses updates and is told how many through a
+// "dropped" event.
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	filter := stream.Filter{Prefix: r.URL.Query().Get("prefix")}
+	for _, value := range r.URL.Query()["type"] {
+		for _, mtype := range strings.Split(value, ",") {
+			if mtype = strings.TrimSpace(mtype); mtype == "" {
+				continue
+			}
+			if !isKnownType(mtype) {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+			filter.Types = append(filter.Types, mtype)
+		}
+	}
+
+	sub := h.hub.Subscribe(filter)
+	if sub == nil {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.hub.Unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("Streaming unsupported: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	var seq int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case metric, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if dropped := sub.Dropped(); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			data, err := json.Marshal(metric)
+			if err != nil {
+				log.Printf("Error marshaling stream event: %v", err)
+				continue
+			}
+			seq++
+			fmt.Fprintf(w, "id: %d\nevent: metric\ndata: %s\n\n", seq, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// CloseStreams ends all live streams so server shutdown does not wait on
+// them.
+func (h *Handler) CloseStreams() {
+	h.hub.Close()
+}
+
+// publishUpdates sends the applied updates to stream subscribers, one event
+// per metric: the last gauge value, the summed counter deltas and the
+// estimate of the merged set registers. It publishes the values at hand, so
+// the ingest path never reads storage back for subscribers.
+func (h *Handler) publishUpdates(metrics ...models.Metrics) {
+	if !h.hub.HasSubscribers() {
+		return
+	}
+
+	events := make([]models.Metrics, 0, len(metrics))
+	index := make(map[string]int, len(metrics))
+	sketches := make(map[int]*hll.Sketch)
+	for _, m := range metrics {
+		key := m.MType + ":" + m.ID
+		i, seen := index[key]
+		if !seen {
+			i = len(events)
+			index[key] = i
+			events = append(events, models.Metrics{ID: m.ID, MType: m.MType})
+		}
+		event := &events[i]
+		if m.Timestamp != nil {
+			event.Timestamp = m.Timestamp
+		}
+		switch m.MType {
+		case models.Gauge:
+			if m.Value != nil {
+				value := *m.Value
+				event.Value = &value
+			}
+		case models.Counter:
+			if m.Delta != nil {
+				delta := *m.Delta
+				if event.Delta != nil {
+					delta += *event.Delta
+				}
+				event.Delta = &delta
+			}
+		case models.Set:
+			sketch, err := hll.FromBytes(m.Registers)
+			if err != nil {
+				continue
+			}
+			if merged, ok := sketches[i]; ok {
+				merged.Merge(sketch)
+			} else {
+				sketches[i] = sketch
+			}
+		}
+	}
+	for i, sketch := range sketches {
+		estimate := int64(sketch.Estimate())
+		events[i].Delta = &estimate
+	}
+
+	published := events[:0]
+	for _, event := range events {
+		if event.Value != nil || event.Delta != nil {
+			published = append(published, event)
+		}
+	}
+	h.hub.Publish(published...)
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	t.Helper()
+	var event, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestStreamPublishesFilteredUpdates(t *testing.T) {
+	h := New(repository.NewMemStorage())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/stream", h.Stream)
+	mux.HandleFunc("/update/", h.UpdateMetricJSON)
+	mux.HandleFunc("/updates/", h.UpdateMetricsBatch)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer h.CloseStreams()
+
+	resp, err := http.Get(srv.URL + "/api/v1/stream?prefix=cpu&type=counter,gauge")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !h.hub.HasSubscribers() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	post := func(path, body string) {
+		r, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 from %s, got %d", path, r.StatusCode)
+		}
+	}
+	post("/update/", `{"id":"mem.used","type":"gauge","value":1}`)
+	post("/update/", `{"id":"cpu.ticks","type":"counter","delta":2}`)
+	post("/updates/", `[{"id":"cpu.ticks","type":"counter","delta":3},{"id":"cpu.load","type":"gauge","value":0.5}]`)
+
+	reader := bufio.NewReader(resp.Body)
+	var got []models.Metrics
+	for len(got) < 3 {
+		event, data := readEvent(t, reader)
+		if event != "metric" {
+			t.Fatalf("Unexpected event %q", event)
+		}
+		var m models.Metrics
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		got = append(got, m)
+	}
+
+	if got[0].ID != "cpu.ticks" || *got[0].Delta != 2 {
+		t.Fatalf("Unexpected first event %+v", got[0])
+	}
+	if got[1].ID != "cpu.ticks" || *got[1].Delta != 3 {
+		t.Fatalf("Expected the counter increase 3, got %+v", got[1])
+	}
+	if got[2].ID != "cpu.load" || *got[2].Value != 0.5 {
+		t.Fatalf("Unexpected third event %+v", got[2])
+	}
+}
+
+func TestStreamRejectsUnknownType(t *testing.T) {
+	h := New(repository.NewMemStorage())
+	w := httptest.NewRecorder()
+	h.Stream(w, httptest.NewRequest("GET", "/api/v1/stream?type=histogram", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", w.Code)
+	}
+}
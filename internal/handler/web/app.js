@@ -0,0 +1,205 @@
+(function () {
+  "use strict";
+
+  // Keep as many points per sparkline as the server keeps history.
+  var HISTORY = 120;
+  var SPARK_W = 120;
+  var SPARK_H = 24;
+
+  var metrics = new Map();
+  var sortKey = "id";
+  var sortDir = 1;
+  var renderQueued = false;
+
+  var rows = document.getElementById("rows");
+  var filterInput = document.getElementById("filter");
+  var typeSelect = document.getElementById("type");
+  var statusEl = document.getElementById("status");
+  var countEl = document.getElementById("count");
+
+  function key(m) {
+    return m.type + ":" + m.id;
+  }
+
+  function points(history) {
+    return (history || []).map(function (s) { return s.value; });
+  }
+
+  function setMetric(m) {
+    metrics.set(key(m), {
+      id: m.id,
+      type: m.type,
+      value: m.value,
+      unit: m.unit || "",
+      description: m.description || "",
+      trend: points(m.history).slice(-HISTORY),
+      updated: 0
+    });
+  }
+
+  // Counter history holds increments, so live counter totals are turned
+  // back into increments before they are appended.
+  function applyUpdate(m) {
+    var current = metrics.get(key(m));
+    if (!current) {
+      setMetric(m);
+      current = metrics.get(key(m));
+      current.trend.push(m.value);
+    } else {
+      var point = m.type === "counter" ? m.value - current.value : m.value;
+      current.trend.push(point);
+      if (current.trend.length > HISTORY) {
+        current.trend.shift();
+      }
+      current.value = m.value;
+      if (m.unit) { current.unit = m.unit; }
+      if (m.description) { current.description = m.description; }
+    }
+    current.updated = Date.now();
+  }
+
+  function sparkline(values) {
+    var ns = "http://www.w3.org/2000/svg";
+    var svg = document.createElementNS(ns, "svg");
+    svg.setAttribute("class", "spark");
+    svg.setAttribute("width", SPARK_W);
+    svg.setAttribute("height", SPARK_H);
+    if (values.length < 2) {
+      return svg;
+    }
+    var min = Math.min.apply(null, values);
+    var max = Math.max.apply(null, values);
+    var span = max - min || 1;
+    var step = SPARK_W / (values.length - 1);
+    var coords = values.map(function (v, i) {
+      var y = SPARK_H - 2 - ((v - min) / span) * (SPARK_H - 4);
+      return (i * step).toFixed(1) + "," + y.toFixed(1);
+    });
+    var line = document.createElementNS(ns, "polyline");
+    line.setAttribute("points", coords.join(" "));
+    svg.appendChild(line);
+    return svg;
+  }
+
+  function formatValue(v) {
+    if (Number.isInteger(v)) {
+      return v.toLocaleString();
+    }
+    return v.toLocaleString(undefined, { maximumFractionDigits: 4 });
+  }
+
+  function cell(text, className) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    if (className) {
+      td.className = className;
+    }
+    return td;
+  }
+
+  function compare(a, b) {
+    var x = a[sortKey];
+    var y = b[sortKey];
+    if (typeof x === "number" && typeof y === "number") {
+      return (x - y) * sortDir;
+    }
+    return String(x).localeCompare(String(y)) * sortDir || a.id.localeCompare(b.id);
+  }
+
+  function render() {
+    renderQueued = false;
+    var text = filterInput.value.trim().toLowerCase();
+    var type = typeSelect.value;
+    var now = Date.now();
+
+    var visible = [];
+    metrics.forEach(function (m) {
+      if (type && m.type !== type) { return; }
+      if (text && m.id.toLowerCase().indexOf(text) < 0) { return; }
+      visible.push(m);
+    });
+    visible.sort(compare);
+
+    var fragment = document.createDocumentFragment();
+    visible.forEach(function (m) {
+      var tr = document.createElement("tr");
+      if (now - m.updated < 1000) {
+        tr.className = "flash";
+      }
+      tr.appendChild(cell(m.id));
+      tr.appendChild(cell(m.type));
+      tr.appendChild(cell(formatValue(m.value), "num"));
+      tr.appendChild(cell(m.unit));
+      var trend = document.createElement("td");
+      trend.appendChild(sparkline(m.trend));
+      tr.appendChild(trend);
+      tr.appendChild(cell(m.description, "desc"));
+      fragment.appendChild(tr);
+    });
+    rows.replaceChildren(fragment);
+    countEl.textContent = visible.length + " of " + metrics.size;
+  }
+
+  function scheduleRender() {
+    if (!renderQueued) {
+      renderQueued = true;
+      window.requestAnimationFrame(render);
+    }
+  }
+
+  function setStatus(online) {
+    statusEl.textContent = online ? "live" : "offline";
+    statusEl.className = "status " + (online ? "online" : "offline");
+  }
+
+  var retryDelay = 1000;
+
+  function connect() {
+    var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    var ws = new WebSocket(scheme + location.host + "/api/v1/ws");
+
+    ws.onopen = function () {
+      retryDelay = 1000;
+      setStatus(true);
+    };
+
+    ws.onmessage = function (event) {
+      var msg = JSON.parse(event.data);
+      if (msg.kind === "snapshot") {
+        metrics.clear();
+        (msg.metrics || []).forEach(setMetric);
+      } else if (msg.kind === "update") {
+        (msg.metrics || []).forEach(applyUpdate);
+      } else if (msg.kind === "dropped") {
+        // Some updates were skipped; the next snapshot on reconnect or the
+        // following updates bring the values back in line.
+        console.warn("dashboard: " + msg.dropped + " updates dropped");
+      }
+      scheduleRender();
+    };
+
+    ws.onclose = function () {
+      setStatus(false);
+      window.setTimeout(connect, retryDelay);
+      retryDelay = Math.min(retryDelay * 2, 30000);
+    };
+  }
+
+  document.querySelectorAll("th[data-key]").forEach(function (th) {
+    th.addEventListener("click", function () {
+      var k = th.getAttribute("data-key");
+      sortDir = k === sortKey ? -sortDir : 1;
+      sortKey = k;
+      document.querySelectorAll("th[data-key]").forEach(function (other) {
+        other.classList.remove("asc", "desc");
+      });
+      th.classList.add(sortDir > 0 ? "asc" : "desc");
+      render();
+    });
+  });
+  filterInput.addEventListener("input", render);
+  typeSelect.addEventListener("change", render);
+
+  document.querySelector('th[data-key="id"]').classList.add("asc");
+  connect();
+})();
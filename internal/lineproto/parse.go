@@ -0,0 +1,263 @@
+// Package lineproto parses the InfluxDB line protocol.
+package lineproto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// Field value kinds.
+const (
+	KindFloat = iota
+	KindInteger
+	KindUnsigned
+	KindString
+	KindBoolean
+)
+
+// Field is one field of a point.
+type Field struct {
+	Key  string
+	Kind int
+	// Number holds numeric and boolean values; booleans are 1 or 0.
+	Number float64
+	Int    int64
+	String string
+}
+
+// Point is one parsed line.
+type Point struct {
+	Measurement string
+	Tags        []models.Label
+	Fields      []Field
+	// Timestamp is in Unix milliseconds, or nil when the line has none.
+	Timestamp *int64
+	// Line is the 1-based line number the point was read from.
+	Line int
+}
+
+// LineError reports a line that could not be parsed.
+type LineError struct {
+	Line int    `json:"line"`
+	Err  string `json:"message"`
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// ErrPrecision is returned for unsupported precision values.
+var ErrPrecision = errors.New("lineproto: unsupported precision")
+
+// Parse parses every line of data. Points of valid lines are returned along
+// with errors for the invalid ones, so callers can accept partial writes.
+func Parse(data string, precision string) ([]Point, []LineError, error) {
+	unit, ok := precisions[precision]
+	if !ok {
+		return nil, nil, ErrPrecision
+	}
+
+	var points []Point
+	var lineErrors []LineError
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseLine(line, unit)
+		if err != nil {
+			lineErrors = append(lineErrors, LineError{Line: i + 1, Err: err.Error()})
+			continue
+		}
+		p.Line = i + 1
+		points = append(points, p)
+	}
+	return points, lineErrors, nil
+}
+
+func parseLine(line string, unit time.Duration) (Point, error) {
+	var p Point
+
+	seriesEnd := scanUnescaped(line, 0, " ", false)
+	series := line[:seriesEnd]
+	if seriesEnd >= len(line) {
+		return p, errors.New("missing fields")
+	}
+
+	parts := splitUnescaped(series, ',')
+	p.Measurement = unescape(parts[0])
+	if p.Measurement == "" {
+		return p, errors.New("missing measurement")
+	}
+	for _, tag := range parts[1:] {
+		kv := splitUnescaped(tag, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return p, fmt.Errorf("invalid tag %q", tag)
+		}
+		p.Tags = append(p.Tags, models.Label{Name: unescape(kv[0]), Value: unescape(kv[1])})
+	}
+
+	rest := line[seriesEnd+1:]
+	fieldsEnd := scanUnescaped(rest, 0, " ", true)
+	fieldSet := rest[:fieldsEnd]
+	if fieldSet == "" {
+		return p, errors.New("missing fields")
+	}
+
+	for _, raw := range splitFields(fieldSet) {
+		f, err := parseField(raw)
+		if err != nil {
+			return p, err
+		}
+		p.Fields = append(p.Fields, f)
+	}
+
+	if fieldsEnd < len(rest) {
+		tsText := strings.TrimSpace(rest[fieldsEnd:])
+		ts, err := strconv.ParseInt(tsText, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp %q", tsText)
+		}
+		ms, err := toMillis(ts, unit)
+		if err != nil {
+			return p, err
+		}
+		p.Timestamp = &ms
+	}
+
+	return p, nil
+}
+
+// toMillis converts ts in unit to Unix milliseconds, checking the range
+// instead of overflowing.
+func toMillis(ts int64, unit time.Duration) (int64, error) {
+	if unit < time.Millisecond {
+		return ts / int64(time.Millisecond/unit), nil
+	}
+	scale := int64(unit / time.Millisecond)
+	if ts > math.MaxInt64/scale || ts < math.MinInt64/scale {
+		return 0, fmt.Errorf("timestamp %d is out of range", ts)
+	}
+	return ts * scale, nil
+}
+
+func parseField(raw string) (Field, error) {
+	eq := scanUnescaped(raw, 0, "=", false)
+	if eq <= 0 || eq >= len(raw)-1 {
+		return Field{}, fmt.Errorf("invalid field %q", raw)
+	}
+	f := Field{Key: unescape(raw[:eq])}
+	value := raw[eq+1:]
+
+	switch {
+	case value[0] == '"':
+		if len(value) < 2 || value[len(value)-1] != '"' {
+			return f, fmt.Errorf("unterminated string in field %q", f.Key)
+		}
+		f.Kind = KindString
+		f.String = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+	case strings.HasSuffix(value, "i"):
+		n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid integer in field %q", f.Key)
+		}
+		f.Kind, f.Int, f.Number = KindInteger, n, float64(n)
+	case strings.HasSuffix(value, "u"):
+		n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		// Counters hold int64, so larger values would wrap around.
+		if err != nil || n > math.MaxInt64 {
+			return f, fmt.Errorf("invalid unsigned integer in field %q", f.Key)
+		}
+		f.Kind, f.Int, f.Number = KindUnsigned, int64(n), float64(n)
+	default:
+		switch value {
+		case "t", "T", "true", "True", "TRUE":
+			f.Kind, f.Number = KindBoolean, 1
+		case "f", "F", "false", "False", "FALSE":
+			f.Kind, f.Number = KindBoolean, 0
+		default:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil || strings.ContainsAny(value, "nN") {
+				return f, fmt.Errorf("invalid value in field %q", f.Key)
+			}
+			f.Kind, f.Number = KindFloat, n
+		}
+	}
+	return f, nil
+}
+
+// scanUnescaped returns the index of the first byte of seps not preceded by
+// a backslash, or len(s). With quotes set, separators inside double-quoted
+// strings are skipped.
+func scanUnescaped(s string, from int, seps string, quotes bool) int {
+	inQuotes := false
+	for i := from; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' {
+			i++
+			continue
+		}
+		if quotes && c == '"' {
+			inQuotes = !inQuotes
+			continue
+		}
+		if !inQuotes && strings.IndexByte(seps, c) >= 0 {
+			return i
+		}
+	}
+	return len(s)
+}
+
+func splitUnescaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for {
+		i := scanUnescaped(s, start, string(sep), false)
+		parts = append(parts, s[start:i])
+		if i >= len(s) {
+			return parts
+		}
+		start = i + 1
+	}
+}
+
+func splitFields(s string) []string {
+	var parts []string
+	start := 0
+	for {
+		i := scanUnescaped(s, start, ",", true)
+		parts = append(parts, s[start:i])
+		if i >= len(s) {
+			return parts
+		}
+		start = i + 1
+	}
+}
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package lineproto
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := `cpu,host=server\ 01,region=us-west usage_idle=92.5,usage_user=3i 1700000000000000000
+# comment
+my\,measure,tag\=key=tag\,value str="hello \"world\"",ok=t,big=9223372036854775807u
+weather temp=-1.5e1 1700000000
+
+bad_line
+cpu,host= x=1
+cpu x=1i 12abc
+cpu x=9223372036854775808u`
+
+	points, errs, err := Parse(data, "")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("expected 3 points, got %+v", points)
+	}
+	if len(errs) != 4 || errs[0].Line != 6 || errs[1].Line != 7 || errs[2].Line != 8 || errs[3].Line != 9 {
+		t.Fatalf("unexpected errors %+v", errs)
+	}
+
+	cpu := points[0]
+	if cpu.Measurement != "cpu" || cpu.Tags[0].Value != "server 01" || cpu.Tags[1].Value != "us-west" {
+		t.Fatalf("unexpected cpu point %+v", cpu)
+	}
+	if cpu.Fields[0].Number != 92.5 || cpu.Fields[1].Kind != KindInteger || cpu.Fields[1].Int != 3 {
+		t.Fatalf("unexpected cpu fields %+v", cpu.Fields)
+	}
+	if cpu.Timestamp == nil || *cpu.Timestamp != 1700000000000 {
+		t.Fatalf("unexpected timestamp %v", cpu.Timestamp)
+	}
+
+	escaped := points[1]
+	if escaped.Measurement != "my,measure" || escaped.Tags[0].Name != "tag=key" || escaped.Tags[0].Value != "tag,value" {
+		t.Fatalf("unexpected escaped point %+v", escaped)
+	}
+	if escaped.Fields[0].Kind != KindString || escaped.Fields[0].String != `hello "world"` {
+		t.Fatalf("unexpected string field %+v", escaped.Fields[0])
+	}
+	if escaped.Fields[1].Kind != KindBoolean || escaped.Fields[1].Number != 1 || escaped.Fields[2].Kind != KindUnsigned || escaped.Fields[2].Int != math.MaxInt64 {
+		t.Fatalf("unexpected fields %+v", escaped.Fields)
+	}
+	if escaped.Timestamp != nil {
+		t.Fatalf("expected no timestamp, got %d", *escaped.Timestamp)
+	}
+
+	if w := points[2]; w.Fields[0].Number != -15 || *w.Timestamp != 1700 {
+		t.Fatalf("unexpected weather point %+v", w)
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	points, _, err := Parse("m v=1 1700000000", "s")
+	if err != nil || *points[0].Timestamp != 1700000000000 {
+		t.Fatalf("unexpected result %v %v", points, err)
+	}
+	if _, errs, _ := Parse("m v=1 9223372036854776", "s"); len(errs) != 1 {
+		t.Fatalf("expected an out of range timestamp to be rejected, got %v", errs)
+	}
+	if _, _, err := Parse("m v=1", "h"); err != ErrPrecision {
+		t.Fatalf("expected ErrPrecision, got %v", err)
+	}
+}
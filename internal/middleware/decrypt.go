@@ -32,7 +32,7 @@ func WithDecrypt(key *rsa.PrivateKey) func(http.Handler) http.Handler {
 				return
 			}
 
-			plain, err := decryptPayload(key, data)
+			plain, err := DecryptPayload(key, data)
 			if err != nil {
 				http.Error(w, "Bad request", http.StatusBadRequest)
 				return
@@ -47,7 +47,8 @@ func WithDecrypt(key *rsa.PrivateKey) func(http.Handler) http.Handler {
 	}
 }
 
-func decryptPayload(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+// DecryptPayload reverses the chunked RSA encryption applied by the agent.
+func DecryptPayload(key *rsa.PrivateKey, data []byte) ([]byte, error) {
 	chunkSize := key.Size()
 	if chunkSize == 0 {
 		return nil, fmt.Errorf("invalid key")
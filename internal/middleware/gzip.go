@@ -3,14 +3,12 @@ package middleware
 
 import (
 	"compress/gzip"
-	"io"
 	"net/http"
 	"strings"
 )
 
 type gzipWriter struct {
 	http.ResponseWriter
-	Writer         io.Writer
 	gzipWriter     *gzip.Writer
 	wroteHeader    bool
 	shouldCompress bool
@@ -28,42 +26,70 @@ func (w *gzipWriter) WriteHeader(statusCode int) {
 
 	if w.shouldCompress {
 		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		// The writer is created only for compressed responses, so plain
+		// bodies never get gzip framing appended on Close.
+		gz, err := gzip.NewWriterLevel(w.ResponseWriter, gzip.BestSpeed)
+		if err != nil {
+			w.shouldCompress = false
+			w.Header().Del("Content-Encoding")
+		} else {
+			w.gzipWriter = gz
+		}
 	}
 
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+// close finishes the gzip stream if the response was compressed.
+func (w *gzipWriter) close() error {
+	if w.gzipWriter == nil {
+		return nil
+	}
+	return w.gzipWriter.Close()
+}
+
 func (w *gzipWriter) Write(b []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(200)
 	}
 
 	if w.shouldCompress {
-		return w.Writer.Write(b)
+		return w.gzipWriter.Write(b)
 	}
 	return w.ResponseWriter.Write(b)
 }
 
+// Flush flushes compressed data and the underlying writer, so streaming
+// handlers work behind the middleware.
+func (w *gzipWriter) Flush() error {
+	if w.shouldCompress {
+		if err := w.gzipWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // WithGzip compresses JSON and HTML responses if the client accepts gzip.
 func WithGzip(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// WebSocket upgrades take over the connection and must not be wrapped.
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") ||
+			strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer gz.Close()
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
 
-		next.ServeHTTP(&gzipWriter{
-			ResponseWriter: w,
-			Writer:         gz,
-			gzipWriter:     gz,
-		}, r)
+		next.ServeHTTP(gw, r)
 	})
 }
 
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// Label is a name/value pair attached to a metric series. Labelled series are
+// stored under IDs of the form name{key="value",...}.
+type Label struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// JoinID builds a metric ID from the base name and labels sorted by name.
+func JoinID(name string, labels []Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(EscapeLabelValue(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// SplitID separates a metric ID into its base name and labels. IDs without a
+// well-formed label block are returned unchanged with no labels.
+func SplitID(id string) (string, []Label) {
+	start := strings.IndexByte(id, '{')
+	if start <= 0 || !strings.HasSuffix(id, "}") {
+		return id, nil
+	}
+
+	name := id[:start]
+	body := id[start+1 : len(id)-1]
+	var labels []Label
+
+	for len(body) > 0 {
+		eq := strings.Index(body, `="`)
+		if eq <= 0 {
+			return id, nil
+		}
+		label := Label{Name: body[:eq]}
+		body = body[eq+2:]
+
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(body); i++ {
+			c := body[i]
+			if c == '\\' && i+1 < len(body) {
+				i++
+				switch body[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(body[i])
+				}
+				continue
+			}
+			if c == '"' {
+				body = body[i+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return id, nil
+		}
+		label.Value = value.String()
+		labels = append(labels, label)
+
+		if strings.HasPrefix(body, ",") {
+			body = body[1:]
+		} else if body != "" {
+			return id, nil
+		}
+	}
+
+	return name, labels
+}
+
+// EscapeLabelValue escapes backslashes, quotes and newlines in a label value.
+func EscapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	var b strings.Builder
+	for _, r := range v {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// SanitizeMetricName maps a metric name onto the Prometheus name charset
+// [a-zA-Z_:][a-zA-Z0-9_:]*.
+func SanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// SanitizeLabelName maps a label name onto [a-zA-Z_][a-zA-Z0-9_]* outside the
+// reserved "__" prefix.
+func SanitizeLabelName(name string) string {
+	name = sanitizeName(name, false)
+	if strings.HasPrefix(name, "__") {
+		name = "_" + strings.TrimLeft(name, "_")
+	}
+	return name
+}
+
+func sanitizeName(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(allowColon && r == ':') || (i > 0 && r >= '0' && r <= '9')
+		if !valid && i == 0 && r >= '0' && r <= '9' {
+			b.WriteByte('_')
+			b.WriteRune(r)
+			continue
+		}
+		if !valid {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
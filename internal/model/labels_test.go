@@ -0,0 +1,60 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJoinSplitID(t *testing.T) {
+	labels := []Label{{Name: "path", Value: `C:\tmp "x"`}, {Name: "host", Value: "a"}}
+
+	id := JoinID("disk_free", labels)
+	if id != `disk_free{host="a",path="C:\\tmp \"x\""}` {
+		t.Fatalf("unexpected id %s", id)
+	}
+
+	name, got := SplitID(id)
+	want := []Label{{Name: "host", Value: "a"}, {Name: "path", Value: `C:\tmp "x"`}}
+	if name != "disk_free" || !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected split %s %v", name, got)
+	}
+}
+
+func TestSplitIDWithoutLabels(t *testing.T) {
+	tests := []string{"Alloc", "{x=\"1\"}", `bad{x="1"`, `bad{x=1}`, `bad{x="1"y}`}
+	for _, id := range tests {
+		name, labels := SplitID(id)
+		if name != id || labels != nil {
+			t.Fatalf("expected %q to be unlabelled, got %q %v", id, name, labels)
+		}
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := map[string]string{
+		"Alloc":          "Alloc",
+		"http.requests":  "http_requests",
+		"1st":            "_1st",
+		"ns:metric-name": "ns:metric_name",
+		"":               "_",
+	}
+	for in, want := range tests {
+		if got := SanitizeMetricName(in); got != want {
+			t.Fatalf("sanitize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	tests := map[string]string{
+		"service.name": "service_name",
+		"a:b":          "a_b",
+		"__name__":     "_name__",
+		"9lives":       "_9lives",
+	}
+	for in, want := range tests {
+		if got := SanitizeLabelName(in); got != want {
+			t.Fatalf("SanitizeLabelName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
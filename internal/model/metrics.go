@@ -6,13 +6,38 @@ const (
 	Counter = "counter"
 	// Gauge marks gauge metrics.
 	Gauge = "gauge"
+	// Set marks unique-count metrics backed by a HyperLogLog sketch.
+	Set = "set"
 )
 
 // Metrics encodes a metric payload shared by the agent and the server.
+// Set metrics carry their HyperLogLog registers in Registers; when read back
+// the estimated cardinality is returned in Delta. Timestamp is the optional
+// collection time in Unix milliseconds.
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID        string   `json:"id"`
+	MType     string   `json:"type"`
+	Delta     *int64   `json:"delta,omitempty"`
+	Value     *float64 `json:"value,omitempty"`
+	Registers []byte   `json:"registers,omitempty"`
+	Timestamp *int64   `json:"timestamp,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+}
+
+// Sample is one timestamped value kept in metric history.
+type Sample struct {
+	Timestamp int64   `json:"ts"`
+	Value     float64 `json:"value"`
+}
+
+// Metadata describes a metric: what it measures, its unit, the type updates
+// must use and who reports it. TTL is an optional duration such as "10m"
+// after which the metric is removed when it receives no updates.
+type Metadata struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	MType       string `json:"type,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
 }
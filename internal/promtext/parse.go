@@ -0,0 +1,259 @@
+// Package promtext parses the Prometheus text exposition format and its
+// OpenMetrics successor.
+package promtext
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// Sample is one series value of a metric family.
+type Sample struct {
+	Name   string
+	Labels []models.Label
+	Value  float64
+	// Timestamp is the optional sample time in Unix milliseconds.
+	Timestamp *int64
+}
+
+// Family groups samples described by the same TYPE, HELP and UNIT lines.
+type Family struct {
+	Name    string
+	Type    string
+	Help    string
+	Unit    string
+	Samples []Sample
+}
+
+// familySuffixes lists sample name suffixes that belong to a family of
+// another name, such as histogram buckets or OpenMetrics counter totals.
+var familySuffixes = []string{"_bucket", "_count", "_sum", "_total", "_created", "_gcount", "_gsum", "_info"}
+
+// Parse reads exposition text and returns metric families in input order.
+// OpenMetrics input uses timestamps in seconds and may carry exemplars; the
+// classic format uses millisecond timestamps.
+func Parse(r io.Reader, openMetrics bool) ([]Family, error) {
+	var families []Family
+	index := make(map[string]int)
+
+	family := func(name string) *Family {
+		if i, ok := index[name]; ok {
+			return &families[i]
+		}
+		index[name] = len(families)
+		families = append(families, Family{Name: name, Type: "unknown"})
+		return &families[len(families)-1]
+	}
+
+	current := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 2 {
+				continue
+			}
+			if fields[1] == "EOF" {
+				break
+			}
+			if len(fields) < 3 {
+				continue
+			}
+			text := ""
+			if len(fields) == 4 {
+				text = fields[3]
+			}
+			switch fields[1] {
+			case "TYPE":
+				family(fields[2]).Type = strings.ToLower(text)
+				current = fields[2]
+			case "HELP":
+				family(fields[2]).Help = unescapeHelp(text)
+				current = fields[2]
+			case "UNIT":
+				family(fields[2]).Unit = text
+				current = fields[2]
+			}
+			continue
+		}
+
+		sample, err := parseSample(line, openMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		name := current
+		if !belongsTo(sample.Name, current) {
+			name = sample.Name
+			current = name
+		}
+		f := family(name)
+		f.Samples = append(f.Samples, sample)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+func belongsTo(sampleName, familyName string) bool {
+	if familyName == "" {
+		return false
+	}
+	if sampleName == familyName {
+		return true
+	}
+	if !strings.HasPrefix(sampleName, familyName) {
+		return false
+	}
+	suffix := sampleName[len(familyName):]
+	for _, s := range familySuffixes {
+		if suffix == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSample(line string, openMetrics bool) (Sample, error) {
+	var s Sample
+
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return s, fmt.Errorf("missing value")
+	}
+	s.Name = line[:end]
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return s, err
+		}
+		s.Labels = labels
+		rest = rest[n:]
+	}
+
+	if openMetrics {
+		if i := strings.Index(rest, " # "); i >= 0 {
+			rest = rest[:i]
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("malformed sample %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value %q", fields[0])
+	}
+	s.Value = value
+
+	if len(fields) == 2 {
+		ts, err := parseTimestamp(fields[1], openMetrics)
+		if err != nil {
+			return s, err
+		}
+		s.Timestamp = &ts
+	}
+	return s, nil
+}
+
+// parseLabels reads a {name="value",...} block and returns the number of
+// bytes consumed.
+func parseLabels(in string) ([]models.Label, int, error) {
+	var labels []models.Label
+	i := 1
+	for {
+		for i < len(in) && in[i] == ' ' {
+			i++
+		}
+		if i >= len(in) {
+			return nil, 0, fmt.Errorf("unterminated label set")
+		}
+		if in[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		eq := strings.IndexByte(in[i:], '=')
+		if eq <= 0 {
+			return nil, 0, fmt.Errorf("malformed label")
+		}
+		name := strings.TrimSpace(in[i : i+eq])
+		i += eq + 1
+		if i >= len(in) || in[i] != '"' {
+			return nil, 0, fmt.Errorf("label %s: missing quote", name)
+		}
+		i++
+
+		var value strings.Builder
+		closed := false
+		for ; i < len(in); i++ {
+			c := in[i]
+			if c == '\\' && i+1 < len(in) {
+				i++
+				switch in[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(in[i])
+				}
+				continue
+			}
+			if c == '"' {
+				closed = true
+				i++
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, 0, fmt.Errorf("label %s: unterminated value", name)
+		}
+		labels = append(labels, models.Label{Name: name, Value: value.String()})
+
+		for i < len(in) && in[i] == ' ' {
+			i++
+		}
+		if i < len(in) && in[i] == ',' {
+			i++
+		}
+	}
+}
+
+func parseTimestamp(field string, openMetrics bool) (int64, error) {
+	if openMetrics {
+		sec, err := strconv.ParseFloat(field, 64)
+		if err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return 0, fmt.Errorf("invalid timestamp %q", field)
+		}
+		return int64(math.Round(sec * 1000)), nil
+	}
+	ms, err := strconv.ParseInt(field, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", field)
+	}
+	return ms, nil
+}
+
+func unescapeHelp(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(s)
+}
@@ -0,0 +1,105 @@
+package promtext
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParsePrometheus(t *testing.T) {
+	input := `# HELP http_requests_total Total HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# A normal comment.
+# HELP rpc_duration_seconds A summary.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 33444
+http_request_duration_seconds_bucket{le="+Inf"} 144320
+http_request_duration_seconds_count 144320
+msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9
+metric_without_timestamp_and_labels 12.47
+something_weird{problem="division by zero"} +Inf
+`
+
+	families, err := Parse(strings.NewReader(input), false)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if len(families) != 6 {
+		t.Fatalf("expected 6 families, got %d: %+v", len(families), families)
+	}
+
+	requests := families[0]
+	if requests.Type != "counter" || requests.Help != "Total HTTP requests." || len(requests.Samples) != 2 {
+		t.Fatalf("unexpected family %+v", requests)
+	}
+	if ts := requests.Samples[1].Timestamp; ts == nil || *ts != 1395066363000 || requests.Samples[1].Value != 3 {
+		t.Fatalf("unexpected sample %+v", requests.Samples[1])
+	}
+
+	if summary := families[1]; summary.Type != "summary" || len(summary.Samples) != 3 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if hist := families[2]; hist.Type != "histogram" || len(hist.Samples) != 3 {
+		t.Fatalf("unexpected histogram %+v", hist)
+	}
+
+	msdos := families[3].Samples[0]
+	if msdos.Labels[0].Value != `C:\DIR\FILE.TXT` || msdos.Labels[1].Value != "Cannot find file:\n\"FILE.TXT\"" {
+		t.Fatalf("unexpected labels %+v", msdos.Labels)
+	}
+
+	if weird := families[5].Samples[0]; !math.IsInf(weird.Value, 1) {
+		t.Fatalf("expected +Inf, got %v", weird.Value)
+	}
+}
+
+func TestParseOpenMetrics(t *testing.T) {
+	input := `# TYPE acme_http_router_request_seconds summary
+# UNIT acme_http_router_request_seconds seconds
+acme_http_router_request_seconds_sum{path="/api/v1",method="GET"} 9036.32
+acme_http_router_request_seconds_count{path="/api/v1",method="GET"} 807283.0
+acme_http_router_request_seconds_created{path="/api/v1",method="GET"} 1605281325.0
+# TYPE foo counter
+foo_total 17.0 1520879607.789 # {trace_id="KOO5S4vxi0o"} 0.67
+# EOF
+ignored 1
+`
+
+	families, err := Parse(strings.NewReader(input), true)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(families) != 2 {
+		t.Fatalf("expected 2 families, got %+v", families)
+	}
+	if families[0].Unit != "seconds" || len(families[0].Samples) != 3 {
+		t.Fatalf("unexpected family %+v", families[0])
+	}
+	foo := families[1].Samples[0]
+	if foo.Name != "foo_total" || foo.Value != 17 || foo.Timestamp == nil || *foo.Timestamp != 1520879607789 {
+		t.Fatalf("unexpected sample %+v", foo)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"metric",
+		`metric{a="1" 1`,
+		`metric{a=1} 1`,
+		"metric abc",
+		"metric 1 2 3",
+	}
+	for _, input := range tests {
+		if _, err := Parse(strings.NewReader(input), false); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
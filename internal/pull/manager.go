@@ -0,0 +1,300 @@
+// Package pull scrapes agents that run in pull mode.
+//
+// The manager fetches the snapshot of every target each interval and stores
+// it through the handler like a pushed batch. After every scrape it records
+// whether the target answered in the up{instance="<target>"} gauge.
+//
+// Agents keep counter increases until a snapshot holding them is
+// acknowledged. The manager acknowledges a stored snapshot with the next
+// scrape of its target, and with a final acknowledgement when it stops.
+package pull
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-metrics-and-alerts/internal/handler"
+	models "go-metrics-and-alerts/internal/model"
+)
+
+const (
+	// UpMetric reports whether the last scrape of a target succeeded.
+	UpMetric = "up"
+
+	// snapshotPath, snapshotSeqHeader and ackParam match
+	// agent.SnapshotPath, agent.SnapshotSeqHeader and agent.AckParam.
+	snapshotPath      = "/snapshot"
+	snapshotSeqHeader = "X-Snapshot-Seq"
+	ackParam          = "ack"
+)
+
+// Config lists the agents to scrape.
+type Config struct {
+	// Targets are agent listen addresses, host:port or base URLs.
+	Targets  []string
+	Interval time.Duration
+	// Timeout bounds a single scrape and defaults to the interval.
+	Timeout time.Duration
+	// Key signs snapshot requests and verifies the snapshot signature when
+	// set.
+	Key    string
+	Client *http.Client
+}
+
+// TargetStatus describes the result of the last scrape of a target.
+type TargetStatus struct {
+	Target     string    `json:"target"`
+	Up         bool      `json:"up"`
+	LastScrape time.Time `json:"last_scrape,omitzero"`
+	Duration   float64   `json:"duration_seconds"`
+	Samples    int       `json:"samples"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Manager scrapes the configured targets.
+type Manager struct {
+	cfg Config
+	h   *handler.Handler
+
+	mu      sync.Mutex
+	targets map[string]*TargetStatus
+	// stored holds the sequence number of the last stored snapshot of
+	// each target, acknowledged by the next request.
+	stored map[string]string
+
+	wg sync.WaitGroup
+}
+
+// New creates a manager storing through h.
+func New(h *handler.Handler, cfg Config) *Manager {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 || cfg.Timeout > cfg.Interval {
+		cfg.Timeout = cfg.Interval
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+
+	m := &Manager{cfg: cfg, h: h, targets: make(map[string]*TargetStatus), stored: make(map[string]string)}
+	for _, t := range cfg.Targets {
+		m.targets[t] = &TargetStatus{Target: t}
+	}
+	return m
+}
+
+// Start scrapes every target once per interval until ctx is done. Targets
+// are scraped concurrently, each on its own schedule.
+func (m *Manager) Start(ctx context.Context) {
+	for _, target := range m.cfg.Targets {
+		m.wg.Add(1)
+		go func(target string) {
+			defer m.wg.Done()
+			ticker := time.NewTicker(m.cfg.Interval)
+			defer ticker.Stop()
+			for {
+				m.scrape(ctx, target)
+				select {
+				case <-ctx.Done():
+					m.acknowledge(target)
+					return
+				case <-ticker.C:
+				}
+			}
+		}(target)
+	}
+}
+
+// Wait blocks until all scrape loops have returned.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+// Status lists the targets and the result of their last scrape as JSON.
+func (m *Manager) Status(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(m.Targets())
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// Targets returns the status of every target sorted by target.
+func (m *Manager) Targets() []TargetStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	targets := make([]TargetStatus, 0, len(m.targets))
+	for _, t := range m.targets {
+		targets = append(targets, *t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Target < targets[j].Target })
+	return targets
+}
+
+func (m *Manager) scrape(ctx context.Context, target string) {
+	start := time.Now()
+	samples, err := m.fetchAndStore(ctx, target)
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	status, ok := m.targets[target]
+	if !ok {
+		status = &TargetStatus{Target: target}
+		m.targets[target] = status
+	}
+	wasUp, scraped := status.Up, !status.LastScrape.IsZero()
+	status.LastScrape = start
+	status.Duration = time.Since(start).Seconds()
+	status.Samples = samples
+	status.Up = err == nil
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+	}
+	m.mu.Unlock()
+
+	switch {
+	case err != nil && (wasUp || !scraped):
+		log.Printf("Scrape target %s is down: %v", target, err)
+	case err == nil && !wasUp:
+		log.Printf("Scrape target %s is up", target)
+	}
+
+	value := 0.0
+	if err == nil {
+		value = 1
+	}
+	id := models.JoinID(UpMetric, []models.Label{{Name: "instance", Value: target}})
+	if err := m.h.StoreBatch(ctx, "pull", []models.Metrics{{ID: id, MType: models.Gauge, Value: &value}}); err != nil {
+		log.Printf("Error storing %s: %v", id, err)
+	}
+}
+
+// fetchAndStore scrapes target and stores its snapshot, returning the
+// number of metrics stored.
+func (m *Manager) fetchAndStore(ctx context.Context, target string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+
+	req, err := m.newRequest(ctx, http.MethodGet, target)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := m.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("snapshot returned %d", resp.StatusCode)
+	}
+	if m.cfg.Key != "" && !m.validHash(body, resp.Header.Get("HashSHA256")) {
+		return 0, errors.New("snapshot hash mismatch")
+	}
+
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		return 0, err
+	}
+	if len(metrics) > 0 {
+		if err := m.h.StoreBatch(ctx, "pull:"+target, metrics); err != nil {
+			return 0, err
+		}
+	}
+	if seq := resp.Header.Get(snapshotSeqHeader); seq != "" {
+		m.mu.Lock()
+		m.stored[target] = seq
+		m.mu.Unlock()
+	}
+	return len(metrics), nil
+}
+
+// acknowledge tells target that its last stored snapshot is stored, since
+// no further scrape will.
+func (m *Manager) acknowledge(target string) {
+	m.mu.Lock()
+	_, ok := m.stored[target]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+	defer cancel()
+	req, err := m.newRequest(ctx, http.MethodPost, target)
+	if err != nil {
+		log.Printf("Error acknowledging %s: %v", target, err)
+		return
+	}
+	resp, err := m.cfg.Client.Do(req)
+	if err != nil {
+		log.Printf("Error acknowledging %s: %v", target, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		log.Printf("Error acknowledging %s: agent returned %d", target, resp.StatusCode)
+	}
+}
+
+// newRequest builds a snapshot request acknowledging the last stored
+// snapshot of target, signed over its query when a key is set.
+func (m *Manager) newRequest(ctx context.Context, method, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, snapshotURL(target), nil)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	seq, ok := m.stored[target]
+	m.mu.Unlock()
+	if ok {
+		req.URL.RawQuery = url.Values{ackParam: {seq}}.Encode()
+	}
+	if m.cfg.Key != "" {
+		mac := hmac.New(sha256.New, []byte(m.cfg.Key))
+		mac.Write([]byte(req.URL.RawQuery))
+		req.Header.Set("HashSHA256", hex.EncodeToString(mac.Sum(nil)))
+	}
+	return req, nil
+}
+
+func (m *Manager) validHash(body []byte, header string) bool {
+	want, err := hex.DecodeString(strings.TrimSpace(header))
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(m.cfg.Key))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+func snapshotURL(target string) string {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	return strings.TrimRight(target, "/") + snapshotPath
+}
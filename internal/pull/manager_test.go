@@ -0,0 +1,119 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-metrics-and-alerts/internal/agent"
+	"go-metrics-and-alerts/internal/handler"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+func TestScrapeStoresSnapshotAndMarksTargets(t *testing.T) {
+	ctx := context.Background()
+	a, err := agent.New(&agent.Config{Key: "secret"})
+	if err != nil {
+		t.Fatalf("agent.New: %v", err)
+	}
+	live := httptest.NewServer(http.HandlerFunc(a.Snapshot))
+	defer live.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	storage := repository.NewMemStorage()
+	liveTarget := strings.TrimPrefix(live.URL, "http://")
+	m := New(handler.New(storage), Config{Targets: []string{liveTarget, dead.URL}, Key: "secret"})
+
+	m.scrape(context.Background(), liveTarget)
+	m.scrape(context.Background(), dead.URL)
+
+	if _, ok, _ := storage.GetCounter(ctx, "PollCount"); !ok {
+		t.Fatal("Expected the agent snapshot to be stored")
+	}
+
+	upID := func(target string) string {
+		return models.JoinID(UpMetric, []models.Label{{Name: "instance", Value: target}})
+	}
+	if v, _, _ := storage.GetGauge(ctx, upID(liveTarget)); v != 1 {
+		t.Fatalf("Expected live target up, got %v", v)
+	}
+	if v, ok, _ := storage.GetGauge(ctx, upID(dead.URL)); !ok || v != 0 {
+		t.Fatalf("Expected dead target down, got %v", v)
+	}
+
+	targets := m.Targets()
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(targets))
+	}
+	for _, target := range targets {
+		if target.Target == dead.URL && (target.Up || target.Error == "") {
+			t.Fatalf("Expected an error for the dead target, got %+v", target)
+		}
+		if target.Target == liveTarget && (!target.Up || target.Samples == 0) {
+			t.Fatalf("Expected samples from the live target, got %+v", target)
+		}
+	}
+}
+
+func TestScrapeRejectsUnsignedSnapshot(t *testing.T) {
+	ctx := context.Background()
+	a, err := agent.New(&agent.Config{})
+	if err != nil {
+		t.Fatalf("agent.New: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(a.Snapshot))
+	defer srv.Close()
+
+	storage := repository.NewMemStorage()
+	m := New(handler.New(storage), Config{Targets: []string{srv.URL}, Key: "secret"})
+	m.scrape(context.Background(), srv.URL)
+
+	if _, ok, _ := storage.GetCounter(ctx, "PollCount"); ok {
+		t.Fatal("Unsigned snapshot should not be stored")
+	}
+	if targets := m.Targets(); targets[0].Up {
+		t.Fatal("Expected the target to be down")
+	}
+}
+
+func TestScrapeAcknowledgesStoredSnapshots(t *testing.T) {
+	ctx := context.Background()
+	var acks []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ack := r.URL.Query().Get(ackParam)
+		acks = append(acks, r.Method+" "+ack)
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		delta := int64(5)
+		if ack == "1" {
+			delta = 0
+		}
+		body, _ := json.Marshal([]models.Metrics{{ID: "hits", MType: models.Counter, Delta: &delta}})
+		w.Header().Set(snapshotSeqHeader, strconv.Itoa(len(acks)))
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	storage := repository.NewMemStorage()
+	m := New(handler.New(storage), Config{Targets: []string{srv.URL}})
+	m.scrape(ctx, srv.URL)
+	m.scrape(ctx, srv.URL)
+	m.acknowledge(srv.URL)
+
+	if v, _, _ := storage.GetCounter(ctx, "hits"); v != 5 {
+		t.Fatalf("Expected hits 5, got %d", v)
+	}
+	want := []string{"GET ", "GET 1", "POST 2"}
+	if strings.Join(acks, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected requests %v, got %v", want, acks)
+	}
+}
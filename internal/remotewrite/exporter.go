@@ -0,0 +1,346 @@
+// Package remotewrite forwards accepted samples to Prometheus remote write
+// receivers.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-metrics-and-alerts/api/prompb"
+	models "go-metrics-and-alerts/internal/model"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+)
+
+// Config describes where and how samples are exported.
+type Config struct {
+	URL string
+	// QueueDir holds one durable queue per shard.
+	QueueDir string
+	// Shards is the number of queues sending in parallel. A series always
+	// goes through the same shard, so its samples stay in order.
+	Shards int
+	// BatchSize caps the number of samples per request.
+	BatchSize int
+	// MinBackoff and MaxBackoff bound the delay between retries of a
+	// failed request.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+	// SegmentSize is the size at which queue segment files are rotated.
+	SegmentSize int64
+	Client      *http.Client
+}
+
+// Sample is one value of the metric ID at a Unix millisecond timestamp.
+type Sample struct {
+	ID        string
+	Value     float64
+	Timestamp int64
+	// Suffix is appended to the metric name, to tell the series from one of
+	// another type with the same ID.
+	Suffix string
+}
+
+// Exporter queues samples on disk and sends them in the background. Requests
+// failing with a network error, 5xx or 429 are retried with exponential
+// backoff until they succeed. A request rejected with 400 is split until the
+// rejected series are found, and only those are dropped; other rejections
+// drop the batch, as the remote write spec requires.
+type Exporter struct {
+	cfg    Config
+	queues []*queue
+	wg     sync.WaitGroup
+}
+
+var (
+	// errPermanent marks a batch the receiver will never accept.
+	errPermanent = errors.New("remotewrite: rejected by receiver")
+	// errBadData marks a permanent rejection caused by some of the series.
+	errBadData = errors.New("bad data")
+)
+
+// New opens the shard queues under cfg.QueueDir. Samples left over from a
+// previous run are sent once Start is called.
+func New(cfg Config) (*Exporter, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("remotewrite: URL is required")
+	}
+	if cfg.QueueDir == "" {
+		return nil, errors.New("remotewrite: queue directory is required")
+	}
+	if cfg.Shards <= 0 {
+		cfg.Shards = 4
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 8 << 20
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	e := &Exporter{cfg: cfg}
+	for i := 0; i < cfg.Shards; i++ {
+		q, err := openQueue(filepath.Join(cfg.QueueDir, fmt.Sprintf("shard-%d", i)), cfg.SegmentSize)
+		if err != nil {
+			e.closeQueues()
+			return nil, err
+		}
+		e.queues = append(e.queues, q)
+	}
+	return e, nil
+}
+
+// Start runs one sender per shard until ctx is done.
+func (e *Exporter) Start(ctx context.Context) {
+	for _, q := range e.queues {
+		e.wg.Add(1)
+		go e.run(ctx, q)
+	}
+}
+
+// Wait blocks until the senders stopped and the queues are synced to disk.
+// Samples not yet delivered stay queued for the next start.
+func (e *Exporter) Wait() {
+	e.wg.Wait()
+	e.closeQueues()
+}
+
+// Append queues samples for export.
+func (e *Exporter) Append(samples []Sample) error {
+	records := make([][][]byte, len(e.queues))
+	for _, s := range samples {
+		data, err := proto.Marshal(toTimeSeries(s))
+		if err != nil {
+			return err
+		}
+		shard := e.shardOf(s.ID)
+		records[shard] = append(records[shard], data)
+	}
+
+	for i, recs := range records {
+		if len(recs) == 0 {
+			continue
+		}
+		if err := e.queues[i].push(recs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) shardOf(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(e.queues)))
+}
+
+func (e *Exporter) closeQueues() {
+	for _, q := range e.queues {
+		if err := q.close(); err != nil {
+			log.Printf("remotewrite: closing queue: %v", err)
+		}
+	}
+}
+
+func (e *Exporter) run(ctx context.Context, q *queue) {
+	defer e.wg.Done()
+
+	// The ticker picks up records whose notification was missed, such as
+	// the ones queued before the previous shutdown.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		records, next, err := q.read(e.cfg.BatchSize)
+		if err != nil {
+			log.Printf("remotewrite: reading queue: %v", err)
+		}
+		if len(records) == 0 {
+			if next != q.cursor {
+				q.commit(next)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		req, err := buildRequest(records)
+		if err != nil {
+			log.Printf("remotewrite: dropping undecodable records: %v", err)
+		} else if !e.sendWithBackoff(ctx, req) {
+			return
+		}
+
+		if err := q.commit(next); err != nil {
+			log.Printf("remotewrite: committing queue: %v", err)
+		}
+	}
+}
+
+// sendWithBackoff sends req until it is delivered or permanently rejected.
+// A request rejected for bad data is sent again in halves, so that only the
+// rejected series are dropped. It returns false when ctx ends first.
+func (e *Exporter) sendWithBackoff(ctx context.Context, req *prompb.WriteRequest) bool {
+	backoff := e.cfg.MinBackoff
+	for {
+		err := e.send(ctx, req)
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, errBadData) && len(req.Timeseries) > 1 {
+			half := len(req.Timeseries) / 2
+			return e.sendWithBackoff(ctx, &prompb.WriteRequest{Timeseries: req.Timeseries[:half]}) &&
+				e.sendWithBackoff(ctx, &prompb.WriteRequest{Timeseries: req.Timeseries[half:]})
+		}
+		if errors.Is(err, errPermanent) {
+			log.Printf("remotewrite: dropping %d series: %v", len(req.Timeseries), err)
+			return true
+		}
+
+		log.Printf("remotewrite: send failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > e.cfg.MaxBackoff {
+			backoff = e.cfg.MaxBackoff
+		}
+	}
+}
+
+func (e *Exporter) send(ctx context.Context, req *prompb.WriteRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	httpReq.Header.Set("User-Agent", "go-metrics-and-alerts")
+
+	resp, err := e.cfg.Client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("receiver returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	case resp.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("%w: %w: %s", errPermanent, errBadData, strings.TrimSpace(string(body)))
+	default:
+		return fmt.Errorf("%w: %d %s", errPermanent, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+// buildRequest merges queued single-sample series into one request. The
+// samples of a series are ordered by timestamp, keeping the last queued one
+// of each timestamp, since receivers reject samples out of order.
+func buildRequest(records [][]byte) (*prompb.WriteRequest, error) {
+	req := &prompb.WriteRequest{}
+	index := make(map[string]*prompb.TimeSeries)
+	for _, rec := range records {
+		var ts prompb.TimeSeries
+		if err := proto.Unmarshal(rec, &ts); err != nil {
+			return nil, err
+		}
+		key := seriesKey(ts.Labels)
+		if existing, ok := index[key]; ok {
+			existing.Samples = append(existing.Samples, ts.Samples...)
+			continue
+		}
+		series := &ts
+		index[key] = series
+		req.Timeseries = append(req.Timeseries, series)
+	}
+
+	for _, series := range req.Timeseries {
+		if len(series.Samples) < 2 {
+			continue
+		}
+		sort.SliceStable(series.Samples, func(i, j int) bool {
+			return series.Samples[i].Timestamp < series.Samples[j].Timestamp
+		})
+		samples := series.Samples[:1]
+		for _, sample := range series.Samples[1:] {
+			if last := samples[len(samples)-1]; last.Timestamp == sample.Timestamp {
+				samples[len(samples)-1] = sample
+				continue
+			}
+			samples = append(samples, sample)
+		}
+		series.Samples = samples
+	}
+	return req, nil
+}
+
+func seriesKey(labels []*prompb.Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0)
+		b.WriteString(l.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// toTimeSeries maps a metric ID onto sorted labels with __name__.
+func toTimeSeries(s Sample) *prompb.TimeSeries {
+	base, labels := models.SplitID(s.ID)
+	series := &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: models.SanitizeMetricName(base) + s.Suffix}},
+		Samples: []*prompb.Sample{{Value: s.Value, Timestamp: s.Timestamp}},
+	}
+	for _, l := range labels {
+		series.Labels = append(series.Labels, &prompb.Label{Name: models.SanitizeLabelName(l.Name), Value: l.Value})
+	}
+	sort.Slice(series.Labels, func(i, j int) bool { return series.Labels[i].Name < series.Labels[j].Name })
+	return series
+}
+
+// String describes the exporter for logs.
+func (e *Exporter) String() string {
+	return e.cfg.URL + " (" + strconv.Itoa(len(e.queues)) + " shards)"
+}
@@ -0,0 +1,297 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-metrics-and-alerts/api/prompb"
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver decodes remote write requests and records their samples by series.
+type receiver struct {
+	mu      sync.Mutex
+	failing int32
+	calls   int32
+	samples map[string][]float64
+	got     chan struct{}
+}
+
+func newReceiver() *receiver {
+	return &receiver{samples: make(map[string][]float64), got: make(chan struct{}, 100)}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&rc.calls, 1)
+	if atomic.AddInt32(&rc.failing, -1) >= 0 {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	compressed, _ := io.ReadAll(r.Body)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	rc.mu.Lock()
+	for _, ts := range req.Timeseries {
+		key := ""
+		for _, l := range ts.Labels {
+			key += l.Name + "=" + l.Value + ";"
+		}
+		for _, s := range ts.Samples {
+			rc.samples[key] = append(rc.samples[key], s.Value)
+		}
+	}
+	rc.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+	rc.got <- struct{}{}
+}
+
+func (rc *receiver) wait(t *testing.T, key string, n int) []float64 {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		rc.mu.Lock()
+		values := rc.samples[key]
+		rc.mu.Unlock()
+		if len(values) >= n {
+			return values
+		}
+		select {
+		case <-rc.got:
+		case <-deadline:
+			t.Fatalf("Timed out waiting for %d samples of %s, got %v", n, key, values)
+		}
+	}
+}
+
+func startExporter(t *testing.T, url string) *Exporter {
+	t.Helper()
+	e, err := New(Config{URL: url, QueueDir: t.TempDir(), Shards: 2, MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		e.Wait()
+	})
+	return e
+}
+
+func TestExporterSendsLabelledSeries(t *testing.T) {
+	rc := newReceiver()
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	e := startExporter(t, srv.URL)
+	id := models.JoinID("http.requests", []models.Label{{Name: "method", Value: "GET"}})
+	if err := e.Append([]Sample{{ID: id, Value: 1, Timestamp: 1000}, {ID: id, Value: 2, Timestamp: 2000}}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := rc.wait(t, "__name__=http_requests;method=GET;", 2)
+	if values[0] != 1 || values[1] != 2 {
+		t.Fatalf("Expected samples in order, got %v", values)
+	}
+}
+
+func TestExporterRetriesServerErrors(t *testing.T) {
+	rc := newReceiver()
+	rc.failing = 2
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	e := startExporter(t, srv.URL)
+	e.Append([]Sample{{ID: "load", Value: 0.5, Timestamp: 1000}})
+
+	rc.wait(t, "__name__=load;", 1)
+	if calls := atomic.LoadInt32(&rc.calls); calls != 3 {
+		t.Fatalf("Expected 2 failed attempts and 1 success, got %d calls", calls)
+	}
+}
+
+func TestExporterDropsRejectedBatches(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	e := startExporter(t, srv.URL)
+	e.Append([]Sample{{ID: "load", Value: 0.5, Timestamp: 1000}})
+
+	time.Sleep(200 * time.Millisecond)
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Fatalf("Expected a rejected batch to be sent once, got %d calls", c)
+	}
+}
+
+func TestStorageExportsTotals(t *testing.T) {
+	ctx := context.Background()
+	rc := newReceiver()
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	storage := Wrap(repository.NewMemStorage(), startExporter(t, srv.URL))
+	storage.UpdateCounter(ctx, "hits", 3)
+	// Samples of a series sharing a timestamp are merged, so the totals
+	// need distinct ones.
+	time.Sleep(5 * time.Millisecond)
+	delta := int64(4)
+	value := 7.5
+	ts := int64(5000)
+	storage.UpdateBatch(ctx, []models.Metrics{
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "temp", MType: models.Gauge, Value: &value, Timestamp: &ts},
+	})
+
+	if hits := rc.wait(t, "__name__=hits;", 2); hits[0] != 3 || hits[1] != 11 {
+		t.Fatalf("Expected counter totals 3 and 11, got %v", hits)
+	}
+	if temp := rc.wait(t, "__name__=temp;", 1); temp[0] != 7.5 {
+		t.Fatalf("Expected gauge 7.5, got %v", temp)
+	}
+}
+
+func TestExporterDropsOnlyRejectedSeries(t *testing.T) {
+	rc := newReceiver()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := io.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, compressed)
+		var req prompb.WriteRequest
+		proto.Unmarshal(data, &req)
+		for _, ts := range req.Timeseries {
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" && l.Value == "bad" {
+					http.Error(w, "Bad request", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(compressed))
+		rc.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	e, err := New(Config{URL: srv.URL, QueueDir: t.TempDir(), Shards: 1, MinBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Append([]Sample{{ID: "a", Value: 1, Timestamp: 1000}, {ID: "bad", Value: 2, Timestamp: 1000}, {ID: "c", Value: 3, Timestamp: 1000}})
+	ctx, cancel := context.WithCancel(context.Background())
+	e.Start(ctx)
+	defer func() {
+		cancel()
+		e.Wait()
+	}()
+
+	rc.wait(t, "__name__=a;", 1)
+	rc.wait(t, "__name__=c;", 1)
+}
+
+func TestBuildRequestOrdersSamples(t *testing.T) {
+	var records [][]byte
+	for _, s := range []Sample{
+		{ID: "load", Value: 3, Timestamp: 3000},
+		{ID: "load", Value: 1, Timestamp: 1000},
+		{ID: "load", Value: 2, Timestamp: 3000},
+	} {
+		data, _ := proto.Marshal(toTimeSeries(s))
+		records = append(records, data)
+	}
+
+	req, err := buildRequest(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := req.Timeseries[0].Samples
+	if len(samples) != 2 || samples[0].Timestamp != 1000 || samples[1].Timestamp != 3000 || samples[1].Value != 2 {
+		t.Fatalf("Expected samples at 1000 and 3000 with the last value queued, got %v", samples)
+	}
+}
+
+func TestStorageSuffixesSharedNames(t *testing.T) {
+	ctx := context.Background()
+	rc := newReceiver()
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	storage := Wrap(repository.NewMemStorage(), startExporter(t, srv.URL))
+	storage.UpdateGauge(ctx, "requests", 1.5)
+	storage.UpdateCounter(ctx, "requests", 2)
+
+	if v := rc.wait(t, "__name__=requests;", 1); v[0] != 1.5 {
+		t.Fatalf("Expected the gauge under its own name, got %v", v)
+	}
+	if v := rc.wait(t, "__name__=requests_counter;", 1); v[0] != 2 {
+		t.Fatalf("Expected the counter with a suffix, got %v", v)
+	}
+}
+
+// countingStorage counts the reads of single metrics.
+type countingStorage struct {
+	*repository.MemStorage
+	reads atomic.Int32
+}
+
+func (c *countingStorage) GetGauge(ctx context.Context, name string) (float64, bool, error) {
+	c.reads.Add(1)
+	return c.MemStorage.GetGauge(ctx, name)
+}
+
+func (c *countingStorage) GetCounter(ctx context.Context, name string) (int64, bool, error) {
+	c.reads.Add(1)
+	return c.MemStorage.GetCounter(ctx, name)
+}
+
+func TestStorageExportsWithoutReadingBack(t *testing.T) {
+	ctx := context.Background()
+	rc := newReceiver()
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	mem := &countingStorage{MemStorage: repository.NewMemStorage()}
+	mem.UpdateCounter(ctx, "hits", 10)
+	storage := Wrap(mem, startExporter(t, srv.URL))
+
+	// The stored total is loaded once and the batch decides the suffix.
+	delta, value := int64(3), 1.5
+	storage.UpdateBatch(ctx, []models.Metrics{
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "hits", MType: models.Gauge, Value: &value},
+	})
+
+	if hits := rc.wait(t, "__name__=hits_counter;", 1); hits[0] != 13 {
+		t.Fatalf("Expected the counter total 13, got %v", hits)
+	}
+	if n := mem.reads.Load(); n != 0 {
+		t.Fatalf("Expected no reads of single metrics, got %d", n)
+	}
+}
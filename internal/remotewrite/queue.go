@@ -0,0 +1,302 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor.json"
+	frameHeader   = 8
+	// maxRecordSize bounds a single record so a corrupt length cannot make
+	// the reader allocate arbitrary amounts of memory.
+	maxRecordSize = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// position addresses a record in the queue.
+type position struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// queue is a durable FIFO of records kept in numbered segment files. Each
+// record is framed as a little-endian uint32 length, a CRC-32C of the
+// payload and the payload. The committed read position is stored in a
+// cursor file, so records that were read but not committed are read again
+// after a restart. Segments are synced when they are rotated and when the
+// queue is closed; a crash of the machine may lose unsynced records, a crash
+// of the process does not.
+type queue struct {
+	dir         string
+	segmentSize int64
+
+	// notify receives a value whenever records are pushed.
+	notify chan struct{}
+
+	mu     sync.Mutex
+	w      *os.File
+	wSeg   int64
+	wSize  int64
+	cursor position
+}
+
+func openQueue(dir string, segmentSize int64) (*queue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queue{dir: dir, segmentSize: segmentSize, notify: make(chan struct{}, 1)}
+	if data, err := os.ReadFile(filepath.Join(dir, cursorFile)); err == nil {
+		if err := json.Unmarshal(data, &q.cursor); err != nil {
+			log.Printf("remotewrite: ignoring corrupt cursor in %s: %v", dir, err)
+			q.cursor = position{}
+		}
+	}
+	// The cursor points into the oldest segment still holding undelivered
+	// records; anything else means those records are gone.
+	found := false
+	for _, seg := range segments {
+		if seg >= q.cursor.Segment {
+			if seg != q.cursor.Segment {
+				q.cursor = position{Segment: seg}
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		q.cursor = position{}
+	}
+
+	// Writing always starts in a fresh segment, so a torn record at the end
+	// of the previous one is never followed by new data in the same file.
+	q.wSeg = 1
+	if len(segments) > 0 {
+		q.wSeg = segments[len(segments)-1] + 1
+	}
+	if q.cursor.Segment == 0 {
+		q.cursor.Segment = q.wSeg
+	}
+	if err := q.openSegment(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func listSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (q *queue) segmentPath(n int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", n, segmentSuffix))
+}
+
+func (q *queue) openSegment() error {
+	f, err := os.OpenFile(q.segmentPath(q.wSeg), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	q.w = f
+	q.wSize = 0
+	return nil
+}
+
+// push appends records to the queue.
+func (q *queue) push(records [][]byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.w == nil {
+		return errors.New("remotewrite: queue is closed")
+	}
+
+	for _, rec := range records {
+		if q.wSize >= q.segmentSize {
+			if err := q.w.Sync(); err != nil {
+				return err
+			}
+			q.w.Close()
+			q.wSeg++
+			if err := q.openSegment(); err != nil {
+				q.w = nil
+				return err
+			}
+		}
+
+		frame := make([]byte, frameHeader+len(rec))
+		binary.LittleEndian.PutUint32(frame[0:4], uint32(len(rec)))
+		binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(rec, crcTable))
+		copy(frame[frameHeader:], rec)
+		n, err := q.w.Write(frame)
+		q.wSize += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// read returns up to max records after the committed position and the
+// position following the last of them. A corrupt or truncated record ends
+// its segment; reading continues with the next one.
+func (q *queue) read(max int) ([][]byte, position, error) {
+	q.mu.Lock()
+	pos, wSeg, wSize := q.cursor, q.wSeg, q.wSize
+	q.mu.Unlock()
+
+	var records [][]byte
+	for len(records) < max && pos.Segment <= wSeg {
+		limit := int64(-1)
+		if pos.Segment == wSeg {
+			limit = wSize
+			if pos.Offset >= limit {
+				break
+			}
+		}
+
+		recs, next, err := q.readSegment(pos, limit, max-len(records))
+		records = append(records, recs...)
+		switch {
+		case errors.Is(err, os.ErrNotExist), errors.Is(err, io.EOF):
+			if pos.Segment == wSeg {
+				return records, next, nil
+			}
+			pos = position{Segment: pos.Segment + 1}
+		case err != nil:
+			if pos.Segment == wSeg {
+				return records, next, err
+			}
+			log.Printf("remotewrite: skipping rest of segment %d: %v", pos.Segment, err)
+			pos = position{Segment: pos.Segment + 1}
+		default:
+			pos = next
+		}
+	}
+	return records, pos, nil
+}
+
+// readSegment reads up to max records of one segment starting at pos. It
+// stops at limit when limit is not negative and returns io.EOF at the end of
+// the segment.
+func (q *queue) readSegment(pos position, limit int64, max int) ([][]byte, position, error) {
+	f, err := os.Open(q.segmentPath(pos.Segment))
+	if err != nil {
+		return nil, pos, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return nil, pos, err
+	}
+
+	var records [][]byte
+	header := make([]byte, frameHeader)
+	for len(records) < max {
+		if limit >= 0 && pos.Offset >= limit {
+			return records, pos, nil
+		}
+		if _, err := io.ReadFull(f, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, pos, io.EOF
+			}
+			return records, pos, fmt.Errorf("truncated record header at %d", pos.Offset)
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return records, pos, fmt.Errorf("record of %d bytes at %d", size, pos.Offset)
+		}
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(f, rec); err != nil {
+			return records, pos, fmt.Errorf("truncated record at %d", pos.Offset)
+		}
+		if crc32.Checksum(rec, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return records, pos, fmt.Errorf("checksum mismatch at %d", pos.Offset)
+		}
+		records = append(records, rec)
+		pos.Offset += frameHeader + int64(size)
+	}
+	return records, pos, nil
+}
+
+// commit marks everything before pos as delivered and removes segments that
+// are no longer needed.
+func (q *queue) commit(pos position) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.dir, cursorFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, cursorFile)); err != nil {
+		return err
+	}
+
+	for seg := q.cursor.Segment; seg < pos.Segment; seg++ {
+		if err := os.Remove(q.segmentPath(seg)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("remotewrite: removing segment %d: %v", seg, err)
+		}
+	}
+	q.cursor = pos
+	return nil
+}
+
+// close syncs and closes the segment being written.
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.w == nil {
+		return nil
+	}
+	err := q.w.Sync()
+	if cerr := q.w.Close(); err == nil {
+		err = cerr
+	}
+	q.w = nil
+	return err
+}
@@ -0,0 +1,274 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+// Storage exports every accepted update of the wrapped repository. Counters
+// are exported as their running total and sets as their estimated
+// cardinality, which is what a Prometheus scrape of /metrics reports. Like
+// there, a counter sharing its ID with a gauge is exported with a "_counter"
+// suffix, and a set sharing it with a gauge or counter with a "_set" one.
+//
+// Totals and names are kept in memory, loaded with one bulk read before the
+// first write and then updated from the writes, so exporting costs no
+// storage reads and the exported totals of a counter never go backwards.
+type Storage struct {
+	repository.Repository
+	exporter *Exporter
+
+	mu       sync.Mutex
+	loaded   bool
+	gauges   map[string]struct{}
+	counters map[string]int64
+	sets     map[string]*hll.Sketch
+}
+
+// Wrap returns repo with its updates forwarded to e.
+func Wrap(repo repository.Repository, e *Exporter) *Storage {
+	return &Storage{Repository: repo, exporter: e}
+}
+
+func (s *Storage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	loaded := s.load(ctx)
+	if err := s.Repository.UpdateGauge(ctx, name, value); err != nil {
+		return err
+	}
+	if loaded {
+		s.export([]models.Metrics{{ID: name, MType: models.Gauge, Value: &value}})
+	}
+	return nil
+}
+
+func (s *Storage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	loaded := s.load(ctx)
+	if err := s.Repository.UpdateCounter(ctx, name, value); err != nil {
+		return err
+	}
+	if loaded {
+		s.export([]models.Metrics{{ID: name, MType: models.Counter, Delta: &value}})
+	}
+	return nil
+}
+
+func (s *Storage) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	loaded := s.load(ctx)
+	if err := s.Repository.UpdateSet(ctx, name, registers); err != nil {
+		return err
+	}
+	if loaded {
+		s.export([]models.Metrics{{ID: name, MType: models.Set, Registers: registers}})
+	}
+	return nil
+}
+
+// UpdateBatch exports every gauge sample of the batch at its own timestamp
+// and the resulting total of each counter and set once.
+func (s *Storage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	loaded := s.load(ctx)
+	if err := s.Repository.UpdateBatch(ctx, metrics); err != nil {
+		return err
+	}
+	if loaded {
+		s.export(metrics)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	found, err := s.Repository.DeleteMetric(ctx, mtype, name)
+	if err != nil {
+		return found, err
+	}
+	s.mu.Lock()
+	s.forget(mtype, name)
+	s.mu.Unlock()
+	return found, nil
+}
+
+func (s *Storage) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	if err := s.Repository.RenameMetric(ctx, mtype, from, to); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		return nil
+	}
+	switch mtype {
+	case models.Gauge:
+		if _, ok := s.gauges[from]; ok {
+			s.gauges[to] = struct{}{}
+		}
+	case models.Counter:
+		if total, ok := s.counters[from]; ok {
+			s.counters[to] = total
+		}
+	case models.Set:
+		if sketch, ok := s.sets[from]; ok {
+			s.sets[to] = sketch
+		}
+	}
+	s.forget(mtype, from)
+	return nil
+}
+
+// export applies stored metrics to the totals and queues their samples.
+func (s *Storage) export(metrics []models.Metrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	samples := make([]Sample, 0, len(metrics))
+	changed := make(map[string]bool)
+	var order []models.Metrics
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Gauge:
+			if m.Value == nil {
+				continue
+			}
+			s.gauges[m.ID] = struct{}{}
+			ts := now
+			if m.Timestamp != nil {
+				ts = *m.Timestamp
+			}
+			samples = append(samples, Sample{ID: m.ID, Value: *m.Value, Timestamp: ts})
+			continue
+		case models.Counter:
+			if m.Delta == nil {
+				continue
+			}
+			s.counters[m.ID] += *m.Delta
+		case models.Set:
+			other, err := hll.FromBytes(m.Registers)
+			if err != nil {
+				continue
+			}
+			sketch, ok := s.sets[m.ID]
+			if !ok {
+				sketch = hll.New()
+				s.sets[m.ID] = sketch
+			}
+			sketch.Merge(other)
+		default:
+			continue
+		}
+		if key := m.MType + ":" + m.ID; !changed[key] {
+			changed[key] = true
+			order = append(order, m)
+		}
+	}
+
+	// Counters and sets are exported once per batch, after the gauges of
+	// the batch are known for their suffixes.
+	for _, m := range order {
+		sample := Sample{ID: m.ID, Timestamp: now, Suffix: s.suffix(m.MType, m.ID)}
+		if m.MType == models.Counter {
+			sample.Value = float64(s.counters[m.ID])
+		} else {
+			sample.Value = float64(s.sets[m.ID].Estimate())
+		}
+		samples = append(samples, sample)
+	}
+	s.append(samples)
+}
+
+// load reads the stored names and totals unless they are loaded, and
+// reports whether they are. Every update calls it before it writes, so no
+// write is in flight while the totals are read and none is counted twice.
+// Updates that find the totals unloaded are stored without export.
+func (s *Storage) load(ctx context.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded {
+		return true
+	}
+	if err := s.read(ctx); err != nil {
+		log.Printf("remotewrite: %v", err)
+		return false
+	}
+	s.loaded = true
+	return true
+}
+
+// read loads the stored names and totals. It must be called with mu held.
+func (s *Storage) read(ctx context.Context) error {
+	gauges, err := s.Repository.GetAllGauges(ctx)
+	if err != nil {
+		return fmt.Errorf("loading gauges: %w", err)
+	}
+	counters, err := s.Repository.GetAllCounters(ctx)
+	if err != nil {
+		return fmt.Errorf("loading counters: %w", err)
+	}
+	sets, err := s.Repository.GetAllSets(ctx)
+	if err != nil {
+		return fmt.Errorf("loading sets: %w", err)
+	}
+
+	s.gauges = make(map[string]struct{}, len(gauges))
+	for id := range gauges {
+		s.gauges[id] = struct{}{}
+	}
+	s.counters = make(map[string]int64, len(counters))
+	for id, total := range counters {
+		s.counters[id] = total
+	}
+	s.sets = make(map[string]*hll.Sketch, len(sets))
+	for id, registers := range sets {
+		if sketch, err := hll.FromBytes(registers); err == nil {
+			s.sets[id] = sketch
+		}
+	}
+	return nil
+}
+
+// forget drops a deleted metric. It must be called with mu held.
+func (s *Storage) forget(mtype, name string) {
+	if !s.loaded {
+		return
+	}
+	switch mtype {
+	case models.Gauge:
+		delete(s.gauges, name)
+	case models.Counter:
+		delete(s.counters, name)
+	case models.Set:
+		delete(s.sets, name)
+	}
+}
+
+// suffix returns the name suffix of a counter or set with the given ID: its
+// type when a gauge, or for a set a counter, has the same ID. It must be
+// called with mu held.
+func (s *Storage) suffix(mtype, name string) string {
+	if _, ok := s.gauges[name]; ok {
+		return "_" + mtype
+	}
+	if mtype == models.Set {
+		if _, ok := s.counters[name]; ok {
+			return "_" + mtype
+		}
+	}
+	return ""
+}
+
+// append queues samples. The update is already stored, so a queue failure
+// only loses the export.
+func (s *Storage) append(samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	if err := s.exporter.Append(samples); err != nil {
+		log.Printf("remotewrite: queueing %d samples: %v", len(samples), err)
+	}
+}
@@ -0,0 +1,453 @@
+package repository
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltGauges   = []byte("gauges")
+	boltCounters = []byte("counters")
+	boltSets     = []byte("sets")
+	boltMetadata = []byte("metadata")
+	boltHistory  = []byte("history")
+)
+
+// sampleSize is the encoded size of one history sample: a big-endian
+// timestamp followed by the float64 bits of the value.
+const sampleSize = 16
+
+// BoltStorage keeps metrics in a single bbolt file. Every update is its own
+// transaction and is synced to disk before it returns, so nothing is lost
+// on a crash and no separate database server is needed. It also stores the
+// samples of a History.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens or creates the database file at path. The file is
+// locked while open; a second process waits up to a second and then fails.
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltGauges, boltCounters, boltSets, boltMetadata, boltHistory} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// Close closes the database file.
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
+
+// UpdateGauge stores the gauge value.
+func (b *BoltStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		return putBoltGauge(tx, name, value)
+	})
+}
+
+// UpdateCounter adds the delta to the stored counter.
+func (b *BoltStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		return addBoltCounter(tx, name, value)
+	})
+}
+
+// UpdateSet unions the HyperLogLog registers into the stored set.
+func (b *BoltStorage) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	sketch, err := hll.FromBytes(registers)
+	if err != nil {
+		return err
+	}
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		return mergeBoltSet(tx, name, sketch)
+	})
+}
+
+// GetGauge fetches a gauge value by name.
+func (b *BoltStorage) GetGauge(ctx context.Context, name string) (float64, bool, error) {
+	var value float64
+	var found bool
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltGauges).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		found = true
+		value = math.Float64frombits(binary.BigEndian.Uint64(data))
+		return nil
+	})
+	return value, found, err
+}
+
+// GetCounter fetches a counter value by name.
+func (b *BoltStorage) GetCounter(ctx context.Context, name string) (int64, bool, error) {
+	var value int64
+	var found bool
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltCounters).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		found = true
+		value = int64(binary.BigEndian.Uint64(data))
+		return nil
+	})
+	return value, found, err
+}
+
+// GetSet fetches the set registers by name.
+func (b *BoltStorage) GetSet(ctx context.Context, name string) ([]byte, bool, error) {
+	var registers []byte
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		if data := tx.Bucket(boltSets).Get([]byte(name)); data != nil {
+			// Values are only valid inside the transaction.
+			registers = append([]byte(nil), data...)
+		}
+		return nil
+	})
+	return registers, registers != nil, err
+}
+
+// GetAllGauges returns every stored gauge.
+func (b *BoltStorage) GetAllGauges(ctx context.Context) (map[string]float64, error) {
+	result := make(map[string]float64)
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltGauges).ForEach(func(k, v []byte) error {
+			result[string(k)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetAllCounters returns every stored counter.
+func (b *BoltStorage) GetAllCounters(ctx context.Context) (map[string]int64, error) {
+	result := make(map[string]int64)
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCounters).ForEach(func(k, v []byte) error {
+			result[string(k)] = int64(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetAllSets returns the registers of every stored set.
+func (b *BoltStorage) GetAllSets(ctx context.Context) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSets).ForEach(func(k, v []byte) error {
+			result[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateBatch applies all updates inside a single transaction.
+func (b *BoltStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		for _, metric := range metrics {
+			switch metric.MType {
+			case "gauge":
+				if metric.Value != nil {
+					if err := putBoltGauge(tx, metric.ID, *metric.Value); err != nil {
+						return err
+					}
+				}
+			case "counter":
+				if metric.Delta != nil {
+					if err := addBoltCounter(tx, metric.ID, *metric.Delta); err != nil {
+						return err
+					}
+				}
+			case "set":
+				sketch, err := hll.FromBytes(metric.Registers)
+				if err != nil {
+					return err
+				}
+				if err := mergeBoltSet(tx, metric.ID, sketch); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// SetMetadata stores the metric metadata.
+func (b *BoltStorage) SetMetadata(ctx context.Context, meta models.Metadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetadata).Put([]byte(meta.ID), data)
+	})
+}
+
+// GetMetadata fetches the metric metadata by name.
+func (b *BoltStorage) GetMetadata(ctx context.Context, name string) (models.Metadata, bool, error) {
+	var meta models.Metadata
+	var found bool
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltMetadata).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &meta)
+	})
+	if err != nil || !found {
+		return models.Metadata{}, false, err
+	}
+	return meta, true, nil
+}
+
+// GetAllMetadata returns every stored metadata record.
+func (b *BoltStorage) GetAllMetadata(ctx context.Context) (map[string]models.Metadata, error) {
+	result := make(map[string]models.Metadata)
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetadata).ForEach(func(k, v []byte) error {
+			var meta models.Metadata
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return fmt.Errorf("metadata %s: %w", k, err)
+			}
+			result[meta.ID] = meta
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteMetric removes the metric and the metadata pinned to its type.
+func (b *BoltStorage) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	bucket := boltBucket(mtype)
+	if bucket == nil {
+		return false, nil
+	}
+	var found bool
+	err := b.update(ctx, func(tx *bolt.Tx) error {
+		metrics := tx.Bucket(bucket)
+		found = metrics.Get([]byte(name)) != nil
+		if err := metrics.Delete([]byte(name)); err != nil {
+			return err
+		}
+		return deletePinnedMetadata(tx, mtype, name)
+	})
+	return found, err
+}
+
+// RenameMetric moves the metric, and the metadata pinned to its type, from
+// one name to another.
+func (b *BoltStorage) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	bucket := boltBucket(mtype)
+	if bucket == nil {
+		return ErrMetricNotFound
+	}
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		metrics := tx.Bucket(bucket)
+		value := metrics.Get([]byte(from))
+		if value == nil {
+			return ErrMetricNotFound
+		}
+		if metrics.Get([]byte(to)) != nil {
+			return ErrMetricExists
+		}
+		// Values are only valid until the next modification.
+		value = append([]byte(nil), value...)
+		if err := metrics.Put([]byte(to), value); err != nil {
+			return err
+		}
+		if err := metrics.Delete([]byte(from)); err != nil {
+			return err
+		}
+
+		metadata := tx.Bucket(boltMetadata)
+		data := metadata.Get([]byte(from))
+		if data == nil {
+			return nil
+		}
+		var meta models.Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("metadata %s: %w", from, err)
+		}
+		if meta.MType != mtype {
+			return nil
+		}
+		meta.ID = to
+		moved, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := metadata.Put([]byte(to), moved); err != nil {
+			return err
+		}
+		return metadata.Delete([]byte(from))
+	})
+}
+
+// SaveSamples replaces the stored history samples of every key in samples
+// in one transaction. No samples delete the key.
+func (b *BoltStorage) SaveSamples(samples map[string][]models.Sample) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltHistory)
+		for key, list := range samples {
+			if len(list) == 0 {
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			data := make([]byte, len(list)*sampleSize)
+			for i, s := range list {
+				binary.BigEndian.PutUint64(data[i*sampleSize:], uint64(s.Timestamp))
+				binary.BigEndian.PutUint64(data[i*sampleSize+8:], math.Float64bits(s.Value))
+			}
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadSamples returns every stored history keyed as saved.
+func (b *BoltStorage) LoadSamples() (map[string][]models.Sample, error) {
+	result := make(map[string][]models.Sample)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltHistory).ForEach(func(k, v []byte) error {
+			if len(v)%sampleSize != 0 {
+				return fmt.Errorf("history %s: invalid length %d", k, len(v))
+			}
+			samples := make([]models.Sample, len(v)/sampleSize)
+			for i := range samples {
+				samples[i] = models.Sample{
+					Timestamp: int64(binary.BigEndian.Uint64(v[i*sampleSize:])),
+					Value:     math.Float64frombits(binary.BigEndian.Uint64(v[i*sampleSize+8:])),
+				}
+			}
+			result[string(k)] = samples
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// update runs fn in a write transaction unless ctx is already done. A
+// transaction cannot be interrupted once it has started.
+func (b *BoltStorage) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(fn)
+}
+
+func (b *BoltStorage) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.View(fn)
+}
+
+// boltBucket returns the bucket of the metric type, or nil for an unknown
+// type.
+func boltBucket(mtype string) []byte {
+	switch mtype {
+	case models.Gauge:
+		return boltGauges
+	case models.Counter:
+		return boltCounters
+	case models.Set:
+		return boltSets
+	}
+	return nil
+}
+
+func deletePinnedMetadata(tx *bolt.Tx, mtype, name string) error {
+	metadata := tx.Bucket(boltMetadata)
+	data := metadata.Get([]byte(name))
+	if data == nil {
+		return nil
+	}
+	var meta models.Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("metadata %s: %w", name, err)
+	}
+	if meta.MType != mtype {
+		return nil
+	}
+	return metadata.Delete([]byte(name))
+}
+
+func putBoltGauge(tx *bolt.Tx, name string, value float64) error {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], math.Float64bits(value))
+	return tx.Bucket(boltGauges).Put([]byte(name), data[:])
+}
+
+func addBoltCounter(tx *bolt.Tx, name string, delta int64) error {
+	bucket := tx.Bucket(boltCounters)
+	var total int64
+	if data := bucket.Get([]byte(name)); data != nil {
+		if len(data) != 8 {
+			return errors.New("corrupt counter " + name)
+		}
+		total = int64(binary.BigEndian.Uint64(data))
+	}
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(total+delta))
+	return bucket.Put([]byte(name), data[:])
+}
+
+func mergeBoltSet(tx *bolt.Tx, name string, sketch *hll.Sketch) error {
+	bucket := tx.Bucket(boltSets)
+	if data := bucket.Get([]byte(name)); data != nil {
+		stored, err := hll.FromBytes(data)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", name, err)
+		}
+		stored.Merge(sketch)
+		sketch = stored
+	}
+	return bucket.Put([]byte(name), sketch.Bytes())
+}
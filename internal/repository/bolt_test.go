@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+func openBolt(t *testing.T, path string) *BoltStorage {
+	t.Helper()
+	b, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return b
+}
+
+func TestBoltStorageSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	b := openBolt(t, path)
+
+	b.UpdateGauge(ctx, "load", 0.5)
+	b.UpdateCounter(ctx, "hits", 3)
+	b.UpdateCounter(ctx, "hits", 4)
+	sketch := hll.New()
+	sketch.AddString("alice")
+	b.UpdateSet(ctx, "users", sketch.Bytes())
+	b.SetMetadata(ctx, models.Metadata{ID: "load", Unit: "percent", MType: models.Gauge})
+
+	value, delta := 1.5, int64(5)
+	err := b.UpdateBatch(ctx, []models.Metrics{
+		{ID: "temp", MType: models.Gauge, Value: &value},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+	})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = openBolt(t, path)
+	defer b.Close()
+	if v, ok, _ := b.GetGauge(ctx, "load"); !ok || v != 0.5 {
+		t.Fatalf("Expected load 0.5, got %v", v)
+	}
+	if v, ok, _ := b.GetCounter(ctx, "hits"); !ok || v != 12 {
+		t.Fatalf("Expected hits 12, got %d", v)
+	}
+	registers, ok, _ := b.GetSet(ctx, "users")
+	if !ok {
+		t.Fatal("Expected the set to be stored")
+	}
+	restored, err := hll.FromBytes(registers)
+	if err != nil || restored.Estimate() != 1 {
+		t.Fatalf("Expected one user, got %v", err)
+	}
+	if meta, ok, _ := b.GetMetadata(ctx, "load"); !ok || meta.Unit != "percent" {
+		t.Fatalf("Expected load metadata, got %+v", meta)
+	}
+	gauges, err := b.GetAllGauges(ctx)
+	if err != nil || len(gauges) != 2 || gauges["temp"] != 1.5 {
+		t.Fatalf("Expected two gauges, got %v %v", gauges, err)
+	}
+	if _, ok, _ := b.GetGauge(ctx, "missing"); ok {
+		t.Fatal("Expected missing gauge to be absent")
+	}
+}
+
+func TestBoltStorageHistorySurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	b := openBolt(t, path)
+	h, err := LoadHistory(2, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Insert(models.Gauge, "load", models.Sample{Timestamp: 10, Value: 1})
+	h.Insert(models.Gauge, "load", models.Sample{Timestamp: 30, Value: 3})
+	h.Insert(models.Gauge, "load", models.Sample{Timestamp: 20, Value: 2})
+	b.Close()
+
+	b = openBolt(t, path)
+	defer b.Close()
+	h, err = LoadHistory(2, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := h.Get(models.Gauge, "load")
+	if len(got) != 2 || got[0].Timestamp != 20 || got[1].Value != 3 {
+		t.Fatalf("Expected samples at 20 and 30, got %+v", got)
+	}
+}
+
+func TestBoltStorageCancelledContext(t *testing.T) {
+	b := openBolt(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.UpdateGauge(ctx, "load", 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, _, err := b.GetGauge(ctx, "load"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestBoltStorageDeleteAndRename(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	b := openBolt(t, path)
+
+	b.UpdateGauge(ctx, "load", 0.5)
+	b.UpdateGauge(ctx, "taken", 1)
+	b.UpdateCounter(ctx, "hits", 3)
+	b.SetMetadata(ctx, models.Metadata{ID: "load", MType: models.Gauge, Unit: "percent"})
+
+	if err := b.RenameMetric(ctx, models.Gauge, "load", "taken"); !errors.Is(err, ErrMetricExists) {
+		t.Fatalf("Expected ErrMetricExists, got %v", err)
+	}
+	if err := b.RenameMetric(ctx, models.Gauge, "load", "cpu"); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := b.DeleteMetric(ctx, models.Counter, "hits"); err != nil || !found {
+		t.Fatalf("Expected hits to be deleted, got %v", err)
+	}
+	b.Close()
+
+	b = openBolt(t, path)
+	defer b.Close()
+	if v, ok, _ := b.GetGauge(ctx, "cpu"); !ok || v != 0.5 {
+		t.Fatalf("Expected cpu 0.5, got %v", v)
+	}
+	if _, ok, _ := b.GetGauge(ctx, "load"); ok {
+		t.Fatal("Expected load to be renamed")
+	}
+	if meta, ok, _ := b.GetMetadata(ctx, "cpu"); !ok || meta.Unit != "percent" {
+		t.Fatalf("Expected the metadata to move, got %+v", meta)
+	}
+	if _, ok, _ := b.GetCounter(ctx, "hits"); ok {
+		t.Fatal("Expected hits to stay deleted")
+	}
+}
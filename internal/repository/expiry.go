@@ -0,0 +1,299 @@
+package repository
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// DefaultExpiryInterval is how often an Expiring looks for expired metrics.
+const DefaultExpiryInterval = time.Minute
+
+// ExpiryConfig configures an Expiring.
+type ExpiryConfig struct {
+	// TTL expires metrics without a TTL of their own in the metadata. Zero
+	// keeps them forever.
+	TTL time.Duration
+	// Interval is the time between checks.
+	Interval time.Duration
+	// OnDelete, if set, is called for every expired metric, e.g. to drop
+	// its history.
+	OnDelete func(mtype, name string)
+}
+
+// Expiring deletes metrics that received no update within their TTL: the
+// TTL of their metadata or, failing that, the configured one. Update times
+// are kept in memory, so after a restart every stored metric gets a full TTL
+// from the first check.
+type Expiring struct {
+	Repository
+	cfg ExpiryConfig
+
+	mu      sync.Mutex
+	updated map[string]time.Time
+	// deleting holds the metrics Expire is deleting. Updates of them wait
+	// for the channel to close, so the delete cannot drop them.
+	deleting map[string]chan struct{}
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewExpiring wraps repo and starts the periodic check.
+func NewExpiring(repo Repository, cfg ExpiryConfig) *Expiring {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultExpiryInterval
+	}
+	e := &Expiring{
+		Repository: repo,
+		cfg:        cfg,
+		updated:    make(map[string]time.Time),
+		deleting:   make(map[string]chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go e.expireLoop()
+	return e
+}
+
+func (e *Expiring) expireLoop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case now := <-ticker.C:
+			n, err := e.Expire(context.Background(), now)
+			if err != nil {
+				log.Printf("expiry: %v", err)
+			}
+			if n > 0 {
+				log.Printf("expiry: deleted %d metrics", n)
+			}
+		}
+	}
+}
+
+// Close stops the periodic check.
+func (e *Expiring) Close() {
+	e.closeOnce.Do(func() {
+		close(e.stop)
+		<-e.done
+	})
+}
+
+// Expire deletes the metrics that expired by now and returns how many.
+func (e *Expiring) Expire(ctx context.Context, now time.Time) (int, error) {
+	metadata, err := e.Repository.GetAllMetadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if e.cfg.TTL <= 0 && !hasTTL(metadata) {
+		return 0, nil
+	}
+	names, err := e.names(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, m := range names {
+		ttl := e.cfg.TTL
+		if meta, ok := metadata[m.ID]; ok && meta.TTL != "" && (meta.MType == "" || meta.MType == m.MType) {
+			d, err := time.ParseDuration(meta.TTL)
+			if err != nil {
+				log.Printf("expiry: invalid TTL %q of %s", meta.TTL, m.ID)
+			} else {
+				ttl = d
+			}
+		}
+		if ttl <= 0 {
+			continue
+		}
+
+		key := m.MType + ":" + m.ID
+		e.mu.Lock()
+		last, seen := e.updated[key]
+		if !seen {
+			e.updated[key] = now
+		}
+		e.mu.Unlock()
+		if !seen || now.Sub(last) < ttl {
+			continue
+		}
+
+		// An update may have arrived since the check, so the metric is
+		// checked again, and its updates wait until it is deleted.
+		e.mu.Lock()
+		if !e.updated[key].Equal(last) {
+			e.mu.Unlock()
+			continue
+		}
+		done := make(chan struct{})
+		e.deleting[key] = done
+		e.mu.Unlock()
+
+		_, err := e.Repository.DeleteMetric(ctx, m.MType, m.ID)
+		if err == nil && e.cfg.OnDelete != nil {
+			e.cfg.OnDelete(m.MType, m.ID)
+		}
+
+		e.mu.Lock()
+		delete(e.deleting, key)
+		if err == nil {
+			delete(e.updated, key)
+		}
+		e.mu.Unlock()
+		close(done)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// names lists every stored metric.
+func (e *Expiring) names(ctx context.Context) ([]models.Metrics, error) {
+	gauges, err := e.Repository.GetAllGauges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := e.Repository.GetAllCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := e.Repository.GetAllSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]models.Metrics, 0, len(gauges)+len(counters)+len(sets))
+	for id := range gauges {
+		names = append(names, models.Metrics{ID: id, MType: models.Gauge})
+	}
+	for id := range counters {
+		names = append(names, models.Metrics{ID: id, MType: models.Counter})
+	}
+	for id := range sets {
+		names = append(names, models.Metrics{ID: id, MType: models.Set})
+	}
+	return names, nil
+}
+
+// touch records the update time before the update is stored, so Expire
+// never deletes a metric whose update it has not seen. It returns the keys
+// it added, for untouch to drop if the update fails.
+func (e *Expiring) touch(metrics ...models.Metrics) []string {
+	e.mu.Lock()
+	for {
+		done := e.deletingAny(metrics)
+		if done == nil {
+			break
+		}
+		e.mu.Unlock()
+		<-done
+		e.mu.Lock()
+	}
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	var added []string
+	for _, m := range metrics {
+		key := m.MType + ":" + m.ID
+		if _, ok := e.updated[key]; !ok {
+			added = append(added, key)
+		}
+		e.updated[key] = now
+	}
+	return added
+}
+
+// deletingAny returns the channel of a metric Expire is deleting, if any.
+// It must be called with mu held.
+func (e *Expiring) deletingAny(metrics []models.Metrics) chan struct{} {
+	if len(e.deleting) == 0 {
+		return nil
+	}
+	for _, m := range metrics {
+		if done, ok := e.deleting[m.MType+":"+m.ID]; ok {
+			return done
+		}
+	}
+	return nil
+}
+
+// untouch forgets the metrics a failed update added, such as names rejected
+// by a Limiter, so they do not pile up.
+func (e *Expiring) untouch(added []string, err error) error {
+	if err == nil || len(added) == 0 {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, key := range added {
+		delete(e.updated, key)
+	}
+	return err
+}
+
+func (e *Expiring) UpdateGauge(ctx context.Context, name string, value float64) error {
+	added := e.touch(models.Metrics{ID: name, MType: models.Gauge})
+	return e.untouch(added, e.Repository.UpdateGauge(ctx, name, value))
+}
+
+func (e *Expiring) UpdateCounter(ctx context.Context, name string, value int64) error {
+	added := e.touch(models.Metrics{ID: name, MType: models.Counter})
+	return e.untouch(added, e.Repository.UpdateCounter(ctx, name, value))
+}
+
+func (e *Expiring) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	added := e.touch(models.Metrics{ID: name, MType: models.Set})
+	return e.untouch(added, e.Repository.UpdateSet(ctx, name, registers))
+}
+
+func (e *Expiring) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	added := e.touch(metrics...)
+	return e.untouch(added, e.Repository.UpdateBatch(ctx, metrics))
+}
+
+func (e *Expiring) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	found, err := e.Repository.DeleteMetric(ctx, mtype, name)
+	if err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	delete(e.updated, mtype+":"+name)
+	e.mu.Unlock()
+	return found, nil
+}
+
+// RenameMetric keeps the update time of the metric under its new name.
+func (e *Expiring) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	if err := e.Repository.RenameMetric(ctx, mtype, from, to); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if last, ok := e.updated[mtype+":"+from]; ok {
+		delete(e.updated, mtype+":"+from)
+		e.updated[mtype+":"+to] = last
+	}
+	return nil
+}
+
+// hasTTL reports whether any metadata record sets a TTL.
+func hasTTL(metadata map[string]models.Metadata) bool {
+	for _, meta := range metadata {
+		if meta.TTL != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+func TestExpiringDeletesStaleMetrics(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	mem.UpdateGauge(ctx, "restored", 1)
+	var expired []string
+	e := NewExpiring(mem, ExpiryConfig{TTL: time.Minute, Interval: time.Hour, OnDelete: func(mtype, name string) {
+		expired = append(expired, mtype+":"+name)
+	}})
+	defer e.Close()
+
+	e.UpdateGauge(ctx, "load", 0.5)
+	e.UpdateCounter(ctx, "hits", 1)
+	e.SetMetadata(ctx, models.Metadata{ID: "hits", MType: models.Counter, TTL: "1h"})
+
+	now := time.Now()
+	if n, err := e.Expire(ctx, now); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to expire yet, got %d %v", n, err)
+	}
+
+	n, err := e.Expire(ctx, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// restored got its TTL from the first check, load from its update;
+	// hits has a longer TTL of its own.
+	if n != 2 {
+		t.Fatalf("Expected 2 expired metrics, got %d", n)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("Expected OnDelete for both metrics, got %v", expired)
+	}
+	if _, ok, _ := mem.GetGauge(ctx, "restored"); ok {
+		t.Fatal("Expected restored to expire")
+	}
+	if _, ok, _ := mem.GetCounter(ctx, "hits"); !ok {
+		t.Fatal("Expected hits to keep its own TTL")
+	}
+
+	e.UpdateCounter(ctx, "hits", 1)
+	if n, _ := e.Expire(ctx, now.Add(30*time.Minute)); n != 0 {
+		t.Fatalf("Expected hits to stay, got %d expired", n)
+	}
+	if n, _ := e.Expire(ctx, now.Add(2*time.Hour)); n != 1 {
+		t.Fatalf("Expected hits to expire, got %d", n)
+	}
+}
+
+func TestExpiringUsesMetadataTTLWithoutGlobalTTL(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	e := NewExpiring(mem, ExpiryConfig{Interval: time.Hour})
+	defer e.Close()
+
+	e.UpdateGauge(ctx, "load", 0.5)
+	now := time.Now()
+	if n, _ := e.Expire(ctx, now.Add(2*time.Hour)); n != 0 {
+		t.Fatalf("Expected no expiry without any TTL, got %d", n)
+	}
+
+	e.SetMetadata(ctx, models.Metadata{ID: "load", TTL: "1m"})
+	if n, _ := e.Expire(ctx, now.Add(2*time.Hour)); n != 1 {
+		t.Fatalf("Expected load to expire by its metadata TTL, got %d", n)
+	}
+}
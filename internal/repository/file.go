@@ -0,0 +1,341 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// DefaultCheckpointInterval is how often a FileStorage in sync mode
+// checkpoints a wrapped Checkpointer.
+const DefaultCheckpointInterval = 300 * time.Second
+
+// Checkpointer is implemented by repositories that persist updates on their
+// own, such as the write-ahead log. FileStorage writes its snapshots through
+// Checkpoint so the repository learns what the snapshot covers.
+type Checkpointer interface {
+	Checkpoint(save func() error) error
+}
+
+// FileConfig configures a FileStorage.
+type FileConfig struct {
+	// Path is the JSON snapshot file.
+	Path string
+	// Interval is the time between snapshots. Zero selects sync mode, in
+	// which every update is written out before it returns.
+	Interval time.Duration
+	// Restore loads the snapshot into the repository on creation.
+	Restore bool
+}
+
+// FileStorage persists the wrapped repository to a JSON snapshot file,
+// either after every update or at a fixed interval, and once more on Close.
+// A wrapped Checkpointer already makes every update durable, so sync mode
+// then only checkpoints every DefaultCheckpointInterval.
+type FileStorage struct {
+	Repository
+	cfg  FileConfig
+	sync bool
+
+	// saveMu keeps snapshots from overlapping.
+	saveMu sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileStorage wraps repo, restoring the snapshot first when cfg.Restore
+// is set. A snapshot that cannot be loaded is logged and skipped, so the
+// server still starts.
+func NewFileStorage(repo Repository, cfg FileConfig) (*FileStorage, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file storage path is required")
+	}
+
+	s := &FileStorage{Repository: repo, cfg: cfg}
+	if cfg.Restore {
+		if err := LoadFile(context.Background(), cfg.Path, repo); err != nil {
+			log.Printf("Failed to load from file: %v", err)
+		}
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		if _, ok := repo.(Checkpointer); !ok {
+			s.sync = true
+			return s, nil
+		}
+		interval = DefaultCheckpointInterval
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.saveLoop(interval)
+	return s, nil
+}
+
+func (s *FileStorage) saveLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("Failed to save to file: %v", err)
+			}
+		}
+	}
+}
+
+// Save writes the snapshot now. It is not tied to any request, so it runs
+// without a deadline.
+func (s *FileStorage) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	save := func() error { return SaveFile(context.Background(), s.cfg.Path, s.Repository) }
+	if c, ok := s.Repository.(Checkpointer); ok {
+		return c.Checkpoint(save)
+	}
+	return save()
+}
+
+// Close stops the interval saves and writes the final snapshot.
+func (s *FileStorage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+			<-s.done
+		}
+		err = s.Save()
+	})
+	return err
+}
+
+func (s *FileStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if err := s.Repository.UpdateGauge(ctx, name, value); err != nil {
+		return err
+	}
+	s.syncSave()
+	return nil
+}
+
+func (s *FileStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	if err := s.Repository.UpdateCounter(ctx, name, value); err != nil {
+		return err
+	}
+	s.syncSave()
+	return nil
+}
+
+func (s *FileStorage) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	if err := s.Repository.UpdateSet(ctx, name, registers); err != nil {
+		return err
+	}
+	s.syncSave()
+	return nil
+}
+
+func (s *FileStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	if err := s.Repository.UpdateBatch(ctx, metrics); err != nil {
+		return err
+	}
+	s.syncSave()
+	return nil
+}
+
+func (s *FileStorage) SetMetadata(ctx context.Context, meta models.Metadata) error {
+	if err := s.Repository.SetMetadata(ctx, meta); err != nil {
+		return err
+	}
+	s.syncSave()
+	return nil
+}
+
+func (s *FileStorage) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	found, err := s.Repository.DeleteMetric(ctx, mtype, name)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		s.syncSave()
+	}
+	return found, nil
+}
+
+func (s *FileStorage) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	if err := s.Repository.RenameMetric(ctx, mtype, from, to); err != nil {
+		return err
+	}
+	s.syncSave()
+	return nil
+}
+
+// syncSave writes the snapshot in sync mode. The update itself succeeded,
+// so a failed save is only logged.
+func (s *FileStorage) syncSave() {
+	if !s.sync {
+		return
+	}
+	if err := s.Save(); err != nil {
+		log.Printf("Failed to sync save: %v", err)
+	}
+}
+
+// fileSnapshot is the content of a snapshot file. Older snapshots hold only
+// the metrics array.
+type fileSnapshot struct {
+	Metrics  []models.Metrics  `json:"metrics"`
+	Metadata []models.Metadata `json:"metadata,omitempty"`
+}
+
+// SaveFile writes every metric of repo and its metadata to path as JSON.
+// The file is replaced atomically, so a crash leaves either the old or the
+// new snapshot.
+func SaveFile(ctx context.Context, path string, repo Repository) error {
+	gauges, err := repo.GetAllGauges(ctx)
+	if err != nil {
+		return err
+	}
+	counters, err := repo.GetAllCounters(ctx)
+	if err != nil {
+		return err
+	}
+	sets, err := repo.GetAllSets(ctx)
+	if err != nil {
+		return err
+	}
+	metadata, err := repo.GetAllMetadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	var snapshot fileSnapshot
+	metrics := make([]models.Metrics, 0, len(gauges)+len(counters)+len(sets))
+	for name, value := range gauges {
+		value := value
+		metrics = append(metrics, models.Metrics{ID: name, MType: models.Gauge, Value: &value})
+	}
+	for name, delta := range counters {
+		delta := delta
+		metrics = append(metrics, models.Metrics{ID: name, MType: models.Counter, Delta: &delta})
+	}
+	for name, registers := range sets {
+		metrics = append(metrics, models.Metrics{ID: name, MType: models.Set, Registers: registers})
+	}
+
+	snapshot.Metrics = metrics
+	for _, meta := range metadata {
+		snapshot.Metadata = append(snapshot.Metadata, meta)
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0666)
+}
+
+// LoadFile adds the metrics and metadata saved by SaveFile to repo. A
+// missing file is not an error.
+func LoadFile(ctx context.Context, path string, repo Repository) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var snapshot fileSnapshot
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &snapshot.Metrics)
+	} else {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range snapshot.Metadata {
+		if err := repo.SetMetadata(ctx, meta); err != nil {
+			return err
+		}
+	}
+	for _, metric := range snapshot.Metrics {
+		switch metric.MType {
+		case models.Gauge:
+			if metric.Value != nil {
+				if err := repo.UpdateGauge(ctx, metric.ID, *metric.Value); err != nil {
+					return err
+				}
+			}
+		case models.Counter:
+			if metric.Delta != nil {
+				if err := repo.UpdateCounter(ctx, metric.ID, *metric.Delta); err != nil {
+					return err
+				}
+			}
+		case models.Set:
+			if err := repo.UpdateSet(ctx, metric.ID, metric.Registers); err != nil {
+				log.Printf("Skipping set %s: %v", metric.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteFileAtomic replaces path with data so that a crash leaves either the
+// old or the new content, never a mix.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Some platforms cannot sync directories and report it as invalid.
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
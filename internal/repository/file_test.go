@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+func restoredFrom(t *testing.T, path string) *MemStorage {
+	t.Helper()
+	ctx := context.Background()
+	mem := NewMemStorage()
+	if err := LoadFile(ctx, path, mem); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return mem
+}
+
+func TestFileStorageSyncMode(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	s, err := NewFileStorage(NewMemStorage(), FileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.UpdateCounter(ctx, "hits", 3)
+	if v, _, _ := restoredFrom(t, path).GetCounter(ctx, "hits"); v != 3 {
+		t.Fatalf("Expected the update to be saved immediately, got %d", v)
+	}
+
+	sketch := hll.New()
+	sketch.AddString("alice")
+	s.UpdateSet(ctx, "users", sketch.Bytes())
+	s.UpdateGauge(ctx, "load", 0.5)
+	restored := restoredFrom(t, path)
+	if v, _, _ := restored.GetGauge(ctx, "load"); v != 0.5 {
+		t.Fatalf("Expected load 0.5, got %v", v)
+	}
+	if _, ok, _ := restored.GetSet(ctx, "users"); !ok {
+		t.Fatal("Expected the set to be saved")
+	}
+
+	s.SetMetadata(ctx, models.Metadata{ID: "load", MType: models.Gauge, Description: "System load"})
+	if meta, _, _ := restoredFrom(t, path).GetMetadata(ctx, "load"); meta.Description != "System load" {
+		t.Fatalf("Expected the metadata to be saved, got %+v", meta)
+	}
+}
+
+func TestLoadFileReadsMetricsArray(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	os.WriteFile(path, []byte(`[{"id":"hits","type":"counter","delta":5}]`), 0o644)
+
+	if v, _, _ := restoredFrom(t, path).GetCounter(ctx, "hits"); v != 5 {
+		t.Fatalf("Expected hits 5 from an older snapshot, got %d", v)
+	}
+}
+
+func TestFileStorageIntervalModeAndClose(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	s, err := NewFileStorage(NewMemStorage(), FileConfig{Path: path, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.UpdateCounter(ctx, "hits", 3)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Interval mode should not save on update")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := restoredFrom(t, path).GetCounter(ctx, "hits"); v != 3 {
+		t.Fatalf("Expected Close to flush hits 3, got %d", v)
+	}
+}
+
+func TestFileStorageRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	mem := NewMemStorage()
+	mem.UpdateCounter(ctx, "hits", 7)
+	if err := SaveFile(ctx, path, mem); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewMemStorage()
+	if _, err := NewFileStorage(restored, FileConfig{Path: path, Interval: time.Hour, Restore: true}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := restored.GetCounter(ctx, "hits"); v != 7 {
+		t.Fatalf("Expected hits 7, got %d", v)
+	}
+
+	skipped := NewMemStorage()
+	NewFileStorage(skipped, FileConfig{Path: path, Interval: time.Hour})
+	if _, ok, _ := skipped.GetCounter(ctx, "hits"); ok {
+		t.Fatal("Snapshot should only be loaded with Restore")
+	}
+
+	os.WriteFile(path, []byte("{broken"), 0o644)
+	if _, err := NewFileStorage(NewMemStorage(), FileConfig{Path: path, Restore: true}); err != nil {
+		t.Fatalf("A broken snapshot should not prevent startup: %v", err)
+	}
+}
+
+// checkpointed counts the snapshots written through Checkpoint.
+type checkpointed struct {
+	*MemStorage
+	checkpoints int
+}
+
+func (c *checkpointed) Checkpoint(save func() error) error {
+	c.checkpoints++
+	return save()
+}
+
+func TestFileStorageCheckpointer(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	inner := &checkpointed{MemStorage: NewMemStorage()}
+	s, err := NewFileStorage(inner, FileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.UpdateCounter(ctx, "hits", 1)
+	if inner.checkpoints != 0 {
+		t.Fatal("A Checkpointer should not be saved on every update")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if inner.checkpoints != 1 {
+		t.Fatalf("Expected Close to checkpoint once, got %d", inner.checkpoints)
+	}
+	if v, _, _ := restoredFrom(t, path).GetCounter(ctx, "hits"); v != 1 {
+		t.Fatalf("Expected hits 1, got %d", v)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot.json")
+	if err := WriteFileAtomic(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "new" {
+		t.Fatalf("Expected new content, got %q", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatal("Temporary files left behind")
+	}
+}
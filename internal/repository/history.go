@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// DefaultHistorySize is the number of samples kept per metric by default.
+const DefaultHistorySize = 120
+
+// HistoryStore persists the samples of a History. SaveSamples replaces the
+// samples of every key given in one write, and a key without samples is
+// deleted. BoltStorage implements it.
+type HistoryStore interface {
+	SaveSamples(samples map[string][]models.Sample) error
+	LoadSamples() (map[string][]models.Sample, error)
+}
+
+// HistorySample is a sample of the named metric.
+type HistorySample struct {
+	MType  string
+	Name   string
+	Sample models.Sample
+}
+
+// History keeps the most recent timestamped samples of every metric ordered
+// by timestamp, so late samples land in their proper place.
+//
+// With a store, every change is written before the call returns. Changes
+// made while a write is in progress are written together by the next one,
+// and the writes run outside the lock guarding the samples, so a large batch
+// costs one store write and readers never wait for one.
+type History struct {
+	mu      sync.Mutex
+	limit   int
+	samples map[string][]models.Sample
+	store   HistoryStore
+	// dirty holds the keys changed since the last store write.
+	dirty map[string]struct{}
+
+	// saveMu serializes store writes.
+	saveMu sync.Mutex
+}
+
+// NewHistory creates a history that keeps up to limit samples per metric.
+func NewHistory(limit int) *History {
+	if limit <= 0 {
+		limit = DefaultHistorySize
+	}
+	return &History{
+		limit:   limit,
+		samples: make(map[string][]models.Sample),
+		dirty:   make(map[string]struct{}),
+	}
+}
+
+// LoadHistory creates a history backed by store, starting from the samples
+// it already holds. Every insert is written back to the store.
+func LoadHistory(limit int, store HistoryStore) (*History, error) {
+	h := NewHistory(limit)
+	stored, err := store.LoadSamples()
+	if err != nil {
+		return nil, err
+	}
+	for key, samples := range stored {
+		if len(samples) > h.limit {
+			samples = samples[len(samples)-h.limit:]
+		}
+		h.samples[key] = samples
+	}
+	h.store = store
+	return h, nil
+}
+
+// Insert places the sample in timestamp order and reports whether it is now
+// the newest sample of the metric.
+func (h *History) Insert(mtype, name string, sample models.Sample) bool {
+	h.mu.Lock()
+	newest := h.insert(historyKey(mtype, name), sample)
+	h.mu.Unlock()
+	h.persist()
+	return newest
+}
+
+// InsertBatch places every sample like Insert, with one store write.
+func (h *History) InsertBatch(samples []HistorySample) {
+	if len(samples) == 0 {
+		return
+	}
+	h.mu.Lock()
+	for _, s := range samples {
+		h.insert(historyKey(s.MType, s.Name), s.Sample)
+	}
+	h.mu.Unlock()
+	h.persist()
+}
+
+// insert must be called with mu held.
+func (h *History) insert(key string, sample models.Sample) bool {
+	samples := h.samples[key]
+	idx := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Timestamp > sample.Timestamp
+	})
+	newest := idx == len(samples)
+
+	samples = append(samples, models.Sample{})
+	copy(samples[idx+1:], samples[idx:])
+	samples[idx] = sample
+	if len(samples) > h.limit {
+		samples = samples[len(samples)-h.limit:]
+	}
+	h.samples[key] = samples
+	h.markDirty(key)
+	return newest
+}
+
+// Latest returns the timestamp of the newest sample of the metric.
+func (h *History) Latest(mtype, name string) (int64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	samples := h.samples[historyKey(mtype, name)]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	return samples[len(samples)-1].Timestamp, true
+}
+
+// Get returns a copy of the metric samples ordered from oldest to newest.
+func (h *History) Get(mtype, name string) []models.Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	samples := h.samples[historyKey(mtype, name)]
+	result := make([]models.Sample, len(samples))
+	copy(result, samples)
+	return result
+}
+
+// Delete drops the samples of the metric.
+func (h *History) Delete(mtype, name string) {
+	h.mu.Lock()
+	key := historyKey(mtype, name)
+	if _, ok := h.samples[key]; !ok {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.samples, key)
+	h.markDirty(key)
+	h.mu.Unlock()
+	h.persist()
+}
+
+// Rename moves the samples of the metric to a new name.
+func (h *History) Rename(mtype, from, to string) {
+	h.mu.Lock()
+	fromKey, toKey := historyKey(mtype, from), historyKey(mtype, to)
+	samples, ok := h.samples[fromKey]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.samples, fromKey)
+	h.samples[toKey] = samples
+	h.markDirty(fromKey)
+	h.markDirty(toKey)
+	h.mu.Unlock()
+	h.persist()
+}
+
+// markDirty must be called with mu held.
+func (h *History) markDirty(key string) {
+	if h.store != nil {
+		h.dirty[key] = struct{}{}
+	}
+}
+
+// persist writes the changed keys to the store, if any. A write in progress
+// is waited for, and whatever it left is written next, unless a concurrent
+// persist already did. The change is already made in memory, so a failed
+// write is only logged and its keys are retried with the next write.
+func (h *History) persist() {
+	if h.store == nil {
+		return
+	}
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+
+	h.mu.Lock()
+	if len(h.dirty) == 0 {
+		h.mu.Unlock()
+		return
+	}
+	batch := make(map[string][]models.Sample, len(h.dirty))
+	for key := range h.dirty {
+		samples := h.samples[key]
+		batch[key] = append([]models.Sample(nil), samples...)
+	}
+	clear(h.dirty)
+	h.mu.Unlock()
+
+	if err := h.store.SaveSamples(batch); err != nil {
+		log.Printf("history: saving %d metrics: %v", len(batch), err)
+		h.mu.Lock()
+		for key := range batch {
+			h.dirty[key] = struct{}{}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func historyKey(mtype, name string) string {
+	return mtype + ":" + name
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+func TestHistoryInsertOrdersSamples(t *testing.T) {
+	h := NewHistory(3)
+
+	if !h.Insert(models.Gauge, "load", models.Sample{Timestamp: 10, Value: 1}) {
+		t.Fatal("first sample should be newest")
+	}
+	if !h.Insert(models.Gauge, "load", models.Sample{Timestamp: 30, Value: 3}) {
+		t.Fatal("later sample should be newest")
+	}
+	if h.Insert(models.Gauge, "load", models.Sample{Timestamp: 20, Value: 2}) {
+		t.Fatal("out-of-order sample should not be newest")
+	}
+	h.Insert(models.Gauge, "load", models.Sample{Timestamp: 40, Value: 4})
+
+	got := h.Get(models.Gauge, "load")
+	want := []int64{20, 30, 40}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d samples, got %d", len(want), len(got))
+	}
+	for i, ts := range want {
+		if got[i].Timestamp != ts {
+			t.Fatalf("sample %d: expected ts %d, got %d", i, ts, got[i].Timestamp)
+		}
+	}
+
+	if latest, ok := h.Latest(models.Gauge, "load"); !ok || latest != 40 {
+		t.Fatalf("expected latest 40, got %d", latest)
+	}
+	if _, ok := h.Latest(models.Counter, "load"); ok {
+		t.Fatal("counter history should be separate from gauge history")
+	}
+}
+
+type countingStore struct {
+	saves  int
+	stored map[string][]models.Sample
+}
+
+func (s *countingStore) SaveSamples(samples map[string][]models.Sample) error {
+	s.saves++
+	for key, list := range samples {
+		s.stored[key] = list
+	}
+	return nil
+}
+
+func (s *countingStore) LoadSamples() (map[string][]models.Sample, error) {
+	return nil, nil
+}
+
+func TestHistoryInsertBatchSavesOnce(t *testing.T) {
+	store := &countingStore{stored: make(map[string][]models.Sample)}
+	h, err := LoadHistory(10, store)
+	if err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+
+	var batch []HistorySample
+	for i := range 100 {
+		batch = append(batch, HistorySample{MType: models.Gauge, Name: "load", Sample: models.Sample{Timestamp: int64(i), Value: float64(i)}})
+	}
+	batch = append(batch, HistorySample{MType: models.Counter, Name: "hits", Sample: models.Sample{Timestamp: 1, Value: 1}})
+	h.InsertBatch(batch)
+
+	if store.saves != 1 {
+		t.Fatalf("expected 1 store write, got %d", store.saves)
+	}
+	if got := store.stored[historyKey(models.Gauge, "load")]; len(got) != 10 || got[9].Timestamp != 99 {
+		t.Fatalf("expected the last 10 load samples stored, got %v", got)
+	}
+	if got := store.stored[historyKey(models.Counter, "hits")]; len(got) != 1 {
+		t.Fatalf("expected the hits sample stored, got %v", got)
+	}
+}
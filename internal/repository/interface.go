@@ -1,15 +1,43 @@
 // Package repository provides storage implementations for metrics.
 package repository
 
-import models "go-metrics-and-alerts/internal/model"
+import (
+	"context"
+	"errors"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+var (
+	// ErrMetricNotFound is returned by RenameMetric when the metric does
+	// not exist.
+	ErrMetricNotFound = errors.New("metric not found")
+	// ErrMetricExists is returned by RenameMetric when the new name is
+	// already taken by a metric of the same type.
+	ErrMetricExists = errors.New("metric already exists")
+)
 
 // Repository describes storage operations supported by the server.
+//
+// Reads report a missing metric with found set to false and a nil error; a
+// non-nil error means the storage itself failed and the result is unknown.
+//
+// DeleteMetric and RenameMetric act on the metric of one type. Metadata
+// pinned to that type is deleted or moved along with it.
 type Repository interface {
-	UpdateGauge(name string, value float64) error
-	UpdateCounter(name string, value int64) error
-	GetGauge(name string) (float64, bool)
-	GetCounter(name string) (int64, bool)
-	GetAllGauges() map[string]float64
-	GetAllCounters() map[string]int64
-	UpdateBatch(metrics []models.Metrics) error
+	UpdateGauge(ctx context.Context, name string, value float64) error
+	UpdateCounter(ctx context.Context, name string, value int64) error
+	UpdateSet(ctx context.Context, name string, registers []byte) error
+	GetGauge(ctx context.Context, name string) (value float64, found bool, err error)
+	GetCounter(ctx context.Context, name string) (value int64, found bool, err error)
+	GetSet(ctx context.Context, name string) (registers []byte, found bool, err error)
+	GetAllGauges(ctx context.Context) (map[string]float64, error)
+	GetAllCounters(ctx context.Context) (map[string]int64, error)
+	GetAllSets(ctx context.Context) (map[string][]byte, error)
+	UpdateBatch(ctx context.Context, metrics []models.Metrics) error
+	SetMetadata(ctx context.Context, meta models.Metadata) error
+	GetMetadata(ctx context.Context, name string) (meta models.Metadata, found bool, err error)
+	GetAllMetadata(ctx context.Context) (map[string]models.Metadata, error)
+	DeleteMetric(ctx context.Context, mtype, name string) (found bool, err error)
+	RenameMetric(ctx context.Context, mtype, from, to string) error
 }
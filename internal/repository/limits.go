@@ -0,0 +1,580 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// DefaultMaxNameLength matches the width of the id columns in PostgreSQL.
+const DefaultMaxNameLength = 255
+
+// DefaultMaxSources is the number of sources whose series a Limiter tracks
+// unless LimitConfig.MaxSources says otherwise.
+const DefaultMaxSources = 10000
+
+var (
+	// ErrSeriesLimit is wrapped by the errors of updates that would create
+	// more series than allowed.
+	ErrSeriesLimit = errors.New("series limit exceeded")
+	// ErrInvalidName is wrapped by the errors of updates whose metric name
+	// is too long or does not match the allowed pattern.
+	ErrInvalidName = errors.New("invalid metric name")
+)
+
+// Rejection reasons counted by a Limiter.
+const (
+	RejectSeries       = "series"
+	RejectSourceSeries = "source_series"
+	RejectNameLength   = "name_length"
+	RejectNamePattern  = "name_pattern"
+)
+
+// LimitConfig configures a Limiter. Zero limits are disabled.
+type LimitConfig struct {
+	// MaxSeries bounds the number of stored series. A series is a metric
+	// name of one type.
+	MaxSeries int
+	// MaxSeriesPerSource bounds the number of series each source, as set
+	// by WithSource, may write to.
+	MaxSeriesPerSource int
+	// MaxSources bounds the number of sources tracked for
+	// MaxSeriesPerSource. Beyond it the least recently active source is
+	// forgotten and starts from zero when it writes again. Zero uses
+	// DefaultMaxSources.
+	MaxSources int
+	// MaxNameLength bounds the length of metric names in bytes.
+	MaxNameLength int
+	// NamePattern, if set, must match every metric name.
+	NamePattern *regexp.Regexp
+}
+
+// LimitStats reports the state of a Limiter.
+type LimitStats struct {
+	Series   int              `json:"series"`
+	Sources  int              `json:"sources"`
+	Rejected map[string]int64 `json:"rejected_samples"`
+}
+
+type sourceKey struct{}
+
+// WithSource returns ctx carrying the name of the client writing metrics,
+// which a Limiter uses for its per-source limit.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// SourceFrom returns the source set by WithSource, or "".
+func SourceFrom(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
+
+type partialKey struct{}
+
+// WithPartialWrites returns ctx under which a Limiter stores the part of a
+// batch that is within the limits instead of rejecting the whole batch. The
+// error is then a *RejectedError naming the rejected series. It suits
+// writers that aggregate many clients into one batch, like the statsd and
+// graphite listeners.
+func WithPartialWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, partialKey{}, true)
+}
+
+func partialFrom(ctx context.Context) bool {
+	partial, _ := ctx.Value(partialKey{}).(bool)
+	return partial
+}
+
+// RejectedError is returned by a Limiter for a partial write that rejected
+// some series. It unwraps to the first rejection.
+type RejectedError struct {
+	// Series maps the "type:name" key of each rejected series to the
+	// reason it was rejected.
+	Series map[string]error
+	first  error
+}
+
+func (e *RejectedError) Error() string {
+	return e.first.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.first
+}
+
+// Rejected returns why the series of mtype and name was rejected, or nil
+// if it was stored.
+func (e *RejectedError) Rejected(mtype, name string) error {
+	return e.Series[seriesKey(mtype, name)]
+}
+
+func (e *RejectedError) add(key string, err error) {
+	if e.first == nil {
+		e.first = err
+	}
+	e.Series[key] = err
+}
+
+// rejected reports whether e holds any rejection. It is false for nil.
+func (e *RejectedError) rejected() bool {
+	return e != nil && e.first != nil
+}
+
+// Limiter rejects updates with invalid names and updates that would add
+// series beyond the configured limits, and counts the rejected samples.
+// Metadata is checked the same way, see SetMetadata.
+// Updates of existing series are never rejected for the series limits. A
+// rejected batch is rejected as a whole, unless WithPartialWrites is set.
+//
+// The series of each source are only known from the updates since start, so
+// after a restart every source starts from zero.
+type Limiter struct {
+	Repository
+	cfg LimitConfig
+
+	mu       sync.Mutex
+	series   *seriesSet
+	sources  map[string]*seriesSet
+	rejected map[string]*atomic.Int64
+	// metadata holds the IDs that have metadata.
+	metadata map[string]struct{}
+}
+
+// seriesSet holds stored series and the reservations of writes in flight.
+// Every write holds its own reservation of each series it may create, and a
+// series only leaves the set when no write holds it and it is not stored, so
+// a failed write never releases a series that a concurrent write stored.
+type seriesSet struct {
+	stored  map[string]struct{}
+	pending map[string]int
+	// unstored counts the pending series that are not stored.
+	unstored int
+	lastUsed time.Time
+}
+
+func newSeriesSet() *seriesSet {
+	return &seriesSet{stored: make(map[string]struct{}), pending: make(map[string]int)}
+}
+
+func (s *seriesSet) has(key string) bool {
+	_, stored := s.stored[key]
+	return stored || s.pending[key] > 0
+}
+
+func (s *seriesSet) isStored(key string) bool {
+	_, stored := s.stored[key]
+	return stored
+}
+
+func (s *seriesSet) len() int {
+	return len(s.stored) + s.unstored
+}
+
+// reserve holds key for a write in flight.
+func (s *seriesSet) reserve(key string) {
+	if s.pending[key] == 0 && !s.isStored(key) {
+		s.unstored++
+	}
+	s.pending[key]++
+}
+
+// settle releases a reservation of key, keeping key as stored if the write
+// succeeded.
+func (s *seriesSet) settle(key string, stored bool) {
+	n := s.pending[key]
+	if n == 0 {
+		return
+	}
+	if stored && !s.isStored(key) {
+		s.stored[key] = struct{}{}
+		s.unstored--
+	}
+	if n > 1 {
+		s.pending[key] = n - 1
+		return
+	}
+	delete(s.pending, key)
+	if !s.isStored(key) {
+		s.unstored--
+	}
+}
+
+// add records key as stored.
+func (s *seriesSet) add(key string) {
+	if s.isStored(key) {
+		return
+	}
+	s.stored[key] = struct{}{}
+	if s.pending[key] > 0 {
+		s.unstored--
+	}
+}
+
+// remove drops key from the stored series. Reservations of writes in flight
+// still hold it.
+func (s *seriesSet) remove(key string) {
+	if !s.isStored(key) {
+		return
+	}
+	delete(s.stored, key)
+	if s.pending[key] > 0 {
+		s.unstored++
+	}
+}
+
+func (s *seriesSet) empty() bool {
+	return len(s.stored) == 0 && len(s.pending) == 0
+}
+
+// NewLimiter wraps repo, counting the series it already holds.
+func NewLimiter(ctx context.Context, repo Repository, cfg LimitConfig) (*Limiter, error) {
+	if cfg.MaxSources <= 0 {
+		cfg.MaxSources = DefaultMaxSources
+	}
+	l := &Limiter{
+		Repository: repo,
+		cfg:        cfg,
+		series:     newSeriesSet(),
+		sources:    make(map[string]*seriesSet),
+		rejected:   make(map[string]*atomic.Int64),
+		metadata:   make(map[string]struct{}),
+	}
+	for _, reason := range []string{RejectSeries, RejectSourceSeries, RejectNameLength, RejectNamePattern} {
+		l.rejected[reason] = new(atomic.Int64)
+	}
+
+	gauges, err := repo.GetAllGauges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := repo.GetAllCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := repo.GetAllSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for id := range gauges {
+		l.series.add(seriesKey(models.Gauge, id))
+	}
+	for id := range counters {
+		l.series.add(seriesKey(models.Counter, id))
+	}
+	for id := range sets {
+		l.series.add(seriesKey(models.Set, id))
+	}
+	metadata, err := repo.GetAllMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for id := range metadata {
+		l.metadata[id] = struct{}{}
+	}
+	return l, nil
+}
+
+// Stats returns the current series counts and the rejected samples by
+// reason.
+func (l *Limiter) Stats() LimitStats {
+	l.mu.Lock()
+	stats := LimitStats{Series: l.series.len(), Sources: len(l.sources)}
+	l.mu.Unlock()
+
+	stats.Rejected = make(map[string]int64, len(l.rejected))
+	for reason, n := range l.rejected {
+		stats.Rejected[reason] = n.Load()
+	}
+	return stats
+}
+
+func (l *Limiter) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return l.admit(ctx, []models.Metrics{{ID: name, MType: models.Gauge}}, func([]models.Metrics) error {
+		return l.Repository.UpdateGauge(ctx, name, value)
+	})
+}
+
+func (l *Limiter) UpdateCounter(ctx context.Context, name string, value int64) error {
+	return l.admit(ctx, []models.Metrics{{ID: name, MType: models.Counter}}, func([]models.Metrics) error {
+		return l.Repository.UpdateCounter(ctx, name, value)
+	})
+}
+
+func (l *Limiter) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	return l.admit(ctx, []models.Metrics{{ID: name, MType: models.Set}}, func([]models.Metrics) error {
+		return l.Repository.UpdateSet(ctx, name, registers)
+	})
+}
+
+func (l *Limiter) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	return l.admit(ctx, metrics, func(admitted []models.Metrics) error {
+		return l.Repository.UpdateBatch(ctx, admitted)
+	})
+}
+
+func (l *Limiter) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	found, err := l.Repository.DeleteMetric(ctx, mtype, name)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	l.forget(seriesKey(mtype, name))
+	l.mu.Unlock()
+	return found, nil
+}
+
+// RenameMetric checks the new name like an update. The renamed series
+// keeps its place in the series count.
+func (l *Limiter) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	if _, err := l.checkName(to); err != nil {
+		return err
+	}
+	if err := l.Repository.RenameMetric(ctx, mtype, from, to); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fromKey, toKey := seriesKey(mtype, from), seriesKey(mtype, to)
+	for _, series := range l.sources {
+		if series.isStored(fromKey) {
+			series.remove(fromKey)
+			series.add(toKey)
+		}
+	}
+	l.series.remove(fromKey)
+	l.series.add(toKey)
+	return nil
+}
+
+// SetMetadata checks the metric name like an update. Metadata for a new ID
+// is rejected with ErrSeriesLimit once MaxSeries IDs have metadata, so
+// metadata for metrics that are never written cannot grow without bound.
+func (l *Limiter) SetMetadata(ctx context.Context, meta models.Metadata) error {
+	if _, err := l.checkName(meta.ID); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	_, known := l.metadata[meta.ID]
+	if !known {
+		if l.cfg.MaxSeries > 0 && len(l.metadata) >= l.cfg.MaxSeries {
+			l.mu.Unlock()
+			return fmt.Errorf("%w: the server holds metadata for at most %d series", ErrSeriesLimit, l.cfg.MaxSeries)
+		}
+		l.metadata[meta.ID] = struct{}{}
+	}
+	l.mu.Unlock()
+
+	if err := l.Repository.SetMetadata(ctx, meta); err != nil {
+		if !known {
+			l.mu.Lock()
+			delete(l.metadata, meta.ID)
+			l.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// admit checks metrics against the limits, reserves their series and
+// stores the admitted metrics. The reservations are settled once store
+// returns, keeping the series only if it succeeded.
+func (l *Limiter) admit(ctx context.Context, metrics []models.Metrics, store func([]models.Metrics) error) error {
+	partial := partialFrom(ctx)
+	source := SourceFrom(ctx)
+
+	valid := metrics
+	var rejection *RejectedError
+	if partial {
+		valid = make([]models.Metrics, 0, len(metrics))
+		rejection = &RejectedError{Series: make(map[string]error)}
+	}
+	for _, m := range metrics {
+		reason, err := l.checkName(m.ID)
+		switch {
+		case err == nil:
+			if partial {
+				valid = append(valid, m)
+			}
+		case !partial:
+			return l.reject(reason, len(metrics), err)
+		default:
+			rejection.add(seriesKey(m.MType, m.ID), err)
+			l.reject(reason, 1, err)
+		}
+	}
+
+	l.mu.Lock()
+	admitted, reserved, reservedBySource, err := l.reserve(source, valid, rejection)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(admitted) == 0 && rejection.rejected() {
+		return rejection
+	}
+
+	storeErr := store(admitted)
+
+	l.mu.Lock()
+	for _, key := range reserved {
+		l.series.settle(key, storeErr == nil)
+	}
+	if sourceSeries := l.sources[source]; sourceSeries != nil {
+		for _, key := range reservedBySource {
+			sourceSeries.settle(key, storeErr == nil)
+		}
+		if sourceSeries.empty() {
+			delete(l.sources, source)
+		}
+	}
+	l.mu.Unlock()
+
+	if storeErr != nil {
+		return storeErr
+	}
+	if rejection.rejected() {
+		return rejection
+	}
+	return nil
+}
+
+// reserve reserves the series of metrics that are not stored yet and
+// returns the metrics within the limits. Metrics beyond the limits are
+// added to partial, or without partial one of them rejects them all. It
+// must be called with mu held.
+func (l *Limiter) reserve(source string, metrics []models.Metrics, partial *RejectedError) (admitted []models.Metrics, reserved, reservedBySource []string, err error) {
+	var sourceSeries *seriesSet
+	if source != "" && l.cfg.MaxSeriesPerSource > 0 {
+		sourceSeries = l.trackSource(source)
+	}
+
+	var added, addedToSource int
+	rejected := make(map[string]string)
+	seen := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		key := seriesKey(m.MType, m.ID)
+		if reason, ok := rejected[key]; ok {
+			l.reject(reason, 1, nil)
+			continue
+		}
+		if seen[key] {
+			admitted = append(admitted, m)
+			continue
+		}
+
+		known := l.series.has(key)
+		newToSource := sourceSeries != nil && !sourceSeries.has(key)
+
+		var reason string
+		var cause error
+		switch {
+		case !known && l.cfg.MaxSeries > 0 && l.series.len()+added >= l.cfg.MaxSeries:
+			reason = RejectSeries
+			cause = fmt.Errorf("%w: the server holds at most %d series", ErrSeriesLimit, l.cfg.MaxSeries)
+		case newToSource && sourceSeries.len()+addedToSource >= l.cfg.MaxSeriesPerSource:
+			reason = RejectSourceSeries
+			cause = fmt.Errorf("%w: %s may write at most %d series", ErrSeriesLimit, source, l.cfg.MaxSeriesPerSource)
+		}
+		if cause != nil {
+			if partial == nil {
+				return nil, nil, nil, l.reject(reason, len(metrics), cause)
+			}
+			partial.add(key, cause)
+			rejected[key] = reason
+			l.reject(reason, 1, nil)
+			continue
+		}
+
+		seen[key] = true
+		if !known {
+			added++
+		}
+		if !l.series.isStored(key) {
+			reserved = append(reserved, key)
+		}
+		if newToSource {
+			addedToSource++
+		}
+		if sourceSeries != nil && !sourceSeries.isStored(key) {
+			reservedBySource = append(reservedBySource, key)
+		}
+		admitted = append(admitted, m)
+	}
+
+	for _, key := range reserved {
+		l.series.reserve(key)
+	}
+	for _, key := range reservedBySource {
+		sourceSeries.reserve(key)
+	}
+	if sourceSeries != nil && sourceSeries.empty() {
+		delete(l.sources, source)
+	}
+	return admitted, reserved, reservedBySource, nil
+}
+
+// trackSource returns the series of source, making room for a new source
+// by forgetting the least recently active one. It must be called with mu
+// held.
+func (l *Limiter) trackSource(source string) *seriesSet {
+	now := time.Now()
+	if series, ok := l.sources[source]; ok {
+		series.lastUsed = now
+		return series
+	}
+	if len(l.sources) >= l.cfg.MaxSources {
+		var oldest string
+		var oldestUsed time.Time
+		for name, series := range l.sources {
+			if oldest == "" || series.lastUsed.Before(oldestUsed) {
+				oldest, oldestUsed = name, series.lastUsed
+			}
+		}
+		delete(l.sources, oldest)
+	}
+	series := newSeriesSet()
+	series.lastUsed = now
+	l.sources[source] = series
+	return series
+}
+
+// checkName returns the rejection reason and error for an invalid name.
+func (l *Limiter) checkName(name string) (string, error) {
+	if l.cfg.MaxNameLength > 0 && len(name) > l.cfg.MaxNameLength {
+		return RejectNameLength, fmt.Errorf("%w: %.32q... is longer than %d bytes", ErrInvalidName, name, l.cfg.MaxNameLength)
+	}
+	if l.cfg.NamePattern != nil && !l.cfg.NamePattern.MatchString(name) {
+		return RejectNamePattern, fmt.Errorf("%w: %q does not match %s", ErrInvalidName, name, l.cfg.NamePattern)
+	}
+	return "", nil
+}
+
+// reject counts n rejected samples and returns err.
+func (l *Limiter) reject(reason string, n int, err error) error {
+	l.rejected[reason].Add(int64(n))
+	return err
+}
+
+// forget drops a deleted series from the counts. It must be called with mu
+// held.
+func (l *Limiter) forget(key string) {
+	l.series.remove(key)
+	for source, series := range l.sources {
+		series.remove(key)
+		if series.empty() {
+			delete(l.sources, source)
+		}
+	}
+}
+
+func seriesKey(mtype, name string) string {
+	return mtype + ":" + name
+}
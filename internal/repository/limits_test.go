@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+func newTestLimiter(t *testing.T, repo Repository, cfg LimitConfig) *Limiter {
+	t.Helper()
+	l, err := NewLimiter(context.Background(), repo, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLimiterMaxSeries(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	mem.UpdateGauge(ctx, "load", 1)
+	l := newTestLimiter(t, mem, LimitConfig{MaxSeries: 2})
+
+	if err := l.UpdateCounter(ctx, "hits", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.UpdateGauge(ctx, "temp", 1); !errors.Is(err, ErrSeriesLimit) {
+		t.Fatalf("Expected ErrSeriesLimit, got %v", err)
+	}
+	if err := l.UpdateGauge(ctx, "load", 2); err != nil {
+		t.Fatalf("Expected updates of existing series to pass, got %v", err)
+	}
+
+	value := 1.0
+	err := l.UpdateBatch(ctx, []models.Metrics{
+		{ID: "load", MType: models.Gauge, Value: &value},
+		{ID: "temp", MType: models.Gauge, Value: &value},
+	})
+	if !errors.Is(err, ErrSeriesLimit) {
+		t.Fatalf("Expected ErrSeriesLimit, got %v", err)
+	}
+	if v, _, _ := mem.GetGauge(ctx, "load"); v != 2 {
+		t.Fatalf("Expected the rejected batch not to be stored, got load %v", v)
+	}
+
+	if _, err := l.DeleteMetric(ctx, models.Counter, "hits"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.UpdateGauge(ctx, "temp", 1); err != nil {
+		t.Fatalf("Expected the deleted series to free a slot, got %v", err)
+	}
+
+	stats := l.Stats()
+	if stats.Series != 2 || stats.Rejected[RejectSeries] != 3 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestLimiterMaxSeriesPerSource(t *testing.T) {
+	mem := NewMemStorage()
+	l := newTestLimiter(t, mem, LimitConfig{MaxSeriesPerSource: 1})
+	agent1 := WithSource(context.Background(), "10.0.0.1")
+	agent2 := WithSource(context.Background(), "10.0.0.2")
+
+	if err := l.UpdateGauge(agent1, "load", 1); err != nil {
+		t.Fatal(err)
+	}
+	err := l.UpdateGauge(agent1, "temp", 1)
+	if !errors.Is(err, ErrSeriesLimit) || !strings.Contains(err.Error(), "10.0.0.1") {
+		t.Fatalf("Expected the source limit, got %v", err)
+	}
+	if err := l.UpdateGauge(agent2, "load", 1); err != nil {
+		t.Fatalf("Expected another source to write the same series, got %v", err)
+	}
+	if err := l.UpdateGauge(agent2, "temp", 1); !errors.Is(err, ErrSeriesLimit) {
+		t.Fatalf("Expected ErrSeriesLimit, got %v", err)
+	}
+	if stats := l.Stats(); stats.Sources != 2 || stats.Rejected[RejectSourceSeries] != 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestLimiterNames(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, NewMemStorage(), LimitConfig{
+		MaxNameLength: 8,
+		NamePattern:   regexp.MustCompile(`^[a-z_]+$`),
+	})
+
+	if err := l.UpdateGauge(ctx, "much_too_long", 1); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected ErrInvalidName, got %v", err)
+	}
+	if err := l.UpdateGauge(ctx, "load%", 1); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected ErrInvalidName, got %v", err)
+	}
+	l.UpdateGauge(ctx, "load", 1)
+	if err := l.RenameMetric(ctx, models.Gauge, "load", "Load"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected the rename to be checked, got %v", err)
+	}
+
+	stats := l.Stats()
+	if stats.Rejected[RejectNameLength] != 1 || stats.Rejected[RejectNamePattern] != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestLimiterMetadata(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	mem.SetMetadata(ctx, models.Metadata{ID: "load", Unit: "1"})
+	l := newTestLimiter(t, mem, LimitConfig{MaxSeries: 2, MaxNameLength: 8})
+
+	if err := l.SetMetadata(ctx, models.Metadata{ID: "much_too_long"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected ErrInvalidName, got %v", err)
+	}
+	if err := l.SetMetadata(ctx, models.Metadata{ID: "hits"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetMetadata(ctx, models.Metadata{ID: "temp"}); !errors.Is(err, ErrSeriesLimit) {
+		t.Fatalf("Expected ErrSeriesLimit, got %v", err)
+	}
+	if err := l.SetMetadata(ctx, models.Metadata{ID: "load", Unit: "%"}); err != nil {
+		t.Fatalf("Expected updates of existing metadata to pass, got %v", err)
+	}
+	if all, _ := mem.GetAllMetadata(ctx); len(all) != 2 {
+		t.Fatalf("Expected 2 metadata records, got %v", all)
+	}
+}
+
+func TestLimiterPartialWrites(t *testing.T) {
+	mem := NewMemStorage()
+	l := newTestLimiter(t, mem, LimitConfig{MaxSeries: 2, MaxNameLength: 8})
+	ctx := WithPartialWrites(context.Background())
+
+	one := 1.0
+	err := l.UpdateBatch(ctx, []models.Metrics{
+		{ID: "a", MType: models.Gauge, Value: &one},
+		{ID: "much_too_long", MType: models.Gauge, Value: &one},
+		{ID: "b", MType: models.Gauge, Value: &one},
+		{ID: "c", MType: models.Gauge, Value: &one},
+		{ID: "c", MType: models.Gauge, Value: &one},
+	})
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected the first rejection, got %v", err)
+	}
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || len(rejected.Series) != 2 ||
+		!errors.Is(rejected.Rejected(models.Gauge, "c"), ErrSeriesLimit) || rejected.Rejected(models.Gauge, "a") != nil {
+		t.Fatalf("Expected much_too_long and c to be named, got %+v", rejected)
+	}
+	gauges, _ := mem.GetAllGauges(context.Background())
+	if len(gauges) != 2 || gauges["a"] != 1 || gauges["b"] != 1 {
+		t.Fatalf("Expected a and b stored, got %v", gauges)
+	}
+	stats := l.Stats()
+	if stats.Rejected[RejectNameLength] != 1 || stats.Rejected[RejectSeries] != 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestLimiterReleasesFailedWrites(t *testing.T) {
+	repo := &flakyStorage{MemStorage: NewMemStorage(), fail: true}
+	l := newTestLimiter(t, repo, LimitConfig{MaxSeries: 1})
+	ctx := context.Background()
+
+	one := 1.0
+	batch := []models.Metrics{{ID: "a", MType: models.Gauge, Value: &one}}
+	if err := l.UpdateBatch(ctx, batch); !errors.Is(err, errBatchFailed) {
+		t.Fatalf("Expected the storage error, got %v", err)
+	}
+	repo.fail = false
+	batch[0].ID = "b"
+	if err := l.UpdateBatch(ctx, batch); err != nil {
+		t.Fatalf("Expected the failed write not to hold a slot, got %v", err)
+	}
+}
+
+func TestLimiterKeepsSeriesStoredByConcurrentWrite(t *testing.T) {
+	mem := NewMemStorage()
+	l := newTestLimiter(t, mem, LimitConfig{MaxSeries: 1})
+	ctx := context.Background()
+
+	batch := []models.Metrics{{ID: "a", MType: models.Gauge}}
+	err := l.admit(ctx, batch, func([]models.Metrics) error {
+		// A concurrent write stores the same series while this one fails.
+		if err := l.UpdateGauge(ctx, "a", 1); err != nil {
+			t.Fatalf("Expected the concurrent write to pass, got %v", err)
+		}
+		return errBatchFailed
+	})
+	if !errors.Is(err, errBatchFailed) {
+		t.Fatalf("Expected the storage error, got %v", err)
+	}
+	if stats := l.Stats(); stats.Series != 1 {
+		t.Fatalf("Expected the stored series to stay counted, got %+v", stats)
+	}
+	if err := l.UpdateGauge(ctx, "b", 1); !errors.Is(err, ErrSeriesLimit) {
+		t.Fatalf("Expected ErrSeriesLimit, got %v", err)
+	}
+}
+
+func TestLimiterForgetsIdleSources(t *testing.T) {
+	l := newTestLimiter(t, NewMemStorage(), LimitConfig{MaxSeriesPerSource: 1, MaxSources: 2})
+	for _, source := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := l.UpdateGauge(WithSource(context.Background(), source), "load", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := l.Stats(); stats.Sources != 2 {
+		t.Fatalf("Expected at most 2 tracked sources, got %+v", stats)
+	}
+	if err := l.UpdateGauge(WithSource(context.Background(), "10.0.0.1"), "temp", 1); err != nil {
+		t.Fatalf("Expected the forgotten source to start from zero, got %v", err)
+	}
+}
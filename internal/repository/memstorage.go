@@ -1,98 +1,382 @@
 package repository
 
 import (
+	"context"
+	"math"
 	"sync"
+	"sync/atomic"
 
 	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
 )
 
+// DefaultShards is the number of shards of NewMemStorage.
+const DefaultShards = 32
+
 // generate:reset
-// MemStorage keeps metrics in memory using simple maps.
+// memShard holds the metrics whose names hash to it. Gauge and counter
+// values are atomics, so reads and updates of existing metrics only take the
+// read lock; the write lock is needed to add a metric or merge a set.
+type memShard struct {
+	mu       sync.RWMutex
+	gauges   map[string]*atomic.Uint64
+	counters map[string]*atomic.Int64
+	sets     map[string]*hll.Sketch
+}
+
+// MemStorage keeps metrics in memory, spread over shards by name so that
+// readers and writers of different metrics rarely contend. Each operation
+// on a single metric is atomic; UpdateBatch and the GetAll methods are not
+// atomic across shards.
 type MemStorage struct {
-	gauges   map[string]float64
-	counters map[string]int64
-	mu       *sync.Mutex
+	shards []*memShard
+	mask   uint32
+
+	metaMu   sync.RWMutex
+	metadata map[string]models.Metadata
 }
 
-// NewMemStorage creates an empty in-memory storage.
+// NewMemStorage creates an empty in-memory storage with DefaultShards shards.
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		gauges:   make(map[string]float64),
-		counters: make(map[string]int64),
-		mu:       &sync.Mutex{},
+	return NewShardedMemStorage(DefaultShards)
+}
+
+// NewShardedMemStorage creates an empty in-memory storage with n shards,
+// rounded up to a power of two.
+func NewShardedMemStorage(n int) *MemStorage {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	m := &MemStorage{
+		shards:   make([]*memShard, size),
+		mask:     uint32(size - 1),
+		metadata: make(map[string]models.Metadata),
+	}
+	for i := range m.shards {
+		m.shards[i] = &memShard{
+			gauges:   make(map[string]*atomic.Uint64),
+			counters: make(map[string]*atomic.Int64),
+			sets:     make(map[string]*hll.Sketch),
+		}
+	}
+	return m
+}
+
+// shard returns the shard of name.
+func (m *MemStorage) shard(name string) *memShard {
+	return m.shards[m.shardIndex(name)]
+}
+
+// shardIndex hashes name using FNV-1a.
+func (m *MemStorage) shardIndex(name string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
 	}
+	return h & m.mask
 }
 
 // UpdateGauge sets the gauge value.
-func (m *MemStorage) UpdateGauge(name string, value float64) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.gauges[name] = value
+func (m *MemStorage) UpdateGauge(_ context.Context, name string, value float64) error {
+	m.shard(name).setGauge(name, value)
 	return nil
 }
 
 // UpdateCounter adds the delta to the counter value.
-func (m *MemStorage) UpdateCounter(name string, value int64) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.counters[name] += value
+func (m *MemStorage) UpdateCounter(_ context.Context, name string, value int64) error {
+	m.shard(name).addCounter(name, value)
+	return nil
+}
+
+// UpdateSet unions the provided HyperLogLog registers into the set.
+func (m *MemStorage) UpdateSet(_ context.Context, name string, registers []byte) error {
+	sketch, err := hll.FromBytes(registers)
+	if err != nil {
+		return err
+	}
+	m.shard(name).mergeSet(name, sketch)
 	return nil
 }
 
 // GetGauge returns the gauge value and flag indicating presence.
-func (m *MemStorage) GetGauge(name string) (float64, bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	value, exists := m.gauges[name]
-	return value, exists
+func (m *MemStorage) GetGauge(_ context.Context, name string) (float64, bool, error) {
+	s := m.shard(name)
+	s.mu.RLock()
+	bits, exists := s.gauges[name]
+	s.mu.RUnlock()
+	if !exists {
+		return 0, false, nil
+	}
+	return math.Float64frombits(bits.Load()), true, nil
 }
 
 // GetCounter returns the counter value and flag indicating presence.
-func (m *MemStorage) GetCounter(name string) (int64, bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	value, exists := m.counters[name]
-	return value, exists
+func (m *MemStorage) GetCounter(_ context.Context, name string) (int64, bool, error) {
+	s := m.shard(name)
+	s.mu.RLock()
+	value, exists := s.counters[name]
+	s.mu.RUnlock()
+	if !exists {
+		return 0, false, nil
+	}
+	return value.Load(), true, nil
+}
+
+// GetSet returns a copy of the set registers and flag indicating presence.
+func (m *MemStorage) GetSet(_ context.Context, name string) ([]byte, bool, error) {
+	s := m.shard(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sketch, exists := s.sets[name]
+	if !exists {
+		return nil, false, nil
+	}
+	return sketch.Bytes(), true, nil
 }
 
 // GetAllGauges returns a copy of all gauge values.
-func (m *MemStorage) GetAllGauges() map[string]float64 {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+func (m *MemStorage) GetAllGauges(_ context.Context) (map[string]float64, error) {
 	result := make(map[string]float64)
-	for k, v := range m.gauges {
-		result[k] = v
+	for _, s := range m.shards {
+		s.mu.RLock()
+		for k, v := range s.gauges {
+			result[k] = math.Float64frombits(v.Load())
+		}
+		s.mu.RUnlock()
 	}
-	return result
+	return result, nil
 }
 
 // GetAllCounters returns a copy of all counter values.
-func (m *MemStorage) GetAllCounters() map[string]int64 {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+func (m *MemStorage) GetAllCounters(_ context.Context) (map[string]int64, error) {
 	result := make(map[string]int64)
-	for k, v := range m.counters {
-		result[k] = v
+	for _, s := range m.shards {
+		s.mu.RLock()
+		for k, v := range s.counters {
+			result[k] = v.Load()
+		}
+		s.mu.RUnlock()
 	}
-	return result
+	return result, nil
 }
 
-// UpdateBatch applies all metrics updates in order.
-func (m *MemStorage) UpdateBatch(metrics []models.Metrics) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// GetAllSets returns a copy of all set registers.
+func (m *MemStorage) GetAllSets(_ context.Context) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	for _, s := range m.shards {
+		s.mu.RLock()
+		for k, v := range s.sets {
+			result[k] = v.Bytes()
+		}
+		s.mu.RUnlock()
+	}
+	return result, nil
+}
 
-	for _, metric := range metrics {
+// UpdateBatch applies all metrics updates in order. Invalid set registers
+// fail the batch before anything is applied, as in the other storages.
+func (m *MemStorage) UpdateBatch(_ context.Context, metrics []models.Metrics) error {
+	sketches := make(map[int]*hll.Sketch)
+	for i, metric := range metrics {
+		if metric.MType != "set" {
+			continue
+		}
+		sketch, err := hll.FromBytes(metric.Registers)
+		if err != nil {
+			return err
+		}
+		sketches[i] = sketch
+	}
+
+	for i, metric := range metrics {
 		switch metric.MType {
 		case "gauge":
 			if metric.Value != nil {
-				m.gauges[metric.ID] = *metric.Value
+				m.shard(metric.ID).setGauge(metric.ID, *metric.Value)
 			}
 		case "counter":
 			if metric.Delta != nil {
-				m.counters[metric.ID] += *metric.Delta
+				m.shard(metric.ID).addCounter(metric.ID, *metric.Delta)
 			}
+		case "set":
+			m.shard(metric.ID).mergeSet(metric.ID, sketches[i])
 		}
 	}
 	return nil
 }
+
+// SetMetadata registers or replaces the metadata of a metric.
+func (m *MemStorage) SetMetadata(_ context.Context, meta models.Metadata) error {
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	m.metadata[meta.ID] = meta
+	return nil
+}
+
+// GetMetadata returns the metric metadata and flag indicating presence.
+func (m *MemStorage) GetMetadata(_ context.Context, name string) (models.Metadata, bool, error) {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	meta, exists := m.metadata[name]
+	return meta, exists, nil
+}
+
+// GetAllMetadata returns a copy of all registered metadata.
+func (m *MemStorage) GetAllMetadata(_ context.Context) (map[string]models.Metadata, error) {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	result := make(map[string]models.Metadata)
+	for k, v := range m.metadata {
+		result[k] = v
+	}
+	return result, nil
+}
+
+// DeleteMetric removes the metric and the metadata pinned to its type.
+func (m *MemStorage) DeleteMetric(_ context.Context, mtype, name string) (bool, error) {
+	s := m.shard(name)
+	s.mu.Lock()
+	found := s.delete(mtype, name)
+	s.mu.Unlock()
+
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	if meta, ok := m.metadata[name]; ok && meta.MType == mtype {
+		delete(m.metadata, name)
+	}
+	return found, nil
+}
+
+// RenameMetric moves the metric, and the metadata pinned to its type, from
+// one name to another.
+func (m *MemStorage) RenameMetric(_ context.Context, mtype, from, to string) error {
+	src, dst := m.shard(from), m.shard(to)
+	// Lock both shards in a fixed order so that concurrent renames in
+	// opposite directions cannot deadlock.
+	first, second := src, dst
+	if m.shardIndex(to) < m.shardIndex(from) {
+		first, second = dst, src
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if second != first {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
+
+	switch mtype {
+	case models.Gauge:
+		if err := move(src.gauges, dst.gauges, from, to); err != nil {
+			return err
+		}
+	case models.Counter:
+		if err := move(src.counters, dst.counters, from, to); err != nil {
+			return err
+		}
+	case models.Set:
+		if err := move(src.sets, dst.sets, from, to); err != nil {
+			return err
+		}
+	default:
+		return ErrMetricNotFound
+	}
+
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	if meta, ok := m.metadata[from]; ok && meta.MType == mtype {
+		delete(m.metadata, from)
+		meta.ID = to
+		m.metadata[to] = meta
+	}
+	return nil
+}
+
+func move[V any](src, dst map[string]V, from, to string) error {
+	value, ok := src[from]
+	if !ok {
+		return ErrMetricNotFound
+	}
+	if _, ok := dst[to]; ok {
+		return ErrMetricExists
+	}
+	delete(src, from)
+	dst[to] = value
+	return nil
+}
+
+// Reset empties the storage. It must not run concurrently with other calls.
+func (m *MemStorage) Reset() {
+	if m == nil {
+		return
+	}
+	for _, s := range m.shards {
+		s.Reset()
+	}
+	clear(m.metadata)
+}
+
+func (s *memShard) setGauge(name string, value float64) {
+	bits := math.Float64bits(value)
+
+	s.mu.RLock()
+	current, exists := s.gauges[name]
+	s.mu.RUnlock()
+	if exists {
+		current.Store(bits)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, exists = s.gauges[name]; !exists {
+		current = new(atomic.Uint64)
+		s.gauges[name] = current
+	}
+	current.Store(bits)
+}
+
+func (s *memShard) addCounter(name string, delta int64) {
+	s.mu.RLock()
+	current, exists := s.counters[name]
+	s.mu.RUnlock()
+	if exists {
+		current.Add(delta)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, exists = s.counters[name]; !exists {
+		current = new(atomic.Int64)
+		s.counters[name] = current
+	}
+	current.Add(delta)
+}
+
+func (s *memShard) mergeSet(name string, sketch *hll.Sketch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.sets[name]; ok {
+		existing.Merge(sketch)
+		return
+	}
+	s.sets[name] = sketch
+}
+
+func (s *memShard) delete(mtype, name string) bool {
+	var found bool
+	switch mtype {
+	case models.Gauge:
+		_, found = s.gauges[name]
+		delete(s.gauges, name)
+	case models.Counter:
+		_, found = s.counters[name]
+		delete(s.counters, name)
+	case models.Set:
+		_, found = s.sets[name]
+		delete(s.sets, name)
+	}
+	return found
+}
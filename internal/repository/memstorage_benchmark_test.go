@@ -1,12 +1,16 @@
 package repository
 
 import (
+	"context"
+	"fmt"
+	"sync/atomic"
 	"testing"
 
 	models "go-metrics-and-alerts/internal/model"
 )
 
 func BenchmarkMemStorageUpdateBatch(b *testing.B) {
+	ctx := context.Background()
 	storage := NewMemStorage()
 	val := 123.45
 	delta := int64(5)
@@ -17,8 +21,82 @@ func BenchmarkMemStorageUpdateBatch(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := storage.UpdateBatch(items); err != nil {
+		if err := storage.UpdateBatch(ctx, items); err != nil {
 			b.Fatalf("update batch: %v", err)
 		}
 	}
 }
+
+const benchMetrics = 1024
+
+// benchBatches returns batches of gauge and counter updates covering
+// benchMetrics names, as a fleet of agents would send them.
+func benchBatches() [][]models.Metrics {
+	batches := make([][]models.Metrics, benchMetrics/32)
+	for i := range batches {
+		batch := make([]models.Metrics, 0, 32)
+		for j := 0; j < 32; j++ {
+			n := i*32 + j
+			value := float64(n)
+			delta := int64(1)
+			if n%2 == 0 {
+				batch = append(batch, models.Metrics{ID: fmt.Sprintf("gauge_%d", n), MType: models.Gauge, Value: &value})
+			} else {
+				batch = append(batch, models.Metrics{ID: fmt.Sprintf("counter_%d", n), MType: models.Counter, Delta: &delta})
+			}
+		}
+		batches[i] = batch
+	}
+	return batches
+}
+
+// benchmarkMixed runs batch updates, single gauge reads and full listings in
+// parallel. One operation in a thousand lists all gauges, as the dashboard
+// and /metrics do; readPercent of the rest are reads, the others updates.
+func benchmarkMixed(b *testing.B, shards int, readPercent int) {
+	ctx := context.Background()
+	storage := NewShardedMemStorage(shards)
+	batches := benchBatches()
+	var gauges []string
+	for _, batch := range batches {
+		storage.UpdateBatch(ctx, batch)
+		for _, m := range batch {
+			if m.MType == models.Gauge {
+				gauges = append(gauges, m.ID)
+			}
+		}
+	}
+
+	var seq atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := seq.Add(1)
+			switch {
+			case n%1000 == 0:
+				if _, err := storage.GetAllGauges(ctx); err != nil {
+					b.Fatal(err)
+				}
+			case int(n%100) < readPercent:
+				if _, _, err := storage.GetGauge(ctx, gauges[n%uint64(len(gauges))]); err != nil {
+					b.Fatal(err)
+				}
+			default:
+				if err := storage.UpdateBatch(ctx, batches[n%uint64(len(batches))]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkMemStorageParallelMixed(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		for _, reads := range []int{10, 50, 90} {
+			b.Run(fmt.Sprintf("shards=%d/reads=%d%%", shards, reads), func(b *testing.B) {
+				benchmarkMixed(b, shards, reads)
+			})
+		}
+	}
+}
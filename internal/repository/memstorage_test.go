@@ -1,20 +1,160 @@
 package repository
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
+)
 
 func TestMemStorage(t *testing.T) {
+	ctx := context.Background()
 	storage := NewMemStorage()
 
-	storage.UpdateGauge("test", 123.45)
-	value, exists := storage.GetGauge("test")
+	storage.UpdateGauge(ctx, "test", 123.45)
+	value, exists, _ := storage.GetGauge(ctx, "test")
 	if !exists || value != 123.45 {
 		t.Errorf("Expected 123.45, got %f", value)
 	}
 
-	storage.UpdateCounter("counter", 10)
-	storage.UpdateCounter("counter", 5)
-	counter, exists := storage.GetCounter("counter")
+	storage.UpdateCounter(ctx, "counter", 10)
+	storage.UpdateCounter(ctx, "counter", 5)
+	counter, exists, _ := storage.GetCounter(ctx, "counter")
 	if !exists || counter != 15 {
 		t.Errorf("Expected 15, got %d", counter)
 	}
 }
+
+func TestMemStorageSet(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemStorage()
+
+	first := hll.New()
+	first.AddString("alice")
+	first.AddString("bob")
+	second := hll.New()
+	second.AddString("bob")
+	second.AddString("carol")
+
+	if err := storage.UpdateSet(ctx, "users", first.Bytes()); err != nil {
+		t.Fatalf("update set: %v", err)
+	}
+	if err := storage.UpdateBatch(ctx, []models.Metrics{{ID: "users", MType: models.Set, Registers: second.Bytes()}}); err != nil {
+		t.Fatalf("update batch: %v", err)
+	}
+
+	registers, exists, _ := storage.GetSet(ctx, "users")
+	if !exists {
+		t.Fatal("expected set to exist")
+	}
+	sketch, err := hll.FromBytes(registers)
+	if err != nil {
+		t.Fatalf("decode registers: %v", err)
+	}
+	if got := sketch.Estimate(); got != 3 {
+		t.Errorf("Expected 3, got %d", got)
+	}
+
+	if err := storage.UpdateSet(ctx, "users", []byte{1, 2, 3}); err == nil {
+		t.Error("expected error for invalid registers")
+	}
+
+	delta := int64(1)
+	err = storage.UpdateBatch(ctx, []models.Metrics{
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "users", MType: models.Set, Registers: []byte{1, 2, 3}},
+	})
+	if !errors.Is(err, hll.ErrInvalidSize) {
+		t.Fatalf("expected ErrInvalidSize from the batch, got %v", err)
+	}
+	if _, exists, _ := storage.GetCounter(ctx, "hits"); exists {
+		t.Error("expected the rejected batch to store nothing")
+	}
+}
+
+func TestMemStorageConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	storage := NewShardedMemStorage(4)
+
+	const workers, updates = 8, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			delta := int64(1)
+			for i := 0; i < updates; i++ {
+				value := float64(i)
+				storage.UpdateBatch(ctx, []models.Metrics{
+					{ID: fmt.Sprintf("hits_%d", i%16), MType: models.Counter, Delta: &delta},
+					{ID: fmt.Sprintf("load_%d", w), MType: models.Gauge, Value: &value},
+				})
+				storage.GetAllCounters(ctx)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	counters, _ := storage.GetAllCounters(ctx)
+	var total int64
+	for _, v := range counters {
+		total += v
+	}
+	if len(counters) != 16 || total != workers*updates {
+		t.Fatalf("Expected 16 counters totalling %d, got %d totalling %d", workers*updates, len(counters), total)
+	}
+	gauges, _ := storage.GetAllGauges(ctx)
+	if len(gauges) != workers || gauges["load_0"] != updates-1 {
+		t.Fatalf("Expected %d gauges with the last value, got %v", workers, gauges)
+	}
+
+	storage.Reset()
+	if counters, _ := storage.GetAllCounters(ctx); len(counters) != 0 {
+		t.Fatal("Expected Reset to empty the storage")
+	}
+}
+
+func TestMemStorageDeleteAndRename(t *testing.T) {
+	ctx := context.Background()
+	// A single shard covers renames within one shard.
+	for _, shards := range []int{1, DefaultShards} {
+		m := NewShardedMemStorage(shards)
+		m.UpdateGauge(ctx, "load", 0.5)
+		m.UpdateCounter(ctx, "load", 3)
+		m.UpdateGauge(ctx, "taken", 1)
+		m.SetMetadata(ctx, models.Metadata{ID: "load", MType: models.Gauge, Unit: "percent"})
+
+		if err := m.RenameMetric(ctx, models.Gauge, "load", "taken"); !errors.Is(err, ErrMetricExists) {
+			t.Fatalf("Expected ErrMetricExists, got %v", err)
+		}
+		if err := m.RenameMetric(ctx, models.Gauge, "missing", "other"); !errors.Is(err, ErrMetricNotFound) {
+			t.Fatalf("Expected ErrMetricNotFound, got %v", err)
+		}
+		if err := m.RenameMetric(ctx, models.Gauge, "load", "cpu"); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok, _ := m.GetGauge(ctx, "cpu"); !ok || v != 0.5 {
+			t.Fatalf("Expected cpu 0.5, got %v", v)
+		}
+		if meta, ok, _ := m.GetMetadata(ctx, "cpu"); !ok || meta.ID != "cpu" || meta.Unit != "percent" {
+			t.Fatalf("Expected the metadata to move, got %+v", meta)
+		}
+		if _, ok, _ := m.GetCounter(ctx, "load"); !ok {
+			t.Fatal("Expected the counter of the same name to stay")
+		}
+
+		if found, _ := m.DeleteMetric(ctx, models.Gauge, "cpu"); !found {
+			t.Fatal("Expected cpu to be found")
+		}
+		if found, _ := m.DeleteMetric(ctx, models.Gauge, "cpu"); found {
+			t.Fatal("Expected cpu to be gone")
+		}
+		if _, ok, _ := m.GetMetadata(ctx, "cpu"); ok {
+			t.Fatal("Expected the metadata to be deleted")
+		}
+	}
+}
@@ -1,30 +1,109 @@
 package repository
 
 import (
-	"database/sql"
+	"context"
 	"errors"
+	"maps"
+	"slices"
+	"strconv"
 	"time"
 
 	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
 
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// PostgresConfig configures the connection pool of NewPostgresPool. Zero
+// values keep the settings of the DSN, such as pool_max_conns, or the pgx
+// defaults.
+type PostgresConfig struct {
+	DSN string
+	// MaxConns and MinConns bound the number of pooled connections.
+	MaxConns int32
+	MinConns int32
+	// StatementTimeout makes the server cancel any statement running longer.
+	StatementTimeout time.Duration
+	// HealthCheckPeriod is how often idle connections are checked and
+	// replaced when broken.
+	HealthCheckPeriod time.Duration
+}
+
+// NewPostgresPool creates the connection pool. Connections are opened on
+// demand, so an unreachable database is reported by the first query.
+func NewPostgresPool(ctx context.Context, cfg PostgresConfig) (*pgxpool.Pool, error) {
+	poolCfg, err := pgxpool.ParseConfig(cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolCfg.MinConns = cfg.MinConns
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+	if cfg.StatementTimeout > 0 {
+		poolCfg.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+
+	return pgxpool.NewWithConfig(ctx, poolCfg)
+}
+
 // PostgresStorage stores metrics inside PostgreSQL tables.
 type PostgresStorage struct {
-	db *sql.DB
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStorage wraps the provided connection pool.
+func NewPostgresStorage(pool *pgxpool.Pool) (*PostgresStorage, error) {
+	return &PostgresStorage{pool: pool}, nil
 }
 
-// NewPostgresStorage wraps the provided database handle.
-func NewPostgresStorage(db *sql.DB) (*PostgresStorage, error) {
-	return &PostgresStorage{db: db}, nil
+// PoolStats is a snapshot of the connection pool counters.
+type PoolStats struct {
+	MaxConns           int32         `json:"max_conns"`
+	TotalConns         int32         `json:"total_conns"`
+	IdleConns          int32         `json:"idle_conns"`
+	AcquiredConns      int32         `json:"acquired_conns"`
+	ConstructingConns  int32         `json:"constructing_conns"`
+	AcquireCount       int64         `json:"acquire_count"`
+	EmptyAcquireCount  int64         `json:"empty_acquire_count"`
+	CanceledAcquires   int64         `json:"canceled_acquire_count"`
+	AcquireDuration    time.Duration `json:"acquire_duration_ns"`
+	NewConns           int64         `json:"new_conns"`
+	MaxLifetimeDestroy int64         `json:"max_lifetime_destroy_count"`
+	MaxIdleDestroy     int64         `json:"max_idle_destroy_count"`
+}
+
+// PoolStats returns the current connection pool counters.
+func (p *PostgresStorage) PoolStats() PoolStats {
+	stat := p.pool.Stat()
+	return PoolStats{
+		MaxConns:           stat.MaxConns(),
+		TotalConns:         stat.TotalConns(),
+		IdleConns:          stat.IdleConns(),
+		AcquiredConns:      stat.AcquiredConns(),
+		ConstructingConns:  stat.ConstructingConns(),
+		AcquireCount:       stat.AcquireCount(),
+		EmptyAcquireCount:  stat.EmptyAcquireCount(),
+		CanceledAcquires:   stat.CanceledAcquireCount(),
+		AcquireDuration:    stat.AcquireDuration(),
+		NewConns:           stat.NewConnsCount(),
+		MaxLifetimeDestroy: stat.MaxLifetimeDestroyCount(),
+		MaxIdleDestroy:     stat.MaxIdleDestroyCount(),
+	}
 }
 
 // UpdateGauge upserts the gauge value in the database.
-func (p *PostgresStorage) UpdateGauge(name string, value float64) error {
-	return p.executeWithRetry(func() error {
-		_, err := p.db.Exec(`
+func (p *PostgresStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return p.executeWithRetry(ctx, func() error {
+		_, err := p.pool.Exec(ctx, `
 			INSERT INTO gauges (id, value) VALUES ($1, $2)
 			ON CONFLICT (id) DO UPDATE SET value = $2
 		`, name, value)
@@ -33,9 +112,9 @@ func (p *PostgresStorage) UpdateGauge(name string, value float64) error {
 }
 
 // UpdateCounter increments the counter value in the database.
-func (p *PostgresStorage) UpdateCounter(name string, value int64) error {
-	return p.executeWithRetry(func() error {
-		_, err := p.db.Exec(`
+func (p *PostgresStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	return p.executeWithRetry(ctx, func() error {
+		_, err := p.pool.Exec(ctx, `
 			INSERT INTO counters (id, delta) VALUES ($1, $2)
 			ON CONFLICT (id) DO UPDATE SET delta = counters.delta + $2
 		`, name, value)
@@ -43,161 +122,535 @@ func (p *PostgresStorage) UpdateCounter(name string, value int64) error {
 	})
 }
 
-// GetGauge fetches a gauge value by name.
-func (p *PostgresStorage) GetGauge(name string) (float64, bool) {
-	var value float64
-	err := p.db.QueryRow("SELECT value FROM gauges WHERE id = $1", name).Scan(&value)
+// UpdateSet unions the HyperLogLog registers into the stored set.
+func (p *PostgresStorage) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	sketch, err := hll.FromBytes(registers)
 	if err != nil {
-		return 0, false
+		return err
 	}
-	return value, true
+
+	return p.executeWithRetry(ctx, func() error {
+		tx, err := p.pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		if err := mergeSetTx(ctx, tx, name, sketch); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// GetGauge fetches a gauge value by name.
+func (p *PostgresStorage) GetGauge(ctx context.Context, name string) (float64, bool, error) {
+	var value float64
+	found, err := p.queryRow(ctx, "SELECT value FROM gauges WHERE id = $1", []any{name}, &value)
+	return value, found, err
 }
 
 // GetCounter fetches a counter value by name.
-func (p *PostgresStorage) GetCounter(name string) (int64, bool) {
+func (p *PostgresStorage) GetCounter(ctx context.Context, name string) (int64, bool, error) {
 	var value int64
-	err := p.db.QueryRow("SELECT delta FROM counters WHERE id = $1", name).Scan(&value)
-	if err != nil {
-		return 0, false
-	}
-	return value, true
+	found, err := p.queryRow(ctx, "SELECT delta FROM counters WHERE id = $1", []any{name}, &value)
+	return value, found, err
+}
+
+// GetSet fetches the set registers by name.
+func (p *PostgresStorage) GetSet(ctx context.Context, name string) ([]byte, bool, error) {
+	var registers []byte
+	found, err := p.queryRow(ctx, "SELECT registers FROM sets WHERE id = $1", []any{name}, &registers)
+	return registers, found, err
 }
 
 // GetAllGauges returns every gauge stored in the database.
-func (p *PostgresStorage) GetAllGauges() map[string]float64 {
+func (p *PostgresStorage) GetAllGauges(ctx context.Context) (map[string]float64, error) {
 	result := make(map[string]float64)
-	rows, err := p.db.Query("SELECT id, value FROM gauges")
-	if err != nil {
-		return result
-	}
-	defer rows.Close()
-
-	for rows.Next() {
+	err := p.queryRows(ctx, "SELECT id, value FROM gauges", func(rows pgx.Rows) error {
 		var name string
 		var value float64
-		if err := rows.Scan(&name, &value); err == nil {
-			result[name] = value
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
 		}
+		result[name] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	_ = rows.Err()
-
-	return result
+	return result, nil
 }
 
 // GetAllCounters returns every counter stored in the database.
-func (p *PostgresStorage) GetAllCounters() map[string]int64 {
+func (p *PostgresStorage) GetAllCounters(ctx context.Context) (map[string]int64, error) {
 	result := make(map[string]int64)
-	rows, err := p.db.Query("SELECT id, delta FROM counters")
+	err := p.queryRows(ctx, "SELECT id, delta FROM counters", func(rows pgx.Rows) error {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		result[name] = value
+		return nil
+	})
 	if err != nil {
-		return result
+		return nil, err
 	}
-	defer rows.Close()
+	return result, nil
+}
 
-	for rows.Next() {
+// GetAllSets returns the registers of every set stored in the database.
+func (p *PostgresStorage) GetAllSets(ctx context.Context) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	err := p.queryRows(ctx, "SELECT id, registers FROM sets", func(rows pgx.Rows) error {
 		var name string
-		var value int64
-		if err := rows.Scan(&name, &value); err == nil {
-			result[name] = value
+		var registers []byte
+		if err := rows.Scan(&name, &registers); err != nil {
+			return err
+		}
+		result[name] = registers
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateBatch aggregates the batch in memory and writes each metric type
+// with a single multi-row statement inside one transaction.
+func (p *PostgresStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	batch, err := aggregateBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	return p.executeWithRetry(ctx, func() error {
+		tx, err := p.pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		if len(batch.gaugeIDs) > 0 {
+			_, err = tx.Exec(ctx, `
+				INSERT INTO gauges (id, value)
+				SELECT * FROM unnest($1::text[], $2::double precision[])
+				ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value
+			`, batch.gaugeIDs, batch.gaugeValues)
+			if err != nil {
+				return err
+			}
+		}
+		if len(batch.counterIDs) > 0 {
+			_, err = tx.Exec(ctx, `
+				INSERT INTO counters (id, delta)
+				SELECT * FROM unnest($1::text[], $2::bigint[])
+				ON CONFLICT (id) DO UPDATE SET delta = counters.delta + EXCLUDED.delta
+			`, batch.counterIDs, batch.counterDeltas)
+			if err != nil {
+				return err
+			}
+		}
+		if len(batch.setIDs) > 0 {
+			if err := mergeSetsTx(ctx, tx, batch.setIDs, batch.sets); err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit(ctx)
+	})
+}
+
+// aggregatedBatch holds one entry per metric of a batch, sorted by name so
+// that concurrent batches lock rows in the same order.
+type aggregatedBatch struct {
+	gaugeIDs      []string
+	gaugeValues   []float64
+	counterIDs    []string
+	counterDeltas []int64
+	setIDs        []string
+	sets          []*hll.Sketch
+}
+
+// aggregateBatch keeps the last value of every gauge, sums the deltas of
+// every counter and unions the sketches of every set. A single upsert cannot
+// touch the same row twice, so this is required, not just an optimisation.
+func aggregateBatch(metrics []models.Metrics) (aggregatedBatch, error) {
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+	sets := make(map[string]*hll.Sketch)
+	for _, metric := range metrics {
+		switch metric.MType {
+		case "gauge":
+			if metric.Value != nil {
+				gauges[metric.ID] = *metric.Value
+			}
+		case "counter":
+			if metric.Delta != nil {
+				counters[metric.ID] += *metric.Delta
+			}
+		case "set":
+			sketch, err := hll.FromBytes(metric.Registers)
+			if err != nil {
+				return aggregatedBatch{}, err
+			}
+			if existing, ok := sets[metric.ID]; ok {
+				existing.Merge(sketch)
+			} else {
+				sets[metric.ID] = sketch
+			}
 		}
 	}
 
-	_ = rows.Err()
+	var batch aggregatedBatch
+	batch.gaugeIDs = slices.Sorted(maps.Keys(gauges))
+	for _, id := range batch.gaugeIDs {
+		batch.gaugeValues = append(batch.gaugeValues, gauges[id])
+	}
+	batch.counterIDs = slices.Sorted(maps.Keys(counters))
+	for _, id := range batch.counterIDs {
+		batch.counterDeltas = append(batch.counterDeltas, counters[id])
+	}
+	batch.setIDs = slices.Sorted(maps.Keys(sets))
+	for _, id := range batch.setIDs {
+		batch.sets = append(batch.sets, sets[id])
+	}
+	return batch, nil
+}
 
-	return result
+// SetMetadata upserts the metric metadata.
+func (p *PostgresStorage) SetMetadata(ctx context.Context, meta models.Metadata) error {
+	return p.executeWithRetry(ctx, func() error {
+		_, err := p.pool.Exec(ctx, `
+			INSERT INTO metadata (id, description, unit, type, owner, ttl) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO UPDATE SET description = $2, unit = $3, type = $4, owner = $5, ttl = $6
+		`, meta.ID, meta.Description, meta.Unit, meta.MType, meta.Owner, meta.TTL)
+		return err
+	})
+}
+
+// GetMetadata fetches the metric metadata by name.
+func (p *PostgresStorage) GetMetadata(ctx context.Context, name string) (models.Metadata, bool, error) {
+	meta := models.Metadata{ID: name}
+	found, err := p.queryRow(ctx, "SELECT description, unit, type, owner, ttl FROM metadata WHERE id = $1", []any{name},
+		&meta.Description, &meta.Unit, &meta.MType, &meta.Owner, &meta.TTL)
+	if !found {
+		return models.Metadata{}, false, err
+	}
+	return meta, true, nil
+}
+
+// GetAllMetadata returns every metadata record stored in the database.
+func (p *PostgresStorage) GetAllMetadata(ctx context.Context) (map[string]models.Metadata, error) {
+	result := make(map[string]models.Metadata)
+	err := p.queryRows(ctx, "SELECT id, description, unit, type, owner, ttl FROM metadata", func(rows pgx.Rows) error {
+		var meta models.Metadata
+		if err := rows.Scan(&meta.ID, &meta.Description, &meta.Unit, &meta.MType, &meta.Owner, &meta.TTL); err != nil {
+			return err
+		}
+		result[meta.ID] = meta
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-// UpdateBatch applies all updates inside a single transaction.
-func (p *PostgresStorage) UpdateBatch(metrics []models.Metrics) error {
-	return p.executeWithRetry(func() error {
-		tx, err := p.db.Begin()
+// metricTables maps metric types to their tables.
+var metricTables = map[string]string{
+	models.Gauge:   "gauges",
+	models.Counter: "counters",
+	models.Set:     "sets",
+}
+
+// DeleteMetric removes the metric and the metadata pinned to its type.
+func (p *PostgresStorage) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	table, ok := metricTables[mtype]
+	if !ok {
+		return false, nil
+	}
+
+	var found bool
+	err := p.executeWithRetry(ctx, func() error {
+		tx, err := p.pool.Begin(ctx)
 		if err != nil {
 			return err
 		}
-		defer tx.Rollback()
+		defer tx.Rollback(ctx)
 
-		gaugeStmt, err := tx.Prepare(`
-			INSERT INTO gauges (id, value) VALUES ($1, $2)
-			ON CONFLICT (id) DO UPDATE SET value = $2
-		`)
+		res, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE id = $1", name)
 		if err != nil {
 			return err
 		}
-		defer gaugeStmt.Close()
+		found = res.RowsAffected() > 0
+		if _, err := tx.Exec(ctx, "DELETE FROM metadata WHERE id = $1 AND type = $2", name, mtype); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	return found, err
+}
 
-		counterStmt, err := tx.Prepare(`
-			INSERT INTO counters (id, delta) VALUES ($1, $2)
-			ON CONFLICT (id) DO UPDATE SET delta = counters.delta + $2
-		`)
+// RenameMetric moves the metric, and the metadata pinned to its type, from
+// one name to another.
+func (p *PostgresStorage) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	table, ok := metricTables[mtype]
+	if !ok {
+		return ErrMetricNotFound
+	}
+
+	return p.executeWithRetry(ctx, func() error {
+		tx, err := p.pool.Begin(ctx)
 		if err != nil {
 			return err
 		}
-		defer counterStmt.Close()
-
-		for _, metric := range metrics {
-			switch metric.MType {
-			case "gauge":
-				if metric.Value != nil {
-					_, err = gaugeStmt.Exec(metric.ID, *metric.Value)
-					if err != nil {
-						return err
-					}
-				}
-			case "counter":
-				if metric.Delta != nil {
-					_, err = counterStmt.Exec(metric.ID, *metric.Delta)
-					if err != nil {
-						return err
-					}
-				}
-			}
+		defer tx.Rollback(ctx)
+
+		res, err := tx.Exec(ctx, "UPDATE "+table+" SET id = $2 WHERE id = $1", from, to)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrMetricExists
+		}
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrMetricNotFound
+		}
+
+		_, err = tx.Exec(ctx, `
+			DELETE FROM metadata WHERE id = $2
+			AND EXISTS (SELECT 1 FROM metadata WHERE id = $1 AND type = $3)
+		`, from, to, mtype)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE metadata SET id = $2 WHERE id = $1 AND type = $3", from, to, mtype)
+		if err != nil {
+			return err
 		}
+		return tx.Commit(ctx)
+	})
+}
 
-		return tx.Commit()
+// queryRow scans a single row into dest. A missing row is reported as not
+// found rather than as an error.
+func (p *PostgresStorage) queryRow(ctx context.Context, query string, args []any, dest ...any) (bool, error) {
+	err := p.executeWithRetry(ctx, func() error {
+		return p.pool.QueryRow(ctx, query, args...).Scan(dest...)
 	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (p *PostgresStorage) executeWithRetry(fn func() error) error {
-	retryIntervals := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
+// queryRows calls scan for every row returned by query.
+func (p *PostgresStorage) queryRows(ctx context.Context, query string, scan func(pgx.Rows) error) error {
+	return p.executeWithRetry(ctx, func() error {
+		rows, err := p.pool.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	for attempt := 0; attempt <= len(retryIntervals); attempt++ {
-		if attempt > 0 {
-			time.Sleep(retryIntervals[attempt-1])
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
 		}
+		return rows.Err()
+	})
+}
 
-		err := fn()
-		if err == nil {
-			return nil
+// mergeSetTx inserts the set or, when it already exists, locks the row and
+// stores the union of both sketches.
+func mergeSetTx(ctx context.Context, tx pgx.Tx, name string, sketch *hll.Sketch) error {
+	res, err := tx.Exec(ctx, `
+		INSERT INTO sets (id, registers) VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, name, sketch.Bytes())
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() > 0 {
+		return nil
+	}
+
+	var current []byte
+	if err := tx.QueryRow(ctx, "SELECT registers FROM sets WHERE id = $1 FOR UPDATE", name).Scan(&current); err != nil {
+		return err
+	}
+
+	stored, err := hll.FromBytes(current)
+	if err != nil {
+		return err
+	}
+	stored.Merge(sketch)
+
+	_, err = tx.Exec(ctx, "UPDATE sets SET registers = $2 WHERE id = $1", name, stored.Bytes())
+	return err
+}
+
+// mergeSetsTx is the multi-row form of mergeSetTx: sets that do not exist
+// yet are inserted, the others are locked, merged and updated.
+func mergeSetsTx(ctx context.Context, tx pgx.Tx, ids []string, sketches []*hll.Sketch) error {
+	registers := make([][]byte, len(sketches))
+	for i, sketch := range sketches {
+		registers[i] = sketch.Bytes()
+	}
+
+	inserted := make(map[string]bool)
+	err := scanRows(ctx, tx, `
+		INSERT INTO sets (id, registers)
+		SELECT * FROM unnest($1::text[], $2::bytea[])
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, []any{ids, registers}, func(rows pgx.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
 		}
+		inserted[id] = true
+		return nil
+	})
+	if err != nil || len(inserted) == len(ids) {
+		return err
+	}
 
-		if !p.isRetriableError(err) {
+	pending := make(map[string]*hll.Sketch)
+	for i, id := range ids {
+		if !inserted[id] {
+			pending[id] = sketches[i]
+		}
+	}
+	var updateIDs []string
+	var updateRegisters [][]byte
+	err = scanRows(ctx, tx, `
+		SELECT id, registers FROM sets WHERE id = ANY($1::text[]) ORDER BY id FOR UPDATE
+	`, []any{slices.Sorted(maps.Keys(pending))}, func(rows pgx.Rows) error {
+		var id string
+		var current []byte
+		if err := rows.Scan(&id, &current); err != nil {
 			return err
 		}
+		stored, err := hll.FromBytes(current)
+		if err != nil {
+			return err
+		}
+		stored.Merge(pending[id])
+		updateIDs = append(updateIDs, id)
+		updateRegisters = append(updateRegisters, stored.Bytes())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE sets SET registers = u.registers
+		FROM unnest($1::text[], $2::bytea[]) AS u(id, registers)
+		WHERE sets.id = u.id
+	`, updateIDs, updateRegisters)
+	return err
+}
+
+// scanRows calls scan for every row returned by query within tx.
+func scanRows(ctx context.Context, tx pgx.Tx, query string, args []any, scan func(pgx.Rows) error) error {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-		if attempt == len(retryIntervals) {
+	for rows.Next() {
+		if err := scan(rows); err != nil {
 			return err
 		}
 	}
+	return rows.Err()
+}
+
+type retryPauseKey struct{}
 
-	return nil
+// retryPause is run around the waits between retries.
+type retryPause struct {
+	release, acquire func()
 }
 
+// withRetryPause returns ctx under which executeWithRetry calls release
+// before every wait between attempts and acquire after it, so a caller can
+// let go of a lock it holds across the write while nothing can commit.
+func withRetryPause(ctx context.Context, release, acquire func()) context.Context {
+	return context.WithValue(ctx, retryPauseKey{}, retryPause{release: release, acquire: acquire})
+}
+
+func retryPauseFrom(ctx context.Context) retryPause {
+	if pause, ok := ctx.Value(retryPauseKey{}).(retryPause); ok {
+		return pause
+	}
+	return retryPause{release: func() {}, acquire: func() {}}
+}
+
+// executeWithRetry runs fn, retrying retriable errors with increasing
+// pauses. It gives up as soon as ctx is done. A pause set by withRetryPause
+// brackets every wait between attempts.
+func (p *PostgresStorage) executeWithRetry(ctx context.Context, fn func() error) error {
+	retryIntervals := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !p.isRetriableError(err) || attempt == len(retryIntervals) {
+			return err
+		}
+
+		pause := retryPauseFrom(ctx)
+		pause.release()
+		timer := time.NewTimer(retryIntervals[attempt])
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			pause.acquire()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		pause.acquire()
+	}
+}
+
+// isRetriableError reports whether fn may run again after err without
+// applying an update twice: the statement never reached the server, or the
+// server rolled it back for a transient reason.
 func (p *PostgresStorage) isRetriableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
 	var pgErr *pgconn.PgError
-	if !errors.As(err, &pgErr) {
+	if errors.As(err, &pgErr) {
+		if pgerrcode.IsConnectionException(pgErr.Code) {
+			return true
+		}
+		switch pgErr.Code {
+		case pgerrcode.SerializationFailure,
+			pgerrcode.DeadlockDetected,
+			pgerrcode.TooManyConnections,
+			pgerrcode.CannotConnectNow,
+			pgerrcode.AdminShutdown:
+			return true
+		}
 		return false
 	}
 
-	switch pgErr.Code {
-	case pgerrcode.ConnectionException,
-		pgerrcode.ConnectionDoesNotExist,
-		pgerrcode.ConnectionFailure,
-		pgerrcode.SQLClientUnableToEstablishSQLConnection,
-		pgerrcode.SQLServerRejectedEstablishmentOfSQLConnection,
-		pgerrcode.TransactionResolutionUnknown,
-		pgerrcode.ProtocolViolation:
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
 		return true
 	}
-
-	return false
+	return pgconn.SafeToRetry(err)
 }
@@ -0,0 +1,298 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/pkg/hll"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// testPostgres connects to the database in TEST_DATABASE_DSN, applies the
+// migrations and empties the tables. Tests using it are skipped without it.
+func testPostgres(tb testing.TB) *PostgresStorage {
+	tb.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+	pool, err := NewPostgresPool(ctx, PostgresConfig{DSN: dsn, StatementTimeout: 10 * time.Second})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(pool.Close)
+
+	files, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		query, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := pool.Exec(ctx, string(query)); err != nil {
+			tb.Fatalf("%s: %v", file, err)
+		}
+	}
+	if _, err := pool.Exec(ctx, "TRUNCATE gauges, counters, sets, metadata"); err != nil {
+		tb.Fatal(err)
+	}
+
+	p, err := NewPostgresStorage(pool)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func testBatch(n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, 2*n)
+	for i := 0; i < n; i++ {
+		value, delta := float64(i), int64(1)
+		metrics = append(metrics,
+			models.Metrics{ID: fmt.Sprintf("gauge%d", i), MType: models.Gauge, Value: &value},
+			models.Metrics{ID: fmt.Sprintf("counter%d", i%(n/10+1)), MType: models.Counter, Delta: &delta},
+		)
+	}
+	return metrics
+}
+
+func TestExecuteWithRetryStopsOnCancel(t *testing.T) {
+	p := &PostgresStorage{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	start := time.Now()
+	err := p.executeWithRetry(ctx, func() error {
+		attempts++
+		cancel()
+		return &pgconn.PgError{Code: pgerrcode.ConnectionFailure}
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Retry did not stop on cancel, took %v", elapsed)
+	}
+}
+
+func TestExecuteWithRetryReturnsPermanentErrors(t *testing.T) {
+	p := &PostgresStorage{}
+	attempts := 0
+	err := p.executeWithRetry(context.Background(), func() error {
+		attempts++
+		return &pgconn.PgError{Code: pgerrcode.UniqueViolation}
+	})
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || attempts != 1 {
+		t.Fatalf("Expected one attempt returning the error, got %d attempts and %v", attempts, err)
+	}
+}
+
+func TestIsRetriableError(t *testing.T) {
+	p := &PostgresStorage{}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection failure", &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, true},
+		{"serialization failure", &pgconn.PgError{Code: pgerrcode.SerializationFailure}, true},
+		{"too many connections", &pgconn.PgError{Code: pgerrcode.TooManyConnections}, true},
+		{"unique violation", &pgconn.PgError{Code: pgerrcode.UniqueViolation}, false},
+		{"statement timeout", &pgconn.PgError{Code: pgerrcode.QueryCanceled}, false},
+		{"connect error", &pgconn.ConnectError{}, true},
+		{"broken connection", io.ErrUnexpectedEOF, false},
+		{"canceled", fmt.Errorf("query: %w", context.Canceled), false},
+	}
+	for _, tt := range tests {
+		if got := p.isRetriableError(tt.err); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestAggregateBatch(t *testing.T) {
+	first, last := 1.0, 2.0
+	delta := int64(3)
+	alice, bob := hll.New(), hll.New()
+	alice.AddString("alice")
+	bob.AddString("bob")
+
+	batch, err := aggregateBatch([]models.Metrics{
+		{ID: "load", MType: models.Gauge, Value: &first},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "users", MType: models.Set, Registers: alice.Bytes()},
+		{ID: "load", MType: models.Gauge, Value: &last},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "errors", MType: models.Counter, Delta: &delta},
+		{ID: "users", MType: models.Set, Registers: bob.Bytes()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(batch.gaugeIDs, []string{"load"}) || batch.gaugeValues[0] != 2 {
+		t.Fatalf("Expected the last gauge value, got %v %v", batch.gaugeIDs, batch.gaugeValues)
+	}
+	if !slices.Equal(batch.counterIDs, []string{"errors", "hits"}) || !slices.Equal(batch.counterDeltas, []int64{3, 6}) {
+		t.Fatalf("Expected summed and sorted counters, got %v %v", batch.counterIDs, batch.counterDeltas)
+	}
+	if len(batch.sets) != 1 || batch.sets[0].Estimate() != 2 {
+		t.Fatalf("Expected one merged set, got %d", len(batch.sets))
+	}
+
+	if _, err := aggregateBatch([]models.Metrics{{ID: "bad", MType: models.Set, Registers: []byte{1}}}); err == nil {
+		t.Fatal("Expected invalid registers to fail")
+	}
+}
+
+func TestPostgresUpdateBatch(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+
+	alice, bob := hll.New(), hll.New()
+	alice.AddString("alice")
+	bob.AddString("bob")
+	if err := p.UpdateSet(ctx, "users", alice.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpdateCounter(ctx, "hits", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	value, delta := 0.5, int64(2)
+	err := p.UpdateBatch(ctx, []models.Metrics{
+		{ID: "load", MType: models.Gauge, Value: &value},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "users", MType: models.Set, Registers: bob.Bytes()},
+		{ID: "visitors", MType: models.Set, Registers: bob.Bytes()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok, _ := p.GetGauge(ctx, "load"); !ok || v != 0.5 {
+		t.Fatalf("Expected load 0.5, got %v", v)
+	}
+	if v, _, _ := p.GetCounter(ctx, "hits"); v != 14 {
+		t.Fatalf("Expected hits 14, got %d", v)
+	}
+	for name, want := range map[string]uint64{"users": 2, "visitors": 1} {
+		registers, _, _ := p.GetSet(ctx, name)
+		sketch, err := hll.FromBytes(registers)
+		if err != nil || sketch.Estimate() != want {
+			t.Fatalf("Expected %s estimate %d, got %v", name, want, err)
+		}
+	}
+}
+
+func TestPostgresDeleteAndRename(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+
+	p.UpdateGauge(ctx, "load", 0.5)
+	p.UpdateGauge(ctx, "taken", 1)
+	p.SetMetadata(ctx, models.Metadata{ID: "load", MType: models.Gauge, TTL: "1h"})
+
+	if err := p.RenameMetric(ctx, models.Gauge, "load", "taken"); !errors.Is(err, ErrMetricExists) {
+		t.Fatalf("Expected ErrMetricExists, got %v", err)
+	}
+	if err := p.RenameMetric(ctx, models.Gauge, "missing", "other"); !errors.Is(err, ErrMetricNotFound) {
+		t.Fatalf("Expected ErrMetricNotFound, got %v", err)
+	}
+	if err := p.RenameMetric(ctx, models.Gauge, "load", "cpu"); err != nil {
+		t.Fatal(err)
+	}
+	if meta, ok, _ := p.GetMetadata(ctx, "cpu"); !ok || meta.TTL != "1h" {
+		t.Fatalf("Expected the metadata to move, got %+v", meta)
+	}
+
+	if found, err := p.DeleteMetric(ctx, models.Gauge, "cpu"); err != nil || !found {
+		t.Fatalf("Expected cpu to be deleted, got %v", err)
+	}
+	if _, ok, _ := p.GetMetadata(ctx, "cpu"); ok {
+		t.Fatal("Expected the metadata to be deleted")
+	}
+	if found, _ := p.DeleteMetric(ctx, models.Gauge, "cpu"); found {
+		t.Fatal("Expected cpu to be gone")
+	}
+}
+
+// updateBatchPrepared is the UpdateBatch that bulk upserts replaced: one
+// transaction executing prepared statements metric by metric. It is kept as
+// the benchmark baseline.
+func updateBatchPrepared(ctx context.Context, p *PostgresStorage, metrics []models.Metrics) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Prepare(ctx, "bench_gauge", `
+		INSERT INTO gauges (id, value) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET value = $2
+	`); err != nil {
+		return err
+	}
+	if _, err := tx.Prepare(ctx, "bench_counter", `
+		INSERT INTO counters (id, delta) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET delta = counters.delta + $2
+	`); err != nil {
+		return err
+	}
+
+	for _, m := range metrics {
+		switch {
+		case m.MType == models.Gauge && m.Value != nil:
+			_, err = tx.Exec(ctx, "bench_gauge", m.ID, *m.Value)
+		case m.MType == models.Counter && m.Delta != nil:
+			_, err = tx.Exec(ctx, "bench_counter", m.ID, *m.Delta)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func BenchmarkPostgresUpdateBatch(b *testing.B) {
+	p := testPostgres(b)
+	ctx := context.Background()
+
+	for _, n := range []int{100, 1000, 10000} {
+		metrics := testBatch(n)
+		b.Run(fmt.Sprintf("prepared/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := updateBatchPrepared(ctx, p, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("bulk/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := p.UpdateBatch(ctx, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -7,17 +7,12 @@ import (
 	"sync"
 )
 
-func (m *MemStorage) Reset() {
+func (m *memShard) Reset() {
 	if m == nil {
 		return
 	}
+	m.mu = sync.RWMutex{}
 	clear(m.gauges)
 	clear(m.counters)
-	if m.mu != nil {
-		if resetter, ok := interface{}(m.mu).(interface{ Reset() }); ok {
-			resetter.Reset()
-		} else {
-			*m.mu = sync.Mutex{}
-		}
-	}
+	clear(m.sets)
 }
@@ -0,0 +1,411 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// Durability controls when a WriteBehind acknowledges an update.
+type Durability string
+
+const (
+	// DurabilityAsync acknowledges updates once they are buffered. A crash
+	// loses at most the updates of one flush interval; failed flushes are
+	// kept and retried with the next one.
+	DurabilityAsync Durability = "async"
+	// DurabilitySync acknowledges updates once the flush that contains them
+	// has committed, so nothing acknowledged is lost. Concurrent updates
+	// share one flush.
+	DurabilitySync Durability = "sync"
+)
+
+// ParseDurability parses a durability mode name.
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(strings.ToLower(strings.TrimSpace(s))); d {
+	case DurabilityAsync, DurabilitySync:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown write-behind durability %q", s)
+	}
+}
+
+const (
+	// DefaultFlushInterval is the flush period of a WriteBehind.
+	DefaultFlushInterval = 100 * time.Millisecond
+	// DefaultFlushEntries is the number of buffered metrics that triggers
+	// an early flush.
+	DefaultFlushEntries = 1000
+)
+
+// WriteBehindConfig configures a WriteBehind.
+type WriteBehindConfig struct {
+	// Interval is the time between flushes.
+	Interval time.Duration
+	// MaxEntries is the number of distinct buffered gauges and counters
+	// that triggers a flush before the interval ends.
+	MaxEntries int
+	// Durability selects when updates are acknowledged.
+	Durability Durability
+}
+
+// WriteBehind buffers gauge and counter updates in memory and writes them to
+// the wrapped repository as one aggregated batch: the latest value of every
+// gauge and the summed delta of every counter. Reads see buffered updates
+// merged with the stored values. Sets and metadata are written through.
+type WriteBehind struct {
+	Repository
+	cfg WriteBehindConfig
+
+	// mu guards the buffer and the batch being flushed.
+	mu               sync.Mutex
+	gauges           map[string]float64
+	counters         map[string]int64
+	waiters          []chan error
+	flushingGauges   map[string]float64
+	flushingCounters map[string]int64
+
+	// readMu keeps counter reads from seeing a flushed batch both in the
+	// repository and in flushingCounters while it commits. It is released
+	// while the repository waits to retry, when nothing can commit.
+	readMu sync.RWMutex
+	// flushMu keeps flushes from overlapping.
+	flushMu sync.Mutex
+
+	kick      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWriteBehind wraps repo and starts the flush loop. Close flushes what is
+// left.
+func NewWriteBehind(repo Repository, cfg WriteBehindConfig) *WriteBehind {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultFlushInterval
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = DefaultFlushEntries
+	}
+	if cfg.Durability == "" {
+		cfg.Durability = DurabilityAsync
+	}
+	w := &WriteBehind{
+		Repository: repo,
+		cfg:        cfg,
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		kick:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go w.flushLoop()
+	return w
+}
+
+func (w *WriteBehind) flushLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		}
+		if err := w.Flush(); err != nil {
+			log.Printf("write-behind: flush failed: %v", err)
+		}
+	}
+}
+
+// Close stops the flush loop and flushes the remaining updates.
+func (w *WriteBehind) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+		err = w.Flush()
+	})
+	return err
+}
+
+// Flush writes the buffered updates now. It is not tied to any request, so
+// it runs without a deadline.
+func (w *WriteBehind) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	return w.flushLocked()
+}
+
+func (w *WriteBehind) flushLocked() error {
+	w.mu.Lock()
+	gauges, counters, waiters := w.gauges, w.counters, w.waiters
+	if len(gauges) == 0 && len(counters) == 0 {
+		w.waiters = nil
+		w.mu.Unlock()
+		notify(waiters, nil)
+		return nil
+	}
+	w.gauges = make(map[string]float64)
+	w.counters = make(map[string]int64)
+	w.waiters = nil
+	w.flushingGauges, w.flushingCounters = gauges, counters
+	w.mu.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(gauges)+len(counters))
+	for name, value := range gauges {
+		value := value
+		metrics = append(metrics, models.Metrics{ID: name, MType: models.Gauge, Value: &value})
+	}
+	for name, delta := range counters {
+		delta := delta
+		metrics = append(metrics, models.Metrics{ID: name, MType: models.Counter, Delta: &delta})
+	}
+
+	w.readMu.Lock()
+	ctx := withRetryPause(context.Background(), w.readMu.Unlock, w.readMu.Lock)
+	err := w.Repository.UpdateBatch(ctx, metrics)
+	w.mu.Lock()
+	w.flushingGauges, w.flushingCounters = nil, nil
+	if err != nil && w.cfg.Durability == DurabilityAsync {
+		// Nobody was told about the failure, so keep the updates for the
+		// next flush. Newer gauge values win.
+		for name, value := range gauges {
+			if _, ok := w.gauges[name]; !ok {
+				w.gauges[name] = value
+			}
+		}
+		for name, delta := range counters {
+			w.counters[name] += delta
+		}
+	}
+	w.mu.Unlock()
+	w.readMu.Unlock()
+
+	notify(waiters, err)
+	return err
+}
+
+func notify(waiters []chan error, err error) {
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// buffer applies fn to the buffer under the lock and, in sync mode, waits
+// for the flush that writes it. If ctx is done while the update is still
+// buffered, undo takes it back under the lock and ctx.Err is returned, so a
+// retried request does not apply it twice. Once a flush has taken the update
+// the flush result is returned whatever ctx says.
+func (w *WriteBehind) buffer(ctx context.Context, fn, undo func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var wait chan error
+	w.mu.Lock()
+	fn()
+	if w.cfg.Durability == DurabilitySync {
+		wait = make(chan error, 1)
+		w.waiters = append(w.waiters, wait)
+	}
+	full := len(w.gauges)+len(w.counters) >= w.cfg.MaxEntries
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	if wait == nil {
+		return nil
+	}
+	select {
+	case err := <-wait:
+		return err
+	case <-ctx.Done():
+	}
+
+	w.mu.Lock()
+	for i, ch := range w.waiters {
+		if ch == wait {
+			w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
+			undo()
+			w.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	w.mu.Unlock()
+	return <-wait
+}
+
+// UpdateGauge buffers the gauge value. An undone gauge keeps its buffered
+// value: writing it again is harmless.
+func (w *WriteBehind) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return w.buffer(ctx, func() { w.gauges[name] = value }, func() {})
+}
+
+// UpdateCounter buffers the counter delta.
+func (w *WriteBehind) UpdateCounter(ctx context.Context, name string, value int64) error {
+	return w.buffer(ctx, func() { w.counters[name] += value }, func() { w.undoCounter(name, value) })
+}
+
+// undoCounter takes a buffered delta back, unless the counter was deleted
+// meanwhile. It must be called with mu held.
+func (w *WriteBehind) undoCounter(name string, delta int64) {
+	if _, ok := w.counters[name]; ok {
+		w.counters[name] -= delta
+	}
+}
+
+// UpdateBatch buffers the gauges and counters of the batch and writes its
+// sets through.
+func (w *WriteBehind) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	var sets []models.Metrics
+	for _, metric := range metrics {
+		if metric.MType == models.Set {
+			sets = append(sets, metric)
+		}
+	}
+	if len(sets) > 0 {
+		if err := w.Repository.UpdateBatch(ctx, sets); err != nil {
+			return err
+		}
+	}
+
+	return w.buffer(ctx, func() {
+		for _, metric := range metrics {
+			switch metric.MType {
+			case models.Gauge:
+				if metric.Value != nil {
+					w.gauges[metric.ID] = *metric.Value
+				}
+			case models.Counter:
+				if metric.Delta != nil {
+					w.counters[metric.ID] += *metric.Delta
+				}
+			}
+		}
+	}, func() {
+		for _, metric := range metrics {
+			if metric.MType == models.Counter && metric.Delta != nil {
+				w.undoCounter(metric.ID, *metric.Delta)
+			}
+		}
+	})
+}
+
+// DeleteMetric drops the buffered updates of the metric and deletes it from
+// the wrapped repository.
+func (w *WriteBehind) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	// Waits for a running flush, which could otherwise store the metric
+	// again after it is deleted.
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	var buffered bool
+	w.mu.Lock()
+	switch mtype {
+	case models.Gauge:
+		_, buffered = w.gauges[name]
+		delete(w.gauges, name)
+	case models.Counter:
+		_, buffered = w.counters[name]
+		delete(w.counters, name)
+	}
+	w.mu.Unlock()
+
+	found, err := w.Repository.DeleteMetric(ctx, mtype, name)
+	return found || buffered, err
+}
+
+// RenameMetric flushes the buffer and renames the metric in the wrapped
+// repository.
+func (w *WriteBehind) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	return w.Repository.RenameMetric(ctx, mtype, from, to)
+}
+
+// GetGauge returns the newest value, buffered or stored.
+func (w *WriteBehind) GetGauge(ctx context.Context, name string) (float64, bool, error) {
+	w.mu.Lock()
+	value, ok := w.gauges[name]
+	if !ok {
+		value, ok = w.flushingGauges[name]
+	}
+	w.mu.Unlock()
+	if ok {
+		return value, true, nil
+	}
+	return w.Repository.GetGauge(ctx, name)
+}
+
+// GetCounter returns the stored total plus the buffered deltas.
+func (w *WriteBehind) GetCounter(ctx context.Context, name string) (int64, bool, error) {
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+
+	total, found, err := w.Repository.GetCounter(ctx, name)
+	if err != nil {
+		return 0, false, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, pending := range []map[string]int64{w.flushingCounters, w.counters} {
+		if delta, ok := pending[name]; ok {
+			total += delta
+			found = true
+		}
+	}
+	return total, found, nil
+}
+
+// GetAllGauges returns the stored gauges overlaid with the buffered ones.
+func (w *WriteBehind) GetAllGauges(ctx context.Context) (map[string]float64, error) {
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+
+	result, err := w.Repository.GetAllGauges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, pending := range []map[string]float64{w.flushingGauges, w.gauges} {
+		for name, value := range pending {
+			result[name] = value
+		}
+	}
+	return result, nil
+}
+
+// GetAllCounters returns the stored totals plus the buffered deltas.
+func (w *WriteBehind) GetAllCounters(ctx context.Context) (map[string]int64, error) {
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+
+	result, err := w.Repository.GetAllCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, pending := range []map[string]int64{w.flushingCounters, w.counters} {
+		for name, delta := range pending {
+			result[name] += delta
+		}
+	}
+	return result, nil
+}
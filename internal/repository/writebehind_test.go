@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+var errBatchFailed = errors.New("batch failed")
+
+// flakyStorage fails UpdateBatch while fail is set.
+type flakyStorage struct {
+	*MemStorage
+	fail bool
+}
+
+func (f *flakyStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	if f.fail {
+		return errBatchFailed
+	}
+	return f.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestWriteBehindMergesReadsAndFlushes(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	mem.UpdateCounter(ctx, "hits", 10)
+	w := NewWriteBehind(mem, WriteBehindConfig{Interval: time.Hour})
+	defer w.Close()
+
+	w.UpdateGauge(ctx, "load", 0.5)
+	w.UpdateCounter(ctx, "hits", 2)
+	delta := int64(3)
+	w.UpdateBatch(ctx, []models.Metrics{{ID: "hits", MType: models.Counter, Delta: &delta}})
+
+	if _, ok, _ := mem.GetGauge(ctx, "load"); ok {
+		t.Fatal("Expected the gauge to stay buffered")
+	}
+	if v, ok, _ := w.GetGauge(ctx, "load"); !ok || v != 0.5 {
+		t.Fatalf("Expected buffered load 0.5, got %v", v)
+	}
+	if v, _, _ := w.GetCounter(ctx, "hits"); v != 15 {
+		t.Fatalf("Expected merged hits 15, got %d", v)
+	}
+	if all, _ := w.GetAllCounters(ctx); all["hits"] != 15 {
+		t.Fatalf("Expected merged hits 15, got %v", all)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := mem.GetCounter(ctx, "hits"); v != 15 {
+		t.Fatalf("Expected stored hits 15, got %d", v)
+	}
+	if v, _, _ := w.GetCounter(ctx, "hits"); v != 15 {
+		t.Fatalf("Expected hits 15 after flush, got %d", v)
+	}
+}
+
+func TestWriteBehindFlushesWhenFull(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	w := NewWriteBehind(mem, WriteBehindConfig{Interval: time.Hour, MaxEntries: 2})
+	defer w.Close()
+
+	w.UpdateGauge(ctx, "a", 1)
+	w.UpdateGauge(ctx, "b", 2)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok, _ := mem.GetGauge(ctx, "b"); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a flush once the buffer is full")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWriteBehindAsyncKeepsFailedFlush(t *testing.T) {
+	ctx := context.Background()
+	repo := &flakyStorage{MemStorage: NewMemStorage(), fail: true}
+	w := NewWriteBehind(repo, WriteBehindConfig{Interval: time.Hour})
+
+	w.UpdateCounter(ctx, "hits", 2)
+	if err := w.Flush(); !errors.Is(err, errBatchFailed) {
+		t.Fatalf("Expected the flush to fail, got %v", err)
+	}
+	w.UpdateCounter(ctx, "hits", 3)
+	if v, _, _ := w.GetCounter(ctx, "hits"); v != 5 {
+		t.Fatalf("Expected hits 5 to stay buffered, got %d", v)
+	}
+
+	repo.fail = false
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := repo.GetCounter(ctx, "hits"); v != 5 {
+		t.Fatalf("Expected hits 5 stored on close, got %d", v)
+	}
+}
+
+func TestWriteBehindSyncWaitsForFlush(t *testing.T) {
+	ctx := context.Background()
+	repo := &flakyStorage{MemStorage: NewMemStorage()}
+	w := NewWriteBehind(repo, WriteBehindConfig{Interval: 10 * time.Millisecond, Durability: DurabilitySync})
+	defer w.Close()
+
+	if err := w.UpdateCounter(ctx, "hits", 2); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := repo.GetCounter(ctx, "hits"); v != 2 {
+		t.Fatalf("Expected hits stored before the update returns, got %d", v)
+	}
+
+	repo.fail = true
+	if err := w.UpdateCounter(ctx, "hits", 3); !errors.Is(err, errBatchFailed) {
+		t.Fatalf("Expected the flush error, got %v", err)
+	}
+}
+
+func TestWriteBehindSyncUndoesCancelledUpdate(t *testing.T) {
+	mem := NewMemStorage()
+	w := NewWriteBehind(mem, WriteBehindConfig{Interval: time.Hour, Durability: DurabilitySync})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.UpdateCounter(ctx, "hits", 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline error, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := mem.GetCounter(context.Background(), "hits"); v != 0 {
+		t.Fatalf("Expected the cancelled delta not to be stored, got %d", v)
+	}
+}
+
+func TestWriteBehindDeleteDropsBuffer(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	mem.UpdateCounter(ctx, "hits", 10)
+	w := NewWriteBehind(mem, WriteBehindConfig{Interval: time.Hour})
+
+	w.UpdateCounter(ctx, "hits", 2)
+	w.UpdateGauge(ctx, "load", 1)
+	if found, _ := w.DeleteMetric(ctx, models.Counter, "hits"); !found {
+		t.Fatal("Expected hits to be found")
+	}
+	if found, _ := w.DeleteMetric(ctx, models.Gauge, "load"); !found {
+		t.Fatal("Expected the buffered gauge to be found")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := mem.GetCounter(ctx, "hits"); ok {
+		t.Fatal("Expected the flush not to bring hits back")
+	}
+	if _, ok, _ := mem.GetGauge(ctx, "load"); ok {
+		t.Fatal("Expected the flush not to store load")
+	}
+}
+
+func TestParseDurability(t *testing.T) {
+	if d, err := ParseDurability(" Sync "); err != nil || d != DurabilitySync {
+		t.Fatalf("Expected sync, got %q %v", d, err)
+	}
+	if _, err := ParseDurability("eventually"); err == nil {
+		t.Fatal("Expected an unknown mode to fail")
+	}
+}
@@ -0,0 +1,276 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"sync"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+type timerAgg struct {
+	name   string
+	labels []models.Label
+	values []float64
+	count  float64
+}
+
+// Aggregator accumulates StatsD lines between flushes. Counters are summed
+// with their sample rate applied, gauges keep their last value, timers and
+// histograms are summarised and set members are collected into HyperLogLog
+// sketches. The fractions that sample rates leave in counts are carried
+// into the next interval rather than rounded away.
+type Aggregator struct {
+	storage repository.Repository
+
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	dirty    map[string]bool
+	timers   map[string]*timerAgg
+	sets     map[string]*hll.Sketch
+	// remainders holds the fractional timer counts left by the last drain.
+	remainders map[string]float64
+}
+
+// NewAggregator creates an aggregator flushing into storage.
+func NewAggregator(storage repository.Repository) *Aggregator {
+	return &Aggregator{
+		storage:  storage,
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		dirty:    make(map[string]bool),
+		timers:   make(map[string]*timerAgg),
+		sets:     make(map[string]*hll.Sketch),
+
+		remainders: make(map[string]float64),
+	}
+}
+
+// Add folds the line into the current interval. A relative gauge update
+// whose current value cannot be read is dropped.
+func (a *Aggregator) Add(l Line) {
+	id := l.ID()
+	if l.Type == TypeGauge && l.Relative && !a.loadGauge(id) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch l.Type {
+	case TypeCounter:
+		a.counters[id] += l.Value / l.Rate
+	case TypeGauge:
+		if l.Relative {
+			a.gauges[id] += l.Value
+		} else {
+			a.gauges[id] = l.Value
+		}
+		a.dirty[id] = true
+	case TypeTimer, TypeHistogram:
+		t, ok := a.timers[id]
+		if !ok {
+			t = &timerAgg{name: l.Name, labels: l.Labels}
+			a.timers[id] = t
+		}
+		t.values = append(t.values, l.Value)
+		t.count += 1 / l.Rate
+	case TypeSet:
+		s, ok := a.sets[id]
+		if !ok {
+			s = hll.New()
+			a.sets[id] = s
+		}
+		s.AddString(l.Member)
+	}
+}
+
+// loadGauge seeds a gauge the aggregator has not seen with its stored
+// value, so relative updates continue from it, and reports whether the gauge
+// is known. Storage is read without holding mu.
+func (a *Aggregator) loadGauge(id string) bool {
+	a.mu.Lock()
+	_, ok := a.gauges[id]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	value, _, err := a.storage.GetGauge(context.Background(), id)
+	if err != nil {
+		log.Printf("statsd: reading gauge %s, dropping relative update: %v", id, err)
+		return false
+	}
+	a.mu.Lock()
+	if _, ok := a.gauges[id]; !ok {
+		a.gauges[id] = value
+	}
+	a.mu.Unlock()
+	return true
+}
+
+// Flush writes the aggregated interval into storage and starts a new one.
+// Gauges keep their value so relative updates continue from it. Metrics
+// beyond the storage limits are dropped without holding back the rest. If the
+// storage fails, the interval is merged back into the next one.
+func (a *Aggregator) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	iv := a.drain()
+	a.mu.Unlock()
+
+	metrics := iv.metrics()
+	if len(metrics) == 0 {
+		return nil
+	}
+	ctx = repository.WithPartialWrites(repository.WithSource(ctx, "statsd"))
+	err := a.storage.UpdateBatch(ctx, metrics)
+	if err != nil && !errors.Is(err, repository.ErrSeriesLimit) && !errors.Is(err, repository.ErrInvalidName) {
+		a.mu.Lock()
+		a.restore(iv)
+		a.mu.Unlock()
+	}
+	return err
+}
+
+// interval is the drained state of one flush interval.
+type interval struct {
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string]*timerAgg
+	sets     map[string]*hll.Sketch
+}
+
+// drain takes the current interval and starts a new one. Counts are
+// rounded and their remainders start the new interval. It must be called
+// with mu held.
+func (a *Aggregator) drain() interval {
+	iv := interval{
+		counters: a.counters,
+		gauges:   make(map[string]float64, len(a.dirty)),
+		timers:   a.timers,
+		sets:     a.sets,
+	}
+	for id := range a.dirty {
+		iv.gauges[id] = a.gauges[id]
+	}
+	a.counters = make(map[string]float64)
+	a.dirty = make(map[string]bool)
+	a.timers = make(map[string]*timerAgg)
+	a.sets = make(map[string]*hll.Sketch)
+
+	for id, total := range iv.counters {
+		iv.counters[id] = math.Round(total)
+		if rest := total - iv.counters[id]; rest != 0 {
+			a.counters[id] = rest
+		}
+	}
+	for id, t := range iv.timers {
+		total := t.count + a.remainders[id]
+		t.count = math.Round(total)
+		if rest := total - t.count; rest != 0 {
+			a.remainders[id] = rest
+		} else {
+			delete(a.remainders, id)
+		}
+	}
+	return iv
+}
+
+// restore merges an interval that could not be stored into the current
+// one. Gauges set since the drain keep their newer value. It must be called
+// with mu held.
+func (a *Aggregator) restore(iv interval) {
+	for id, total := range iv.counters {
+		a.counters[id] += total
+	}
+	for id := range iv.gauges {
+		a.dirty[id] = true
+	}
+	for id, t := range iv.timers {
+		if current, ok := a.timers[id]; ok {
+			current.values = append(current.values, t.values...)
+			current.count += t.count
+			continue
+		}
+		a.timers[id] = t
+	}
+	for id, s := range iv.sets {
+		if current, ok := a.sets[id]; ok {
+			current.Merge(s)
+			continue
+		}
+		a.sets[id] = s
+	}
+}
+
+func (iv interval) metrics() []models.Metrics {
+	var metrics []models.Metrics
+
+	for id, total := range iv.counters {
+		delta := int64(total)
+		if delta != 0 {
+			metrics = append(metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &delta})
+		}
+	}
+
+	for id, value := range iv.gauges {
+		value := value
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &value})
+	}
+
+	for _, t := range iv.timers {
+		metrics = append(metrics, summarise(t)...)
+	}
+
+	for id, s := range iv.sets {
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Set, Registers: s.Bytes()})
+	}
+
+	return metrics
+}
+
+// summarise turns timer samples into a count counter and min, max, mean,
+// median and 95th percentile gauges.
+func summarise(t *timerAgg) []models.Metrics {
+	sort.Float64s(t.values)
+
+	sum := 0.0
+	for _, v := range t.values {
+		sum += v
+	}
+	n := len(t.values)
+	count := int64(t.count)
+
+	gauges := []struct {
+		suffix string
+		value  float64
+	}{
+		{".min", t.values[0]},
+		{".max", t.values[n-1]},
+		{".mean", sum / float64(n)},
+		{".median", percentile(t.values, 0.5)},
+		{".p95", percentile(t.values, 0.95)},
+	}
+
+	metrics := []models.Metrics{{ID: models.JoinID(t.name+".count", t.labels), MType: models.Counter, Delta: &count}}
+	for _, g := range gauges {
+		value := g.value
+		metrics = append(metrics, models.Metrics{ID: models.JoinID(t.name+g.suffix, t.labels), MType: models.Gauge, Value: &value})
+	}
+	return metrics
+}
+
+// percentile uses the nearest-rank method on sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
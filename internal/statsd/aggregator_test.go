@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+type flakyStorage struct {
+	*repository.MemStorage
+	fail bool
+}
+
+var errStorageDown = errors.New("storage down")
+
+func (f *flakyStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	if f.fail {
+		return errStorageDown
+	}
+	return f.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestFlushKeepsIntervalOnStorageError(t *testing.T) {
+	ctx := context.Background()
+	storage := &flakyStorage{MemStorage: repository.NewMemStorage(), fail: true}
+	agg := NewAggregator(storage)
+
+	for _, line := range []string{"hits:2|c", "users:alice|s", "latency:10|ms"} {
+		l, err := ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg.Add(l)
+	}
+	if err := agg.Flush(ctx); !errors.Is(err, errStorageDown) {
+		t.Fatalf("expected the storage error, got %v", err)
+	}
+
+	for _, line := range []string{"hits:1|c", "latency:30|ms"} {
+		l, _ := ParseLine(line)
+		agg.Add(l)
+	}
+	storage.fail = false
+	if err := agg.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if v, _, _ := storage.GetCounter(ctx, "hits"); v != 3 {
+		t.Fatalf("expected hits 3, got %d", v)
+	}
+	if v, _, _ := storage.GetCounter(ctx, "latency.count"); v != 2 {
+		t.Fatalf("expected latency.count 2, got %d", v)
+	}
+	if _, ok, _ := storage.GetSet(ctx, "users"); !ok {
+		t.Fatal("expected users set")
+	}
+}
+
+func TestFlushCarriesSampledRemainders(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	agg := NewAggregator(storage)
+
+	// Each interval counts 1/0.3 ≈ 3.33 hits and timings.
+	for i := 0; i < 3; i++ {
+		for _, line := range []string{"hits:1|c|@0.3", "latency:10|ms|@0.3"} {
+			l, err := ParseLine(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			agg.Add(l)
+		}
+		if err := agg.Flush(ctx); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+	}
+
+	if v, _, _ := storage.GetCounter(ctx, "hits"); v != 10 {
+		t.Fatalf("expected hits 10, got %d", v)
+	}
+	if v, _, _ := storage.GetCounter(ctx, "latency.count"); v != 10 {
+		t.Fatalf("expected latency.count 10, got %d", v)
+	}
+}
+
+type unreadableStorage struct {
+	*repository.MemStorage
+}
+
+func (u unreadableStorage) GetGauge(ctx context.Context, name string) (float64, bool, error) {
+	return 0, false, errStorageDown
+}
+
+func TestRelativeGaugeDroppedWhenUnreadable(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	if err := storage.UpdateGauge(ctx, "temp", 20); err != nil {
+		t.Fatal(err)
+	}
+	agg := NewAggregator(unreadableStorage{storage})
+
+	l, _ := ParseLine("temp:+5|g")
+	agg.Add(l)
+	if err := agg.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "temp"); v != 20 {
+		t.Fatalf("expected temp to stay 20, got %v", v)
+	}
+}
@@ -0,0 +1,105 @@
+// Package statsd receives StatsD lines over UDP and TCP, aggregates them per
+// flush interval and writes the result into the metrics repository.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// StatsD metric types.
+const (
+	TypeCounter   = "c"
+	TypeGauge     = "g"
+	TypeTimer     = "ms"
+	TypeHistogram = "h"
+	TypeSet       = "s"
+)
+
+// ErrInvalidLine is returned for lines that do not follow the StatsD format.
+var ErrInvalidLine = errors.New("statsd: invalid line")
+
+// Line is one parsed StatsD sample.
+type Line struct {
+	Name   string
+	Labels []models.Label
+	Type   string
+	// Value is the numeric sample; set members are kept in Member instead.
+	Value  float64
+	Member string
+	// Relative marks gauge values prefixed with + or - that adjust the
+	// current gauge instead of replacing it.
+	Relative bool
+	Rate     float64
+}
+
+// ParseLine parses name:value|type[|@rate][|#tag:value,...].
+func ParseLine(line string) (Line, error) {
+	l := Line{Rate: 1}
+
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return l, fmt.Errorf("%w: missing name in %q", ErrInvalidLine, line)
+	}
+	l.Name = line[:colon]
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return l, fmt.Errorf("%w: missing value or type in %q", ErrInvalidLine, line)
+	}
+	raw := parts[0]
+	l.Type = parts[1]
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return l, fmt.Errorf("%w: bad sample rate in %q", ErrInvalidLine, line)
+			}
+			l.Rate = rate
+		case strings.HasPrefix(part, "#"):
+			l.Labels = parseTags(part[1:])
+		}
+	}
+
+	switch l.Type {
+	case TypeSet:
+		l.Member = raw
+		return l, nil
+	case TypeCounter, TypeTimer, TypeHistogram:
+	case TypeGauge:
+		l.Relative = raw[0] == '+' || raw[0] == '-'
+	default:
+		return l, fmt.Errorf("%w: unknown type %q", ErrInvalidLine, l.Type)
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return l, fmt.Errorf("%w: bad value in %q", ErrInvalidLine, line)
+	}
+	l.Value = value
+	return l, nil
+}
+
+// ID returns the repository metric ID of the line.
+func (l Line) ID() string {
+	return models.JoinID(l.Name, l.Labels)
+}
+
+// parseTags reads DogStatsD style tags; tags without a value get an empty one.
+func parseTags(s string) []models.Label {
+	var labels []models.Label
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(tag, ":")
+		labels = append(labels, models.Label{Name: name, Value: value})
+	}
+	return labels
+}
@@ -0,0 +1,49 @@
+package statsd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Line
+	}{
+		{"hits:1|c", Line{Name: "hits", Type: TypeCounter, Value: 1, Rate: 1}},
+		{"hits:2|c|@0.5", Line{Name: "hits", Type: TypeCounter, Value: 2, Rate: 0.5}},
+		{"temp:-3.5|g", Line{Name: "temp", Type: TypeGauge, Value: -3.5, Relative: true, Rate: 1}},
+		{"temp:20|g", Line{Name: "temp", Type: TypeGauge, Value: 20, Rate: 1}},
+		{"req.time:320|ms", Line{Name: "req.time", Type: TypeTimer, Value: 320, Rate: 1}},
+		{"users:alice|s", Line{Name: "users", Type: TypeSet, Member: "alice", Rate: 1}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseLine(test.line)
+		if err != nil {
+			t.Fatalf("parse %q: %v", test.line, err)
+		}
+		if got.Name != test.want.Name || got.Type != test.want.Type || got.Value != test.want.Value ||
+			got.Member != test.want.Member || got.Relative != test.want.Relative || got.Rate != test.want.Rate {
+			t.Fatalf("parse %q: got %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseLineTags(t *testing.T) {
+	l, err := ParseLine("hits:1|c|#env:prod,region:eu")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if id := l.ID(); id != `hits{env="prod",region="eu"}` {
+		t.Fatalf("unexpected id %s", id)
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, line := range []string{"hits", ":1|c", "hits:1", "hits:x|c", "hits:1|q", "hits:1|c|@2"} {
+		if _, err := ParseLine(line); !errors.Is(err, ErrInvalidLine) {
+			t.Fatalf("expected ErrInvalidLine for %q, got %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go-metrics-and-alerts/internal/repository"
+)
+
+const maxPacketSize = 64 * 1024
+
+// idleTimeout closes TCP connections that send nothing for this long.
+const idleTimeout = 5 * time.Minute
+
+// Config describes where the listener accepts StatsD traffic.
+type Config struct {
+	// UDPAddr and TCPAddr are listen addresses; an empty one is disabled.
+	UDPAddr       string
+	TCPAddr       string
+	FlushInterval time.Duration
+}
+
+// Server listens for StatsD lines and flushes aggregates periodically.
+type Server struct {
+	cfg Config
+	agg *Aggregator
+
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+	// readers tracks the goroutines reading lines, which must be done
+	// before the final flush.
+	readers sync.WaitGroup
+
+	connMu  sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+}
+
+// NewServer creates a StatsD server writing into storage.
+func NewServer(cfg Config, storage repository.Repository) *Server {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 10 * time.Second
+	}
+	return &Server{cfg: cfg, agg: NewAggregator(storage), conns: make(map[net.Conn]struct{})}
+}
+
+// Start opens the configured listeners and serves them until ctx is done.
+// The final interval is flushed on shutdown; Wait blocks until then.
+func (s *Server) Start(ctx context.Context) error {
+	if s.cfg.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", s.cfg.UDPAddr)
+		if err != nil {
+			return err
+		}
+		s.udp = conn
+	}
+	if s.cfg.TCPAddr != "" {
+		ln, err := net.Listen("tcp", s.cfg.TCPAddr)
+		if err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return err
+		}
+		s.tcp = ln
+	}
+
+	if s.udp != nil {
+		s.readers.Add(1)
+		go s.serveUDP()
+	}
+	if s.tcp != nil {
+		s.readers.Add(1)
+		go s.serveTCP()
+	}
+
+	s.wg.Add(1)
+	go s.flushLoop(ctx)
+
+	return nil
+}
+
+// Wait blocks until listeners are closed and the last flush is done.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// UDPAddr returns the bound UDP address, or nil if UDP is disabled.
+func (s *Server) UDPAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// TCPAddr returns the bound TCP address, or nil if TCP is disabled.
+func (s *Server) TCPAddr() net.Addr {
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr()
+}
+
+// Flush writes the current interval into storage immediately.
+func (s *Server) Flush(ctx context.Context) error {
+	return s.agg.Flush(ctx)
+}
+
+func (s *Server) flushLoop(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop()
+			// ctx is done by now, so the final flush runs without it.
+			if err := s.Flush(context.Background()); err != nil {
+				log.Printf("statsd: final flush error: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				log.Printf("statsd: flush error: %v", err)
+			}
+		}
+	}
+}
+
+// stop closes the listeners and open connections and waits for their
+// readers, so that every line received makes it into the final flush.
+func (s *Server) stop() {
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.connMu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMu.Unlock()
+	s.readers.Wait()
+}
+
+func (s *Server) serveUDP() {
+	defer s.readers.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("statsd: udp read error: %v", err)
+			}
+			return
+		}
+		for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+			s.handleLine(string(bytes.TrimSpace(line)))
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.readers.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("statsd: tcp accept error: %v", err)
+			}
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.readers.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// track registers conn to be closed on shutdown. It reports false once
+// shutdown has begun.
+func (s *Server) track(conn net.Conn) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.readers.Done()
+	defer func() {
+		s.connMu.Lock()
+		delete(s.conns, conn)
+		s.connMu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxPacketSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		s.handleLine(string(bytes.TrimSpace(scanner.Bytes())))
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Printf("statsd: tcp read error: %v", err)
+	}
+}
+
+func (s *Server) handleLine(line string) {
+	if line == "" {
+		return
+	}
+	l, err := ParseLine(line)
+	if err != nil {
+		log.Printf("statsd: %v", err)
+		return
+	}
+	s.agg.Add(l)
+}
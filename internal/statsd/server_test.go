@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go-metrics-and-alerts/internal/repository"
+	"go-metrics-and-alerts/pkg/hll"
+)
+
+func TestServerUDPAndTCP(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(ctx, "queue", 10)
+
+	srv := NewServer(Config{UDPAddr: "127.0.0.1:0", TCPAddr: "127.0.0.1:0", FlushInterval: time.Hour}, storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	udp, err := net.Dial("udp", srv.UDPAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer udp.Close()
+	fmt.Fprint(udp, "hits:1|c\nhits:1|c|@0.5\nqueue:+5|g\nbad line")
+	fmt.Fprint(udp, "users:alice|s\nusers:bob|s\nusers:alice|s")
+
+	tcp, err := net.Dial("tcp", srv.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("dial tcp: %v", err)
+	}
+	fmt.Fprint(tcp, "latency:10|ms\nlatency:30|ms\nlatency:20|ms|#env:prod\n")
+	tcp.Close()
+
+	waitFor(t, func() bool {
+		srv.agg.mu.Lock()
+		defer srv.agg.mu.Unlock()
+		return srv.agg.counters["hits"] == 3 && len(srv.agg.timers) == 2 && len(srv.agg.sets) == 1
+	})
+
+	cancel()
+	srv.Wait()
+
+	if v, _, _ := storage.GetCounter(ctx, "hits"); v != 3 {
+		t.Fatalf("expected hits 3, got %d", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "queue"); v != 15 {
+		t.Fatalf("expected relative gauge 15, got %v", v)
+	}
+	if v, _, _ := storage.GetCounter(ctx, "latency.count"); v != 2 {
+		t.Fatalf("expected latency.count 2, got %d", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, "latency.mean"); v != 20 {
+		t.Fatalf("expected latency.mean 20, got %v", v)
+	}
+	if v, _, _ := storage.GetGauge(ctx, `latency.max{env="prod"}`); v != 20 {
+		t.Fatalf("expected tagged latency.max 20, got %v", v)
+	}
+
+	registers, ok, _ := storage.GetSet(ctx, "users")
+	if !ok {
+		t.Fatal("expected users set")
+	}
+	sketch, _ := hll.FromBytes(registers)
+	if sketch.Estimate() != 2 {
+		t.Fatalf("expected 2 users, got %d", sketch.Estimate())
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestServerFlushesOpenConnectionsOnShutdown(t *testing.T) {
+	storage := repository.NewMemStorage()
+	srv := NewServer(Config{TCPAddr: "127.0.0.1:0", FlushInterval: time.Hour}, storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	tcp, err := net.Dial("tcp", srv.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("dial tcp: %v", err)
+	}
+	defer tcp.Close()
+	fmt.Fprint(tcp, "hits:2|c\n")
+	waitFor(t, func() bool {
+		srv.agg.mu.Lock()
+		defer srv.agg.mu.Unlock()
+		return srv.agg.counters["hits"] == 2
+	})
+
+	cancel()
+	srv.Wait()
+
+	if v, _, _ := storage.GetCounter(context.Background(), "hits"); v != 2 {
+		t.Fatalf("expected hits 2, got %d", v)
+	}
+}
@@ -0,0 +1,134 @@
+// Package stream fans accepted metric updates out to live subscribers.
+package stream
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+// DefaultBuffer is the number of updates queued per subscriber before new
+// ones are dropped.
+const DefaultBuffer = 256
+
+// Filter selects the updates a subscriber receives. Empty fields match
+// everything.
+type Filter struct {
+	Prefix string
+	Types  []string
+}
+
+// Match reports whether m passes the filter.
+func (f Filter) Match(m models.Metrics) bool {
+	if !strings.HasPrefix(m.ID, f.Prefix) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == m.MType {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives updates on C until it is unsubscribed or the hub is
+// closed, at which point C is closed.
+type Subscription struct {
+	C <-chan models.Metrics
+
+	ch      chan models.Metrics
+	filter  Filter
+	dropped atomic.Int64
+}
+
+// Dropped returns the number of updates dropped because the buffer was full
+// since the previous call.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+// Hub delivers published updates to every matching subscription. Publishing
+// never blocks: a subscriber that does not keep up loses updates instead of
+// slowing ingestion down.
+type Hub struct {
+	buffer int
+
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub creates a hub with buffer updates queued per subscriber.
+func NewHub(buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	return &Hub{buffer: buffer, subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers a subscription for updates matching f. It returns nil
+// once the hub is closed.
+func (h *Hub) Subscribe(f Filter) *Subscription {
+	ch := make(chan models.Metrics, h.buffer)
+	s := &Subscription{C: ch, ch: ch, filter: f}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe removes s and closes its channel.
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
+
+// HasSubscribers reports whether anyone is listening, so publishers can skip
+// preparing updates nobody receives.
+func (h *Hub) HasSubscribers() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs) > 0
+}
+
+// Publish offers updates to every matching subscription.
+func (h *Hub) Publish(updates ...models.Metrics) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		for _, m := range updates {
+			if !s.filter.Match(m) {
+				continue
+			}
+			select {
+			case s.ch <- m:
+			default:
+				s.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Close ends every subscription and refuses new ones.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
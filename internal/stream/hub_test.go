@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+)
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &v}
+}
+
+func TestHubFiltersAndDrops(t *testing.T) {
+	h := NewHub(2)
+	all := h.Subscribe(Filter{})
+	cpu := h.Subscribe(Filter{Prefix: "cpu", Types: []string{models.Gauge}})
+
+	delta := int64(1)
+	h.Publish(gauge("cpu.load", 1), gauge("mem.used", 2), models.Metrics{ID: "cpu.ticks", MType: models.Counter, Delta: &delta})
+
+	if got := (<-cpu.C).ID; got != "cpu.load" {
+		t.Fatalf("Expected cpu.load, got %s", got)
+	}
+	if len(cpu.C) != 0 {
+		t.Fatalf("Filtered subscription received %d extra updates", len(cpu.C))
+	}
+
+	if len(all.C) != 2 {
+		t.Fatalf("Expected a full buffer of 2, got %d", len(all.C))
+	}
+	if d := all.Dropped(); d != 1 {
+		t.Fatalf("Expected 1 dropped update, got %d", d)
+	}
+	if d := all.Dropped(); d != 0 {
+		t.Fatalf("Dropped should reset after reading, got %d", d)
+	}
+
+	h.Unsubscribe(cpu)
+	if _, ok := <-cpu.C; ok {
+		t.Fatal("Unsubscribed channel should be closed")
+	}
+
+	h.Close()
+	<-all.C
+	<-all.C
+	if _, ok := <-all.C; ok {
+		t.Fatal("Close should close remaining subscriptions")
+	}
+	if h.Subscribe(Filter{}) != nil {
+		t.Fatal("Subscribe after Close should fail")
+	}
+}
@@ -0,0 +1,332 @@
+// Package wal implements the write-ahead log of the file storage mode.
+//
+// Every update is appended to the log before the request returns, so a crash
+// loses at most what the sync policy has not yet flushed instead of
+// everything since the last snapshot. The log is kept in numbered segment
+// files and checkpointed by writing a snapshot and removing the segments the
+// snapshot covers.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when appended records are flushed to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes every record before Append returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval flushes in the background every SyncPeriod, so a crash
+	// of the machine loses at most that much. A crash of the process alone
+	// loses nothing.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// SyncPeriod is the flush period of SyncInterval.
+const SyncPeriod = time.Second
+
+const (
+	segmentSuffix = ".wal"
+	frameHeader   = 8
+	// maxRecordSize bounds a record so a corrupt length cannot make replay
+	// allocate arbitrary amounts of memory.
+	maxRecordSize = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ParseSyncPolicy validates a policy name.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown WAL sync policy %q", s)
+	}
+}
+
+// Log is an append-only sequence of records. Each record is framed as a
+// little-endian uint32 length, a CRC-32C of the payload and the payload.
+type Log struct {
+	dir    string
+	policy SyncPolicy
+
+	mu    sync.Mutex
+	f     *os.File
+	seg   int64
+	dirty bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the log in dir. Appending always starts a new segment, so a
+// torn record left by a crash is never followed by new data in its file.
+func Open(dir string, policy SyncPolicy) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir, policy: policy, seg: 1}
+	if len(segments) > 0 {
+		l.seg = segments[len(segments)-1] + 1
+	}
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+
+	if policy == SyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+func listSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func segmentPath(dir string, n int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", n, segmentSuffix))
+}
+
+func (l *Log) openSegment() error {
+	f, err := os.OpenFile(segmentPath(l.dir, l.seg), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	return syncDir(l.dir)
+}
+
+// Append writes one record and flushes it according to the sync policy.
+func (l *Log) Append(record []byte) error {
+	if len(record) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds the limit", len(record))
+	}
+
+	frame := make([]byte, frameHeader+len(record))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(record, crcTable))
+	copy(frame[frameHeader:], record)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return errors.New("wal: log is closed")
+	}
+	if _, err := l.f.Write(frame); err != nil {
+		return err
+	}
+	if l.policy == SyncAlways {
+		return l.f.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// Rotate closes the current segment and starts a new one. It returns the
+// number of the closed segment; records appended afterwards are in later
+// segments.
+func (l *Log) Rotate() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, errors.New("wal: log is closed")
+	}
+
+	if err := l.f.Sync(); err != nil {
+		return 0, err
+	}
+	l.f.Close()
+	l.dirty = false
+	closed := l.seg
+	l.seg++
+	if err := l.openSegment(); err != nil {
+		l.f = nil
+		return 0, err
+	}
+	return closed, nil
+}
+
+// RemoveThrough deletes the segments up to and including seg.
+func (l *Log) RemoveThrough(seg int64) error {
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n > seg {
+			break
+		}
+		if err := os.Remove(segmentPath(l.dir, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(l.dir)
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+func (l *Log) syncLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(SyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.f != nil && l.dirty {
+				if err := l.f.Sync(); err != nil {
+					log.Printf("WAL sync failed: %v", err)
+				}
+				l.dirty = false
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Replay calls fn with every record in dir in the order they were appended.
+// A truncated or corrupt record ends its segment, as a crash leaves it at
+// the tail of the segment being written; replay continues with the next
+// segment. It returns the number of records replayed.
+func Replay(dir string, fn func(record []byte) error) (int, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	count := 0
+	for _, seg := range segments {
+		n, err := replaySegment(segmentPath(dir, seg), fn)
+		count += n
+		var corrupt *corruptError
+		switch {
+		case errors.As(err, &corrupt):
+			log.Printf("WAL segment %d: ignoring the rest after %d records: %v", seg, n, err)
+		case err != nil:
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+type corruptError struct {
+	offset int64
+	reason string
+}
+
+func (e *corruptError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.reason, e.offset)
+}
+
+func replaySegment(path string, fn func([]byte) error) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	count := 0
+	header := make([]byte, frameHeader)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return count, nil
+			}
+			return count, &corruptError{offset, "truncated record header"}
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return count, &corruptError{offset, fmt.Sprintf("record length %d", size)}
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(f, record); err != nil {
+			return count, &corruptError{offset, "truncated record"}
+		}
+		if crc32.Checksum(record, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return count, &corruptError{offset, "checksum mismatch"}
+		}
+		if err := fn(record); err != nil {
+			return count, err
+		}
+		count++
+		offset += frameHeader + int64(size)
+	}
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func appendAll(t *testing.T, l *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := l.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+}
+
+func replayAll(t *testing.T, dir string) []string {
+	t.Helper()
+	var got []string
+	if _, err := Replay(dir, func(r []byte) error {
+		got = append(got, string(r))
+		return nil
+	}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return got
+}
+
+func TestReplayAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, 0, 2)
+	seg, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, 2, 4)
+	l.Close()
+
+	if got := replayAll(t, dir); fmt.Sprint(got) != "[record-0 record-1 record-2 record-3]" {
+		t.Fatalf("Unexpected records: %v", got)
+	}
+
+	if err := l.RemoveThrough(seg); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayAll(t, dir); fmt.Sprint(got) != "[record-2 record-3]" {
+		t.Fatalf("Unexpected records after removal: %v", got)
+	}
+}
+
+func TestReplayStopsAtDamagedTail(t *testing.T) {
+	cases := map[string]func([]byte) []byte{
+		"truncated header": func(b []byte) []byte { return b[:len(b)-len("record-2")-4] },
+		"truncated record": func(b []byte) []byte { return b[:len(b)-2] },
+		"corrupt record": func(b []byte) []byte {
+			b[len(b)-1] ^= 0xff
+			return b
+		},
+		"garbage length": func(b []byte) []byte {
+			return append(b, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+		},
+	}
+	for name, damage := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, SyncNever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendAll(t, l, 0, 3)
+			l.Close()
+
+			path := segmentPath(dir, 1)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, damage(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// The log reopened after the crash keeps working.
+			l, err = Open(dir, SyncInterval)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendAll(t, l, 3, 4)
+			l.Close()
+
+			got := replayAll(t, dir)
+			want := "[record-0 record-1 record-3]"
+			if name == "garbage length" {
+				want = "[record-0 record-1 record-2 record-3]"
+			}
+			if fmt.Sprint(got) != want {
+				t.Fatalf("Expected %s, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	if p, err := ParseSyncPolicy(" Always "); err != nil || p != SyncAlways {
+		t.Fatalf("Expected always, got %q, %v", p, err)
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Fatal("Expected an error for an unknown policy")
+	}
+}
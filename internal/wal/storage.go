@@ -0,0 +1,256 @@
+package wal
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+// Storage logs every update of the wrapped repository. A record holds the
+// state of the updated metrics after the update: gauge values, counter
+// totals and merged set registers. Replaying a record therefore has the same
+// effect however often it is applied, which lets a checkpoint snapshot and the
+// log overlap safely. Metadata is logged as a metadataRecord.
+type Storage struct {
+	repository.Repository
+	log *Log
+
+	// mu orders updates and their records, so the last record of a metric
+	// always holds its latest state.
+	mu sync.Mutex
+}
+
+// Wrap returns repo with its updates logged to l.
+func Wrap(repo repository.Repository, l *Log) *Storage {
+	return &Storage{Repository: repo, log: l}
+}
+
+func (s *Storage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Repository.UpdateGauge(ctx, name, value); err != nil {
+		return err
+	}
+	return s.logState(ctx, []models.Metrics{{ID: name, MType: models.Gauge}})
+}
+
+func (s *Storage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Repository.UpdateCounter(ctx, name, value); err != nil {
+		return err
+	}
+	return s.logState(ctx, []models.Metrics{{ID: name, MType: models.Counter}})
+}
+
+func (s *Storage) UpdateSet(ctx context.Context, name string, registers []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Repository.UpdateSet(ctx, name, registers); err != nil {
+		return err
+	}
+	return s.logState(ctx, []models.Metrics{{ID: name, MType: models.Set}})
+}
+
+// UpdateBatch logs the whole batch as one record, so it is replayed
+// completely or not at all.
+func (s *Storage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Repository.UpdateBatch(ctx, metrics); err != nil {
+		return err
+	}
+	return s.logState(ctx, metrics)
+}
+
+// metadataRecord logs registered metadata. Metric records are JSON arrays,
+// so the two never mix up.
+type metadataRecord struct {
+	Metadata models.Metadata `json:"metadata"`
+}
+
+// SetMetadata logs the registered metadata.
+func (s *Storage) SetMetadata(ctx context.Context, meta models.Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Repository.SetMetadata(ctx, meta); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadataRecord{Metadata: meta})
+	if err != nil {
+		return err
+	}
+	return s.log.Append(data)
+}
+
+// DeleteMetric logs the metric as deleted.
+func (s *Storage) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, err := s.Repository.DeleteMetric(ctx, mtype, name)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, s.appendState([]models.Metrics{{ID: name, MType: mtype}})
+}
+
+// RenameMetric logs the old name as deleted and the state under the new name
+// in one record.
+func (s *Storage) RenameMetric(ctx context.Context, mtype, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Repository.RenameMetric(ctx, mtype, from, to); err != nil {
+		return err
+	}
+	state, err := s.state(ctx, []models.Metrics{{ID: to, MType: mtype}})
+	if err != nil {
+		return err
+	}
+	return s.appendState(append([]models.Metrics{{ID: from, MType: mtype}}, state...))
+}
+
+// logState appends the current state of metrics, each metric once.
+func (s *Storage) logState(ctx context.Context, metrics []models.Metrics) error {
+	state, err := s.state(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	return s.appendState(state)
+}
+
+// state reads the current state of metrics, skipping missing ones.
+func (s *Storage) state(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	state := make([]models.Metrics, 0, len(metrics))
+	seen := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		key := m.MType + ":" + m.ID
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		entry := models.Metrics{ID: m.ID, MType: m.MType}
+		switch m.MType {
+		case models.Gauge:
+			value, ok, err := s.Repository.GetGauge(ctx, m.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			entry.Value = &value
+		case models.Counter:
+			total, ok, err := s.Repository.GetCounter(ctx, m.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			entry.Delta = &total
+		case models.Set:
+			registers, ok, err := s.Repository.GetSet(ctx, m.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			entry.Registers = registers
+		default:
+			continue
+		}
+		state = append(state, entry)
+	}
+	return state, nil
+}
+
+// appendState appends a record of state. An entry without a value marks a
+// deleted metric.
+func (s *Storage) appendState(state []models.Metrics) error {
+	if len(state) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.log.Append(data)
+}
+
+// Checkpoint saves a snapshot with save and drops the log segments it covers.
+// save must write the snapshot atomically, for example with
+// repository.WriteFileAtomic; updates may continue while it runs.
+func (s *Storage) Checkpoint(save func() error) error {
+	s.mu.Lock()
+	seg, err := s.log.Rotate()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Everything up to seg is in the repository by now, so the snapshot
+	// covers it. Records appended meanwhile stay in the log.
+	if err := save(); err != nil {
+		return err
+	}
+	return s.log.RemoveThrough(seg)
+}
+
+// Restore replays the log in dir into repo, which should already hold the
+// last snapshot.
+func Restore(ctx context.Context, dir string, repo repository.Repository) (int, error) {
+	return Replay(dir, func(record []byte) error {
+		if len(record) > 0 && record[0] == '{' {
+			var rec metadataRecord
+			if err := json.Unmarshal(record, &rec); err != nil {
+				return err
+			}
+			return repo.SetMetadata(ctx, rec.Metadata)
+		}
+
+		var state []models.Metrics
+		if err := json.Unmarshal(record, &state); err != nil {
+			return err
+		}
+		for _, m := range state {
+			if m.Value == nil && m.Delta == nil && m.Registers == nil {
+				if _, err := repo.DeleteMetric(ctx, m.MType, m.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			switch m.MType {
+			case models.Gauge:
+				if m.Value != nil {
+					if err := repo.UpdateGauge(ctx, m.ID, *m.Value); err != nil {
+						return err
+					}
+				}
+			case models.Counter:
+				if m.Delta == nil {
+					continue
+				}
+				current, _, err := repo.GetCounter(ctx, m.ID)
+				if err != nil {
+					return err
+				}
+				if diff := *m.Delta - current; diff != 0 {
+					if err := repo.UpdateCounter(ctx, m.ID, diff); err != nil {
+						return err
+					}
+				}
+			case models.Set:
+				if err := repo.UpdateSet(ctx, m.ID, m.Registers); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
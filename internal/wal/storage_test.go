@@ -0,0 +1,159 @@
+package wal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	models "go-metrics-and-alerts/internal/model"
+	"go-metrics-and-alerts/internal/repository"
+)
+
+func TestRestoreAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := Open(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Wrap(repository.NewMemStorage(), l)
+
+	s.UpdateCounter(ctx, "hits", 3)
+	s.UpdateCounter(ctx, "hits", 4)
+	s.UpdateGauge(ctx, "load", 0.5)
+	s.SetMetadata(ctx, models.Metadata{ID: "load", MType: models.Gauge, Unit: "percent"})
+	delta := int64(10)
+	value := 1.5
+	s.UpdateBatch(ctx, []models.Metrics{
+		{ID: "hits", MType: models.Counter, Delta: &delta},
+		{ID: "load", MType: models.Gauge, Value: &value},
+	})
+	// No Close: the process dies here.
+
+	restored := repository.NewMemStorage()
+	n, err := Restore(ctx, dir, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("Expected 5 records, got %d", n)
+	}
+	if v, _, _ := restored.GetCounter(ctx, "hits"); v != 17 {
+		t.Fatalf("Expected hits 17, got %d", v)
+	}
+	if v, _, _ := restored.GetGauge(ctx, "load"); v != 1.5 {
+		t.Fatalf("Expected load 1.5, got %v", v)
+	}
+	if meta, _, _ := restored.GetMetadata(ctx, "load"); meta.Unit != "percent" {
+		t.Fatalf("Expected the metadata of load to be restored, got %+v", meta)
+	}
+}
+
+func TestRestoreDeletesAndRenames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := Open(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Wrap(repository.NewMemStorage(), l)
+
+	s.UpdateCounter(ctx, "hits", 3)
+	s.UpdateGauge(ctx, "CPUutilization16", 0.5)
+	s.UpdateGauge(ctx, "load", 1)
+	s.DeleteMetric(ctx, models.Gauge, "CPUutilization16")
+	if err := s.RenameMetric(ctx, models.Counter, "hits", "requests"); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// The snapshot still holds the metrics as they were before.
+	restored := repository.NewMemStorage()
+	restored.UpdateGauge(ctx, "CPUutilization16", 0.5)
+	restored.UpdateCounter(ctx, "hits", 3)
+	if _, err := Restore(ctx, dir, restored); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := restored.GetGauge(ctx, "CPUutilization16"); ok {
+		t.Fatal("Expected the deleted gauge to stay deleted")
+	}
+	if _, ok, _ := restored.GetCounter(ctx, "hits"); ok {
+		t.Fatal("Expected hits to be renamed")
+	}
+	if v, _, _ := restored.GetCounter(ctx, "requests"); v != 3 {
+		t.Fatalf("Expected requests 3, got %d", v)
+	}
+	if v, _, _ := restored.GetGauge(ctx, "load"); v != 1 {
+		t.Fatalf("Expected load 1, got %v", v)
+	}
+}
+
+func TestCheckpointOverlapsLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	snapshot := filepath.Join(t.TempDir(), "snapshot.json")
+	l, err := Open(dir, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := repository.NewMemStorage()
+	s := Wrap(mem, l)
+
+	s.UpdateCounter(ctx, "hits", 5)
+	err = s.Checkpoint(func() error {
+		// An update landing while the snapshot is written ends up in both
+		// the snapshot and the log.
+		s.UpdateCounter(ctx, "hits", 2)
+		total, _, _ := mem.GetCounter(ctx, "hits")
+		data, _ := json.Marshal(total)
+		return repository.WriteFileAtomic(snapshot, data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateCounter(ctx, "hits", 1)
+	l.Close()
+
+	restored := repository.NewMemStorage()
+	data, err := os.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	json.Unmarshal(data, &total)
+	restored.UpdateCounter(ctx, "hits", total)
+
+	if _, err := Restore(ctx, dir, restored); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := restored.GetCounter(ctx, "hits"); v != 8 {
+		t.Fatalf("Expected hits 8 without double counting, got %d", v)
+	}
+}
+
+func TestRestoreSkipsCorruptTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := Open(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Wrap(repository.NewMemStorage(), l)
+	s.UpdateCounter(ctx, "hits", 1)
+	s.UpdateCounter(ctx, "hits", 1)
+	l.Close()
+
+	path := segmentPath(dir, 1)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-5], 0o644)
+
+	restored := repository.NewMemStorage()
+	if _, err := Restore(ctx, dir, restored); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := restored.GetCounter(ctx, "hits"); v != 1 {
+		t.Fatalf("Expected the last complete record, hits 1, got %d", v)
+	}
+}
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS sets (
+    id VARCHAR(255) PRIMARY KEY,
+    registers BYTEA NOT NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metadata (
+    id VARCHAR(255) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    unit VARCHAR(64) NOT NULL DEFAULT '',
+    type VARCHAR(16) NOT NULL DEFAULT '',
+    owner VARCHAR(255) NOT NULL DEFAULT ''
+);
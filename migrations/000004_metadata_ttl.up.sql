@@ -0,0 +1 @@
+ALTER TABLE metadata ADD COLUMN IF NOT EXISTS ttl VARCHAR(32) NOT NULL DEFAULT '';
@@ -0,0 +1,121 @@
+// Package hll implements a HyperLogLog sketch used by set metrics.
+package hll
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// Precision is the number of hash bits used to select a register.
+	Precision = 14
+	// Size is the length of the register array.
+	Size = 1 << Precision
+	// MaxRegister is the largest value Add stores in a register.
+	MaxRegister = 64 - Precision + 1
+)
+
+var (
+	// ErrInvalidSize is returned when a register array has an unexpected length.
+	ErrInvalidSize = errors.New("hll: invalid register array size")
+	// ErrInvalidRegister is returned when a register exceeds MaxRegister.
+	ErrInvalidRegister = errors.New("hll: invalid register value")
+)
+
+// Sketch estimates the number of distinct items added to it.
+type Sketch struct {
+	registers []byte
+}
+
+// New creates an empty sketch.
+func New() *Sketch {
+	return &Sketch{registers: make([]byte, Size)}
+}
+
+// FromBytes builds a sketch from a copy of the provided register array.
+func FromBytes(data []byte) (*Sketch, error) {
+	if len(data) != Size {
+		return nil, ErrInvalidSize
+	}
+	for _, v := range data {
+		if v > MaxRegister {
+			return nil, ErrInvalidRegister
+		}
+	}
+	registers := make([]byte, Size)
+	copy(registers, data)
+	return &Sketch{registers: registers}, nil
+}
+
+// Add records the item in the sketch.
+func (s *Sketch) Add(item []byte) {
+	h := fnv.New64a()
+	h.Write(item)
+	x := mix(h.Sum64())
+
+	idx := x >> (64 - Precision)
+	w := x<<Precision | 1<<(Precision-1)
+	rho := byte(bits.LeadingZeros64(w) + 1)
+
+	if rho > s.registers[idx] {
+		s.registers[idx] = rho
+	}
+}
+
+// AddString records the string item in the sketch.
+func (s *Sketch) AddString(item string) {
+	s.Add([]byte(item))
+}
+
+// Merge folds other into s so that s estimates the union of both sets.
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil {
+		return
+	}
+	for i, v := range other.registers {
+		if v > s.registers[i] {
+			s.registers[i] = v
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct items.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(Size)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, v := range s.registers {
+		sum += 1 / float64(uint64(1)<<v)
+		if v == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// Bytes returns a copy of the register array.
+func (s *Sketch) Bytes() []byte {
+	out := make([]byte, Size)
+	copy(out, s.registers)
+	return out
+}
+
+// mix spreads FNV output across all bits; FNV alone clusters the high bits
+// used for register selection.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,59 @@
+package hll
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	tests := []int{0, 1, 100, 10000, 200000}
+
+	for _, n := range tests {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.AddString(fmt.Sprintf("user-%d", i))
+			s.AddString(fmt.Sprintf("user-%d", i))
+		}
+
+		got := float64(s.Estimate())
+		if diff := got - float64(n); diff > float64(n)*0.03+1 || diff < -float64(n)*0.03-1 {
+			t.Fatalf("estimate for %d items is %v", n, got)
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a := New()
+	b := New()
+	for i := 0; i < 1000; i++ {
+		a.AddString(fmt.Sprintf("id-%d", i))
+		b.AddString(fmt.Sprintf("id-%d", i+500))
+	}
+
+	a.Merge(b)
+	got := a.Estimate()
+	if got < 1450 || got > 1550 {
+		t.Fatalf("expected union estimate near 1500, got %d", got)
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	if _, err := FromBytes(make([]byte, 10)); err != ErrInvalidSize {
+		t.Fatalf("expected ErrInvalidSize, got %v", err)
+	}
+	invalid := make([]byte, Size)
+	invalid[0] = MaxRegister + 1
+	if _, err := FromBytes(invalid); err != ErrInvalidRegister {
+		t.Fatalf("expected ErrInvalidRegister, got %v", err)
+	}
+
+	s := New()
+	s.AddString("alice")
+	restored, err := FromBytes(s.Bytes())
+	if err != nil {
+		t.Fatalf("from bytes: %v", err)
+	}
+	if restored.Estimate() != 1 {
+		t.Fatalf("expected 1, got %d", restored.Estimate())
+	}
+}